@@ -0,0 +1,67 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// AggregationStrategy determines how values of series that became indistinguishable after dropping
+// or renaming labels are merged.
+type AggregationStrategy string
+
+const (
+	// AggregateSum sums the values, it's the default for counters.
+	AggregateSum AggregationStrategy = "sum"
+	// AggregateMax keeps the biggest value.
+	AggregateMax AggregationStrategy = "max"
+	// AggregateMin keeps the smallest value.
+	AggregateMin AggregationStrategy = "min"
+	// AggregateLast keeps the value of the last series, it's the default for gauges.
+	AggregateLast AggregationStrategy = "last"
+)
+
+// AggregationStrategies maps metric names to the strategies used for them. It holds values of the
+// repeated flag in "metric=strategy" format.
+type AggregationStrategies map[string]AggregationStrategy
+
+// String returns human-readable representation of the strategies.
+func (s AggregationStrategies) String() string {
+	var strategies []string
+	for metric, strategy := range s {
+		strategies = append(strategies, metric+"="+string(strategy))
+	}
+	sort.Strings(strategies)
+	return "[" + strings.Join(strategies, " ") + "]"
+}
+
+// Set parses a single strategy and adds it to the map.
+func (s AggregationStrategies) Set(value string) error {
+	kv := strings.SplitN(value, "=", 2)
+	if len(kv) != 2 || kv[0] == "" {
+		return fmt.Errorf("invalid aggregation strategy %q, expected metric=strategy", value)
+	}
+	switch strategy := AggregationStrategy(kv[1]); strategy {
+	case AggregateSum, AggregateMax, AggregateMin, AggregateLast:
+		s[kv[0]] = strategy
+		return nil
+	default:
+		return fmt.Errorf("invalid aggregation strategy %q of metric %s, expected sum, max, min or last", kv[1], kv[0])
+	}
+}
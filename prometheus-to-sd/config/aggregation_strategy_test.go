@@ -0,0 +1,38 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAggregationStrategiesSet(t *testing.T) {
+	strategies := AggregationStrategies{}
+	assert.NoError(t, strategies.Set("queue_length=max"))
+	assert.NoError(t, strategies.Set("requests=last"))
+	assert.Equal(t, AggregationStrategies{
+		"queue_length": AggregateMax,
+		"requests":     AggregateLast,
+	}, strategies)
+	assert.Equal(t, "[queue_length=max requests=last]", strategies.String())
+
+	for _, incorrect := range []string{"no-strategy", "=max", "requests=avg", "requests=SUM"} {
+		assert.Error(t, strategies.Set(incorrect), "strategy %q should be rejected", incorrect)
+	}
+}
@@ -17,6 +17,8 @@ limitations under the License.
 package config
 
 import (
+	"time"
+
 	dto "github.com/prometheus/client_model/go"
 )
 
@@ -74,4 +76,83 @@ type CommonConfig struct {
 	SourceConfig        *SourceConfig
 	OmitComponentName   bool
 	DowncaseMetricNames bool
+	// DeriveComponentName makes OmitComponentName remove the prefix derived from the metric names by
+	// translator.DeriveComponentName for sources with an empty component name.
+	DeriveComponentName bool
+	// CustomMetricsPrefixes are prefixes of the metrics whose descriptors are created and updated by
+	// prometheus-to-sd, descriptors of other metrics are only validated. Empty means custom.googleapis.com.
+	CustomMetricsPrefixes []string
+	// StripPrefix and StripSuffix are removed from the metric names, after the component name is omitted.
+	StripPrefix string
+	StripSuffix string
+	// CounterResetCacheSize limits the number of series tracked to detect counter resets.
+	// Zero means that the default size is used.
+	CounterResetCacheSize int
+	// HistogramsAsDistributions normalizes histogram buckets to match Stackdriver explicit bucket distributions.
+	HistogramsAsDistributions bool
+	// BucketBoundPrecision is the number of significant digits to which the histogram bucket bounds are
+	// rounded before normalizing them, so that near-equal bounds are merged. Zero disables rounding.
+	BucketBoundPrecision int
+	// SummaryQuantileAsLabel exports quantiles of the summary metrics as a single gauge with the quantile label,
+	// instead of one gauge per quantile named like <name>_p99.
+	SummaryQuantileAsLabel bool
+	// DropUntyped removes metrics exposed without the type.
+	DropUntyped bool
+	// TreatUntypedAsGauge exports metrics exposed without the type as gauges. DropUntyped takes precedence.
+	TreatUntypedAsGauge bool
+	// RelabelRules are Prometheus style relabeling rules applied in order to every series, after the labels
+	// of the source are renamed, dropped and added.
+	RelabelRules []RelabelRule
+	// MetricNameRewrites are applied to metric names in order, only the first matching one is used.
+	MetricNameRewrites []MetricNameRewrite
+	// DryRun disables all writes to Stackdriver, metric descriptors and time series are only logged.
+	DryRun bool
+	// SanitizeNames replaces characters not accepted by Stackdriver in metric names and label keys with "_".
+	// Otherwise names are exported as they are.
+	SanitizeNames bool
+	// LabelCollisionMode determines how label keys colliding with another label after sanitization are handled.
+	// Empty means LabelCollisionDropLabel.
+	LabelCollisionMode LabelCollisionMode
+	// MaxSeriesPerMetric limits the number of series exported for a single metric, series above the limit
+	// are dropped. Zero means no limit.
+	MaxSeriesPerMetric int
+	// MaxMetricFamilies limits the number of metric families of a single scrape. Scrapes above the limit fail,
+	// unless TruncateMetricFamilies is set, in which case the families above the limit are dropped. Zero means
+	// no limit.
+	MaxMetricFamilies      int
+	TruncateMetricFamilies bool
+	// MaxLabelsPerMetric limits the number of label keys of a single metric. Labels above the limit are dropped
+	// in the order of LabelPriority, followed by the labels not listed there by name, unless
+	// DropMetricsAboveLabelLimit is set, in which case the whole metric is dropped. Zero means no limit.
+	MaxLabelsPerMetric         int
+	LabelPriority              []string
+	DropMetricsAboveLabelLimit bool
+	// LogRawResponseBytes is the number of bytes of the scraped body logged at verbosity 4 when the body
+	// can't be parsed. Zero disables logging of the body.
+	LogRawResponseBytes int
+	// MaxLabelValueLength is the maximal length of label values in bytes, longer values are truncated.
+	// Zero means no limit.
+	MaxLabelValueLength int
+	// PruneStaleDescriptorsAfter is the number of scrapes after which descriptors of custom metrics that
+	// are no longer exposed are deleted. Zero disables pruning.
+	PruneStaleDescriptorsAfter int
+	// PruneStaleDescriptorsDryRun makes stale descriptors be only logged instead of deleted.
+	PruneStaleDescriptorsDryRun bool
+	// DescriptorCacheTTL is the age after which cached metric descriptors are fetched again from the Stackdriver
+	// before being used, in addition to the periodic refresh of the whole cache. Zero disables expiration.
+	DescriptorCacheTTL time.Duration
+	// DescriptorUpdateConcurrency limits the number of metric descriptors of a single source created or updated
+	// in the Stackdriver at once. Zero means that descriptors are updated one by one.
+	DescriptorUpdateConcurrency int
+	// DNSCacheTTL is the time for which addresses of the scraped hosts are cached. If resolving a host again
+	// fails, its last good addresses are used for up to another TTL. Zero disables the cache.
+	DNSCacheTTL time.Duration
+	// AggregationStrategies determine how series that became indistinguishable after dropping or renaming
+	// labels are merged, by metric name. Counters are summed and the last value of gauges wins by default.
+	// Metrics are named as exposed by the target or given by RelabelRules, before the component name is
+	// omitted, StripPrefix and StripSuffix are removed, names are downcased or MetricNameRewrites applied.
+	AggregationStrategies AggregationStrategies
+	// FamilyProcessors are run in order on the scraped metric families after the built-in transformations,
+	// before the metric descriptors are updated.
+	FamilyProcessors []FamilyProcessor
 }
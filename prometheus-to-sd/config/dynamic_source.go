@@ -51,6 +51,9 @@ func validateSources(sources flags.Uris) (map[string]url.URL, error) {
 		if source.Val.Port() == "" {
 			return nil, errors.New("port should NOT be empty for any dynamic source")
 		}
+		if err := checkUnsetEnv(source); err != nil {
+			return nil, err
+		}
 		sourceMap[source.Key] = source.Val
 	}
 	if len(sourceMap) != len(sources) {
@@ -106,5 +109,16 @@ func mapToSourceConfig(componentName string, url url.URL, ip, podId, namespaceId
 	containerNamelabel := url.Query().Get("containerNamelabel")
 	metricsPrefix := url.Query().Get("metricsPrefix")
 	podConfig := NewPodConfig(podId, namespaceId, podIdLabel, namespaceIdLabel, containerNamelabel)
-	return newSourceConfig(componentName, ip, port, url.Path, whitelisted, metricsPrefix, podConfig)
+	sourceConfig, err := newSourceConfig(componentName, ip, port, url.EscapedPath(), whitelisted, metricsPrefix, podConfig)
+	if err != nil {
+		return nil, err
+	}
+	sourceConfig.Scheme = url.Scheme
+	if err := sourceConfig.parseOptions(url.Query()); err != nil {
+		return nil, err
+	}
+	if err := sourceConfig.NormalizeAndValidate(); err != nil {
+		return nil, err
+	}
+	return sourceConfig, nil
 }
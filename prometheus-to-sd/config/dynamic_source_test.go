@@ -185,6 +185,21 @@ func TestValidateSources(t *testing.T) {
 			want:      map[string]url.URL{},
 			wantError: true,
 		},
+		{
+			sources: flags.Uris{
+				{Key: "component-name1", Val: url.URL{Host: ":80", RawQuery: "requireEnv=true"}, UnsetEnv: []string{"TOKEN_DIR"}},
+			},
+			wantError: true,
+		},
+		{
+			sources: flags.Uris{
+				{Key: "component-name1", Val: url.URL{Host: ":80"}, UnsetEnv: []string{"TOKEN_DIR"}},
+			},
+			want: map[string]url.URL{
+				"component-name1": {Host: ":80"},
+			},
+			wantError: false,
+		},
 	}
 	for _, test := range testcases {
 		sourceMap, err := validateSources(test.sources)
@@ -0,0 +1,35 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	dto "github.com/prometheus/client_model/go"
+)
+
+// FamilyProcessor transforms metric families scraped from the component, e.g. to compute derived metrics.
+// Processors may modify the passed families and return them, or return new ones.
+type FamilyProcessor interface {
+	Process(metrics map[string]*dto.MetricFamily) (map[string]*dto.MetricFamily, error)
+}
+
+// FamilyProcessorFunc allows using ordinary functions as FamilyProcessors.
+type FamilyProcessorFunc func(metrics map[string]*dto.MetricFamily) (map[string]*dto.MetricFamily, error)
+
+// Process calls f(metrics).
+func (f FamilyProcessorFunc) Process(metrics map[string]*dto.MetricFamily) (map[string]*dto.MetricFamily, error) {
+	return f(metrics)
+}
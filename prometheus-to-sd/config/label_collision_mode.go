@@ -0,0 +1,49 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import "fmt"
+
+// LabelCollisionMode determines how label keys that collide with another label of the series after
+// their invalid characters were replaced with "_" are handled, e.g. "a.b" and "a-b" both becoming "a_b".
+type LabelCollisionMode string
+
+const (
+	// LabelCollisionDropLabel drops the colliding label, it's the default.
+	LabelCollisionDropLabel LabelCollisionMode = "drop-label"
+	// LabelCollisionDropMetric drops the whole metric with the colliding labels.
+	LabelCollisionDropMetric LabelCollisionMode = "drop-metric"
+	// LabelCollisionSuffix renames the colliding label by adding the lowest numeric suffix, like "a_b_1",
+	// which makes it unique.
+	LabelCollisionSuffix LabelCollisionMode = "suffix"
+)
+
+// String returns the name of the mode.
+func (m *LabelCollisionMode) String() string {
+	return string(*m)
+}
+
+// Set parses the mode, holding the value of the flag.
+func (m *LabelCollisionMode) Set(value string) error {
+	switch mode := LabelCollisionMode(value); mode {
+	case LabelCollisionDropLabel, LabelCollisionDropMetric, LabelCollisionSuffix:
+		*m = mode
+		return nil
+	default:
+		return fmt.Errorf("invalid label collision mode %q, expected drop-label, drop-metric or suffix", value)
+	}
+}
@@ -0,0 +1,37 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLabelCollisionModeSet(t *testing.T) {
+	mode := LabelCollisionDropLabel
+	assert.NoError(t, mode.Set("suffix"))
+	assert.Equal(t, LabelCollisionSuffix, mode)
+	assert.Equal(t, "suffix", mode.String())
+	assert.NoError(t, mode.Set("drop-metric"))
+	assert.Equal(t, LabelCollisionDropMetric, mode)
+
+	for _, incorrect := range []string{"", "rename", "Suffix"} {
+		assert.Error(t, mode.Set(incorrect), "mode %q should be rejected", incorrect)
+		assert.Equal(t, LabelCollisionDropMetric, mode, "rejected mode shouldn't change the value")
+	}
+}
@@ -0,0 +1,28 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+// Logger receives messages logged while scraping and processing metrics of the source, so that they can be
+// passed to structured logging libraries like zap or logrus. Messages are accompanied by alternating keys and
+// values of the fields describing them, e.g. "component", "url" or "status".
+type Logger interface {
+	// Debug logs a verbose message, level corresponds to the glog verbosity needed to log it by default.
+	Debug(level int, msg string, keysAndValues ...interface{})
+	Info(msg string, keysAndValues ...interface{})
+	Warning(msg string, keysAndValues ...interface{})
+	Error(msg string, keysAndValues ...interface{})
+}
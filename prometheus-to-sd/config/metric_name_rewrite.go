@@ -0,0 +1,55 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// MetricNameRewrite replaces metric names matching the regular expression with the replacement,
+// which can refer to the capture groups of the expression, e.g. $1.
+type MetricNameRewrite struct {
+	Match   string
+	Replace string
+}
+
+// MetricNameRewrites holds values of the repeated flag in "regexp=replacement" format.
+type MetricNameRewrites []MetricNameRewrite
+
+// String returns human-readable representation of the rewrites.
+func (r *MetricNameRewrites) String() string {
+	var rewrites []string
+	for _, rewrite := range *r {
+		rewrites = append(rewrites, rewrite.Match+"="+rewrite.Replace)
+	}
+	return "[" + strings.Join(rewrites, " ") + "]"
+}
+
+// Set parses a single rewrite and appends it to the list.
+func (r *MetricNameRewrites) Set(value string) error {
+	s := strings.SplitN(value, "=", 2)
+	if len(s) != 2 || s[0] == "" {
+		return fmt.Errorf("invalid metric name rewrite %q, expected regexp=replacement", value)
+	}
+	if _, err := regexp.Compile(s[0]); err != nil {
+		return fmt.Errorf("invalid metric name rewrite %q: %v", value, err)
+	}
+	*r = append(*r, MetricNameRewrite{Match: s[0], Replace: s[1]})
+	return nil
+}
@@ -0,0 +1,38 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricNameRewritesSet(t *testing.T) {
+	var rewrites MetricNameRewrites
+	assert.NoError(t, rewrites.Set("^prometheus_(.*)$=$1"))
+	assert.NoError(t, rewrites.Set("_seconds$=_s"))
+	assert.Equal(t, MetricNameRewrites{
+		{Match: "^prometheus_(.*)$", Replace: "$1"},
+		{Match: "_seconds$", Replace: "_s"},
+	}, rewrites)
+	assert.Equal(t, "[^prometheus_(.*)$=$1 _seconds$=_s]", rewrites.String())
+
+	for _, incorrect := range []string{"no-replacement", "=empty", "(=unbalanced"} {
+		assert.Error(t, rewrites.Set(incorrect), "rewrite %q should be rejected", incorrect)
+	}
+}
@@ -0,0 +1,117 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Relabeling actions of the RelabelRule.
+const (
+	// RelabelReplace sets the target label to the replacement if the regex matches the source labels.
+	RelabelReplace = "replace"
+	// RelabelKeep drops the series whose source labels don't match the regex.
+	RelabelKeep = "keep"
+	// RelabelDrop drops the series whose source labels match the regex.
+	RelabelDrop = "drop"
+	// RelabelLabelMap copies values of the labels matching the regex to the labels named by the replacement.
+	RelabelLabelMap = "labelmap"
+)
+
+// Defaults of the RelabelRule fields, the same as in Prometheus.
+const (
+	defaultRelabelSeparator   = ";"
+	defaultRelabelRegex       = "(.*)"
+	defaultRelabelReplacement = "$1"
+)
+
+// RelabelRule is a Prometheus style relabeling rule, applied to the labels of every series. The metric name
+// is available as the __name__ label. Values of the source labels are joined with the separator and matched
+// against the regex, which is anchored at both ends.
+type RelabelRule struct {
+	SourceLabels []string `json:"source_labels,omitempty"`
+	Separator    string   `json:"separator,omitempty"`
+	Regex        string   `json:"regex,omitempty"`
+	TargetLabel  string   `json:"target_label,omitempty"`
+	Replacement  string   `json:"replacement,omitempty"`
+	Action       string   `json:"action,omitempty"`
+}
+
+// RelabelRules holds values of the repeated flag, each being a rule in JSON format, e.g.
+// {"source_labels": ["pod_name"], "target_label": "pod"}.
+type RelabelRules []RelabelRule
+
+// String returns human-readable representation of the rules.
+func (r *RelabelRules) String() string {
+	var rules []string
+	for _, rule := range *r {
+		encoded, _ := json.Marshal(rule)
+		rules = append(rules, string(encoded))
+	}
+	return "[" + strings.Join(rules, " ") + "]"
+}
+
+// Set parses a single rule, fills in the defaults and appends it to the list.
+func (r *RelabelRules) Set(value string) error {
+	rule := RelabelRule{}
+	decoder := json.NewDecoder(strings.NewReader(value))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&rule); err != nil {
+		return fmt.Errorf("invalid relabel rule %q: %v", value, err)
+	}
+	if err := rule.setDefaults(); err != nil {
+		return fmt.Errorf("invalid relabel rule %q: %v", value, err)
+	}
+	*r = append(*r, rule)
+	return nil
+}
+
+// setDefaults fills in the unset fields with the defaults and validates the rule.
+func (rule *RelabelRule) setDefaults() error {
+	if rule.Action == "" {
+		rule.Action = RelabelReplace
+	}
+	if rule.Separator == "" {
+		rule.Separator = defaultRelabelSeparator
+	}
+	if rule.Regex == "" {
+		rule.Regex = defaultRelabelRegex
+	}
+	if rule.Replacement == "" {
+		rule.Replacement = defaultRelabelReplacement
+	}
+	if _, err := regexp.Compile(rule.Regex); err != nil {
+		return err
+	}
+	switch rule.Action {
+	case RelabelReplace:
+		if rule.TargetLabel == "" {
+			return fmt.Errorf("action replace requires target_label")
+		}
+	case RelabelKeep, RelabelDrop:
+		if len(rule.SourceLabels) == 0 {
+			return fmt.Errorf("action %s requires source_labels", rule.Action)
+		}
+	case RelabelLabelMap:
+	default:
+		return fmt.Errorf("unknown action %q, expected replace, keep, drop or labelmap", rule.Action)
+	}
+	return nil
+}
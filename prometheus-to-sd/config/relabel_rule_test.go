@@ -0,0 +1,47 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRelabelRulesSet(t *testing.T) {
+	var rules RelabelRules
+	assert.NoError(t, rules.Set(`{"source_labels": ["pod_name"], "target_label": "pod"}`))
+	assert.NoError(t, rules.Set(`{"action": "drop", "source_labels": ["__name__"], "regex": "go_.*"}`))
+	assert.NoError(t, rules.Set(`{"action": "labelmap", "regex": "k8s_(.+)"}`))
+	assert.Equal(t, RelabelRules{
+		{SourceLabels: []string{"pod_name"}, Separator: ";", Regex: "(.*)", TargetLabel: "pod", Replacement: "$1", Action: "replace"},
+		{SourceLabels: []string{"__name__"}, Separator: ";", Regex: "go_.*", Replacement: "$1", Action: "drop"},
+		{Separator: ";", Regex: "k8s_(.+)", Replacement: "$1", Action: "labelmap"},
+	}, rules)
+	assert.Contains(t, rules.String(), `"target_label":"pod"`)
+
+	for _, incorrect := range []string{
+		`not json`,
+		`{"action": "hashmod", "source_labels": ["a"]}`,
+		`{"source_labels": ["a"]}`,
+		`{"action": "keep"}`,
+		`{"action": "drop", "source_labels": ["a"], "regex": "("}`,
+		`{"action": "keep", "source_labels": ["a"], "modulus": 2}`,
+	} {
+		assert.Error(t, rules.Set(incorrect), "rule %s should be rejected", incorrect)
+	}
+}
@@ -0,0 +1,31 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+// ScrapeErrorSink receives failures of the scrapes of the source, e.g. to forward them to Cloud Logging
+// as structured log entries. It's called from the scraping goroutine, so it should return quickly.
+type ScrapeErrorSink interface {
+	ScrapeFailed(component, url string, err error)
+}
+
+// ScrapeErrorSinkFunc allows using ordinary functions as ScrapeErrorSinks.
+type ScrapeErrorSinkFunc func(component, url string, err error)
+
+// ScrapeFailed calls f(component, url, err).
+func (f ScrapeErrorSinkFunc) ScrapeFailed(component, url string, err error) {
+	f(component, url, err)
+}
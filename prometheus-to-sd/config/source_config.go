@@ -17,10 +17,13 @@ limitations under the License.
 package config
 
 import (
+	"crypto/tls"
 	"fmt"
 	"net"
+	"reflect"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/golang/glog"
 
@@ -29,13 +32,156 @@ import (
 
 // SourceConfig contains data specific for scraping one component.
 type SourceConfig struct {
-	Component     string
+	Component string
+	Scheme    string
+	// Host can have the unix:///path/to.sock form, in which case metrics are scraped over the Unix
+	// socket and Port is ignored.
 	Host          string
 	Port          uint
 	Path          string
 	Whitelisted   []string
 	PodConfig     PodConfig
 	MetricsPrefix string
+	// ScrapeTimeout limits the time of a single scrape. Zero means that the default timeout is used.
+	ScrapeTimeout time.Duration
+	// DialTimeout, TLSHandshakeTimeout and ResponseHeaderTimeout limit the time of establishing the connection,
+	// of the TLS handshake and of waiting for the response headers after the request was sent, all within the
+	// ScrapeTimeout. Zero means that the default timeout is used.
+	DialTimeout           time.Duration
+	TLSHandshakeTimeout   time.Duration
+	ResponseHeaderTimeout time.Duration
+	// BearerToken is sent in the Authorization header of every scrape request.
+	BearerToken string
+	// BearerTokenFile is a path to the file with the bearer token. It takes precedence over BearerToken.
+	BearerTokenFile string
+	// BasicAuthUsername enables basic authentication of scrape requests. Bearer token, if also set,
+	// takes precedence.
+	BasicAuthUsername string
+	// BasicAuthPassword is the password used for basic authentication.
+	BasicAuthPassword string
+	// BasicAuthPasswordFile is a path to the file with the basic auth password. It takes precedence
+	// over BasicAuthPassword.
+	BasicAuthPasswordFile string
+	// CACertFiles are paths to the PEM encoded CA certificates used, in addition to the system ones,
+	// to verify the scraped endpoint. Paths can point to directories, in which case all *.pem and *.crt
+	// files placed directly in them are used. Entries starting with "-----BEGIN" are PEM encoded certificates
+	// themselves.
+	CACertFiles []string
+	// ClientCertFile and ClientKeyFile are paths to the PEM encoded certificate and key presented
+	// to the endpoint requiring client authentication.
+	ClientCertFile string
+	ClientKeyFile  string
+	// TLSServerName is the name used for SNI and verification of the endpoint certificate instead of the Host,
+	// e.g. when scraping by IP an endpoint whose certificate names its hostname.
+	TLSServerName string
+	// MinTLSVersion is the minimal TLS version (1.0, 1.1, 1.2 or 1.3) accepted by the scrapes. Empty means 1.2.
+	MinTLSVersion string
+	// InsecureSkipVerify disables verification of the endpoint certificate. It takes precedence over CACertFiles.
+	InsecureSkipVerify bool
+	// ScrapeRetries is the number of times a scrape is retried after a connection or server error.
+	ScrapeRetries int
+	// ScrapeRetryBackoff is the delay before the first retry, it's doubled after each retry.
+	// Zero means that the default backoff is used.
+	ScrapeRetryBackoff time.Duration
+	// PreferProtobuf makes scrapes ask for the protobuf exposition format, which is faster to parse.
+	PreferProtobuf bool
+	// AcceptFormats are the exposition formats the endpoint is asked for, in the order of preference. Supported
+	// formats are protobuf, openmetrics and text. Overrides PreferProtobuf.
+	AcceptFormats []string
+	// MetricNameInclude and MetricNameExclude are regular expressions filtering scraped metrics by name.
+	// If include patterns are provided only matching metrics are kept. Exclude patterns take precedence.
+	MetricNameInclude []string
+	MetricNameExclude []string
+	// StaticLabels are added to every metric scraped from the source. Labels already present on
+	// the metric are kept, unless OverwriteStaticLabels is set.
+	StaticLabels          map[string]string
+	OverwriteStaticLabels bool
+	// LabelRename maps names of the scraped labels to the names used in Stackdriver.
+	LabelRename map[string]string
+	// LabelDrop lists labels removed from every metric to reduce cardinality.
+	LabelDrop []string
+	// LabelKeep lists the only labels kept on every metric, if it's not empty. It's applied before LabelDrop.
+	LabelKeep []string
+	// HonorTimestamps makes the timestamps exposed with the samples be used instead of the scrape time.
+	HonorTimestamps bool
+	// MaxBodyBytes limits the size of the scraped response body, bigger responses are rejected.
+	// Zero means no limit.
+	MaxBodyBytes int64
+	// Format is the exposition format of the endpoint, one of the Format* constants. Empty means FormatPrometheus.
+	Format string
+	// StreamResponse makes the body be parsed while it's read instead of being buffered as a whole, bounding
+	// the memory used by the scrapes of large responses. Raw body of such responses isn't available, and
+	// malformed metric families of the text format fail the whole scrape instead of being skipped.
+	StreamResponse bool
+	// ProxyURL is the proxy used for scrapes of the source. If empty, proxy is taken from the environment.
+	ProxyURL string
+	// Headers are added to every scrape request. Authorization header is ignored if the authentication
+	// is configured.
+	Headers map[string]string
+	// Query contains query parameters of the metrics endpoint url. They take precedence over the ones
+	// included in Path.
+	Query map[string]string
+	// AdditionalPaths are paths of other metrics endpoints of the component, scraped together with Path.
+	// Metric families exposed by several endpoints are merged.
+	AdditionalPaths []string
+	// AdditionalPorts are other ports of the host exposing metrics of the component at Path, scraped together
+	// with Port. If set, series of every port get the "port" label with the port number, so that series of
+	// metric families exposed on several ports remain distinguishable when merged.
+	AdditionalPorts []uint
+	// WhitelistedRegex are regular expressions admitting metrics in addition to the Whitelisted ones.
+	// Patterns have to match the whole metric name.
+	WhitelistedRegex []string
+	// MetricPrefixOverrides maps metric names to the prefixes used for them instead of MetricsPrefix.
+	MetricPrefixOverrides map[string]string
+	// MetricKindOverride maps metric names to the Stackdriver metric kinds (GAUGE, CUMULATIVE or DELTA) used
+	// instead of the ones derived from the Prometheus metric types. Counters overridden to DELTA are exported
+	// like DeltaCounters, DELTA overrides of other metric types are ignored.
+	MetricKindOverride map[string]string
+	// DeltaCounters are the names of the counters exported as DELTA metrics, with the increase of the value
+	// since the previous scrape instead of the cumulative value. MetricKindOverride takes precedence.
+	DeltaCounters []string
+	// StartTimeMetric is the name of the gauge exposing the start time of cumulative metrics in seconds.
+	// Empty means process_start_time_seconds. If the metric is missing, the time of the first scrape is used.
+	StartTimeMetric string
+	// TraceScrapes enables logging of DNS, connect, TLS handshake and first byte timings of the scrapes.
+	TraceScrapes bool
+	// UserAgent is sent in the User-Agent header of the scrapes instead of the default prometheus-to-sd/<version>.
+	UserAgent string
+	// StaleWindow is the time for which the last successful response is served instead of the failed scrapes.
+	// Zero disables serving stale responses.
+	StaleWindow time.Duration
+	// ScrapeInterval is the time between the scrapes of the source. Zero means the global --scrape-interval.
+	ScrapeInterval time.Duration
+	// FallbackHost and FallbackPort point to the endpoint scraped when the scrape of Host and Port fails after
+	// all retries. Unset fields default to Host and Port.
+	FallbackHost string
+	FallbackPort uint
+	// EmitScrapeMetadata adds the up and scrape_samples_scraped gauges describing the scrapes to the metrics
+	// of the source, like the Prometheus server does for its targets.
+	EmitScrapeMetadata bool
+	// FailOnEmptyScrape makes successful scrapes without any metric families fail, so that the component
+	// is reported unavailable.
+	FailOnEmptyScrape bool
+	// ProbeBeforeScrape makes every scrape be preceded by a TCP, or TLS for https sources, connection to the
+	// target, so that unreachable targets fail fast with a clear error.
+	ProbeBeforeScrape bool
+	// ProbeTimeout limits the time of the connectivity probe. Zero means that the default timeout is used.
+	ProbeTimeout time.Duration
+	// PinResolvedHost makes the Host be resolved once per scrape, so that the retries connect to the same
+	// address even if the host resolves to several ones.
+	PinResolvedHost bool
+	// RequireEnv makes references to unset environment variables in the string fields an error. Otherwise
+	// they are replaced with empty strings.
+	RequireEnv bool
+	// AllowUnknownPrefix allows MetricsPrefix and MetricPrefixOverrides to use domains other than the known
+	// Stackdriver ones.
+	AllowUnknownPrefix bool
+	// Logger receives messages logged while scraping and processing metrics of the source. Nil means that
+	// they are logged with glog.
+	Logger Logger
+	// ScrapeErrorSink, if set, receives the scrape failures reported by GetPrometheusMetrics, i.e. the ones
+	// not recovered by the fallback endpoint or the stale response.
+	ScrapeErrorSink ScrapeErrorSink
 }
 
 const defaultMetricsPath = "/metrics"
@@ -79,7 +225,8 @@ func parseSourceConfig(uri flags.Uri, podId, namespaceId string) (*SourceConfig,
 
 	component := uri.Key
 	values := uri.Val.Query()
-	path := uri.Val.Path
+	// Escaped path keeps escaped slashes and other reserved characters of the path segments.
+	path := uri.Val.EscapedPath()
 	whitelisted := values.Get("whitelisted")
 	podIdLabel := values.Get("podIdLabel")
 	namespaceIdLabel := values.Get("namespaceIdLabel")
@@ -87,7 +234,78 @@ func parseSourceConfig(uri flags.Uri, podId, namespaceId string) (*SourceConfig,
 	metricsPrefix := values.Get("metricsPrefix")
 	podConfig := NewPodConfig(podId, namespaceId, podIdLabel, namespaceIdLabel, containerNamelabel)
 
-	return newSourceConfig(component, host, port, path, whitelisted, metricsPrefix, podConfig)
+	sourceConfig, err := newSourceConfig(component, host, port, path, whitelisted, metricsPrefix, podConfig)
+	if err != nil {
+		return nil, err
+	}
+	sourceConfig.Scheme = uri.Val.Scheme
+	if err := checkUnsetEnv(uri); err != nil {
+		return nil, err
+	}
+	if err := sourceConfig.parseOptions(values); err != nil {
+		return nil, err
+	}
+	return sourceConfig, nil
+}
+
+// tlsVersions maps the values of MinTLSVersion to the TLS versions.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// TLSMinVersion returns the minimal TLS version accepted by the scrapes of the source.
+func (config *SourceConfig) TLSMinVersion() (uint16, error) {
+	if config.MinTLSVersion == "" {
+		return tls.VersionTLS12, nil
+	}
+	version, found := tlsVersions[config.MinTLSVersion]
+	if !found {
+		return 0, fmt.Errorf("invalid minimal TLS version %q, expected 1.0, 1.1, 1.2 or 1.3", config.MinTLSVersion)
+	}
+	return version, nil
+}
+
+// checkUnsetEnv returns an error if the source flag references unset environment variables and has
+// the requireEnv option set. The references are expanded to empty strings when the flag is parsed.
+func checkUnsetEnv(source flags.Uri) error {
+	var required bool
+	if err := parseBoolOption(source.Val.Query(), "requireEnv", &required); err != nil {
+		return err
+	}
+	if required && len(source.UnsetEnv) > 0 {
+		return fmt.Errorf("environment variables %s referenced by the config of %s are not set", strings.Join(source.UnsetEnv, ", "), source.Key)
+	}
+	return nil
+}
+
+// FallbackConfig returns the copy of the config scraping the fallback endpoint, if one is configured.
+func (config *SourceConfig) FallbackConfig() (*SourceConfig, bool) {
+	if config.FallbackHost == "" && config.FallbackPort == 0 {
+		return nil, false
+	}
+	fallback := *config
+	if config.FallbackHost != "" {
+		fallback.Host = config.FallbackHost
+	}
+	if config.FallbackPort != 0 {
+		fallback.Port = config.FallbackPort
+	}
+	return &fallback, true
+}
+
+// Equal returns true if the configs scrape the source the same way. Logger and ScrapeErrorSink are ignored,
+// as they may be functions, which are never deeply equal.
+func (config *SourceConfig) Equal(other *SourceConfig) bool {
+	if config == nil || other == nil {
+		return config == other
+	}
+	a, b := *config, *other
+	a.Logger, b.Logger = nil, nil
+	a.ScrapeErrorSink, b.ScrapeErrorSink = nil, nil
+	return reflect.DeepEqual(a, b)
 }
 
 // UpdateWhitelistedMetrics sets passed list as a list of whitelisted metrics.
@@ -95,6 +313,81 @@ func (config *SourceConfig) UpdateWhitelistedMetrics(list []string) {
 	config.Whitelisted = list
 }
 
+const (
+	// FormatPrometheus is the text, OpenMetrics or protobuf exposition format, detected by the content type.
+	FormatPrometheus = "prometheus"
+	// FormatOpenMetrics is the OpenMetrics exposition format, used regardless of the content type.
+	FormatOpenMetrics = "openmetrics"
+	// FormatJSON is the list of samples in JSON, see README.md for the schema.
+	FormatJSON = "json"
+)
+
+// unixSocketScheme is the prefix of the Host pointing to a Unix socket.
+const unixSocketScheme = "unix://"
+
+// UnixSocket returns the path of the Unix socket the metrics are scraped from, if the Host points to one.
+func (config *SourceConfig) UnixSocket() (string, bool) {
+	if !strings.HasPrefix(config.Host, unixSocketScheme) {
+		return "", false
+	}
+	return strings.TrimPrefix(config.Host, unixSocketScheme), true
+}
+
+// MetricsPrefixFor returns the prefix of the Stackdriver metric type of the metric with the given name.
+func (config *SourceConfig) MetricsPrefixFor(metricName string) string {
+	if prefix, found := config.MetricPrefixOverrides[metricName]; found {
+		return prefix
+	}
+	return config.MetricsPrefix
+}
+
+// knownMetricsPrefixes are the domains of the Stackdriver metric types accepted by NormalizeAndValidate.
+var knownMetricsPrefixes = map[string]bool{
+	"custom.googleapis.com":    true,
+	"external.googleapis.com":  true,
+	"container.googleapis.com": true,
+	"kubernetes.io":            true,
+}
+
+// NormalizeAndValidate trims whitespace and trailing slashes from MetricsPrefix and MetricPrefixOverrides
+// and lowercases their domains. Unless AllowUnknownPrefix is set, it returns an error if a domain isn't one
+// of the known Stackdriver ones. Empty MetricsPrefix is left as is. Scheme is lowercased and has to be http
+// or https, empty Scheme means http.
+func (config *SourceConfig) NormalizeAndValidate() error {
+	config.Scheme = strings.ToLower(config.Scheme)
+	if config.Scheme != "" && config.Scheme != "http" && config.Scheme != "https" {
+		return fmt.Errorf("invalid scheme %q of component %s, expected http or https", config.Scheme, config.Component)
+	}
+	var err error
+	if config.MetricsPrefix != "" {
+		if config.MetricsPrefix, err = config.normalizeMetricsPrefix(config.MetricsPrefix); err != nil {
+			return err
+		}
+	}
+	for name, prefix := range config.MetricPrefixOverrides {
+		if config.MetricPrefixOverrides[name], err = config.normalizeMetricsPrefix(prefix); err != nil {
+			return fmt.Errorf("invalid prefix override of metric %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+func (config *SourceConfig) normalizeMetricsPrefix(prefix string) (string, error) {
+	normalized := strings.TrimRight(strings.TrimSpace(prefix), "/")
+	domain, path := normalized, ""
+	if i := strings.Index(normalized, "/"); i >= 0 {
+		domain, path = normalized[:i], normalized[i:]
+	}
+	domain = strings.ToLower(domain)
+	if domain == "" {
+		return "", fmt.Errorf("metrics prefix %q has no domain", prefix)
+	}
+	if !knownMetricsPrefixes[domain] && !config.AllowUnknownPrefix {
+		return "", fmt.Errorf("unknown metrics prefix %q of component %s, expected custom.googleapis.com, external.googleapis.com, container.googleapis.com or kubernetes.io", prefix, config.Component)
+	}
+	return domain + path, nil
+}
+
 // SourceConfigsFromFlags creates a slice of SourceConfig's base on the provided flags.
 func SourceConfigsFromFlags(source flags.Uris, podId *string, namespaceId *string, defaultMetricsPrefix string) []*SourceConfig {
 	var sourceConfigs []*SourceConfig
@@ -105,6 +398,9 @@ func SourceConfigsFromFlags(source flags.Uris, podId *string, namespaceId *strin
 			if sourceConfig.MetricsPrefix == "" {
 				sourceConfig.MetricsPrefix = defaultMetricsPrefix
 			}
+			if err := sourceConfig.NormalizeAndValidate(); err != nil {
+				glog.Fatalf("Error while parsing source config flag %v: %v", c, err)
+			}
 			sourceConfigs = append(sourceConfigs, sourceConfig)
 		}
 	}
@@ -0,0 +1,30 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+// SourceConfigProvider returns the current set of sources to scrape, e.g. the targets discovered at runtime.
+type SourceConfigProvider interface {
+	SourceConfigs() ([]*SourceConfig, error)
+}
+
+// SourceConfigProviderFunc allows using ordinary functions as SourceConfigProviders.
+type SourceConfigProviderFunc func() ([]*SourceConfig, error)
+
+// SourceConfigs calls f().
+func (f SourceConfigProviderFunc) SourceConfigs() ([]*SourceConfig, error) {
+	return f()
+}
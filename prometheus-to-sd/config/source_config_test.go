@@ -19,6 +19,7 @@ package config
 import (
 	"net/url"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 
@@ -107,6 +108,7 @@ func TestParseSourceConfig(t *testing.T) {
 			},
 			SourceConfig{
 				Component:   "testComponent",
+				Scheme:      "http",
 				Host:        "hostname",
 				Port:        1234,
 				Path:        defaultMetricsPath,
@@ -126,6 +128,7 @@ func TestParseSourceConfig(t *testing.T) {
 			},
 			SourceConfig{
 				Component:   "testComponent",
+				Scheme:      "http",
 				Host:        "hostname",
 				Port:        1234,
 				Path:        "/status/prometheus",
@@ -133,6 +136,25 @@ func TestParseSourceConfig(t *testing.T) {
 				PodConfig:   NewPodConfig(podId, namespaceId, "", "", ""),
 			},
 		},
+		{
+			flags.Uri{
+				Key: "testComponent",
+				Val: url.URL{
+					Scheme:  "http",
+					Host:    "hostname:1234",
+					Path:    "/metrics/raw",
+					RawPath: "/metrics%2Fraw",
+				},
+			},
+			SourceConfig{
+				Component: "testComponent",
+				Scheme:    "http",
+				Host:      "hostname",
+				Port:      1234,
+				Path:      "/metrics%2Fraw",
+				PodConfig: NewPodConfig(podId, namespaceId, "", "", ""),
+			},
+		},
 		{
 			flags.Uri{
 				Key: "testComponent",
@@ -145,6 +167,7 @@ func TestParseSourceConfig(t *testing.T) {
 			},
 			SourceConfig{
 				Component:     "testComponent",
+				Scheme:        "http",
 				Host:          "localhost",
 				Port:          8080,
 				Path:          defaultMetricsPath,
@@ -152,6 +175,89 @@ func TestParseSourceConfig(t *testing.T) {
 				PodConfig:     NewPodConfig(podId, namespaceId, "", "", ""),
 			},
 		},
+		{
+			flags.Uri{
+				Key: "testComponent",
+				Val: url.URL{
+					Scheme:   "http",
+					Host:     "localhost:8080",
+					Path:     defaultMetricsPath,
+					RawQuery: "scrapeTimeout=5s",
+				},
+			},
+			SourceConfig{
+				Component:     "testComponent",
+				Scheme:        "http",
+				Host:          "localhost",
+				Port:          8080,
+				Path:          defaultMetricsPath,
+				PodConfig:     NewPodConfig(podId, namespaceId, "", "", ""),
+				ScrapeTimeout: 5 * time.Second,
+			},
+		},
+		{
+			flags.Uri{
+				Key: "testComponent",
+				Val: url.URL{
+					Scheme:   "https",
+					Host:     "localhost:8443",
+					Path:     defaultMetricsPath,
+					RawQuery: "caCertFiles=/etc/ca1.pem,/etc/ca2.pem&clientCertFile=/etc/client.crt&clientKeyFile=/etc/client.key",
+				},
+			},
+			SourceConfig{
+				Component:      "testComponent",
+				Scheme:         "https",
+				Host:           "localhost",
+				Port:           8443,
+				Path:           defaultMetricsPath,
+				PodConfig:      NewPodConfig(podId, namespaceId, "", "", ""),
+				CACertFiles:    []string{"/etc/ca1.pem", "/etc/ca2.pem"},
+				ClientCertFile: "/etc/client.crt",
+				ClientKeyFile:  "/etc/client.key",
+			},
+		},
+		{
+			flags.Uri{
+				Key: "testComponent",
+				Val: url.URL{
+					Scheme:   "https",
+					Host:     "localhost:8443",
+					Path:     defaultMetricsPath,
+					RawQuery: "insecureSkipVerify=true",
+				},
+			},
+			SourceConfig{
+				Component:          "testComponent",
+				Scheme:             "https",
+				Host:               "localhost",
+				Port:               8443,
+				Path:               defaultMetricsPath,
+				PodConfig:          NewPodConfig(podId, namespaceId, "", "", ""),
+				InsecureSkipVerify: true,
+			},
+		},
+		{
+			flags.Uri{
+				Key: "testComponent",
+				Val: url.URL{
+					Scheme:   "http",
+					Host:     "localhost:8080",
+					Path:     defaultMetricsPath,
+					RawQuery: "scrapeRetries=3&scrapeRetryBackoff=100ms",
+				},
+			},
+			SourceConfig{
+				Component:          "testComponent",
+				Scheme:             "http",
+				Host:               "localhost",
+				Port:               8080,
+				Path:               defaultMetricsPath,
+				PodConfig:          NewPodConfig(podId, namespaceId, "", "", ""),
+				ScrapeRetries:      3,
+				ScrapeRetryBackoff: 100 * time.Millisecond,
+			},
+		},
 	}
 
 	for _, c := range correct {
@@ -178,6 +284,30 @@ func TestParseSourceConfig(t *testing.T) {
 				RawQuery: "whitelisted=a,b,c,d",
 			},
 		},
+		{
+			Key: "incorrectScrapeTimeout",
+			Val: url.URL{
+				Scheme:   "http",
+				Host:     "hostname:1234",
+				RawQuery: "scrapeTimeout=abc",
+			},
+		},
+		{
+			Key: "incorrectInsecureSkipVerify",
+			Val: url.URL{
+				Scheme:   "https",
+				Host:     "hostname:1234",
+				RawQuery: "insecureSkipVerify=maybe",
+			},
+		},
+		{
+			Key: "negativeScrapeRetries",
+			Val: url.URL{
+				Scheme:   "http",
+				Host:     "hostname:1234",
+				RawQuery: "scrapeRetries=-1",
+			},
+		},
 	}
 
 	for _, c := range incorrect {
@@ -185,3 +315,186 @@ func TestParseSourceConfig(t *testing.T) {
 		assert.Error(t, err)
 	}
 }
+
+func TestParseSourceConfigExpandsEnv(t *testing.T) {
+	t.Setenv("PTSD_HOST", "kubelet")
+	t.Setenv("PTSD_TOKEN_DIR", "/var/run/secrets")
+	tests := []struct {
+		flag    string
+		want    SourceConfig
+		wantErr bool
+	}{
+		{
+			flag: "kubelet:https://${PTSD_HOST}:10250/metrics?bearerTokenFile=${PTSD_TOKEN_DIR}/token&metricsPrefix=${PTSD_PREFIX:-kubernetes.io/internal}",
+			want: SourceConfig{Host: "kubelet", BearerTokenFile: "/var/run/secrets/token", MetricsPrefix: "kubernetes.io/internal"},
+		},
+		{
+			flag: "kubelet:https://${PTSD_HOST}:10250/metrics?bearerTokenFile=${PTSD_MISSING}/token",
+			want: SourceConfig{Host: "kubelet", BearerTokenFile: "/token"},
+		},
+		{
+			flag:    "kubelet:https://${PTSD_HOST}:10250/metrics?bearerTokenFile=${PTSD_MISSING}/token&requireEnv=true",
+			wantErr: true,
+		},
+		{
+			flag: "kubelet:https://${PTSD_HOST}:10250/metrics?bearerTokenFile=${PTSD_TOKEN_DIR}/token&requireEnv=true",
+			want: SourceConfig{Host: "kubelet", BearerTokenFile: "/var/run/secrets/token", RequireEnv: true},
+		},
+		{
+			flag: "kubelet:https://${PTSD_MISSING}:10250/metrics",
+			want: SourceConfig{Host: ""},
+		},
+		{
+			flag:    "kubelet:https://${PTSD_MISSING}:10250/metrics?requireEnv=true",
+			wantErr: true,
+		},
+		{
+			flag: "kubelet:https://${PTSD_HOST}:10250/metrics?whitelisted=up${PTSD_MISSING}",
+			want: SourceConfig{Host: "kubelet", Whitelisted: []string{"up"}},
+		},
+		{
+			flag:    "kubelet:https://${PTSD_HOST}:10250/metrics?whitelisted=${PTSD_MISSING}&requireEnv=true",
+			wantErr: true,
+		},
+	}
+	for _, c := range tests {
+		var uri flags.Uri
+		if err := uri.Set(c.flag); err != nil {
+			t.Fatalf("Failed to parse flag %q: %v", c.flag, err)
+		}
+		sourceConfig, err := parseSourceConfig(uri, "", "")
+		if c.wantErr {
+			assert.Error(t, err, "expected error for %q", c.flag)
+			continue
+		}
+		if assert.NoError(t, err, "unexpected error for %q", c.flag) {
+			assert.Equal(t, c.want.Host, sourceConfig.Host)
+			assert.Equal(t, c.want.BearerTokenFile, sourceConfig.BearerTokenFile)
+			assert.Equal(t, c.want.MetricsPrefix, sourceConfig.MetricsPrefix)
+			assert.Equal(t, c.want.RequireEnv, sourceConfig.RequireEnv)
+			if c.want.Whitelisted != nil {
+				assert.Equal(t, c.want.Whitelisted, sourceConfig.Whitelisted)
+			}
+		}
+	}
+}
+
+func TestNormalizeAndValidate(t *testing.T) {
+	testcases := []struct {
+		description string
+		config      SourceConfig
+		want        SourceConfig
+	}{
+		{
+			description: "valid prefix",
+			config:      SourceConfig{MetricsPrefix: "custom.googleapis.com/addons"},
+			want:        SourceConfig{MetricsPrefix: "custom.googleapis.com/addons"},
+		},
+		{
+			description: "trailing slash",
+			config:      SourceConfig{MetricsPrefix: " custom.googleapis.com/ "},
+			want:        SourceConfig{MetricsPrefix: "custom.googleapis.com"},
+		},
+		{
+			description: "uppercase domain",
+			config:      SourceConfig{MetricsPrefix: "External.GoogleAPIs.com/MyApp/"},
+			want:        SourceConfig{MetricsPrefix: "external.googleapis.com/MyApp"},
+		},
+		{
+			description: "prefix overrides",
+			config: SourceConfig{
+				MetricsPrefix:         "container.googleapis.com/master",
+				MetricPrefixOverrides: map[string]string{"requests": "CUSTOM.googleapis.com/"},
+			},
+			want: SourceConfig{
+				MetricsPrefix:         "container.googleapis.com/master",
+				MetricPrefixOverrides: map[string]string{"requests": "custom.googleapis.com"},
+			},
+		},
+		{
+			description: "mixed-case scheme",
+			config:      SourceConfig{Scheme: "HTTPs"},
+			want:        SourceConfig{Scheme: "https"},
+		},
+		{
+			description: "http scheme",
+			config:      SourceConfig{Scheme: "http"},
+			want:        SourceConfig{Scheme: "http"},
+		},
+		{
+			description: "allowed unknown prefix",
+			config:      SourceConfig{MetricsPrefix: "example.com/metrics/", AllowUnknownPrefix: true},
+			want:        SourceConfig{MetricsPrefix: "example.com/metrics", AllowUnknownPrefix: true},
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			config := tc.config
+			if assert.NoError(t, config.NormalizeAndValidate()) {
+				assert.Equal(t, tc.want, config)
+			}
+		})
+	}
+}
+
+func TestNormalizeAndValidateErrors(t *testing.T) {
+	incorrect := []SourceConfig{
+		{MetricsPrefix: "custom.googleapi.com"},
+		{MetricsPrefix: "/custom.googleapis.com"},
+		{MetricsPrefix: "container.googleapis.com", MetricPrefixOverrides: map[string]string{"requests": "example.com"}},
+	}
+	for _, config := range incorrect {
+		assert.Error(t, config.NormalizeAndValidate(), "prefix %q should be invalid", config.MetricsPrefix)
+	}
+}
+
+func TestNormalizeAndValidateScheme(t *testing.T) {
+	for _, scheme := range []string{"htpp", "ftp", "unix"} {
+		config := SourceConfig{Component: "kubelet", Scheme: scheme}
+		if err := config.NormalizeAndValidate(); assert.Error(t, err, "scheme %q should be invalid", scheme) {
+			assert.Contains(t, err.Error(), "kubelet")
+			assert.Contains(t, err.Error(), scheme)
+		}
+	}
+}
+
+func TestSourceConfigEqual(t *testing.T) {
+	newConfig := func() *SourceConfig {
+		return &SourceConfig{
+			Component:       "kubelet",
+			Host:            "localhost",
+			Port:            10255,
+			Whitelisted:     []string{"up"},
+			ScrapeErrorSink: ScrapeErrorSinkFunc(func(component, url string, err error) {}),
+		}
+	}
+	assert.True(t, newConfig().Equal(newConfig()), "configs differing only by the functions should be equal")
+	changed := newConfig()
+	changed.Whitelisted = []string{"up", "requests"}
+	assert.False(t, newConfig().Equal(changed))
+	var missing *SourceConfig
+	assert.False(t, newConfig().Equal(missing))
+	assert.True(t, missing.Equal(nil))
+}
+
+func TestFallbackConfig(t *testing.T) {
+	primary := &SourceConfig{Component: "exporter", Host: "primary", Port: 9090}
+	_, ok := primary.FallbackConfig()
+	assert.False(t, ok)
+
+	primary.FallbackHost = "backup"
+	fallback, ok := primary.FallbackConfig()
+	if assert.True(t, ok) {
+		assert.Equal(t, "backup", fallback.Host)
+		assert.Equal(t, uint(9090), fallback.Port)
+	}
+
+	primary.FallbackHost = ""
+	primary.FallbackPort = 9091
+	fallback, ok = primary.FallbackConfig()
+	if assert.True(t, ok) {
+		assert.Equal(t, "primary", fallback.Host)
+		assert.Equal(t, uint(9091), fallback.Port)
+	}
+	assert.Equal(t, "primary", primary.Host, "primary config should not be modified")
+}
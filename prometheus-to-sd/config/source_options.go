@@ -0,0 +1,337 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// parseOptions sets optional scraping parameters passed as query parameters of the source url.
+func (config *SourceConfig) parseOptions(values url.Values) error {
+	var err error
+	if err := parseDurationOption(values, "scrapeTimeout", &config.ScrapeTimeout); err != nil {
+		return err
+	}
+	if config.ScrapeTimeout < 0 {
+		return fmt.Errorf("invalid scrapeTimeout %v: must not be negative", config.ScrapeTimeout)
+	}
+	if err := parseDurationOption(values, "dialTimeout", &config.DialTimeout); err != nil {
+		return err
+	}
+	if config.DialTimeout < 0 {
+		return fmt.Errorf("invalid dialTimeout %v: must not be negative", config.DialTimeout)
+	}
+	if err := parseDurationOption(values, "tlsHandshakeTimeout", &config.TLSHandshakeTimeout); err != nil {
+		return err
+	}
+	if config.TLSHandshakeTimeout < 0 {
+		return fmt.Errorf("invalid tlsHandshakeTimeout %v: must not be negative", config.TLSHandshakeTimeout)
+	}
+	if err := parseDurationOption(values, "responseHeaderTimeout", &config.ResponseHeaderTimeout); err != nil {
+		return err
+	}
+	if config.ResponseHeaderTimeout < 0 {
+		return fmt.Errorf("invalid responseHeaderTimeout %v: must not be negative", config.ResponseHeaderTimeout)
+	}
+	config.BearerTokenFile = values.Get("bearerTokenFile")
+	config.BasicAuthUsername = values.Get("basicAuthUsername")
+	config.BasicAuthPasswordFile = values.Get("basicAuthPasswordFile")
+	config.CACertFiles = parseListOption(values, "caCertFiles")
+	config.ClientCertFile = values.Get("clientCertFile")
+	config.ClientKeyFile = values.Get("clientKeyFile")
+	if err := parseBoolOption(values, "insecureSkipVerify", &config.InsecureSkipVerify); err != nil {
+		return err
+	}
+	if err := parseIntOption(values, "scrapeRetries", &config.ScrapeRetries); err != nil {
+		return err
+	}
+	if err := parseDurationOption(values, "scrapeRetryBackoff", &config.ScrapeRetryBackoff); err != nil {
+		return err
+	}
+	if config.ScrapeRetryBackoff < 0 {
+		return fmt.Errorf("invalid scrapeRetryBackoff %v: must not be negative", config.ScrapeRetryBackoff)
+	}
+	if err := parseBoolOption(values, "preferProtobuf", &config.PreferProtobuf); err != nil {
+		return err
+	}
+	config.Format = values.Get("format")
+	if config.Format != "" && !formats[config.Format] {
+		return fmt.Errorf("invalid format %q, expected prometheus, openmetrics or json", config.Format)
+	}
+	config.AcceptFormats = parseListOption(values, "acceptFormats")
+	for _, format := range config.AcceptFormats {
+		if !acceptFormats[format] {
+			return fmt.Errorf("invalid accepted format %q, expected protobuf, openmetrics or text", format)
+		}
+	}
+	if config.MetricNameInclude, err = parseRegexpListOption(values, "metricNameInclude"); err != nil {
+		return err
+	}
+	if config.MetricNameExclude, err = parseRegexpListOption(values, "metricNameExclude"); err != nil {
+		return err
+	}
+	if config.StaticLabels, err = parseMapOption(values, "staticLabels"); err != nil {
+		return err
+	}
+	if err := parseBoolOption(values, "overwriteStaticLabels", &config.OverwriteStaticLabels); err != nil {
+		return err
+	}
+	if config.LabelRename, err = parseMapOption(values, "labelRename"); err != nil {
+		return err
+	}
+	config.LabelDrop = parseListOption(values, "labelDrop")
+	config.LabelKeep = parseListOption(values, "labelKeep")
+	if err := parseBoolOption(values, "honorTimestamps", &config.HonorTimestamps); err != nil {
+		return err
+	}
+	if err := parseInt64Option(values, "maxBodyBytes", &config.MaxBodyBytes); err != nil {
+		return err
+	}
+	if err := parseBoolOption(values, "streamResponse", &config.StreamResponse); err != nil {
+		return err
+	}
+	if config.ProxyURL, err = parseURLOption(values, "proxyURL"); err != nil {
+		return err
+	}
+	if config.Headers, err = parseMapOption(values, "headers"); err != nil {
+		return err
+	}
+	if config.Query, err = parseMapOption(values, "pathQuery"); err != nil {
+		return err
+	}
+	config.AdditionalPaths = parseListOption(values, "additionalPaths")
+	for _, port := range parseListOption(values, "additionalPorts") {
+		parsed, err := strconv.ParseUint(port, 10, 16)
+		if err != nil || parsed == 0 {
+			return fmt.Errorf("invalid port %q in additionalPorts, expected a port number", port)
+		}
+		config.AdditionalPorts = append(config.AdditionalPorts, uint(parsed))
+	}
+	if config.WhitelistedRegex, err = parseRegexpListOption(values, "whitelistedRegex"); err != nil {
+		return err
+	}
+	config.TLSServerName = values.Get("tlsServerName")
+	config.MinTLSVersion = values.Get("minTLSVersion")
+	if _, err := config.TLSMinVersion(); err != nil {
+		return err
+	}
+	config.StartTimeMetric = values.Get("startTimeMetric")
+	config.UserAgent = values.Get("userAgent")
+	if err := parseBoolOption(values, "traceScrapes", &config.TraceScrapes); err != nil {
+		return err
+	}
+	if err := parseDurationOption(values, "staleWindow", &config.StaleWindow); err != nil {
+		return err
+	}
+	if err := parseDurationOption(values, "scrapeInterval", &config.ScrapeInterval); err != nil {
+		return err
+	}
+	if config.ScrapeInterval < 0 {
+		return fmt.Errorf("invalid scrapeInterval %v: must not be negative", config.ScrapeInterval)
+	}
+	config.FallbackHost = values.Get("fallbackHost")
+	if port := values.Get("fallbackPort"); port != "" {
+		parsed, err := strconv.ParseUint(port, 10, 16)
+		if err != nil || parsed == 0 {
+			return fmt.Errorf("invalid fallbackPort %q, expected a port number", port)
+		}
+		config.FallbackPort = uint(parsed)
+	}
+	if err := parseBoolOption(values, "emitScrapeMetadata", &config.EmitScrapeMetadata); err != nil {
+		return err
+	}
+	if err := parseBoolOption(values, "failOnEmptyScrape", &config.FailOnEmptyScrape); err != nil {
+		return err
+	}
+	if err := parseBoolOption(values, "probeBeforeScrape", &config.ProbeBeforeScrape); err != nil {
+		return err
+	}
+	if err := parseDurationOption(values, "probeTimeout", &config.ProbeTimeout); err != nil {
+		return err
+	}
+	if config.ProbeTimeout < 0 {
+		return fmt.Errorf("invalid probeTimeout %v: must not be negative", config.ProbeTimeout)
+	}
+	if err := parseBoolOption(values, "pinResolvedHost", &config.PinResolvedHost); err != nil {
+		return err
+	}
+	if err := parseBoolOption(values, "requireEnv", &config.RequireEnv); err != nil {
+		return err
+	}
+	if err := parseBoolOption(values, "allowUnknownPrefix", &config.AllowUnknownPrefix); err != nil {
+		return err
+	}
+	if socket := values.Get("unixSocket"); socket != "" {
+		config.Host = unixSocketScheme + socket
+	}
+	if config.MetricPrefixOverrides, err = parseMapOption(values, "metricPrefixOverrides"); err != nil {
+		return err
+	}
+	if config.MetricKindOverride, err = parseMapOption(values, "metricKindOverride"); err != nil {
+		return err
+	}
+	for name, kind := range config.MetricKindOverride {
+		if !metricKinds[kind] {
+			return fmt.Errorf("invalid metric kind %q of metric %s, expected GAUGE, CUMULATIVE or DELTA", kind, name)
+		}
+	}
+	config.DeltaCounters = parseListOption(values, "deltaCounters")
+	if config.BasicAuthUsername != "" && config.BearerTokenFile != "" {
+		glog.Warningf("Both basicAuthUsername and bearerTokenFile are set for component %s, bearer token will be used", config.Component)
+	}
+	if config.BasicAuthUsername != "" || config.BearerTokenFile != "" {
+		for name := range config.Headers {
+			if strings.EqualFold(name, "Authorization") {
+				glog.Warningf("Both headers with %s and authentication are set for component %s, the header will be ignored", name, config.Component)
+			}
+		}
+	}
+	if config.PreferProtobuf && len(config.AcceptFormats) > 0 {
+		glog.Warningf("Both preferProtobuf and acceptFormats are set for component %s, acceptFormats will be used", config.Component)
+	}
+	if config.InsecureSkipVerify && len(config.CACertFiles) > 0 {
+		glog.Warningf("Both insecureSkipVerify and caCertFiles are set for component %s, certificate of the endpoint won't be verified", config.Component)
+	}
+	return nil
+}
+
+// metricKinds are the Stackdriver metric kinds accepted by the metricKindOverride option.
+var metricKinds = map[string]bool{
+	"GAUGE":      true,
+	"CUMULATIVE": true,
+	"DELTA":      true,
+}
+
+// acceptFormats are the exposition formats accepted by the acceptFormats option.
+var acceptFormats = map[string]bool{
+	"protobuf":    true,
+	"openmetrics": true,
+	"text":        true,
+}
+
+// formats are the exposition formats accepted by the format option.
+var formats = map[string]bool{
+	FormatPrometheus:  true,
+	FormatOpenMetrics: true,
+	FormatJSON:        true,
+}
+
+// parseListOption returns comma separated values of the option, or nil if the option is not set.
+func parseListOption(values url.Values, name string) []string {
+	if value := values.Get(name); value != "" {
+		return strings.Split(value, ",")
+	}
+	return nil
+}
+
+// parseMapOption parses the option in format "key1:value1,key2:value2". Returns nil if the option is not set.
+func parseMapOption(values url.Values, name string) (map[string]string, error) {
+	entries := parseListOption(values, name)
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	result := make(map[string]string)
+	for _, entry := range entries {
+		kv := strings.SplitN(entry, ":", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("invalid %s entry %q, expected key:value", name, entry)
+		}
+		result[kv[0]] = kv[1]
+	}
+	return result, nil
+}
+
+// parseRegexpListOption returns all values of the repeated option, validating that each of them
+// is a valid regular expression.
+func parseRegexpListOption(values url.Values, name string) ([]string, error) {
+	patterns := values[name]
+	for _, pattern := range patterns {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return nil, fmt.Errorf("invalid %s %q: %v", name, pattern, err)
+		}
+	}
+	return patterns, nil
+}
+
+// parseURLOption validates that the option is an absolute url.
+func parseURLOption(values url.Values, name string) (string, error) {
+	value := values.Get(name)
+	if value == "" {
+		return "", nil
+	}
+	parsed, err := url.Parse(value)
+	if err != nil {
+		return "", fmt.Errorf("invalid %s %q: %v", name, value, err)
+	}
+	if parsed.Scheme == "" || parsed.Host == "" {
+		return "", fmt.Errorf("invalid %s %q, expected scheme://host:port", name, value)
+	}
+	return value, nil
+}
+
+func parseBoolOption(values url.Values, name string, result *bool) error {
+	if value := values.Get(name); value != "" {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid %s %q: %v", name, value, err)
+		}
+		*result = parsed
+	}
+	return nil
+}
+
+// parseIntOption parses the option which is expected to be a non-negative number.
+func parseIntOption(values url.Values, name string, result *int) error {
+	if value := values.Get(name); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 {
+			return fmt.Errorf("invalid %s %q, expected a non-negative number", name, value)
+		}
+		*result = parsed
+	}
+	return nil
+}
+
+// parseInt64Option parses the option which is expected to be a non-negative 64-bit number.
+func parseInt64Option(values url.Values, name string, result *int64) error {
+	if value := values.Get(name); value != "" {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || parsed < 0 {
+			return fmt.Errorf("invalid %s %q, expected a non-negative number", name, value)
+		}
+		*result = parsed
+	}
+	return nil
+}
+
+func parseDurationOption(values url.Values, name string, result *time.Duration) error {
+	if value := values.Get(name); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid %s %q: %v", name, value, err)
+		}
+		*result = parsed
+	}
+	return nil
+}
@@ -0,0 +1,255 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseOptions(t *testing.T) {
+	testcases := []struct {
+		query string
+		want  SourceConfig
+	}{
+		{
+			query: "preferProtobuf=true",
+			want:  SourceConfig{PreferProtobuf: true},
+		},
+		{
+			query: "acceptFormats=protobuf,openmetrics,text",
+			want:  SourceConfig{AcceptFormats: []string{"protobuf", "openmetrics", "text"}},
+		},
+		{
+			query: "metricNameInclude=^http_&metricNameInclude=^grpc_&metricNameExclude=_bucket$",
+			want: SourceConfig{
+				MetricNameInclude: []string{"^http_", "^grpc_"},
+				MetricNameExclude: []string{"_bucket$"},
+			},
+		},
+		{
+			query: "staticLabels=cluster:prod,zone:us-east1-b&overwriteStaticLabels=true",
+			want: SourceConfig{
+				StaticLabels:          map[string]string{"cluster": "prod", "zone": "us-east1-b"},
+				OverwriteStaticLabels: true,
+			},
+		},
+		{
+			query: "labelRename=pod_name:pod,container_name:container",
+			want: SourceConfig{
+				LabelRename: map[string]string{"pod_name": "pod", "container_name": "container"},
+			},
+		},
+		{
+			query: "labelDrop=id,instance",
+			want:  SourceConfig{LabelDrop: []string{"id", "instance"}},
+		},
+		{
+			query: "labelKeep=code,method",
+			want:  SourceConfig{LabelKeep: []string{"code", "method"}},
+		},
+		{
+			query: "additionalPaths=/metrics/cadvisor,/metrics/resource",
+			want:  SourceConfig{AdditionalPaths: []string{"/metrics/cadvisor", "/metrics/resource"}},
+		},
+		{
+			query: "additionalPorts=9090,9091",
+			want:  SourceConfig{AdditionalPorts: []uint{9090, 9091}},
+		},
+		{
+			query: "whitelistedRegex=http_.*&whitelistedRegex=grpc_(client|server)_.*",
+			want:  SourceConfig{WhitelistedRegex: []string{"http_.*", "grpc_(client|server)_.*"}},
+		},
+		{
+			query: "metricPrefixOverrides=requests_total:custom.googleapis.com,errors:external.googleapis.com/prometheus",
+			want: SourceConfig{MetricPrefixOverrides: map[string]string{
+				"requests_total": "custom.googleapis.com",
+				"errors":         "external.googleapis.com/prometheus",
+			}},
+		},
+		{
+			query: "unixSocket=/var/run/exporter.sock",
+			want:  SourceConfig{Host: "unix:///var/run/exporter.sock"},
+		},
+		{
+			query: "startTimeMetric=app_start_time_seconds",
+			want:  SourceConfig{StartTimeMetric: "app_start_time_seconds"},
+		},
+		{
+			query: "traceScrapes=true",
+			want:  SourceConfig{TraceScrapes: true},
+		},
+		{
+			query: "userAgent=monitoring-agent/1.0",
+			want:  SourceConfig{UserAgent: "monitoring-agent/1.0"},
+		},
+		{
+			query: "metricKindOverride=requests:CUMULATIVE,queue_length:GAUGE",
+			want: SourceConfig{MetricKindOverride: map[string]string{
+				"requests":     "CUMULATIVE",
+				"queue_length": "GAUGE",
+			}},
+		},
+		{
+			query: "deltaCounters=requests_total,errors_total",
+			want:  SourceConfig{DeltaCounters: []string{"requests_total", "errors_total"}},
+		},
+		{
+			query: "tlsServerName=kubelet.cluster.local",
+			want:  SourceConfig{TLSServerName: "kubelet.cluster.local"},
+		},
+		{
+			query: "minTLSVersion=1.3",
+			want:  SourceConfig{MinTLSVersion: "1.3"},
+		},
+		{
+			query: "staleWindow=2m",
+			want:  SourceConfig{StaleWindow: 2 * time.Minute},
+		},
+		{
+			query: "scrapeInterval=5m",
+			want:  SourceConfig{ScrapeInterval: 5 * time.Minute},
+		},
+		{
+			query: "fallbackHost=backup.local&fallbackPort=9091",
+			want:  SourceConfig{FallbackHost: "backup.local", FallbackPort: 9091},
+		},
+		{
+			query: "emitScrapeMetadata=true",
+			want:  SourceConfig{EmitScrapeMetadata: true},
+		},
+		{
+			query: "streamResponse=true",
+			want:  SourceConfig{StreamResponse: true},
+		},
+		{
+			query: "failOnEmptyScrape=true",
+			want:  SourceConfig{FailOnEmptyScrape: true},
+		},
+		{
+			query: "probeBeforeScrape=true&probeTimeout=500ms",
+			want:  SourceConfig{ProbeBeforeScrape: true, ProbeTimeout: 500 * time.Millisecond},
+		},
+		{
+			query: "dialTimeout=2s&tlsHandshakeTimeout=3s&responseHeaderTimeout=4s",
+			want:  SourceConfig{DialTimeout: 2 * time.Second, TLSHandshakeTimeout: 3 * time.Second, ResponseHeaderTimeout: 4 * time.Second},
+		},
+		{
+			query: "format=json",
+			want:  SourceConfig{Format: FormatJSON},
+		},
+		{
+			query: "pinResolvedHost=true",
+			want:  SourceConfig{PinResolvedHost: true},
+		},
+		{
+			query: "allowUnknownPrefix=true",
+			want:  SourceConfig{AllowUnknownPrefix: true},
+		},
+		{
+			query: "requireEnv=true",
+			want:  SourceConfig{RequireEnv: true},
+		},
+		{
+			query: "honorTimestamps=true",
+			want:  SourceConfig{HonorTimestamps: true},
+		},
+		{
+			query: "maxBodyBytes=1048576",
+			want:  SourceConfig{MaxBodyBytes: 1048576},
+		},
+		{
+			query: "basicAuthUsername=admin&basicAuthPasswordFile=/etc/secret/password",
+			want:  SourceConfig{BasicAuthUsername: "admin", BasicAuthPasswordFile: "/etc/secret/password"},
+		},
+		{
+			query: "proxyURL=http://proxy.internal:3128",
+			want:  SourceConfig{ProxyURL: "http://proxy.internal:3128"},
+		},
+		{
+			query: "headers=X-Scope-OrgID:tenant-1,X-Api-Version:2",
+			want:  SourceConfig{Headers: map[string]string{"X-Scope-OrgID": "tenant-1", "X-Api-Version": "2"}},
+		},
+		{
+			query: "pathQuery=format:prometheus",
+			want:  SourceConfig{Query: map[string]string{"format": "prometheus"}},
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.query, func(t *testing.T) {
+			values, err := url.ParseQuery(tc.query)
+			if err != nil {
+				t.Fatalf("Failed to parse query %q: %v", tc.query, err)
+			}
+			sourceConfig := SourceConfig{}
+			if assert.NoError(t, sourceConfig.parseOptions(values)) {
+				assert.Equal(t, tc.want, sourceConfig)
+			}
+		})
+	}
+}
+
+func TestParseOptionsErrors(t *testing.T) {
+	incorrect := []url.Values{
+		{"preferProtobuf": {"yes please"}},
+		{"acceptFormats": {"protobuf,json"}},
+		{"requireEnv": {"1.0"}},
+		{"allowUnknownPrefix": {"sure"}},
+		{"probeBeforeScrape": {"maybe"}},
+		{"probeTimeout": {"fast"}},
+		{"probeTimeout": {"-1s"}},
+		{"format": {"JSON"}},
+		{"additionalPorts": {"9090,http"}},
+		{"additionalPorts": {"0"}},
+		{"additionalPorts": {"65536"}},
+		{"dialTimeout": {"fast"}},
+		{"scrapeTimeout": {"-1s"}},
+		{"scrapeRetryBackoff": {"-1s"}},
+		{"tlsHandshakeTimeout": {"-1s"}},
+		{"responseHeaderTimeout": {"-1s"}},
+		{"pinResolvedHost": {"always"}},
+		{"failOnEmptyScrape": {"yes"}},
+		{"streamResponse": {"large"}},
+		{"emitScrapeMetadata": {"on"}},
+		{"fallbackPort": {"0"}},
+		{"fallbackPort": {"70000"}},
+		{"staleWindow": {"2"}},
+		{"scrapeInterval": {"often"}},
+		{"scrapeInterval": {"-1m"}},
+		{"minTLSVersion": {"1.4"}},
+		{"minTLSVersion": {"TLS1.2"}},
+		{"metricNameInclude": {"("}},
+		{"metricNameExclude": {"[a-"}},
+		{"whitelistedRegex": {"http_(.*"}},
+		{"staticLabels": {"cluster"}},
+		{"staticLabels": {":prod"}},
+		{"metricPrefixOverrides": {"requests_total"}},
+		{"metricKindOverride": {"requests:COUNTER"}},
+		{"metricKindOverride": {"requests:cumulative"}},
+		{"maxBodyBytes": {"-1"}},
+		{"maxBodyBytes": {"1MB"}},
+		{"proxyURL": {"proxy.internal:3128"}},
+		{"proxyURL": {"http://[::1"}},
+	}
+	for _, values := range incorrect {
+		sourceConfig := SourceConfig{}
+		assert.Error(t, sourceConfig.parseOptions(values), "options %v should be rejected", values)
+	}
+}
@@ -31,6 +31,9 @@ import (
 type Uri struct {
 	Key string
 	Val url.URL
+	// UnsetEnv are the names of the unset environment variables referenced by the flag without a default,
+	// which were expanded to empty strings.
+	UnsetEnv []string
 }
 
 func (u *Uri) String() string {
@@ -48,15 +51,54 @@ func (u *Uri) Set(value string) error {
 	if len(s) != 2 || s[1] == "" {
 		return fmt.Errorf("unproperly formatted url %s", value)
 	}
-	e := os.ExpandEnv(s[1])
-	uri, err := url.Parse(e)
+	// Values of the variables referenced by the query are escaped, so that they end up in the options
+	// exactly as they are set.
+	e, query := s[1], ""
+	if i := strings.Index(e, "?"); i >= 0 {
+		e, query = e[:i], e[i:]
+	}
+	e, unset := expandEnv(e, nil, func(v string) string { return v })
+	query, unset = expandEnv(query, unset, url.QueryEscape)
+	uri, err := url.Parse(e + query)
 	if err != nil {
 		return err
 	}
 	u.Val = *uri
+	u.UnsetEnv = unset
 	return nil
 }
 
+// ExpandEnv replaces $VAR and ${VAR} references to the environment variables in the value.
+// ${VAR:-default} is replaced with the default if VAR is unset or empty. References to unset variables
+// without a default are replaced with empty strings, and the names of such variables are returned.
+func ExpandEnv(value string) (string, []string) {
+	return expandEnv(value, nil, func(v string) string { return v })
+}
+
+// expandEnv works like ExpandEnv, passing values of the variables through escape. Defaults are used as they are.
+// Names of the unset variables are appended to unset, unless they are already present.
+func expandEnv(value string, unset []string, escape func(string) string) (string, []string) {
+	expanded := os.Expand(value, func(name string) string {
+		if i := strings.Index(name, ":-"); i >= 0 {
+			if v := os.Getenv(name[:i]); v != "" {
+				return escape(v)
+			}
+			return name[i+2:]
+		}
+		if v, ok := os.LookupEnv(name); ok {
+			return escape(v)
+		}
+		for _, reported := range unset {
+			if reported == name {
+				return ""
+			}
+		}
+		unset = append(unset, name)
+		return ""
+	})
+	return expanded, unset
+}
+
 // Uris holds values of a repeated flag.
 type Uris []Uri
 
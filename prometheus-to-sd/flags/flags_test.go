@@ -129,6 +129,51 @@ func TestUriSet(t *testing.T) {
 	}
 }
 
+func TestExpandEnv(t *testing.T) {
+	t.Setenv("PTSD_HOST", "kubelet")
+	t.Setenv("PTSD_EMPTY", "")
+	tests := []struct {
+		in        string
+		want      string
+		wantUnset []string
+	}{
+		{"http://${PTSD_HOST}:10255", "http://kubelet:10255", nil},
+		{"http://$PTSD_HOST:10255", "http://kubelet:10255", nil},
+		{"${PTSD_HOST:-localhost}", "kubelet", nil},
+		{"${PTSD_MISSING:-localhost}", "localhost", nil},
+		{"${PTSD_EMPTY:-localhost}", "localhost", nil},
+		{"${PTSD_EMPTY}", "", nil},
+		{"/var/run/${PTSD_MISSING}/token", "/var/run//token", []string{"PTSD_MISSING"}},
+		{"$PTSD_MISSING/${PTSD_MISSING}/$PTSD_OTHER", "//", []string{"PTSD_MISSING", "PTSD_OTHER"}},
+	}
+	for _, c := range tests {
+		expanded, unset := ExpandEnv(c.in)
+		assert.Equal(t, c.want, expanded, "unexpected expansion of %q", c.in)
+		assert.Equal(t, c.wantUnset, unset, "unexpected unset variables of %q", c.in)
+	}
+}
+
+func TestUriSetUnsetEnv(t *testing.T) {
+	var uri Uri
+	if assert.NoError(t, uri.Set("kubelet:http://${PTSD_MISSING}:8080/metrics?whitelisted=${PTSD_LIST}"), "unset host should be expanded before parsing") {
+		assert.Equal(t, ":8080", uri.Val.Host)
+		assert.Equal(t, "", uri.Val.Query().Get("whitelisted"))
+		assert.Equal(t, []string{"PTSD_MISSING", "PTSD_LIST"}, uri.UnsetEnv)
+	}
+}
+
+func TestUriSetEscapesEnvInQuery(t *testing.T) {
+	t.Setenv("PTSD_HOST", "kubelet")
+	t.Setenv("PTSD_KEY", "a+b&c=d#e%f")
+	var uri Uri
+	if assert.NoError(t, uri.Set("kubelet:http://${PTSD_HOST}:8080/metrics?headers=X-Key:${PTSD_KEY}&component=${PTSD_EMPTY:-a%2Bb}")) {
+		assert.Equal(t, "kubelet:8080", uri.Val.Host)
+		assert.Equal(t, "X-Key:a+b&c=d#e%f", uri.Val.Query().Get("headers"))
+		assert.Equal(t, "a+b", uri.Val.Query().Get("component"), "default should be used as it is")
+		assert.Empty(t, uri.Val.Fragment)
+	}
+}
+
 func TestUrisString(t *testing.T) {
 	tests := [...]struct {
 		in   Uris
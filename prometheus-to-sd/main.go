@@ -21,6 +21,7 @@ import (
 	"fmt"
 	"net/http"
 	_ "net/http/pprof"
+	"strings"
 	"time"
 
 	"github.com/golang/glog"
@@ -56,19 +57,85 @@ var (
 		"The monitored resource types to use, either the legacy 'gke_container', or the new 'k8s'")
 	omitComponentName = flag.Bool("omit-component-name", true,
 		"If metric name starts with the component name then this substring is removed to keep metric name shorter.")
+	deriveComponentName = flag.Bool("derive-component-name", false,
+		"If enabled together with --omit-component-name, the longest common prefix of the metric names, up to the last '_', is removed from the metric names of components with an empty name.")
 	debugPort      = flag.Uint("port", 6061, "Port on which debug information is exposed.")
 	dynamicSources = flags.Uris{}
 	scrapeInterval = flag.Duration("scrape-interval", 60*time.Second,
 		"The interval between metric scrapes. If there are multiple scrapes between two exports, the last present value is exported, even when missing from last scraping.")
 	exportInterval = flag.Duration("export-interval", 60*time.Second,
 		"The interval between metric exports. Can't be lower than --scrape-interval.")
-	downcaseMetricNames = flag.Bool("downcase-metric-names", false,
+	metricNameRewrites    = config.MetricNameRewrites{}
+	relabelRules          = config.RelabelRules{}
+	aggregationStrategies = config.AggregationStrategies{}
+	labelCollisionMode    = config.LabelCollisionDropLabel
+	downcaseMetricNames   = flag.Bool("downcase-metric-names", false,
 		"If enabled, will downcase all metric names.")
+	customMetricsPrefixes = flag.String("custom-metrics-prefixes", "custom.googleapis.com",
+		"Comma separated prefixes of the metrics whose descriptors are created and updated by prometheus-to-sd. Descriptors of other metrics are only validated.")
+	stripPrefix = flag.String("strip-prefix", "",
+		"Prefix removed from the metric names, after the component name is omitted.")
+	stripSuffix = flag.String("strip-suffix", "",
+		"Suffix removed from the metric names, after the component name is omitted.")
+	counterResetCacheSize = flag.Int("counter-reset-cache-size", translator.DefaultCounterResetCacheSize,
+		"The maximum number of series per component for which the last value is remembered to detect counter resets.")
+	histogramsAsDistributions = flag.Bool("histograms-as-distributions", false,
+		"If enabled, histogram buckets are normalized to match Stackdriver distributions: sorted, deduplicated and ending with the +Inf bucket.")
+	bucketBoundPrecision = flag.Int("bucket-bound-precision", 0,
+		"The number of significant digits to which histogram bucket bounds are rounded with --histograms-as-distributions, so that near-equal bounds are merged. Zero disables rounding.")
+	summaryQuantileAsLabel = flag.Bool("summary-quantile-as-label", false,
+		"If true, quantiles of the summary metrics are exported as a single metric with the quantile label, otherwise as separate metrics named like <name>_p99.")
+	dropUntyped = flag.Bool("drop-untyped", false,
+		"If enabled, metrics exposed without the type are not exported.")
+	treatUntypedAsGauge = flag.Bool("treat-untyped-as-gauge", false,
+		"If enabled, metrics exposed without the type are exported as gauges. Ignored if --drop-untyped is set.")
+	dryRun = flag.Bool("dry-run", false,
+		"If enabled, metric descriptors and time series are only logged instead of being written to Stackdriver.")
+	sanitizeNames = flag.Bool("sanitize-names", false,
+		"If enabled, characters not accepted by Stackdriver in metric names and label keys, e.g. ':' in names of recording rules, are replaced with '_'. Otherwise names are exported as they are.")
+	maxSeriesPerMetric = flag.Int("max-series-per-metric", 0,
+		"Maximum number of series exported for a single metric, series above the limit are dropped. Zero means no limit.")
+	maxMetricFamilies = flag.Int("max-metric-families", 0,
+		"Maximum number of metric families of a single scrape. Scrapes above the limit fail, unless --truncate-metric-families is set. Zero means no limit.")
+	truncateMetricFamilies = flag.Bool("truncate-metric-families", false,
+		"If enabled, metric families above --max-metric-families are dropped in the order of their names instead of failing the scrape.")
+	maxLabelsPerMetric = flag.Int("max-labels-per-metric", 0,
+		"Maximum number of labels of a single metric, labels above the limit are dropped in the order of --label-priority, followed by the other labels by name. Zero means no limit.")
+	labelPriority = flag.String("label-priority", "",
+		"Comma separated labels kept first when a metric has more labels than --max-labels-per-metric.")
+	dropMetricsAboveLabelLimit = flag.Bool("drop-metrics-above-label-limit", false,
+		"If enabled, metrics with more labels than --max-labels-per-metric are dropped instead of their labels.")
+	logRawResponseBytes = flag.Int("log-raw-response-bytes", 0,
+		"Number of bytes of the scraped response logged at verbosity 4 when it can't be parsed. Zero disables logging of the response.")
+	maxLabelValueLength = flag.Int("max-label-value-length", 0,
+		"Maximal length of label values in bytes, longer values are truncated. Zero means no limit.")
+	pruneStaleDescriptorsAfter = flag.Int("prune-stale-descriptors-after", 0,
+		"Number of scrapes after which descriptors of custom metrics no longer exposed by the component are deleted. Zero disables pruning.")
+	pruneStaleDescriptorsDryRun = flag.Bool("prune-stale-descriptors-dry-run", true,
+		"If enabled, stale metric descriptors are only logged instead of being deleted.")
+	metricDescriptorTTL = flag.Duration("metric-descriptor-ttl", 0,
+		"Age after which a cached metric descriptor is fetched again from Stackdriver before being used. Zero disables expiration.")
+	descriptorUpdateConcurrency = flag.Int("descriptor-update-concurrency", 1,
+		"Maximal number of metric descriptors of the component created or updated in Stackdriver at once.")
+	dnsCacheTTL = flag.Duration("dns-cache-ttl", 0,
+		"Time for which addresses of the scraped hosts are cached. If resolving a host fails, its last good addresses are used for up to another TTL. Zero disables the cache.")
+	maxScrapeJitter = flag.Duration("max-scrape-jitter", 0,
+		"Maximal delay of the first scrape of each component, derived from the component name, so that instances started at the same time don't scrape on aligned intervals. Must not be bigger than --scrape-interval.")
+	scrapeHealthWindow = flag.Duration("scrape-health-window", 5*time.Minute,
+		"The /healthz/scrape handler reports failure if any component wasn't scraped successfully within this window.")
 )
 
 func main() {
 	flag.Set("logtostderr", "true")
 	flag.Var(&source, "source", "source(s) to watch in [component-name]:http://host:port/path?whitelisted=a,b,c&podIdLabel=d&namespaceIdLabel=e&containerNameLabel=f&metricsPrefix=prefix format")
+	flag.Var(&metricNameRewrites, "metric-name-rewrite",
+		`rewrite(s) of metric names in "regexp=replacement" format, e.g. "^prometheus_(.*)$=$1". The first matching rewrite is applied.`)
+	flag.Var(&relabelRules, "relabel",
+		`Prometheus style relabeling rule(s) applied to every series, in JSON format, e.g. {"action": "drop", "source_labels": ["__name__"], "regex": "go_.*"}. Supported actions are replace, keep, drop and labelmap.`)
+	flag.Var(&labelCollisionMode, "label-collision-mode",
+		"How label keys colliding with another label after --sanitize-names replaced their invalid characters are handled: drop-label drops the label, drop-metric drops the whole metric and suffix adds a numeric suffix to the label key.")
+	flag.Var(aggregationStrategies, "aggregation-strategy",
+		`strategy (sum, max, min or last) merging series of the metric that became indistinguishable after dropping or renaming labels, in "metric=strategy" format, by the name before the metric name rewrites. Counters are summed and the last value of gauges wins by default.`)
 	flag.Var(&dynamicSources, "dynamic-source",
 		`dynamic source(s) to watch in format: "[component-name]:http://:port/path?whitelisted=metric1,metric2&podIdLabel=label1&namespaceIdLabel=label2&containerNameLabel=label3&metricsPrefix=prefix". Dynamic sources are components (on the same node) discovered dynamically using the kubernetes api.`,
 	)
@@ -87,6 +154,7 @@ func main() {
 
 	go func() {
 		http.Handle("/metrics", promhttp.Handler())
+		http.Handle("/healthz/scrape", translator.ScrapeHealthHandler(*scrapeHealthWindow))
 		glog.Error(http.ListenAndServe(fmt.Sprintf(":%d", *debugPort), nil))
 	}()
 
@@ -104,10 +172,28 @@ func main() {
 		glog.Fatalf("No sources defined. Please specify at least one --source flag.")
 	}
 
+	if *scrapeInterval <= 0 {
+		glog.Fatalf("--scrape-interval must be positive")
+	}
+
 	if *scrapeInterval > *exportInterval {
 		glog.Fatalf("--scrape-interval cannot be bigger than --export-interval")
 	}
 
+	if *maxScrapeJitter > *scrapeInterval {
+		glog.Fatalf("--max-scrape-jitter cannot be bigger than --scrape-interval")
+	}
+
+	for _, sourceConfig := range sourceConfigs {
+		if translator.ScrapeInterval(sourceConfig, *scrapeInterval) > *exportInterval {
+			glog.Fatalf("Scrape interval of component %v cannot be bigger than --export-interval", sourceConfig.Component)
+		}
+	}
+
+	if *dropUntyped && *treatUntypedAsGauge {
+		glog.Warningf("Both --drop-untyped and --treat-untyped-as-gauge are set, untyped metrics will be dropped")
+	}
+
 	for _, sourceConfig := range sourceConfigs {
 		glog.V(4).Infof("Starting goroutine for %+v", sourceConfig)
 
@@ -125,26 +211,73 @@ func getSourceConfigs(defaultMetricsPrefix string, gceConfig *config.GceConfig)
 	glog.Info("Taking source configs from kubernetes api server")
 	dynamicSourceConfigs, err := config.SourceConfigsFromDynamicSources(gceConfig, []flags.Uri(dynamicSources))
 	if err != nil {
-		glog.Fatalf(err.Error())
+		glog.Fatal(err)
 	}
 	return append(staticSourceConfigs, dynamicSourceConfigs...)
 }
 
+// parseList splits the comma separated list, skipping empty entries.
+func parseList(list string) []string {
+	var entries []string
+	for _, entry := range strings.Split(list, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
 func readAndPushDataToStackdriver(stackdriverService *v3.Service, gceConf *config.GceConfig, sourceConfig *config.SourceConfig) {
 	glog.Infof("Running prometheus-to-sd, monitored target is %s %v:%v", sourceConfig.Component, sourceConfig.Host, sourceConfig.Port)
 	commonConfig := &config.CommonConfig{
-		GceConfig:           gceConf,
-		SourceConfig:        sourceConfig,
-		OmitComponentName:   *omitComponentName,
-		DowncaseMetricNames: *downcaseMetricNames,
+		GceConfig:                   gceConf,
+		SourceConfig:                sourceConfig,
+		OmitComponentName:           *omitComponentName,
+		DeriveComponentName:         *deriveComponentName,
+		DowncaseMetricNames:         *downcaseMetricNames,
+		StripPrefix:                 *stripPrefix,
+		StripSuffix:                 *stripSuffix,
+		CustomMetricsPrefixes:       parseList(*customMetricsPrefixes),
+		CounterResetCacheSize:       *counterResetCacheSize,
+		HistogramsAsDistributions:   *histogramsAsDistributions,
+		SummaryQuantileAsLabel:      *summaryQuantileAsLabel,
+		BucketBoundPrecision:        *bucketBoundPrecision,
+		DropUntyped:                 *dropUntyped,
+		TreatUntypedAsGauge:         *treatUntypedAsGauge,
+		MetricNameRewrites:          metricNameRewrites,
+		RelabelRules:                relabelRules,
+		AggregationStrategies:       aggregationStrategies,
+		DryRun:                      *dryRun,
+		SanitizeNames:               *sanitizeNames,
+		LabelCollisionMode:          labelCollisionMode,
+		MaxSeriesPerMetric:          *maxSeriesPerMetric,
+		MaxMetricFamilies:           *maxMetricFamilies,
+		TruncateMetricFamilies:      *truncateMetricFamilies,
+		MaxLabelsPerMetric:          *maxLabelsPerMetric,
+		LabelPriority:               parseList(*labelPriority),
+		DropMetricsAboveLabelLimit:  *dropMetricsAboveLabelLimit,
+		LogRawResponseBytes:         *logRawResponseBytes,
+		MaxLabelValueLength:         *maxLabelValueLength,
+		PruneStaleDescriptorsAfter:  *pruneStaleDescriptorsAfter,
+		PruneStaleDescriptorsDryRun: *pruneStaleDescriptorsDryRun,
+		DescriptorCacheTTL:          *metricDescriptorTTL,
+		DescriptorUpdateConcurrency: *descriptorUpdateConcurrency,
+		DNSCacheTTL:                 *dnsCacheTTL,
 	}
+	translator.ConfigureDNSCache(commonConfig)
 	metricDescriptorCache := translator.NewMetricDescriptorCache(stackdriverService, commonConfig)
 	signal := time.After(0)
-	useWhitelistedMetricsAutodiscovery := *autoWhitelistMetrics && len(sourceConfig.Whitelisted) == 0
+	useWhitelistedMetricsAutodiscovery := *autoWhitelistMetrics && len(sourceConfig.Whitelisted) == 0 && len(sourceConfig.WhitelistedRegex) == 0
 	timeSeriesBuilder := translator.NewTimeSeriesBuilder(commonConfig, metricDescriptorCache)
+	if jitter := translator.ScrapeJitter(sourceConfig.Component, *maxScrapeJitter); jitter > 0 {
+		glog.V(2).Infof("Delaying scrapes of component %v by %v", sourceConfig.Component, jitter)
+		time.Sleep(jitter)
+	}
 	exportTicker := time.Tick(*exportInterval)
+	schedule := translator.NewScrapeSchedule(sourceConfig, *scrapeInterval, time.Now())
 
-	for range time.Tick(*scrapeInterval) {
+	for {
+		time.Sleep(schedule.Wait(time.Now()))
 		// Possibly exporting as a first thing, since errors down the
 		// road will jump to next iteration of the loop.
 		select {
@@ -152,6 +285,8 @@ func readAndPushDataToStackdriver(stackdriverService *v3.Service, gceConf *confi
 			ts, err := timeSeriesBuilder.Build()
 			if err != nil {
 				glog.Errorf("Could not build time series for component %v: %v", sourceConfig.Component, err)
+			} else if *dryRun {
+				glog.Infof("Dry run: built %d time series for component %v", len(ts), sourceConfig.Component)
 			} else {
 				translator.SendToStackdriver(stackdriverService, commonConfig, ts)
 			}
@@ -166,6 +301,7 @@ func readAndPushDataToStackdriver(stackdriverService *v3.Service, gceConf *confi
 		case <-signal:
 			glog.V(4).Infof("Updating metrics cache for component %v", sourceConfig.Component)
 			metricDescriptorCache.Refresh()
+			metricDescriptorCache.PruneStaleDescriptors(commonConfig.PruneStaleDescriptorsAfter, commonConfig.PruneStaleDescriptorsDryRun || *dryRun)
 			if useWhitelistedMetricsAutodiscovery {
 				sourceConfig.UpdateWhitelistedMetrics(metricDescriptorCache.GetMetricNames())
 				glog.V(2).Infof("Autodiscovered whitelisted metrics for component %v: %v", sourceConfig.Component, sourceConfig.Whitelisted)
@@ -180,6 +316,9 @@ func readAndPushDataToStackdriver(stackdriverService *v3.Service, gceConf *confi
 		metrics, err := translator.GetPrometheusMetrics(sourceConfig)
 		if err != nil {
 			glog.V(2).Infof("Error while getting Prometheus metrics %v for component %v", err, sourceConfig.Component)
+			if sourceConfig.EmitScrapeMetadata {
+				timeSeriesBuilder.Update(translator.FailedScrapeResponse(), time.Now())
+			}
 			continue
 		}
 		timeSeriesBuilder.Update(metrics, time.Now())
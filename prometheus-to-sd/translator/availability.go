@@ -0,0 +1,111 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package translator
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/GoogleCloudPlatform/k8s-stackdriver/prometheus-to-sd/config"
+)
+
+// availabilityCheckBytes is the number of body bytes requested and read by the GET fallback of the availability check.
+const availabilityCheckBytes = 1
+
+// CheckAvailability checks that the metrics endpoint of the source responds, without pulling the metrics, and
+// updates the availability of the component exported like by GetPrometheusMetrics. It sends a HEAD request,
+// falling back to a GET of the first byte of the body if the endpoint doesn't support HEAD. The request uses
+// the same TLS and authentication setup as scrapes. If caCerts isn't empty, they are used instead of the CA
+// certificates of the source.
+func CheckAvailability(config *config.SourceConfig, caCerts []string) error {
+	err := checkAvailability(context.Background(), config, caCerts)
+	if err != nil {
+		componentMetricsAvailable.WithLabelValues(config.Component).Set(0.0)
+	} else {
+		componentMetricsAvailable.WithLabelValues(config.Component).Set(1.0)
+	}
+	return err
+}
+
+func checkAvailability(ctx context.Context, sourceConfig *config.SourceConfig, caCerts []string) error {
+	if len(caCerts) > 0 {
+		withCACerts := *sourceConfig
+		withCACerts.CACertFiles = caCerts
+		sourceConfig = &withCACerts
+	}
+	timeout := sourceConfig.ScrapeTimeout
+	if timeout == 0 {
+		timeout = defaultScrapeTimeout
+	}
+	client, err := httpClients.get(sourceConfig, timeout)
+	if err != nil {
+		return err
+	}
+	ctx, err = withPinnedHost(ctx, sourceConfig)
+	if err != nil {
+		return err
+	}
+	url, err := scrapeURL(sourceConfig, sourceConfig.Path)
+	if err != nil {
+		return err
+	}
+
+	resp, err := availabilityRequest(ctx, client, sourceConfig, url, http.MethodHead)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusMethodNotAllowed || resp.StatusCode == http.StatusNotImplemented {
+		loggerFor(sourceConfig).Debug(4, "HEAD isn't supported, checking availability with GET",
+			"component", sourceConfig.Component, "url", url, "status", resp.StatusCode)
+		resp, err = availabilityRequest(ctx, client, sourceConfig, url, http.MethodGet)
+		if err != nil {
+			return err
+		}
+		// The server may ignore the range, so the rest of the body is not read.
+		io.Copy(ioutil.Discard, io.LimitReader(resp.Body, availabilityCheckBytes))
+		resp.Body.Close()
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		return &httpStatusError{code: resp.StatusCode, status: resp.Status}
+	}
+	return nil
+}
+
+// availabilityRequest sends the availability check request with the given method. GET requests ask only
+// for the first bytes of the body.
+func availabilityRequest(ctx context.Context, client *http.Client, config *config.SourceConfig, url, method string) (*http.Response, error) {
+	req, err := newScrapeRequest(ctx, config, url)
+	if err != nil {
+		return nil, err
+	}
+	req.Method = method
+	if method == http.MethodGet {
+		req.Header.Set("Range", fmt.Sprintf("bytes=0-%d", availabilityCheckBytes-1))
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		if isTimeout(err) {
+			return nil, fmt.Errorf("availability check of %s timed out", url)
+		}
+		return nil, fmt.Errorf("availability check %s %s failed: %v", method, url, err)
+	}
+	return resp, nil
+}
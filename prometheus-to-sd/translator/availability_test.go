@@ -0,0 +1,113 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package translator
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// methodRecorder records methods and Range headers of the received requests.
+type methodRecorder struct {
+	mutex    sync.Mutex
+	requests []string
+}
+
+func (m *methodRecorder) record(r *http.Request) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	request := r.Method
+	if rangeHeader := r.Header.Get("Range"); rangeHeader != "" {
+		request += " " + rangeHeader
+	}
+	m.requests = append(m.requests, request)
+}
+
+func TestCheckAvailabilityHead(t *testing.T) {
+	recorder := &methodRecorder{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recorder.record(r)
+		assert.Equal(t, "Bearer secret", r.Header.Get("Authorization"))
+		fmt.Fprint(w, testMetricsBody)
+	}))
+	defer server.Close()
+
+	sourceConfig := sourceConfigForServer(t, server, "availability-head")
+	sourceConfig.BearerToken = "secret"
+	assert.NoError(t, CheckAvailability(sourceConfig, nil))
+	assert.Equal(t, []string{http.MethodHead}, recorder.requests)
+	assert.Equal(t, 1.0, componentMetricsAvailableValue(t, "availability-head"))
+}
+
+func TestCheckAvailabilityGetFallback(t *testing.T) {
+	recorder := &methodRecorder{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recorder.record(r)
+		if r.Method == http.MethodHead {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.WriteHeader(http.StatusPartialContent)
+		fmt.Fprint(w, testMetricsBody[:1])
+	}))
+	defer server.Close()
+
+	assert.NoError(t, CheckAvailability(sourceConfigForServer(t, server, "availability-get"), nil))
+	assert.Equal(t, []string{http.MethodHead, http.MethodGet + " bytes=0-0"}, recorder.requests)
+	assert.Equal(t, 1.0, componentMetricsAvailableValue(t, "availability-get"))
+}
+
+func TestCheckAvailabilityFailures(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	sourceConfig := sourceConfigForServer(t, server, "availability-failures")
+	componentMetricsAvailable.WithLabelValues("availability-failures").Set(1.0)
+	if err := CheckAvailability(sourceConfig, nil); assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "503")
+	}
+	assert.Equal(t, 0.0, componentMetricsAvailableValue(t, "availability-failures"))
+
+	server.Close()
+	componentMetricsAvailable.WithLabelValues("availability-failures").Set(1.0)
+	assert.Error(t, CheckAvailability(sourceConfig, nil), "unreachable target should be unavailable")
+	assert.Equal(t, 0.0, componentMetricsAvailableValue(t, "availability-failures"))
+}
+
+func TestCheckAvailabilityCACerts(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "availability")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	sourceConfig := sourceConfigForServer(t, server, "availability-ca-certs")
+	sourceConfig.Scheme = "https"
+	assert.Error(t, CheckAvailability(sourceConfig, nil), "certificate of the server shouldn't be trusted")
+	assert.NoError(t, CheckAvailability(sourceConfig, []string{writeServerCertificate(t, server, dir)}))
+	assert.Empty(t, sourceConfig.CACertFiles, "config of the source shouldn't be modified")
+}
@@ -0,0 +1,133 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package translator
+
+import (
+	"container/list"
+	"time"
+
+	"github.com/golang/glog"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// DefaultCounterResetCacheSize is the default number of series for which the last observed value is remembered.
+const DefaultCounterResetCacheSize = 10000
+
+// counterResetCache remembers the last observed values of cumulative series, so that a drop of the value,
+// caused e.g. by a restart of the monitored process, can be detected and a new start time reported.
+// The number of remembered series is bounded, the least recently observed ones are evicted first.
+type counterResetCache struct {
+	maxEntries int
+	entries    map[string]*list.Element
+	// lru keeps the series ordered from the most to the least recently observed.
+	lru *list.List
+}
+
+type counterObservation struct {
+	key       string
+	value     float64
+	timestamp time.Time
+	// resetTime is the start time of the series after the last detected reset.
+	resetTime time.Time
+}
+
+func newCounterResetCache(maxEntries int) *counterResetCache {
+	if maxEntries <= 0 {
+		maxEntries = DefaultCounterResetCacheSize
+	}
+	return &counterResetCache{
+		maxEntries: maxEntries,
+		entries:    make(map[string]*list.Element),
+		lru:        list.New(),
+	}
+}
+
+// startTime records the value of the cumulative metric observed at the given time and returns the start
+// time of the series: the start time of the process, unless a reset of the value was detected after it.
+func (c *counterResetCache) startTime(name string, mType dto.MetricType, metric *dto.Metric, processStartTime, timestamp time.Time) time.Time {
+	value, cumulative := cumulativeValue(mType, metric)
+	if !cumulative {
+		return processStartTime
+	}
+	key := name + "{" + labelsSignature(metric.Label) + "}"
+	element, found := c.entries[key]
+	if !found {
+		element = c.lru.PushFront(&counterObservation{key: key, value: value, timestamp: timestamp})
+		c.entries[key] = element
+		c.evict()
+		return processStartTime
+	}
+	c.lru.MoveToFront(element)
+	observation := element.Value.(*counterObservation)
+	if value < observation.value && timestamp.After(observation.timestamp) {
+		// The counter was reset at some point after the previous observation.
+		glog.V(2).Infof("Detected reset of %s from %v to %v", key, observation.value, value)
+		observation.resetTime = observation.timestamp
+	}
+	observation.value = value
+	observation.timestamp = timestamp
+	if observation.resetTime.After(processStartTime) {
+		return observation.resetTime
+	}
+	return processStartTime
+}
+
+// delta records the value of the counter observed at the given time and returns its increase since the previous
+// observation, together with the time of that observation. False is returned for the first observation of the
+// series and for samples not newer than the previous one. After a reset, the whole value is the increase.
+func (c *counterResetCache) delta(name string, metric *dto.Metric, timestamp time.Time) (float64, time.Time, bool) {
+	value := metric.GetCounter().GetValue()
+	key := name + "{" + labelsSignature(metric.Label) + "}"
+	element, found := c.entries[key]
+	if !found {
+		c.entries[key] = c.lru.PushFront(&counterObservation{key: key, value: value, timestamp: timestamp})
+		c.evict()
+		return 0, time.Time{}, false
+	}
+	c.lru.MoveToFront(element)
+	observation := element.Value.(*counterObservation)
+	if !timestamp.After(observation.timestamp) {
+		return 0, time.Time{}, false
+	}
+	previous, start := observation.value, observation.timestamp
+	observation.value = value
+	observation.timestamp = timestamp
+	if value < previous {
+		glog.V(2).Infof("Detected reset of %s from %v to %v", key, previous, value)
+		return value, start, true
+	}
+	return value - previous, start, true
+}
+
+func (c *counterResetCache) evict() {
+	for c.lru.Len() > c.maxEntries {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*counterObservation).key)
+	}
+}
+
+// cumulativeValue returns the value used to detect resets of the metric, and false if the metric isn't cumulative.
+func cumulativeValue(mType dto.MetricType, metric *dto.Metric) (float64, bool) {
+	switch mType {
+	case dto.MetricType_COUNTER:
+		return metric.GetCounter().GetValue(), true
+	case dto.MetricType_HISTOGRAM:
+		return float64(metric.GetHistogram().GetSampleCount()), true
+	}
+	return 0, false
+}
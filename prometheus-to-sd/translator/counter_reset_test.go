@@ -0,0 +1,150 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package translator
+
+import (
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	v3 "google.golang.org/api/monitoring/v3"
+
+	"github.com/GoogleCloudPlatform/k8s-stackdriver/prometheus-to-sd/config"
+)
+
+func counterWithValue(value float64) *dto.Metric {
+	return &dto.Metric{Counter: &dto.Counter{Value: floatPtr(value)}}
+}
+
+func TestCounterResetDetection(t *testing.T) {
+	cache := newCounterResetCache(10)
+	processStart := time.Unix(1000, 0)
+	first, second, third := time.Unix(2000, 0), time.Unix(2060, 0), time.Unix(2120, 0)
+
+	assert.Equal(t, processStart, cache.startTime("requests", dto.MetricType_COUNTER, counterWithValue(10), processStart, first))
+	assert.Equal(t, processStart, cache.startTime("requests", dto.MetricType_COUNTER, counterWithValue(20), processStart, second))
+	// The counter decreased, so it must have been reset after the previous observation.
+	assert.Equal(t, second, cache.startTime("requests", dto.MetricType_COUNTER, counterWithValue(3), processStart, third))
+	assert.Equal(t, second, cache.startTime("requests", dto.MetricType_COUNTER, counterWithValue(5), processStart, time.Unix(2180, 0)))
+	// Gauges are never considered reset.
+	cache.startTime("temperature", dto.MetricType_GAUGE, &dto.Metric{Gauge: &dto.Gauge{Value: floatPtr(30)}}, processStart, first)
+	assert.Equal(t, processStart, cache.startTime("temperature", dto.MetricType_GAUGE, &dto.Metric{Gauge: &dto.Gauge{Value: floatPtr(10)}}, processStart, second))
+}
+
+func TestCounterResetAfterProcessRestart(t *testing.T) {
+	cache := newCounterResetCache(10)
+	cache.startTime("requests", dto.MetricType_COUNTER, counterWithValue(10), time.Unix(1000, 0), time.Unix(2000, 0))
+	cache.startTime("requests", dto.MetricType_COUNTER, counterWithValue(1), time.Unix(1000, 0), time.Unix(2060, 0))
+	// The process start time reported after the restart is more accurate than the detected reset.
+	newProcessStart := time.Unix(2050, 0)
+	assert.Equal(t, newProcessStart, cache.startTime("requests", dto.MetricType_COUNTER, counterWithValue(2), newProcessStart, time.Unix(2120, 0)))
+}
+
+func TestCounterResetCacheEviction(t *testing.T) {
+	cache := newCounterResetCache(2)
+	processStart := time.Unix(1000, 0)
+	cache.startTime("a", dto.MetricType_COUNTER, counterWithValue(10), processStart, time.Unix(2000, 0))
+	cache.startTime("b", dto.MetricType_COUNTER, counterWithValue(10), processStart, time.Unix(2000, 0))
+	cache.startTime("a", dto.MetricType_COUNTER, counterWithValue(11), processStart, time.Unix(2060, 0))
+	cache.startTime("c", dto.MetricType_COUNTER, counterWithValue(10), processStart, time.Unix(2060, 0))
+
+	assert.Equal(t, 2, cache.lru.Len())
+	assert.Contains(t, cache.entries, "a{}")
+	assert.Contains(t, cache.entries, "c{}")
+	assert.NotContains(t, cache.entries, "b{}", "least recently observed series should be evicted")
+}
+
+func TestBuildDetectsCounterReset(t *testing.T) {
+	tsb := NewTimeSeriesBuilder(CommonConfigWithMetrics([]string{testMetricName}), buildCacheForTesting())
+	scrape := func(value string, timestamp time.Time) string {
+		tsb.Update(&PrometheusResponse{rawResponse: "# TYPE test_name counter\ntest_name " + value + "\n" +
+			"# TYPE process_start_time_seconds gauge\nprocess_start_time_seconds 1234567890.0\n"}, timestamp)
+		ts, err := tsb.Build()
+		if !assert.NoError(t, err) || !assert.Equal(t, 1, len(ts)) {
+			return ""
+		}
+		return ts[0].Points[0].Interval.StartTime
+	}
+	assert.Equal(t, "2009-02-13T23:31:30Z", scrape("42", time.Unix(1500000000, 0)))
+	assert.Equal(t, "2009-02-13T23:31:30Z", scrape("50", time.Unix(1500000060, 0)))
+	assert.Equal(t, "2017-07-14T02:41:00Z", scrape("7", time.Unix(1500000120, 0)))
+}
+
+func TestCounterDelta(t *testing.T) {
+	cache := newCounterResetCache(10)
+	first, second, third := time.Unix(2000, 0), time.Unix(2060, 0), time.Unix(2120, 0)
+
+	_, _, ok := cache.delta("requests", counterWithValue(10), first)
+	assert.False(t, ok, "no delta should be emitted for the first observation")
+	increase, start, ok := cache.delta("requests", counterWithValue(25), second)
+	assert.True(t, ok)
+	assert.Equal(t, 15.0, increase)
+	assert.Equal(t, first, start)
+	_, _, ok = cache.delta("requests", counterWithValue(30), second)
+	assert.False(t, ok, "sample not newer than the previous one should be skipped")
+	// The counter was reset, so it increased by its whole value since the previous observation.
+	increase, start, ok = cache.delta("requests", counterWithValue(4), third)
+	assert.True(t, ok)
+	assert.Equal(t, 4.0, increase)
+	assert.Equal(t, second, start)
+}
+
+func TestBuildEmitsDeltaCounters(t *testing.T) {
+	sourceConfig := *commonConfig.SourceConfig
+	sourceConfig.Whitelisted = []string{testMetricName}
+	sourceConfig.DeltaCounters = []string{testMetricName}
+	testBuildEmitsDeltas(t, &sourceConfig)
+}
+
+func TestBuildEmitsDeltasOfCountersOverriddenToDelta(t *testing.T) {
+	sourceConfig := *commonConfig.SourceConfig
+	sourceConfig.Whitelisted = []string{testMetricName}
+	sourceConfig.MetricKindOverride = map[string]string{testMetricName: "DELTA"}
+	testBuildEmitsDeltas(t, &sourceConfig)
+}
+
+func testBuildEmitsDeltas(t *testing.T, sourceConfig *config.SourceConfig) {
+	cfg := *commonConfig
+	cfg.SourceConfig = sourceConfig
+	tsb := NewTimeSeriesBuilder(&cfg, buildCacheForTesting())
+	scrape := func(value string, timestamp time.Time) []*v3.TimeSeries {
+		tsb.Update(&PrometheusResponse{rawResponse: "# TYPE test_name counter\ntest_name " + value + "\n"}, timestamp)
+		ts, err := tsb.Build()
+		assert.NoError(t, err)
+		return ts
+	}
+	assert.Empty(t, scrape("42", time.Unix(1500000000, 0)), "first scrape has no previous value")
+	for _, step := range []struct {
+		value     string
+		timestamp time.Time
+		want      int64
+		start     string
+	}{
+		{"50", time.Unix(1500000060, 0), 8, "2017-07-14T02:40:00Z"},
+		{"80", time.Unix(1500000120, 0), 30, "2017-07-14T02:41:00Z"},
+		{"5", time.Unix(1500000180, 0), 5, "2017-07-14T02:42:00Z"},
+	} {
+		ts := scrape(step.value, step.timestamp)
+		if assert.Equal(t, 1, len(ts)) {
+			assert.Equal(t, "DELTA", ts[0].MetricKind)
+			assert.Equal(t, step.want, *ts[0].Points[0].Value.Int64Value)
+			assert.Equal(t, step.start, ts[0].Points[0].Interval.StartTime)
+			assert.Equal(t, step.timestamp.UTC().Format(time.RFC3339), ts[0].Points[0].Interval.EndTime)
+		}
+	}
+}
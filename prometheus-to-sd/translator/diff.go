@@ -0,0 +1,151 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package translator
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// DiffFamilies describes in a human-readable form how the metric families changed, e.g. by the transformations
+// of the source, one change per line: removed, renamed and added families, followed by the families whose type,
+// label keys or number of series changed. A removed family is reported as renamed if an added family has the
+// same type and label sets of the series. Returns an empty string if nothing changed.
+func DiffFamilies(before, after map[string]*dto.MetricFamily) string {
+	var removed, added []string
+	for name := range before {
+		if _, found := after[name]; !found {
+			removed = append(removed, name)
+		}
+	}
+	for name := range after {
+		if _, found := before[name]; !found {
+			added = append(added, name)
+		}
+	}
+	sort.Strings(removed)
+	sort.Strings(added)
+
+	var lines []string
+	renamed := make(map[string]bool)
+	for _, name := range removed {
+		target := ""
+		for _, candidate := range added {
+			if !renamed[candidate] && sameSeries(before[name], after[candidate]) {
+				target = candidate
+				break
+			}
+		}
+		if target == "" {
+			lines = append(lines, fmt.Sprintf("removed %s (%s)", name, describeFamily(before[name])))
+			continue
+		}
+		renamed[target] = true
+		lines = append(lines, fmt.Sprintf("renamed %s to %s", name, target))
+	}
+	for _, name := range added {
+		if !renamed[name] {
+			lines = append(lines, fmt.Sprintf("added %s (%s)", name, describeFamily(after[name])))
+		}
+	}
+
+	names := make([]string, 0, len(after))
+	for name := range after {
+		if _, found := before[name]; found {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if changes := familyChanges(before[name], after[name]); len(changes) > 0 {
+			lines = append(lines, fmt.Sprintf("changed %s: %s", name, strings.Join(changes, ", ")))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// describeFamily returns the type and the number of series of the family.
+func describeFamily(family *dto.MetricFamily) string {
+	return fmt.Sprintf("%s, %d series", strings.ToLower(family.GetType().String()), len(family.Metric))
+}
+
+// sameSeries returns true if the families have the same type and label sets of the series.
+func sameSeries(a, b *dto.MetricFamily) bool {
+	if a.GetType() != b.GetType() || len(a.Metric) != len(b.Metric) {
+		return false
+	}
+	signatures := func(family *dto.MetricFamily) []string {
+		result := make([]string, 0, len(family.Metric))
+		for _, metric := range family.Metric {
+			result = append(result, labelsSignature(metric.Label))
+		}
+		sort.Strings(result)
+		return result
+	}
+	aSignatures, bSignatures := signatures(a), signatures(b)
+	for i := range aSignatures {
+		if aSignatures[i] != bSignatures[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// familyChanges describes the changes of the type, label keys and number of series of the family.
+func familyChanges(before, after *dto.MetricFamily) []string {
+	var changes []string
+	if before.GetType() != after.GetType() {
+		changes = append(changes, fmt.Sprintf("type %s -> %s", strings.ToLower(before.GetType().String()), strings.ToLower(after.GetType().String())))
+	}
+	beforeKeys, afterKeys := labelKeys(before), labelKeys(after)
+	if removed := missingKeys(beforeKeys, afterKeys); len(removed) > 0 {
+		changes = append(changes, fmt.Sprintf("removed labels %v", removed))
+	}
+	if added := missingKeys(afterKeys, beforeKeys); len(added) > 0 {
+		changes = append(changes, fmt.Sprintf("added labels %v", added))
+	}
+	if len(before.Metric) != len(after.Metric) {
+		changes = append(changes, fmt.Sprintf("series %d -> %d", len(before.Metric), len(after.Metric)))
+	}
+	return changes
+}
+
+// labelKeys returns the label keys used by any series of the family.
+func labelKeys(family *dto.MetricFamily) map[string]bool {
+	keys := make(map[string]bool)
+	for _, metric := range family.Metric {
+		for _, label := range metric.Label {
+			keys[label.GetName()] = true
+		}
+	}
+	return keys
+}
+
+// missingKeys returns the sorted keys of a that aren't in b.
+func missingKeys(a, b map[string]bool) []string {
+	var missing []string
+	for key := range a {
+		if !b[key] {
+			missing = append(missing, key)
+		}
+	}
+	sort.Strings(missing)
+	return missing
+}
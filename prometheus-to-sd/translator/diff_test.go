@@ -0,0 +1,83 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package translator
+
+import (
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/GoogleCloudPlatform/k8s-stackdriver/prometheus-to-sd/config"
+)
+
+var diffResponse = &PrometheusResponse{rawResponse: `
+# TYPE process_requests counter
+process_requests{code="200",pod="web-1"} 10
+process_requests{code="200",pod="web-2"} 5
+process_requests{code="500",pod="web-1"} 2
+# TYPE process_goroutines gauge
+process_goroutines 12
+# TYPE process_up gauge
+process_up 1
+`}
+
+// parseDiffResponse returns two copies of the parsed diff response, to compare the original with the transformed one.
+func parseDiffResponse(t *testing.T) (before, after map[string]*dto.MetricFamily) {
+	metrics, err := diffResponse.parse()
+	if err != nil {
+		t.Fatalf("Failed to parse the response: %v", err)
+	}
+	before, _ = cloneFamilies(metrics, nil)
+	return before, metrics
+}
+
+func TestDiffFamiliesRename(t *testing.T) {
+	before, after := parseDiffResponse(t)
+	after, err := RewriteMetricNames(after, []config.MetricNameRewrite{{Match: "^process_(goroutines|up)$", Replace: "runtime_$1"}})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "renamed process_goroutines to runtime_goroutines\nrenamed process_up to runtime_up", DiffFamilies(before, after))
+}
+
+func TestDiffFamiliesDrop(t *testing.T) {
+	before, after := parseDiffResponse(t)
+	delete(after, "process_up")
+	after = DropLabels(after, []string{"code"}, nil)
+	assert.Equal(t, "removed process_up (gauge, 1 series)\nchanged process_requests: removed labels [code], series 3 -> 2", DiffFamilies(before, after))
+}
+
+func TestDiffFamiliesMerge(t *testing.T) {
+	before, after := parseDiffResponse(t)
+	after = RenameLabels(after, map[string]string{"pod": "instance"}, nil)
+	after = DropLabels(after, []string{"instance"}, nil)
+	after["process_restarts"] = &dto.MetricFamily{Name: stringPtr("process_restarts"), Type: &metricTypeCounter, Metric: []*dto.Metric{{}}}
+	assert.Equal(t, "added process_restarts (counter, 1 series)\nchanged process_requests: removed labels [pod], series 3 -> 2", DiffFamilies(before, after))
+}
+
+func TestDiffFamiliesType(t *testing.T) {
+	before, after := parseDiffResponse(t)
+	after["process_up"].Type = &metricTypeCounter
+	assert.Equal(t, "changed process_up: type gauge -> counter", DiffFamilies(before, after))
+}
+
+func TestDiffFamiliesUnchanged(t *testing.T) {
+	before, after := parseDiffResponse(t)
+	assert.Equal(t, "", DiffFamilies(before, after))
+	assert.Equal(t, "", DiffFamilies(nil, nil))
+}
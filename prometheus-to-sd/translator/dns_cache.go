@@ -0,0 +1,125 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package translator
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/GoogleCloudPlatform/k8s-stackdriver/prometheus-to-sd/config"
+)
+
+// dnsCacheEntry holds the last good addresses of the host.
+type dnsCacheEntry struct {
+	addresses []string
+	resolved  time.Time
+}
+
+// dnsCache caches the addresses of the hosts dialed by the scrapes for the TTL. If the lookup of a host whose
+// entry expired fails, the last good addresses are served for up to another TTL, so that short outages of the
+// DNS don't fail the scrapes. Zero TTL disables the cache.
+type dnsCache struct {
+	mutex   sync.Mutex
+	ttl     time.Duration
+	entries map[string]dnsCacheEntry
+	now     func() time.Time
+}
+
+func newDNSCache(ttl time.Duration) *dnsCache {
+	return &dnsCache{ttl: ttl, entries: make(map[string]dnsCacheEntry), now: time.Now}
+}
+
+// hostsCache is the DNS cache shared by all the sources, configured with ConfigureDNSCache.
+var hostsCache = newDNSCache(0)
+
+// ConfigureDNSCache sets the TTL of the DNS cache used when scraping to config.DNSCacheTTL.
+// Zero TTL disables the cache.
+func ConfigureDNSCache(config *config.CommonConfig) {
+	hostsCache.mutex.Lock()
+	defer hostsCache.mutex.Unlock()
+	if config.DNSCacheTTL != hostsCache.ttl {
+		hostsCache.ttl = config.DNSCacheTTL
+		hostsCache.entries = make(map[string]dnsCacheEntry)
+	}
+}
+
+func (c *dnsCache) enabled() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.ttl > 0
+}
+
+// lookupHost returns the cached addresses of the host, resolving it with the resolver if the entry is missing
+// or expired.
+func (c *dnsCache) lookupHost(ctx context.Context, resolver resolver, host string) ([]string, error) {
+	c.mutex.Lock()
+	entry, found := c.entries[host]
+	ttl := c.ttl
+	c.mutex.Unlock()
+	now := c.now()
+	if found && now.Sub(entry.resolved) < ttl {
+		return entry.addresses, nil
+	}
+
+	addresses, err := resolver.LookupHost(ctx, host)
+	if err == nil && len(addresses) == 0 {
+		err = &net.DNSError{Err: "no addresses", Name: host}
+	}
+	if err != nil {
+		if found && now.Sub(entry.resolved) < 2*ttl {
+			glog.Warningf("Failed to resolve host %s, using the addresses resolved at %v: %v", host, entry.resolved, err)
+			return entry.addresses, nil
+		}
+		return nil, err
+	}
+	c.mutex.Lock()
+	c.entries[host] = dnsCacheEntry{addresses: addresses, resolved: now}
+	c.mutex.Unlock()
+	return addresses, nil
+}
+
+// lookupHost resolves the host with the hostResolver, through the DNS cache if it's enabled.
+func lookupHost(ctx context.Context, host string) ([]string, error) {
+	if hostsCache.enabled() {
+		return hostsCache.lookupHost(ctx, hostResolver, host)
+	}
+	return hostResolver.LookupHost(ctx, host)
+}
+
+// dialCached dials the addresses of the host from the DNS cache in order, until a connection succeeds.
+// The address is dialed as is if the cache is disabled or the host is an IP address.
+func dialCached(ctx context.Context, dialer *net.Dialer, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || net.ParseIP(host) != nil || !hostsCache.enabled() {
+		return dialer.DialContext(ctx, network, addr)
+	}
+	addresses, err := hostsCache.lookupHost(ctx, hostResolver, host)
+	if err != nil {
+		return nil, err
+	}
+	for _, address := range addresses {
+		var conn net.Conn
+		if conn, err = dialer.DialContext(ctx, network, net.JoinHostPort(address, port)); err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
@@ -0,0 +1,120 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package translator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/GoogleCloudPlatform/k8s-stackdriver/prometheus-to-sd/config"
+)
+
+// dnsCacheForTesting returns the cache with the TTL of a minute and the clock advanced by the returned function.
+func dnsCacheForTesting() (*dnsCache, func(time.Duration)) {
+	cache := newDNSCache(time.Minute)
+	now := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	cache.now = func() time.Time { return now }
+	return cache, func(d time.Duration) { now = now.Add(d) }
+}
+
+func TestDNSCacheHit(t *testing.T) {
+	cache, advance := dnsCacheForTesting()
+	stub := &stubResolver{addresses: []string{"10.0.0.1"}}
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		addresses, err := cache.lookupHost(ctx, stub, "metrics.test")
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"10.0.0.1"}, addresses)
+		advance(10 * time.Second)
+	}
+	assert.Equal(t, 1, stub.lookups, "host should be resolved once within the TTL")
+
+	_, err := cache.lookupHost(ctx, stub, "other.test")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, stub.lookups, "hosts should be cached separately")
+}
+
+func TestDNSCacheExpiry(t *testing.T) {
+	cache, advance := dnsCacheForTesting()
+	stub := &stubResolver{addresses: []string{"10.0.0.1"}}
+	ctx := context.Background()
+
+	_, err := cache.lookupHost(ctx, stub, "metrics.test")
+	assert.NoError(t, err)
+	advance(time.Minute)
+	stub.addresses = []string{"10.0.0.2"}
+	addresses, err := cache.lookupHost(ctx, stub, "metrics.test")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.2"}, addresses, "expired entry should be resolved again")
+	assert.Equal(t, 2, stub.lookups)
+}
+
+func TestDNSCacheServesLastGoodResultOnFailure(t *testing.T) {
+	cache, advance := dnsCacheForTesting()
+	stub := &stubResolver{addresses: []string{"10.0.0.1"}}
+	ctx := context.Background()
+
+	_, err := cache.lookupHost(ctx, stub, "metrics.test")
+	assert.NoError(t, err)
+	advance(90 * time.Second)
+	stub.addresses, stub.err = nil, errors.New("no such host")
+	addresses, err := cache.lookupHost(ctx, stub, "metrics.test")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.1"}, addresses, "last good result should be served within another TTL")
+
+	stub.err = nil
+	_, err = cache.lookupHost(ctx, stub, "metrics.test")
+	assert.NoError(t, err, "empty result should be treated like a failure")
+
+	advance(30 * time.Second)
+	_, err = cache.lookupHost(ctx, stub, "metrics.test")
+	assert.Error(t, err, "last good result shouldn't be served after another TTL")
+	_, err = cache.lookupHost(ctx, stub, "unknown.test")
+	assert.Error(t, err)
+	assert.Equal(t, 5, stub.lookups)
+}
+
+func TestGetPrometheusMetricsDNSCache(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, testMetricsBody)
+	}))
+	defer server.Close()
+	stub := &stubResolver{addresses: []string{"127.0.0.2", "127.0.0.1"}}
+	withStubResolver(t, stub)
+	ConfigureDNSCache(&config.CommonConfig{DNSCacheTTL: time.Minute})
+	t.Cleanup(func() { ConfigureDNSCache(&config.CommonConfig{}) })
+
+	sourceConfig := sourceConfigForServer(t, server, "dns-cache")
+	sourceConfig.Host = "metrics.cached.test"
+	// Closing idle connections makes every scrape dial the host again.
+	server.Config.SetKeepAlivesEnabled(false)
+	for i := 0; i < 2; i++ {
+		response, err := GetPrometheusMetrics(sourceConfig)
+		if assert.NoError(t, err) {
+			assert.Equal(t, testMetricsBody, response.Raw())
+		}
+	}
+	assert.Equal(t, 1, stub.lookups, "host should be resolved through the cache")
+}
@@ -0,0 +1,330 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package translator
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/GoogleCloudPlatform/k8s-stackdriver/prometheus-to-sd/config"
+)
+
+// httpClients keeps clients shared by all scrapes, so connections to the scraped endpoints are reused.
+var httpClients = newHTTPClientCache()
+
+const (
+	// defaultDialTimeout and defaultTLSHandshakeTimeout are used when the source config doesn't specify its
+	// own timeouts, matching the ones of http.DefaultTransport. Waiting for the response headers is limited
+	// only by the scrape timeout by default.
+	defaultDialTimeout         = 30 * time.Second
+	defaultTLSHandshakeTimeout = 10 * time.Second
+)
+
+// systemCertPool loads the CA certificates of the system, tests replace it to simulate platforms without them.
+var systemCertPool = x509.SystemCertPool
+
+// dialControl, if set, is called by the dialers of the scrape clients before connecting. Tests use it to delay
+// connections.
+var dialControl func(network, address string, c syscall.RawConn) error
+
+// httpClientKey identifies settings that require a separate client.
+type httpClientKey struct {
+	timeout               time.Duration
+	dialTimeout           time.Duration
+	tlsHandshakeTimeout   time.Duration
+	responseHeaderTimeout time.Duration
+	caCertFiles           string
+	clientCertFile        string
+	clientKeyFile         string
+	insecureSkipVerify    bool
+	tlsServerName         string
+	minTLSVersion         string
+	proxyURL              string
+	unixSocket            string
+}
+
+func newHTTPClientKey(config *config.SourceConfig, timeout time.Duration) httpClientKey {
+	unixSocket, _ := config.UnixSocket()
+	return httpClientKey{
+		timeout:               timeout,
+		dialTimeout:           config.DialTimeout,
+		tlsHandshakeTimeout:   config.TLSHandshakeTimeout,
+		responseHeaderTimeout: config.ResponseHeaderTimeout,
+		caCertFiles:           strings.Join(config.CACertFiles, ","),
+		clientCertFile:        config.ClientCertFile,
+		clientKeyFile:         config.ClientKeyFile,
+		insecureSkipVerify:    config.InsecureSkipVerify,
+		tlsServerName:         config.TLSServerName,
+		minTLSVersion:         config.MinTLSVersion,
+		proxyURL:              config.ProxyURL,
+		unixSocket:            unixSocket,
+	}
+}
+
+type cachedHTTPClient struct {
+	client *http.Client
+	// modTimes contains modification times of the certificate files loaded by the client.
+	modTimes map[string]time.Time
+}
+
+// httpClientCache creates http clients and keeps them for reuse by scrapes with the same settings.
+type httpClientCache struct {
+	mutex   sync.Mutex
+	clients map[httpClientKey]*cachedHTTPClient
+}
+
+func newHTTPClientCache() *httpClientCache {
+	return &httpClientCache{clients: make(map[httpClientKey]*cachedHTTPClient)}
+}
+
+// get returns the client for the given source config. Client is recreated if any of the certificate
+// files it uses has changed on disk since it was created.
+func (c *httpClientCache) get(config *config.SourceConfig, timeout time.Duration) (*http.Client, error) {
+	key := newHTTPClientKey(config, timeout)
+	modTimes := certFilesModTimes(config)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	cached, found := c.clients[key]
+	if found && modTimesEqual(cached.modTimes, modTimes) {
+		return cached.client, nil
+	}
+	client, err := newHTTPClient(config, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if found {
+		glog.V(4).Infof("Certificates of component %v changed, recreating http client", config.Component)
+		if transport, ok := cached.client.Transport.(*http.Transport); ok {
+			transport.CloseIdleConnections()
+		}
+	}
+	c.clients[key] = &cachedHTTPClient{client: client, modTimes: modTimes}
+	return client, nil
+}
+
+// certFilesModTimes returns modification times of all certificate files used by the source config.
+// Files that can't be accessed are skipped, errors are reported while loading them.
+func certFilesModTimes(config *config.SourceConfig) map[string]time.Time {
+	files := append([]string{config.ClientCertFile, config.ClientKeyFile}, config.CACertFiles...)
+	modTimes := make(map[string]time.Time)
+	for _, file := range files {
+		if file == "" || isInlinePEM(file) {
+			continue
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			continue
+		}
+		if !info.IsDir() {
+			modTimes[file] = info.ModTime()
+			continue
+		}
+		// Files can be added to or removed from the directory without changing the existing ones.
+		modTimes[file] = info.ModTime()
+		for _, dirFile := range caCertDirFiles(file) {
+			if info, err := os.Stat(dirFile); err == nil {
+				modTimes[dirFile] = info.ModTime()
+			}
+		}
+	}
+	return modTimes
+}
+
+// isInlinePEM returns true if the CA certificate is passed as the PEM encoded string instead of the path.
+func isInlinePEM(caCert string) bool {
+	return strings.HasPrefix(strings.TrimSpace(caCert), "-----BEGIN")
+}
+
+// caCertDirFiles returns the PEM files (*.pem and *.crt) placed directly in the directory.
+func caCertDirFiles(dir string) []string {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		glog.Warningf("Failed to list CA certificates directory %s: %v", dir, err)
+		return nil
+	}
+	var files []string
+	for _, entry := range entries {
+		ext := filepath.Ext(entry.Name())
+		if !entry.IsDir() && (ext == ".pem" || ext == ".crt") {
+			files = append(files, filepath.Join(dir, entry.Name()))
+		}
+	}
+	return files
+}
+
+// appendCACertDir adds certificates from the directory to the pool. Unlike the explicitly listed
+// files, files that can't be read or parsed are skipped.
+func appendCACertDir(crtPool *x509.CertPool, dir string) {
+	for _, file := range caCertDirFiles(dir) {
+		pem, err := ioutil.ReadFile(file)
+		if err != nil {
+			glog.Warningf("Skipping CA certificate %s: %v", file, err)
+			continue
+		}
+		if !crtPool.AppendCertsFromPEM(pem) {
+			glog.Warningf("Skipping CA certificate %s: no certificates found", file)
+		}
+	}
+}
+
+func modTimesEqual(a, b map[string]time.Time) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for file, modTime := range a {
+		if other, found := b[file]; !found || !other.Equal(modTime) {
+			return false
+		}
+	}
+	return true
+}
+
+// newHTTPClient creates a client that uses timeout, TLS and proxy settings from the source config.
+func newHTTPClient(config *config.SourceConfig, timeout time.Duration) (*http.Client, error) {
+	tlsConfig, err := newTLSConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	proxy, err := newProxyFunc(config)
+	if err != nil {
+		return nil, err
+	}
+	dialTimeout := config.DialTimeout
+	if dialTimeout == 0 {
+		dialTimeout = defaultDialTimeout
+	}
+	tlsHandshakeTimeout := config.TLSHandshakeTimeout
+	if tlsHandshakeTimeout == 0 {
+		tlsHandshakeTimeout = defaultTLSHandshakeTimeout
+	}
+	dialer := &net.Dialer{Timeout: dialTimeout, Control: dialControl}
+	transport := &http.Transport{
+		Proxy:                 proxy,
+		TLSClientConfig:       tlsConfig,
+		DialContext:           pinningDialContext(dialer),
+		TLSHandshakeTimeout:   tlsHandshakeTimeout,
+		ResponseHeaderTimeout: config.ResponseHeaderTimeout,
+	}
+	if socket, ok := config.UnixSocket(); ok {
+		transport.Proxy = nil
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", socket)
+		}
+	}
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: transport,
+	}, nil
+}
+
+// newProxyFunc returns the proxy configured for the source, or the one set by the environment
+// variables (HTTP_PROXY, HTTPS_PROXY and NO_PROXY) if the source doesn't specify it.
+func newProxyFunc(config *config.SourceConfig) (func(*http.Request) (*url.URL, error), error) {
+	if config.ProxyURL == "" {
+		return http.ProxyFromEnvironment, nil
+	}
+	proxyURL, err := url.Parse(config.ProxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy url %q: %v", config.ProxyURL, err)
+	}
+	return http.ProxyURL(proxyURL), nil
+}
+
+// newTLSConfig creates TLS configuration trusting the system and the configured CA certificates,
+// and presenting the client certificate if one is configured. The server name, if configured,
+// replaces the host for SNI and verification. CA certificates are ignored when
+// verification of the endpoint is disabled.
+func newTLSConfig(config *config.SourceConfig) (*tls.Config, error) {
+	minVersion, err := config.TLSMinVersion()
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: config.InsecureSkipVerify,
+		ServerName:         config.TLSServerName,
+		MinVersion:         minVersion,
+	}
+	if !config.InsecureSkipVerify {
+		if tlsConfig.RootCAs, err = newRootCAs(config); err != nil {
+			return nil, err
+		}
+	}
+	if config.ClientCertFile != "" || config.ClientKeyFile != "" {
+		if config.ClientCertFile == "" || config.ClientKeyFile == "" {
+			return nil, fmt.Errorf("both client certificate and key have to be provided, got certificate %q and key %q", config.ClientCertFile, config.ClientKeyFile)
+		}
+		cert, err := tls.LoadX509KeyPair(config.ClientCertFile, config.ClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate %s and key %s: %v", config.ClientCertFile, config.ClientKeyFile, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// newRootCAs returns the pool of the system and the configured CA certificates, or nil if no CA certificates
+// are configured, in which case the system ones are used. If the system certificates can't be loaded, only
+// the configured ones are trusted, and https sources without them are rejected, as none of their certificates
+// could be verified.
+func newRootCAs(config *config.SourceConfig) (*x509.CertPool, error) {
+	crtPool, err := systemCertPool()
+	if len(config.CACertFiles) == 0 {
+		if err != nil && config.Scheme == "https" {
+			return nil, fmt.Errorf("failed to load system cert pool and no CA certificates are configured for https source %s: %v", config.Component, err)
+		}
+		return nil, nil
+	}
+	if err != nil {
+		glog.Warningf("Failed to load system cert pool, trusting only the configured CA certificates of component %s: %v", config.Component, err)
+		crtPool = x509.NewCertPool()
+	}
+	for _, caCert := range config.CACertFiles {
+		if isInlinePEM(caCert) {
+			if !crtPool.AppendCertsFromPEM([]byte(caCert)) {
+				return nil, fmt.Errorf("no certificates found in the inline CA certificate")
+			}
+			continue
+		}
+		if info, err := os.Stat(caCert); err == nil && info.IsDir() {
+			appendCACertDir(crtPool, caCert)
+			continue
+		}
+		pem, err := ioutil.ReadFile(caCert)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA certificate %s: %v", caCert, err)
+		}
+		if !crtPool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caCert)
+		}
+	}
+	return crtPool, nil
+}
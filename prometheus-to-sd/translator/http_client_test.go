@@ -0,0 +1,308 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package translator
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/GoogleCloudPlatform/k8s-stackdriver/prometheus-to-sd/config"
+)
+
+func TestHTTPClientCacheReusesClient(t *testing.T) {
+	cache := newHTTPClientCache()
+
+	first, err := cache.get(&config.SourceConfig{Component: "first"}, time.Second)
+	assert.NoError(t, err)
+	second, err := cache.get(&config.SourceConfig{Component: "second"}, time.Second)
+	assert.NoError(t, err)
+	assert.True(t, first == second, "configs with identical settings should share a client")
+
+	other, err := cache.get(&config.SourceConfig{InsecureSkipVerify: true}, time.Second)
+	assert.NoError(t, err)
+	assert.False(t, first == other, "configs with different TLS settings should not share a client")
+
+	otherTimeout, err := cache.get(&config.SourceConfig{}, 2*time.Second)
+	assert.NoError(t, err)
+	assert.False(t, first == otherTimeout, "configs with different timeouts should not share a client")
+}
+
+func TestHTTPClientCacheInvalidatesOnCertificateChange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "client-cache")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	caFile := writeServerCertificate(t, server, dir)
+
+	cache := newHTTPClientCache()
+	sourceConfig := &config.SourceConfig{CACertFiles: []string{caFile}}
+	first, err := cache.get(sourceConfig, time.Second)
+	assert.NoError(t, err)
+	same, err := cache.get(sourceConfig, time.Second)
+	assert.NoError(t, err)
+	assert.True(t, first == same)
+
+	modTime := time.Now().Add(time.Hour)
+	if err := os.Chtimes(caFile, modTime, modTime); err != nil {
+		t.Fatalf("Failed to change modification time of %s: %v", caFile, err)
+	}
+	updated, err := cache.get(sourceConfig, time.Second)
+	assert.NoError(t, err)
+	assert.False(t, first == updated, "client should be recreated after CA certificate has changed")
+}
+
+func TestNewTLSConfigCACertDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ca-dir")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	writeServerCertificate(t, server, dir)
+	_, _, clientCert := generateClientCertificate(t, dir)
+	writeTempFile(t, dir, "bogus.pem", []byte("not a certificate"))
+	writeTempFile(t, dir, "README", []byte("ignored"))
+	if err := os.Mkdir(filepath.Join(dir, "nested.pem"), 0700); err != nil {
+		t.Fatalf("Failed to create nested dir: %v", err)
+	}
+	assert.Equal(t, []string{
+		filepath.Join(dir, "bogus.pem"),
+		filepath.Join(dir, "client.crt"),
+		filepath.Join(dir, "server-ca.pem"),
+	}, caCertDirFiles(dir))
+
+	tlsConfig, err := newTLSConfig(&config.SourceConfig{CACertFiles: []string{dir}})
+	if !assert.NoError(t, err) {
+		return
+	}
+	for _, cert := range []*x509.Certificate{server.Certificate(), clientCert} {
+		_, err := cert.Verify(x509.VerifyOptions{Roots: tlsConfig.RootCAs, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}})
+		assert.NoError(t, err, "certificate %v from the directory should be trusted", cert.Subject)
+	}
+}
+
+func TestNewTLSConfigInlineCACert(t *testing.T) {
+	dir, err := ioutil.TempDir("", "inline-ca")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	serverCAFile := writeServerCertificate(t, server, dir)
+	clientCertFile, _, clientCert := generateClientCertificate(t, dir)
+	clientCertPEM, err := ioutil.ReadFile(clientCertFile)
+	if err != nil {
+		t.Fatalf("Failed to read client certificate: %v", err)
+	}
+
+	sourceConfig := &config.SourceConfig{CACertFiles: []string{serverCAFile, "\n" + string(clientCertPEM)}}
+	tlsConfig, err := newTLSConfig(sourceConfig)
+	if !assert.NoError(t, err) {
+		return
+	}
+	for _, cert := range []*x509.Certificate{server.Certificate(), clientCert} {
+		_, err := cert.Verify(x509.VerifyOptions{Roots: tlsConfig.RootCAs, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}})
+		assert.NoError(t, err, "certificate %v should be trusted", cert.Subject)
+	}
+	modTimes := certFilesModTimes(sourceConfig)
+	assert.Equal(t, 1, len(modTimes), "inline certificate should not be watched")
+	assert.Contains(t, modTimes, serverCAFile)
+
+	_, err = newTLSConfig(&config.SourceConfig{CACertFiles: []string{"-----BEGIN CERTIFICATE-----\nbogus\n-----END CERTIFICATE-----\n"}})
+	assert.Error(t, err)
+}
+
+// BenchmarkGetPrometheusMetrics reports the number of connections opened per scrape,
+// which is expected to be close to zero as connections are reused.
+func BenchmarkGetPrometheusMetrics(b *testing.B) {
+	var connections int64
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, testMetricsBody)
+	}))
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt64(&connections, 1)
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	sourceConfig := sourceConfigForServer(b, server, "benchmark")
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := GetPrometheusMetrics(sourceConfig); err != nil {
+			b.Fatalf("Scrape failed: %v", err)
+		}
+	}
+	b.ReportMetric(float64(atomic.LoadInt64(&connections))/float64(b.N), "conns/op")
+}
+
+// scrapeStageTimeout scrapes the source with the long scrape timeout, expecting it to fail early because of the
+// timeout of one of the connection stages.
+func scrapeStageTimeout(t *testing.T, sourceConfig *config.SourceConfig, expected string) {
+	sourceConfig.ScrapeTimeout = 5 * time.Second
+	start := time.Now()
+	_, err := GetPrometheusMetrics(sourceConfig)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), expected)
+		assert.NotContains(t, err.Error(), "timed out after", "scrape timeout shouldn't be reported")
+	}
+	assert.True(t, time.Since(start) < 2*time.Second, "scrape should fail early, took %v", time.Since(start))
+}
+
+func TestDialTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, testMetricsBody)
+	}))
+	defer server.Close()
+	dialControl = func(network, address string, c syscall.RawConn) error {
+		time.Sleep(200 * time.Millisecond)
+		return nil
+	}
+	defer func() { dialControl = nil }()
+
+	sourceConfig := sourceConfigForServer(t, server, "dial-timeout")
+	sourceConfig.DialTimeout = 20 * time.Millisecond
+	scrapeStageTimeout(t, sourceConfig, "i/o timeout")
+}
+
+func TestTLSHandshakeTimeout(t *testing.T) {
+	// The listener accepts connections, but never responds to the TLS handshake.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		var conns []net.Conn
+		defer func() {
+			for _, conn := range conns {
+				conn.Close()
+			}
+		}()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conns = append(conns, conn)
+		}
+	}()
+
+	sourceConfig := &config.SourceConfig{
+		Component:           "tls-handshake-timeout",
+		Scheme:              "https",
+		Host:                "127.0.0.1",
+		Port:                uint(listener.Addr().(*net.TCPAddr).Port),
+		TLSHandshakeTimeout: 50 * time.Millisecond,
+	}
+	scrapeStageTimeout(t, sourceConfig, "TLS handshake timeout")
+}
+
+func TestResponseHeaderTimeout(t *testing.T) {
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+		}
+		fmt.Fprint(w, testMetricsBody)
+	}))
+	defer server.Close()
+	defer close(done)
+
+	sourceConfig := sourceConfigForServer(t, server, "response-header-timeout")
+	sourceConfig.ResponseHeaderTimeout = 50 * time.Millisecond
+	scrapeStageTimeout(t, sourceConfig, "timeout awaiting response headers")
+}
+
+// withoutSystemCertPool makes loading of the system certificates fail until the returned function is called.
+func withoutSystemCertPool() func() {
+	systemCertPool = func() (*x509.CertPool, error) {
+		return nil, errors.New("system roots unavailable")
+	}
+	return func() { systemCertPool = x509.SystemCertPool }
+}
+
+func TestSystemCertPoolUnavailableWithoutCACerts(t *testing.T) {
+	defer withoutSystemCertPool()()
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, testMetricsBody)
+	}))
+	defer server.Close()
+
+	sourceConfig := sourceConfigForServer(t, server, "no-system-pool")
+	sourceConfig.Scheme = "https"
+	// Clients are cached by their settings, so the client is created directly rather than by a scrape.
+	_, err := newHTTPClient(sourceConfig, time.Second)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "failed to load system cert pool")
+		assert.Contains(t, err.Error(), "system roots unavailable")
+	}
+
+	sourceConfig.Scheme = "http"
+	_, err = newTLSConfig(sourceConfig)
+	assert.NoError(t, err, "http sources don't need the CA certificates")
+	sourceConfig.Scheme = "https"
+	sourceConfig.InsecureSkipVerify = true
+	_, err = newTLSConfig(sourceConfig)
+	assert.NoError(t, err, "sources not verifying the certificates don't need the CA certificates")
+}
+
+func TestSystemCertPoolUnavailableWithCACerts(t *testing.T) {
+	defer withoutSystemCertPool()()
+	dir, err := ioutil.TempDir("", "no-system-pool")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, testMetricsBody)
+	}))
+	defer server.Close()
+
+	sourceConfig := sourceConfigForServer(t, server, "no-system-pool-ca")
+	sourceConfig.Scheme = "https"
+	sourceConfig.CACertFiles = []string{writeServerCertificate(t, server, dir)}
+	_, err = GetPrometheusMetrics(sourceConfig)
+	assert.NoError(t, err, "configured CA certificates should be trusted")
+
+	tlsConfig, err := newTLSConfig(sourceConfig)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 1, len(tlsConfig.RootCAs.Subjects()), "only the configured CA certificate should be trusted")
+	}
+}
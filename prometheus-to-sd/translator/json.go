@@ -0,0 +1,105 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package translator
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/golang/protobuf/proto"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/GoogleCloudPlatform/k8s-stackdriver/prometheus-to-sd/config"
+)
+
+// jsonMediaType is the media type of the responses in the JSON format.
+const jsonMediaType = "application/json"
+
+// jsonSample is a sample of the JSON format, see README.md.
+type jsonSample struct {
+	Name   string            `json:"name"`
+	Help   string            `json:"help"`
+	Type   string            `json:"type"`
+	Labels map[string]string `json:"labels"`
+	Value  *float64          `json:"value"`
+}
+
+// jsonTypes maps the types of the JSON samples to the metric types.
+var jsonTypes = map[string]dto.MetricType{
+	"":        dto.MetricType_UNTYPED,
+	"untyped": dto.MetricType_UNTYPED,
+	"counter": dto.MetricType_COUNTER,
+	"gauge":   dto.MetricType_GAUGE,
+}
+
+// decoder decodes the metric families of the response body, with their units and exemplars if the format has them.
+type decoder func(contentType string, body io.Reader) (map[string]*dto.MetricFamily, map[string]string, map[*dto.Bucket]*Exemplar, error)
+
+// decoders decode the bodies of the sources with the formats other than the default config.FormatPrometheus,
+// which is detected by the content type.
+var decoders = map[string]decoder{
+	config.FormatOpenMetrics: func(contentType string, body io.Reader) (map[string]*dto.MetricFamily, map[string]string, map[*dto.Bucket]*Exemplar, error) {
+		return parseOpenMetricsWithMetadata(body)
+	},
+	config.FormatJSON: func(contentType string, body io.Reader) (map[string]*dto.MetricFamily, map[string]string, map[*dto.Bucket]*Exemplar, error) {
+		metrics, err := parseJSON(body)
+		return metrics, nil, nil, err
+	},
+}
+
+// parseJSON decodes the list of JSON samples into metric families.
+func parseJSON(in io.Reader) (map[string]*dto.MetricFamily, error) {
+	var samples []jsonSample
+	if err := json.NewDecoder(in).Decode(&samples); err != nil {
+		return nil, fmt.Errorf("failed to decode JSON metrics: %v", err)
+	}
+	metrics := make(map[string]*dto.MetricFamily)
+	for i, sample := range samples {
+		if sample.Name == "" {
+			return nil, fmt.Errorf("JSON sample %d has no name", i)
+		}
+		if sample.Value == nil {
+			return nil, fmt.Errorf("JSON sample %d of metric %s has no value", i, sample.Name)
+		}
+		mType, found := jsonTypes[sample.Type]
+		if !found {
+			return nil, fmt.Errorf("invalid type %q of metric %s, expected counter, gauge or untyped", sample.Type, sample.Name)
+		}
+		family, found := metrics[sample.Name]
+		if !found {
+			family = &dto.MetricFamily{Name: proto.String(sample.Name), Type: mType.Enum()}
+			metrics[sample.Name] = family
+		} else if family.GetType() != mType {
+			return nil, fmt.Errorf("metric %s has samples of types %v and %v", sample.Name, family.GetType(), mType)
+		}
+		if family.Help == nil && sample.Help != "" {
+			family.Help = proto.String(sample.Help)
+		}
+		metric := &dto.Metric{Label: labelPairs(sample.Labels)}
+		switch mType {
+		case dto.MetricType_COUNTER:
+			metric.Counter = &dto.Counter{Value: sample.Value}
+		case dto.MetricType_GAUGE:
+			metric.Gauge = &dto.Gauge{Value: sample.Value}
+		default:
+			metric.Untyped = &dto.Untyped{Value: sample.Value}
+		}
+		family.Metric = append(family.Metric, metric)
+	}
+	return metrics, nil
+}
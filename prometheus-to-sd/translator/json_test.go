@@ -0,0 +1,120 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package translator
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/GoogleCloudPlatform/k8s-stackdriver/prometheus-to-sd/config"
+)
+
+const testJSONBody = `[
+  {"name": "requests_total", "type": "counter", "help": "Number of requests.", "labels": {"code": "200", "method": "GET"}, "value": 1027},
+  {"name": "requests_total", "type": "counter", "labels": {"code": "500", "method": "GET"}, "value": 3},
+  {"name": "queue_length", "type": "gauge", "value": -2.5},
+  {"name": "build_info", "labels": {"version": "1.2.3"}, "value": 1}
+]`
+
+func TestParseJSON(t *testing.T) {
+	metrics, err := parseJSON(strings.NewReader(testJSONBody))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, []string{"build_info", "queue_length", "requests_total"}, sortedNames(metrics))
+
+	requests := metrics["requests_total"]
+	assert.Equal(t, dto.MetricType_COUNTER, requests.GetType())
+	assert.Equal(t, "Number of requests.", requests.GetHelp())
+	if assert.Equal(t, 2, len(requests.Metric)) {
+		assert.Equal(t, map[string]string{"code": "200", "method": "GET"}, labelsOf(requests.Metric[0]))
+		assert.Equal(t, "code", requests.Metric[0].Label[0].GetName(), "labels should be sorted by name")
+		assert.Equal(t, 1027.0, requests.Metric[0].GetCounter().GetValue())
+		assert.Equal(t, 3.0, requests.Metric[1].GetCounter().GetValue())
+	}
+	assert.Equal(t, dto.MetricType_GAUGE, metrics["queue_length"].GetType())
+	assert.Equal(t, -2.5, metrics["queue_length"].Metric[0].GetGauge().GetValue())
+	assert.Equal(t, dto.MetricType_UNTYPED, metrics["build_info"].GetType(), "type should default to untyped")
+	assert.Equal(t, 1.0, metrics["build_info"].Metric[0].GetUntyped().GetValue())
+}
+
+func TestParseJSONErrors(t *testing.T) {
+	for _, body := range []string{
+		`{"name": "requests_total", "value": 1}`,
+		`[{"name": "requests_total", "value": 1`,
+		`[{"value": 1}]`,
+		`[{"name": "requests_total"}]`,
+		`[{"name": "requests_total", "type": "histogram", "value": 1}]`,
+		`[{"name": "requests_total", "type": "counter", "value": 1}, {"name": "requests_total", "type": "gauge", "value": 2}]`,
+	} {
+		_, err := parseJSON(strings.NewReader(body))
+		assert.Error(t, err, "body %s should be invalid", body)
+	}
+}
+
+func TestGetPrometheusMetricsJSON(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		fmt.Fprint(w, testJSONBody)
+	}))
+	defer server.Close()
+
+	for _, stream := range []bool{false, true} {
+		sourceConfig := sourceConfigForServer(t, server, "json-source")
+		sourceConfig.Format = config.FormatJSON
+		sourceConfig.StreamResponse = stream
+		response, err := GetPrometheusMetrics(sourceConfig)
+		if !assert.NoError(t, err, "stream: %v", stream) {
+			continue
+		}
+		cfg := *commonConfig
+		cfg.SourceConfig = sourceConfig
+		cfg.DryRun = true
+		cache := NewMetricDescriptorCache(nil, &cfg)
+		cache.fresh = true
+		metrics, err := response.Build(&cfg, cache)
+		if assert.NoError(t, err) {
+			assert.Equal(t, []string{"build_info", "queue_length", "requests_total"}, sortedNames(metrics), "stream: %v", stream)
+		}
+	}
+
+	_, err := GetPrometheusMetrics(sourceConfigForServer(t, server, "json-source"))
+	if assert.Error(t, err, "JSON should be rejected by the default format") {
+		assert.Contains(t, err.Error(), "unexpected content type")
+	}
+}
+
+func TestGetPrometheusMetricsJSONUnexpectedContentType(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, "<html>login</html>")
+	}))
+	defer server.Close()
+
+	sourceConfig := sourceConfigForServer(t, server, "json-html")
+	sourceConfig.Format = config.FormatJSON
+	_, err := GetPrometheusMetrics(sourceConfig)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "expected application/json")
+	}
+}
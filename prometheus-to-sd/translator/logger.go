@@ -0,0 +1,77 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package translator
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/golang/glog"
+
+	"github.com/GoogleCloudPlatform/k8s-stackdriver/prometheus-to-sd/config"
+)
+
+// glogDepth skips the frames of the glogLogger methods, so that glog reports the location of their callers.
+const glogDepth = 1
+
+// glogLogger is the default config.Logger, logging messages with glog followed by the fields formatted
+// as key=value.
+type glogLogger struct{}
+
+// Debug logs the message if the glog verbosity is at least the level.
+func (glogLogger) Debug(level int, msg string, keysAndValues ...interface{}) {
+	if glog.V(glog.Level(level)) {
+		glog.InfoDepth(glogDepth, formatLogMessage(msg, keysAndValues))
+	}
+}
+
+// Info logs the message with glog.Info.
+func (glogLogger) Info(msg string, keysAndValues ...interface{}) {
+	glog.InfoDepth(glogDepth, formatLogMessage(msg, keysAndValues))
+}
+
+// Warning logs the message with glog.Warning.
+func (glogLogger) Warning(msg string, keysAndValues ...interface{}) {
+	glog.WarningDepth(glogDepth, formatLogMessage(msg, keysAndValues))
+}
+
+// Error logs the message with glog.Error.
+func (glogLogger) Error(msg string, keysAndValues ...interface{}) {
+	glog.ErrorDepth(glogDepth, formatLogMessage(msg, keysAndValues))
+}
+
+// formatLogMessage appends the fields to the message. A key without the value is logged as is.
+func formatLogMessage(msg string, keysAndValues []interface{}) string {
+	var b strings.Builder
+	b.WriteString(msg)
+	for i := 0; i < len(keysAndValues); i += 2 {
+		if i+1 == len(keysAndValues) {
+			fmt.Fprintf(&b, " %v", keysAndValues[i])
+			break
+		}
+		fmt.Fprintf(&b, " %v=%v", keysAndValues[i], keysAndValues[i+1])
+	}
+	return b.String()
+}
+
+// loggerFor returns the logger of the source, or the glog based one if the source doesn't set it.
+func loggerFor(config *config.SourceConfig) config.Logger {
+	if config.Logger == nil {
+		return glogLogger{}
+	}
+	return config.Logger
+}
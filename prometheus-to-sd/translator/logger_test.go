@@ -0,0 +1,121 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package translator
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// logEntry is a message received by the recordingLogger, with the fields indexed by the keys.
+type logEntry struct {
+	level  string
+	msg    string
+	fields map[string]interface{}
+}
+
+// recordingLogger records the logged messages.
+type recordingLogger struct {
+	mutex   sync.Mutex
+	entries []logEntry
+}
+
+func (l *recordingLogger) record(level, msg string, keysAndValues []interface{}) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	fields := make(map[string]interface{})
+	for i := 0; i+1 < len(keysAndValues); i += 2 {
+		fields[keysAndValues[i].(string)] = keysAndValues[i+1]
+	}
+	l.entries = append(l.entries, logEntry{level: level, msg: msg, fields: fields})
+}
+
+func (l *recordingLogger) Debug(level int, msg string, keysAndValues ...interface{}) {
+	l.record("debug", msg, keysAndValues)
+}
+
+func (l *recordingLogger) Info(msg string, keysAndValues ...interface{}) {
+	l.record("info", msg, keysAndValues)
+}
+
+func (l *recordingLogger) Warning(msg string, keysAndValues ...interface{}) {
+	l.record("warning", msg, keysAndValues)
+}
+
+func (l *recordingLogger) Error(msg string, keysAndValues ...interface{}) {
+	l.record("error", msg, keysAndValues)
+}
+
+func TestLoggerScrapeFailure(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	logger := &recordingLogger{}
+	sourceConfig := sourceConfigForServer(t, server, "logger-failure")
+	sourceConfig.Logger = logger
+	sourceConfig.ScrapeRetries = 1
+	sourceConfig.ScrapeRetryBackoff = time.Millisecond
+	_, err := GetPrometheusMetrics(sourceConfig)
+	assert.Error(t, err)
+
+	url := server.URL + "/metrics"
+	if assert.Equal(t, 2, len(logger.entries)) {
+		assert.Equal(t, "Scrape attempt failed, retrying", logger.entries[0].msg)
+		assert.Equal(t, "logger-failure", logger.entries[0].fields["component"])
+		assert.Equal(t, url, logger.entries[0].fields["url"])
+		assert.Equal(t, http.StatusServiceUnavailable, logger.entries[0].fields["status"])
+		assert.Equal(t, 1, logger.entries[0].fields["attempt"])
+		assert.Equal(t, time.Millisecond, logger.entries[0].fields["backoff"])
+
+		assert.Equal(t, "Scrape failed", logger.entries[1].msg)
+		assert.Equal(t, "logger-failure", logger.entries[1].fields["component"])
+		assert.Equal(t, url, logger.entries[1].fields["url"])
+		assert.Equal(t, http.StatusServiceUnavailable, logger.entries[1].fields["status"])
+		assert.Equal(t, 2, logger.entries[1].fields["attempt"])
+		assert.Contains(t, logger.entries[1].fields["error"].(error).Error(), "503")
+	}
+}
+
+func TestLoggerConnectionFailureWithoutStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	logger := &recordingLogger{}
+	sourceConfig := sourceConfigForServer(t, server, "logger-connection")
+	sourceConfig.Logger = logger
+	server.Close()
+
+	_, err := GetPrometheusMetrics(sourceConfig)
+	assert.Error(t, err)
+	if assert.Equal(t, 1, len(logger.entries)) {
+		assert.Equal(t, "logger-connection", logger.entries[0].fields["component"])
+		assert.NotContains(t, logger.entries[0].fields, "status", "failed connection has no status")
+	}
+}
+
+func TestFormatLogMessage(t *testing.T) {
+	assert.Equal(t, "Scrape failed", formatLogMessage("Scrape failed", nil))
+	assert.Equal(t, "Scrape failed component=kubelet status=503",
+		formatLogMessage("Scrape failed", []interface{}{"component", "kubelet", "status", 503}))
+	assert.Equal(t, "Scrape failed component=kubelet dangling",
+		formatLogMessage("Scrape failed", []interface{}{"component", "kubelet", "dangling"}))
+}
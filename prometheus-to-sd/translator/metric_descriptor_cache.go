@@ -17,6 +17,12 @@ limitations under the License.
 package translator
 
 import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
 	"github.com/golang/glog"
 	dto "github.com/prometheus/client_model/go"
 	v3 "google.golang.org/api/monitoring/v3"
@@ -32,6 +38,14 @@ type MetricDescriptorCache struct {
 	config      *config.CommonConfig
 	component   string
 	fresh       bool
+	// scrapes is the number of processed responses, lastSeen contains the number of the last
+	// response in which the metric was present, whether or not it was whitelisted.
+	scrapes  int
+	lastSeen map[string]int
+	// fetched contains times at which the descriptors were fetched from the Stackdriver, so that
+	// the ones older than config.DescriptorCacheTTL are fetched again.
+	fetched map[string]time.Time
+	now     func() time.Time
 }
 
 // NewMetricDescriptorCache creates empty metric descriptor cache for the given component.
@@ -39,6 +53,9 @@ func NewMetricDescriptorCache(service *v3.Service, config *config.CommonConfig)
 	return &MetricDescriptorCache{
 		descriptors: make(map[string]*v3.MetricDescriptor),
 		broken:      make(map[string]bool),
+		lastSeen:    make(map[string]int),
+		fetched:     make(map[string]time.Time),
+		now:         time.Now,
 		service:     service,
 		config:      config,
 		fresh:       false,
@@ -69,15 +86,16 @@ func (cache *MetricDescriptorCache) MarkStale() {
 // If the value has changed then metric family is marked is broken. Use this method to verify that
 // metrics with prefix "container.googleapis.com" haven't changed.
 func (cache *MetricDescriptorCache) ValidateMetricDescriptors(metrics map[string]*dto.MetricFamily, whitelisted []string) {
-	// Perform cache operation only if cache was recently refreshed. This is done mostly from the optimization point
-	// of view, we don't want to check all metric descriptors too often, as they should change rarely.
-	if !cache.fresh {
-		return
-	}
 	for _, metricFamily := range metrics {
 		if !isMetricWhitelisted(metricFamily.GetName(), whitelisted) {
 			continue
 		}
+		// Perform cache operation only if cache was recently refreshed or the descriptor expired. This is done mostly
+		// from the optimization point of view, we don't want to check all metric descriptors too often, as they
+		// should change rarely.
+		if !cache.fresh && !cache.refreshIfExpired(metricFamily.GetName()) {
+			continue
+		}
 		metricDescriptor, ok := cache.descriptors[metricFamily.GetName()]
 		if !ok {
 			continue
@@ -94,17 +112,125 @@ func (cache *MetricDescriptorCache) ValidateMetricDescriptors(metrics map[string
 }
 
 // UpdateMetricDescriptors iterates over all metricFamilies and updates metricDescriptors in the Stackdriver if required.
-func (cache *MetricDescriptorCache) UpdateMetricDescriptors(metrics map[string]*dto.MetricFamily, whitelisted []string) {
-	// Perform cache operation only if cache was recently refreshed. This is done mostly from the optimization point
-	// of view, we don't want to check all metric descriptors too often, as they should change rarely.
-	if !cache.fresh {
-		return
-	}
+// At most config.DescriptorUpdateConcurrency descriptors are updated at once. Returns the errors of all the failed
+// updates, the metrics whose descriptors failed to update are marked as broken.
+func (cache *MetricDescriptorCache) UpdateMetricDescriptors(metrics map[string]*dto.MetricFamily, whitelisted []string) error {
+	return cache.updateMetricDescriptors(metrics, whitelisted, nil)
+}
+
+// updateMetricDescriptors works like UpdateMetricDescriptors, creating the descriptors with the units exposed
+// with the metrics, indexed by the family name.
+func (cache *MetricDescriptorCache) updateMetricDescriptors(metrics map[string]*dto.MetricFamily, whitelisted []string, units map[string]string) error {
+	var stale []*v3.MetricDescriptor
+	var names []string
 	for _, metricFamily := range metrics {
-		if isMetricWhitelisted(metricFamily.GetName(), whitelisted) {
-			cache.updateMetricDescriptorIfStale(metricFamily)
+		if !isMetricWhitelisted(metricFamily.GetName(), whitelisted) {
+			continue
+		}
+		// Perform cache operation only if cache was recently refreshed or the descriptor expired. This is done mostly
+		// from the optimization point of view, we don't want to check all metric descriptors too often, as they
+		// should change rarely.
+		if cache.fresh || cache.refreshIfExpired(metricFamily.GetName()) {
+			if descriptor := cache.staleMetricDescriptor(metricFamily, units[metricFamily.GetName()]); descriptor != nil {
+				stale = append(stale, descriptor)
+				names = append(names, metricFamily.GetName())
+			}
+		}
+	}
+
+	errs := cache.updateMetricDescriptorsInStackdriver(stale)
+	var failed []string
+	for i, name := range names {
+		cache.recordAPICall("create", errs[i] == nil)
+		if errs[i] != nil {
+			cache.broken[name] = true
+			failed = append(failed, fmt.Sprintf("%s: %v", name, errs[i]))
+			continue
 		}
+		cache.descriptors[name] = stale[i]
+		cache.fetched[name] = cache.now()
+		cache.recordEntries()
+	}
+	if len(failed) > 0 {
+		sort.Strings(failed)
+		return fmt.Errorf("failed to update %d metric descriptors: %s", len(failed), strings.Join(failed, "; "))
 	}
+	return nil
+}
+
+// updateMetricDescriptorsInStackdriver writes the descriptors to the Stackdriver, running at most
+// config.DescriptorUpdateConcurrency calls at once. Returns the errors of the calls, in the order of descriptors.
+func (cache *MetricDescriptorCache) updateMetricDescriptorsInStackdriver(descriptors []*v3.MetricDescriptor) []error {
+	concurrency := cache.config.DescriptorUpdateConcurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	errs := make([]error, len(descriptors))
+	semaphore := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, descriptor := range descriptors {
+		semaphore <- struct{}{}
+		wg.Add(1)
+		go func(i int, descriptor *v3.MetricDescriptor) {
+			defer func() {
+				<-semaphore
+				wg.Done()
+			}()
+			errs[i] = updateMetricDescriptorInStackdriver(cache.service, cache.config.GceConfig, descriptor)
+		}(i, descriptor)
+	}
+	wg.Wait()
+	return errs
+}
+
+// refreshIfExpired fetches the descriptor of the metric again if it's older than the TTL. The descriptor is
+// removed from the cache if it no longer exists in the Stackdriver. Returns true if the descriptor was fetched.
+func (cache *MetricDescriptorCache) refreshIfExpired(name string) bool {
+	component := cache.config.SourceConfig.Component
+	descriptor, ok := cache.descriptors[name]
+	if !ok {
+		descriptorCacheLookups.WithLabelValues(component, "miss").Inc()
+		return false
+	}
+	if cache.config.DescriptorCacheTTL <= 0 || cache.now().Sub(cache.fetched[name]) < cache.config.DescriptorCacheTTL {
+		descriptorCacheLookups.WithLabelValues(component, "hit").Inc()
+		return false
+	}
+	descriptorCacheLookups.WithLabelValues(component, "refresh").Inc()
+	refreshed, found, err := getMetricDescriptorFromStackdriver(cache.service, cache.config.GceConfig, descriptor)
+	cache.recordAPICall("get", err == nil)
+	if err != nil {
+		return false
+	}
+	if found {
+		cache.descriptors[name] = refreshed
+	} else {
+		glog.Warningf("Metric descriptor %s was deleted from the Stackdriver", descriptor.Type)
+		delete(cache.descriptors, name)
+		cache.recordEntries()
+	}
+	cache.fetched[name] = cache.now()
+	return true
+}
+
+// PlannedMetricDescriptors returns descriptors of whitelisted metric families, as they would be created
+// or validated by the cache, with the units exposed with the metrics, indexed by the family name.
+// The cache itself is not modified.
+func (cache *MetricDescriptorCache) PlannedMetricDescriptors(metrics map[string]*dto.MetricFamily, whitelisted []string, units map[string]string) []*v3.MetricDescriptor {
+	names := make([]string, 0, len(metrics))
+	for name := range metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var descriptors []*v3.MetricDescriptor
+	for _, name := range names {
+		metricFamily := metrics[name]
+		if !isMetricWhitelisted(metricFamily.GetName(), whitelisted) {
+			continue
+		}
+		descriptors = append(descriptors, newMetricDescriptor(cache.config, metricFamily, cache.descriptors[metricFamily.GetName()], units[metricFamily.GetName()]))
+	}
+	return descriptors
 }
 
 func isMetricWhitelisted(metric string, whitelisted []string) bool {
@@ -120,18 +246,64 @@ func isMetricWhitelisted(metric string, whitelisted []string) bool {
 	return false
 }
 
-// updateMetricDescriptorIfStale checks if descriptor created from MetricFamily object differs from the existing one
-// and updates if needed.
-func (cache *MetricDescriptorCache) updateMetricDescriptorIfStale(metricFamily *dto.MetricFamily) {
+// staleMetricDescriptor checks if descriptor created from MetricFamily object differs from the existing one
+// and returns the new descriptor if it needs to be updated, or nil otherwise.
+func (cache *MetricDescriptorCache) staleMetricDescriptor(metricFamily *dto.MetricFamily, unit string) *v3.MetricDescriptor {
 	metricDescriptor, ok := cache.descriptors[metricFamily.GetName()]
-	updatedMetricDescriptor := MetricFamilyToMetricDescriptor(cache.config, metricFamily, metricDescriptor)
+	updatedMetricDescriptor := newMetricDescriptor(cache.config, metricFamily, metricDescriptor, unit)
 	if !ok || descriptorChanged(metricDescriptor, updatedMetricDescriptor) {
-		if updateMetricDescriptorInStackdriver(cache.service, cache.config.GceConfig, updatedMetricDescriptor) {
-			cache.descriptors[metricFamily.GetName()] = updatedMetricDescriptor
-		} else {
-			cache.broken[metricFamily.GetName()] = true
+		return updatedMetricDescriptor
+	}
+	return nil
+}
+
+// markSeen records that the metrics were present in the processed response.
+func (cache *MetricDescriptorCache) markSeen(metrics map[string]*dto.MetricFamily) {
+	cache.scrapes++
+	for name := range metrics {
+		cache.lastSeen[name] = cache.scrapes
+	}
+}
+
+// PruneStaleDescriptors deletes descriptors of custom metrics that weren't present in the last threshold
+// processed responses, so that they don't count towards the quota. Metrics not seen since the cache was
+// created are treated as seen at that time. In the dry run mode descriptors are only logged. Returns names
+// of the metrics with stale descriptors.
+func (cache *MetricDescriptorCache) PruneStaleDescriptors(threshold int, dryRun bool) []string {
+	if threshold <= 0 {
+		return nil
+	}
+	var stale []string
+	for _, name := range cache.GetMetricNames() {
+		descriptor := cache.descriptors[name]
+		if !isCustomMetricsPrefix(cache.config, descriptor.Type) || cache.scrapes-cache.lastSeen[name] < threshold {
+			continue
+		}
+		stale = append(stale, name)
+		if dryRun {
+			glog.Infof("Dry run: metric descriptor %s not seen in the last %d scrapes would be deleted", descriptor.Type, threshold)
+			continue
 		}
+		deleted := deleteMetricDescriptorInStackdriver(cache.service, cache.config.GceConfig, descriptor)
+		cache.recordAPICall("delete", deleted)
+		if deleted {
+			delete(cache.descriptors, name)
+			delete(cache.lastSeen, name)
+			cache.recordEntries()
+		}
+	}
+	sort.Strings(stale)
+	return stale
+}
+
+// newMetricDescriptor creates the descriptor of the metric family, using the unit exposed with the metric,
+// if any, in preference to the one inferred from its name.
+func newMetricDescriptor(config *config.CommonConfig, metricFamily *dto.MetricFamily, originalDescriptor *v3.MetricDescriptor, unit string) *v3.MetricDescriptor {
+	descriptor := MetricFamilyToMetricDescriptor(config, metricFamily, originalDescriptor)
+	if unit != "" {
+		descriptor.Unit = unit
 	}
+	return descriptor
 }
 
 func (cache *MetricDescriptorCache) getMetricDescriptor(metric string) *v3.MetricDescriptor {
@@ -143,7 +315,18 @@ func (cache *MetricDescriptorCache) getMetricDescriptor(metric string) *v3.Metri
 }
 
 func descriptorChanged(original *v3.MetricDescriptor, checked *v3.MetricDescriptor) bool {
-	return descriptorDescriptionChanged(original, checked) || descriptorLabelSetChanged(original, checked)
+	return descriptorDescriptionChanged(original, checked) || descriptorUnitChanged(original, checked) ||
+		descriptorLabelSetChanged(original, checked)
+}
+
+// descriptorUnitChanged returns true if the checked descriptor has a unit different from the original one.
+// Descriptors without a known unit don't clear the unit of the original one.
+func descriptorUnitChanged(original *v3.MetricDescriptor, checked *v3.MetricDescriptor) bool {
+	if checked.Unit != "" && original.Unit != checked.Unit {
+		glog.V(4).Infof("Unit is different, %v != %v", original.Unit, checked.Unit)
+		return true
+	}
+	return false
 }
 
 func descriptorDescriptionChanged(original *v3.MetricDescriptor, checked *v3.MetricDescriptor) bool {
@@ -175,9 +358,30 @@ func descriptorLabelSetChanged(original *v3.MetricDescriptor, checked *v3.Metric
 // and puts them into cache.
 func (cache *MetricDescriptorCache) Refresh() {
 	metricDescriptors, err := getMetricDescriptors(cache.service, cache.config)
+	cache.recordAPICall("list", err == nil)
 	if err == nil {
 		cache.descriptors = metricDescriptors
 		cache.broken = make(map[string]bool)
+		cache.fetched = make(map[string]time.Time)
+		now := cache.now()
+		for name := range metricDescriptors {
+			cache.fetched[name] = now
+		}
 		cache.fresh = true
+		cache.recordEntries()
 	}
 }
+
+// recordAPICall counts the Stackdriver API call with the given operation made by the cache.
+func (cache *MetricDescriptorCache) recordAPICall(operation string, succeeded bool) {
+	component := cache.config.SourceConfig.Component
+	descriptorAPICalls.WithLabelValues(component, operation).Inc()
+	if !succeeded {
+		descriptorAPIErrors.WithLabelValues(component, operation).Inc()
+	}
+}
+
+// recordEntries exports the number of descriptors kept in the cache.
+func (cache *MetricDescriptorCache) recordEntries() {
+	descriptorCacheEntries.WithLabelValues(cache.config.SourceConfig.Component).Set(float64(len(cache.descriptors)))
+}
@@ -17,8 +17,15 @@ limitations under the License.
 package translator
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	dto "github.com/prometheus/client_model/go"
 	"github.com/stretchr/testify/assert"
@@ -30,6 +37,8 @@ import (
 var equalDescriptor = "equal"
 var differentDescription = "differentDescription"
 var differentLabels = "differentLabels"
+var differentUnit = "differentUnit"
+var unknownUnit = "unknownUnit"
 
 var description1 = "Simple description"
 var description2 = "Complex description"
@@ -42,6 +51,7 @@ var originalDescriptor = v3.MetricDescriptor{
 	Name:        equalDescriptor,
 	Description: description1,
 	Labels:      []*v3.LabelDescriptor{label1, label2},
+	Unit:        "s",
 }
 
 var otherDescriptors = map[*v3.MetricDescriptor]bool{
@@ -49,17 +59,31 @@ var otherDescriptors = map[*v3.MetricDescriptor]bool{
 		Name:        equalDescriptor,
 		Description: description1,
 		Labels:      []*v3.LabelDescriptor{label1, label2},
+		Unit:        "s",
 	}: false,
 	{
 		Name:        differentDescription,
 		Description: description2,
 		Labels:      []*v3.LabelDescriptor{label1, label2},
+		Unit:        "s",
 	}: true,
 	{
 		Name:        differentLabels,
 		Description: description1,
 		Labels:      []*v3.LabelDescriptor{label3},
+		Unit:        "s",
 	}: true,
+	{
+		Name:        differentUnit,
+		Description: description1,
+		Labels:      []*v3.LabelDescriptor{label1, label2},
+		Unit:        "ms",
+	}: true,
+	{
+		Name:        unknownUnit,
+		Description: description1,
+		Labels:      []*v3.LabelDescriptor{label1, label2},
+	}: false,
 }
 
 func TestDescriptorChanged(t *testing.T) {
@@ -204,3 +228,596 @@ func TestValidateMetricDescriptors(t *testing.T) {
 		}
 	}
 }
+
+func TestBuildDryRunDoesNotModifyCache(t *testing.T) {
+	sourceConfig := *commonConfig.SourceConfig
+	sourceConfig.MetricsPrefix = "custom.googleapis.com"
+	sourceConfig.Whitelisted = nil
+	dryRunConfig := *commonConfig
+	dryRunConfig.SourceConfig = &sourceConfig
+	dryRunConfig.DryRun = true
+
+	cache := NewMetricDescriptorCache(nil, &dryRunConfig)
+	cache.descriptors["requests"] = &v3.MetricDescriptor{Name: "requests", MetricKind: "CUMULATIVE", ValueType: "INT64"}
+	cache.fresh = true
+
+	response := &PrometheusResponse{rawResponse: `
+# TYPE requests counter
+requests{code="200"} 10
+# TYPE temperature gauge
+temperature 20.5
+`}
+	metrics, err := response.Build(&dryRunConfig, cache)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(metrics))
+	assert.Equal(t, []string{"requests"}, cache.GetMetricNames())
+	assert.Empty(t, cache.broken)
+	assert.Equal(t, 0, cache.scrapes, "dry run shouldn't count towards pruning of stale descriptors")
+	assert.Empty(t, cache.lastSeen)
+
+	planned, err := response.PlanMetricDescriptors(&dryRunConfig, cache)
+	if assert.NoError(t, err) && assert.Equal(t, 2, len(planned)) {
+		assert.Equal(t, "custom.googleapis.com/testcomponent/requests", planned[0].Type)
+		assert.Equal(t, "CUMULATIVE", planned[0].MetricKind)
+		assert.Equal(t, "custom.googleapis.com/testcomponent/temperature", planned[1].Type)
+		assert.Equal(t, "GAUGE", planned[1].MetricKind)
+	}
+	assert.Equal(t, []string{"requests"}, cache.GetMetricNames())
+}
+
+func TestBuildMetricPrefixOverrides(t *testing.T) {
+	var created []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		descriptor := &v3.MetricDescriptor{}
+		if err := json.NewDecoder(r.Body).Decode(descriptor); err != nil {
+			t.Errorf("Failed to decode metric descriptor: %v", err)
+		}
+		created = append(created, descriptor.Type)
+		json.NewEncoder(w).Encode(descriptor)
+	}))
+	defer server.Close()
+	service, err := v3.New(server.Client())
+	if err != nil {
+		t.Fatalf("Failed to create Stackdriver client: %v", err)
+	}
+	service.BasePath = server.URL + "/"
+
+	sourceConfig := *commonConfig.SourceConfig
+	sourceConfig.Whitelisted = nil
+	sourceConfig.MetricPrefixOverrides = map[string]string{"requests": "custom.googleapis.com"}
+	overridesConfig := *commonConfig
+	overridesConfig.SourceConfig = &sourceConfig
+
+	cache := NewMetricDescriptorCache(service, &overridesConfig)
+	cache.descriptors["temperature"] = &v3.MetricDescriptor{
+		Name:   "temperature",
+		Labels: []*v3.LabelDescriptor{{Key: "room"}},
+	}
+	cache.fresh = true
+
+	response := &PrometheusResponse{rawResponse: `
+# TYPE requests counter
+requests{code="200"} 10
+# TYPE temperature gauge
+temperature{sensor="a"} 20.5
+`}
+	_, err = response.Build(&overridesConfig, cache)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"custom.googleapis.com/testcomponent/requests"}, created, "only descriptor of the custom metric should be created")
+	assert.False(t, cache.IsMetricBroken("requests"))
+	assert.True(t, cache.IsMetricBroken("temperature"), "descriptor of the default prefixed metric should be validated")
+
+	assert.Equal(t, "custom.googleapis.com/testcomponent/requests", getMetricType(&overridesConfig, "requests"))
+	assert.Equal(t, "container.googleapis.com/master/testcomponent/temperature", getMetricType(&overridesConfig, "temperature"))
+}
+
+func TestBuildCustomMetricsPrefixes(t *testing.T) {
+	var created []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		descriptor := &v3.MetricDescriptor{}
+		if err := json.NewDecoder(r.Body).Decode(descriptor); err != nil {
+			t.Errorf("Failed to decode metric descriptor: %v", err)
+		}
+		created = append(created, descriptor.Type)
+		json.NewEncoder(w).Encode(descriptor)
+	}))
+	defer server.Close()
+	service, err := v3.New(server.Client())
+	if err != nil {
+		t.Fatalf("Failed to create Stackdriver client: %v", err)
+	}
+	service.BasePath = server.URL + "/"
+
+	sourceConfig := *commonConfig.SourceConfig
+	sourceConfig.Whitelisted = nil
+	sourceConfig.MetricPrefixOverrides = map[string]string{
+		"requests": "custom.googleapis.com",
+		"latency":  "regional.googleapis.com/custom",
+	}
+	prefixesConfig := *commonConfig
+	prefixesConfig.SourceConfig = &sourceConfig
+	prefixesConfig.CustomMetricsPrefixes = []string{"custom.googleapis.com", "regional.googleapis.com/custom"}
+
+	cache := NewMetricDescriptorCache(service, &prefixesConfig)
+	cache.fresh = true
+
+	response := &PrometheusResponse{rawResponse: `
+# TYPE requests counter
+requests 10
+# TYPE latency gauge
+latency 0.5
+# TYPE temperature gauge
+temperature 20.5
+`}
+	_, err = response.Build(&prefixesConfig, cache)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{
+		"custom.googleapis.com/testcomponent/requests",
+		"regional.googleapis.com/custom/testcomponent/latency",
+	}, created, "descriptors of metrics with all the custom prefixes should be created")
+	assert.ElementsMatch(t, []string{"requests", "latency"}, cache.GetMetricNames())
+}
+
+func TestIsCustomMetricsPrefix(t *testing.T) {
+	defaultConfig := &config.CommonConfig{}
+	assert.True(t, isCustomMetricsPrefix(defaultConfig, "custom.googleapis.com"))
+	assert.False(t, isCustomMetricsPrefix(defaultConfig, "regional.googleapis.com/custom"))
+
+	regionalConfig := &config.CommonConfig{CustomMetricsPrefixes: []string{"regional.googleapis.com/custom"}}
+	assert.True(t, isCustomMetricsPrefix(regionalConfig, "regional.googleapis.com/custom"))
+	assert.False(t, isCustomMetricsPrefix(regionalConfig, "custom.googleapis.com"), "configured prefixes should replace the default")
+	assert.False(t, isCustomMetricsPrefix(regionalConfig, "container.googleapis.com/master"))
+}
+
+func TestPruneStaleDescriptors(t *testing.T) {
+	sourceConfig := *commonConfig.SourceConfig
+	sourceConfig.MetricsPrefix = "custom.googleapis.com"
+	sourceConfig.Whitelisted = nil
+	pruneConfig := *commonConfig
+	pruneConfig.SourceConfig = &sourceConfig
+
+	// The cache isn't fresh, so that existing descriptors aren't updated.
+	cache := NewMetricDescriptorCache(nil, &pruneConfig)
+	cache.descriptors["requests"] = &v3.MetricDescriptor{Type: "custom.googleapis.com/testcomponent/requests"}
+	cache.descriptors["temperature"] = &v3.MetricDescriptor{Type: "custom.googleapis.com/testcomponent/temperature"}
+
+	both := &PrometheusResponse{rawResponse: `
+# TYPE requests counter
+requests 10
+# TYPE temperature gauge
+temperature 20.5
+`}
+	onlyRequests := &PrometheusResponse{rawResponse: `
+# TYPE requests counter
+requests 10
+`}
+	_, err := both.Build(&pruneConfig, cache)
+	assert.NoError(t, err)
+	assert.Empty(t, cache.PruneStaleDescriptors(3, true))
+
+	for i := 0; i < 2; i++ {
+		_, err = onlyRequests.Build(&pruneConfig, cache)
+		assert.NoError(t, err)
+		assert.Empty(t, cache.PruneStaleDescriptors(3, true), "descriptor shouldn't be pruned before the threshold")
+	}
+	_, err = onlyRequests.Build(&pruneConfig, cache)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"temperature"}, cache.PruneStaleDescriptors(3, true))
+	assert.Empty(t, cache.PruneStaleDescriptors(0, true), "pruning should be disabled with zero threshold")
+	assert.ElementsMatch(t, []string{"requests", "temperature"}, cache.GetMetricNames(), "dry run shouldn't modify the cache")
+
+	_, err = both.Build(&pruneConfig, cache)
+	assert.NoError(t, err)
+	assert.Empty(t, cache.PruneStaleDescriptors(3, true), "metric exposed again shouldn't be pruned")
+}
+
+func TestPruneStaleDescriptorsOfWhitelistedSource(t *testing.T) {
+	sourceConfig := *commonConfig.SourceConfig
+	sourceConfig.MetricsPrefix = "custom.googleapis.com"
+	sourceConfig.Whitelisted = nil
+	sourceConfig.WhitelistedRegex = []string{"req.*"}
+	pruneConfig := *commonConfig
+	pruneConfig.SourceConfig = &sourceConfig
+
+	cache := NewMetricDescriptorCache(nil, &pruneConfig)
+	cache.descriptors["requests"] = &v3.MetricDescriptor{Type: "custom.googleapis.com/testcomponent/requests"}
+	cache.descriptors["temperature"] = &v3.MetricDescriptor{Type: "custom.googleapis.com/testcomponent/temperature"}
+	cache.descriptors["removed"] = &v3.MetricDescriptor{Type: "custom.googleapis.com/testcomponent/removed"}
+
+	response := &PrometheusResponse{rawResponse: `
+# TYPE requests counter
+requests 10
+# TYPE temperature gauge
+temperature 20.5
+`}
+	for i := 0; i < 3; i++ {
+		_, err := response.Build(&pruneConfig, cache)
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, []string{"removed"}, cache.PruneStaleDescriptors(3, true), "exposed metric excluded by the whitelist shouldn't be pruned")
+}
+
+func TestPruneStaleDescriptorsDeletes(t *testing.T) {
+	var deleted []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			t.Errorf("Unexpected %s request to %s", r.Method, r.URL.Path)
+		}
+		deleted = append(deleted, r.URL.Path)
+		w.Write([]byte("{}"))
+	}))
+	defer server.Close()
+	service, err := v3.New(server.Client())
+	if err != nil {
+		t.Fatalf("Failed to create Stackdriver client: %v", err)
+	}
+	service.BasePath = server.URL + "/"
+
+	cache := NewMetricDescriptorCache(service, commonConfig)
+	cache.descriptors["requests"] = &v3.MetricDescriptor{Type: "custom.googleapis.com/testcomponent/requests"}
+	cache.descriptors["temperature"] = &v3.MetricDescriptor{Type: "container.googleapis.com/master/testcomponent/temperature"}
+	cache.markSeen(nil)
+
+	assert.Equal(t, []string{"requests"}, cache.PruneStaleDescriptors(1, false), "only descriptors of custom metrics should be pruned")
+	assert.Equal(t, []string{"/v3/projects/test-proj/metricDescriptors/custom.googleapis.com/testcomponent/requests"}, deleted)
+	assert.Equal(t, []string{"temperature"}, cache.GetMetricNames())
+}
+
+func descriptorCacheLookupsValue(t *testing.T, component, result string) float64 {
+	metric := &dto.Metric{}
+	if err := descriptorCacheLookups.WithLabelValues(component, result).Write(metric); err != nil {
+		t.Fatalf("Failed to read descriptorCacheLookups: %v", err)
+	}
+	return metric.GetCounter().GetValue()
+}
+
+func TestUpdateMetricDescriptorsRefreshesExpired(t *testing.T) {
+	var requests []string
+	deleted := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method)
+		switch {
+		case r.Method == http.MethodGet && deleted:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error": {"code": 404, "message": "not found"}}`))
+		case r.Method == http.MethodGet:
+			w.Write([]byte(`{"type": "custom.googleapis.com/ttlcomponent/requests", "description": "requests"}`))
+		default:
+			io.Copy(w, r.Body)
+		}
+	}))
+	defer server.Close()
+	service, err := v3.New(server.Client())
+	if err != nil {
+		t.Fatalf("Failed to create Stackdriver client: %v", err)
+	}
+	service.BasePath = server.URL + "/"
+
+	sourceConfig := *commonConfig.SourceConfig
+	sourceConfig.Component = "ttlcomponent"
+	sourceConfig.MetricsPrefix = "custom.googleapis.com"
+	ttlConfig := *commonConfig
+	ttlConfig.SourceConfig = &sourceConfig
+	ttlConfig.DescriptorCacheTTL = 10 * time.Minute
+
+	now := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	cache := NewMetricDescriptorCache(service, &ttlConfig)
+	cache.now = func() time.Time { return now }
+	cache.descriptors["requests"] = &v3.MetricDescriptor{Type: "custom.googleapis.com/ttlcomponent/requests", Description: "requests"}
+	cache.fetched["requests"] = now
+	metrics := map[string]*dto.MetricFamily{
+		"requests": {Name: stringPtr("requests"), Help: stringPtr("requests"), Type: &metricTypeCounter},
+	}
+
+	now = now.Add(5 * time.Minute)
+	cache.UpdateMetricDescriptors(metrics, nil)
+	assert.Empty(t, requests, "descriptor shouldn't be fetched before the TTL")
+	assert.Equal(t, 1.0, descriptorCacheLookupsValue(t, "ttlcomponent", "hit"))
+
+	now = now.Add(6 * time.Minute)
+	cache.UpdateMetricDescriptors(metrics, nil)
+	assert.Equal(t, []string{http.MethodGet}, requests, "descriptor should be fetched after the TTL")
+	assert.Equal(t, 1.0, descriptorCacheLookupsValue(t, "ttlcomponent", "refresh"))
+	assert.Equal(t, now, cache.fetched["requests"])
+
+	requests = nil
+	deleted = true
+	now = now.Add(11 * time.Minute)
+	cache.UpdateMetricDescriptors(metrics, nil)
+	assert.Equal(t, []string{http.MethodGet, http.MethodPost}, requests, "descriptor deleted from Stackdriver should be recreated")
+	assert.Equal(t, 2.0, descriptorCacheLookupsValue(t, "ttlcomponent", "refresh"))
+	assert.Contains(t, cache.descriptors, "requests")
+	assert.False(t, cache.IsMetricBroken("requests"))
+}
+
+func TestUpdateMetricDescriptorsDoesNotRefreshCreated(t *testing.T) {
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method)
+		io.Copy(w, r.Body)
+	}))
+	defer server.Close()
+	service, err := v3.New(server.Client())
+	if err != nil {
+		t.Fatalf("Failed to create Stackdriver client: %v", err)
+	}
+	service.BasePath = server.URL + "/"
+
+	sourceConfig := *commonConfig.SourceConfig
+	sourceConfig.Component = "createdcomponent"
+	sourceConfig.MetricsPrefix = "custom.googleapis.com"
+	ttlConfig := *commonConfig
+	ttlConfig.SourceConfig = &sourceConfig
+	ttlConfig.DescriptorCacheTTL = 10 * time.Minute
+
+	now := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	cache := NewMetricDescriptorCache(service, &ttlConfig)
+	cache.now = func() time.Time { return now }
+	cache.fresh = true
+	metrics := map[string]*dto.MetricFamily{
+		"requests": {Name: stringPtr("requests"), Help: stringPtr("requests"), Type: &metricTypeCounter},
+	}
+
+	now = now.Add(time.Hour)
+	assert.NoError(t, cache.UpdateMetricDescriptors(metrics, nil))
+	assert.Equal(t, []string{http.MethodPost}, requests)
+	assert.Equal(t, now, cache.fetched["requests"])
+
+	requests = nil
+	cache.MarkStale()
+	now = now.Add(5 * time.Minute)
+	assert.NoError(t, cache.UpdateMetricDescriptors(metrics, nil))
+	assert.Empty(t, requests, "created descriptor shouldn't be fetched before the TTL")
+	assert.Equal(t, 0.0, descriptorCacheLookupsValue(t, "createdcomponent", "refresh"))
+	assert.Equal(t, 1.0, descriptorCacheLookupsValue(t, "createdcomponent", "hit"))
+	calls, _ := descriptorAPICallsValue(t, "createdcomponent", "get")
+	assert.Equal(t, 0.0, calls)
+}
+
+func descriptorAPICallsValue(t *testing.T, component, operation string) (calls, errors float64) {
+	metric := &dto.Metric{}
+	if err := descriptorAPICalls.WithLabelValues(component, operation).Write(metric); err != nil {
+		t.Fatalf("Failed to read descriptorAPICalls: %v", err)
+	}
+	calls = metric.GetCounter().GetValue()
+	if err := descriptorAPIErrors.WithLabelValues(component, operation).Write(metric); err != nil {
+		t.Fatalf("Failed to read descriptorAPIErrors: %v", err)
+	}
+	return calls, metric.GetCounter().GetValue()
+}
+
+func descriptorCacheEntriesValue(t *testing.T, component string) float64 {
+	metric := &dto.Metric{}
+	if err := descriptorCacheEntries.WithLabelValues(component).Write(metric); err != nil {
+		t.Fatalf("Failed to read descriptorCacheEntries: %v", err)
+	}
+	return metric.GetGauge().GetValue()
+}
+
+func TestMetricDescriptorCacheAPIMetrics(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/metricDescriptors"):
+			w.Write([]byte(`{"metricDescriptors": [{"type": "custom.googleapis.com/apicomponent/temperature"}]}`))
+		case r.Method == http.MethodGet:
+			w.Write([]byte(`{"type": "custom.googleapis.com/apicomponent/temperature"}`))
+		default:
+			descriptor := &v3.MetricDescriptor{}
+			if err := json.NewDecoder(r.Body).Decode(descriptor); err != nil {
+				t.Errorf("Failed to decode metric descriptor: %v", err)
+			}
+			if strings.HasSuffix(descriptor.Type, "/broken") {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"error": {"code": 400, "message": "invalid descriptor"}}`))
+				return
+			}
+			json.NewEncoder(w).Encode(descriptor)
+		}
+	}))
+	defer server.Close()
+	service, err := v3.New(server.Client())
+	if err != nil {
+		t.Fatalf("Failed to create Stackdriver client: %v", err)
+	}
+	service.BasePath = server.URL + "/"
+
+	sourceConfig := *commonConfig.SourceConfig
+	sourceConfig.Component = "apicomponent"
+	sourceConfig.MetricsPrefix = "custom.googleapis.com"
+	apiConfig := *commonConfig
+	apiConfig.SourceConfig = &sourceConfig
+	apiConfig.DescriptorCacheTTL = 10 * time.Minute
+
+	now := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	cache := NewMetricDescriptorCache(service, &apiConfig)
+	cache.now = func() time.Time { return now }
+
+	cache.Refresh()
+	calls, errors := descriptorAPICallsValue(t, "apicomponent", "list")
+	assert.Equal(t, 1.0, calls)
+	assert.Equal(t, 0.0, errors)
+	assert.Equal(t, 1.0, descriptorCacheEntriesValue(t, "apicomponent"))
+
+	cache.UpdateMetricDescriptors(map[string]*dto.MetricFamily{
+		"requests": {Name: stringPtr("requests"), Help: stringPtr("requests"), Type: &metricTypeCounter},
+		"broken":   {Name: stringPtr("broken"), Help: stringPtr("broken"), Type: &metricTypeCounter},
+	}, nil)
+	calls, errors = descriptorAPICallsValue(t, "apicomponent", "create")
+	assert.Equal(t, 2.0, calls, "descriptors of both new metrics should be created")
+	assert.Equal(t, 1.0, errors, "creation of the broken descriptor should fail")
+	assert.Equal(t, 2.0, descriptorCacheEntriesValue(t, "apicomponent"))
+
+	cache.MarkStale()
+	now = now.Add(11 * time.Minute)
+	cache.ValidateMetricDescriptors(map[string]*dto.MetricFamily{
+		"temperature": {Name: stringPtr("temperature"), Type: &metricTypeGauge},
+	}, nil)
+	calls, errors = descriptorAPICallsValue(t, "apicomponent", "get")
+	assert.Equal(t, 1.0, calls, "expired descriptor should be fetched during validation")
+	assert.Equal(t, 0.0, errors)
+}
+
+func TestUpdateMetricDescriptorsConcurrency(t *testing.T) {
+	var mutex sync.Mutex
+	inFlight, maxInFlight := 0, 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		mutex.Unlock()
+		defer func() {
+			mutex.Lock()
+			inFlight--
+			mutex.Unlock()
+		}()
+		time.Sleep(20 * time.Millisecond)
+
+		descriptor := &v3.MetricDescriptor{}
+		if err := json.NewDecoder(r.Body).Decode(descriptor); err != nil {
+			t.Errorf("Failed to decode metric descriptor: %v", err)
+		}
+		if strings.Contains(descriptor.Type, "/broken") {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error": {"code": 400, "message": "invalid descriptor"}}`))
+			return
+		}
+		json.NewEncoder(w).Encode(descriptor)
+	}))
+	defer server.Close()
+	service, err := v3.New(server.Client())
+	if err != nil {
+		t.Fatalf("Failed to create Stackdriver client: %v", err)
+	}
+	service.BasePath = server.URL + "/"
+
+	sourceConfig := *commonConfig.SourceConfig
+	sourceConfig.Component = "concurrentcomponent"
+	sourceConfig.MetricsPrefix = "custom.googleapis.com"
+	concurrentConfig := *commonConfig
+	concurrentConfig.SourceConfig = &sourceConfig
+	concurrentConfig.DescriptorUpdateConcurrency = 2
+
+	cache := NewMetricDescriptorCache(service, &concurrentConfig)
+	cache.fresh = true
+	metrics := make(map[string]*dto.MetricFamily)
+	for _, name := range []string{"first", "second", "third", "fourth", "broken_first", "broken_second"} {
+		metrics[name] = &dto.MetricFamily{Name: stringPtr(name), Help: stringPtr(name), Type: &metricTypeCounter}
+	}
+
+	err = cache.UpdateMetricDescriptors(metrics, nil)
+	assert.Equal(t, 2, maxInFlight, "no more than 2 descriptors should be updated at once")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "failed to update 2 metric descriptors")
+		assert.Contains(t, err.Error(), "broken_first")
+		assert.Contains(t, err.Error(), "broken_second")
+	}
+	assert.ElementsMatch(t, []string{"first", "second", "third", "fourth"}, cache.GetMetricNames())
+	assert.True(t, cache.IsMetricBroken("broken_first"))
+	assert.True(t, cache.IsMetricBroken("broken_second"))
+	calls, errors := descriptorAPICallsValue(t, "concurrentcomponent", "create")
+	assert.Equal(t, 6.0, calls)
+	assert.Equal(t, 2.0, errors)
+
+	delete(metrics, "broken_first")
+	delete(metrics, "broken_second")
+	assert.NoError(t, cache.UpdateMetricDescriptors(metrics, nil), "unchanged descriptors shouldn't be updated")
+	calls, _ = descriptorAPICallsValue(t, "concurrentcomponent", "create")
+	assert.Equal(t, 6.0, calls)
+}
+
+func TestUpdateMetricDescriptorsDescription(t *testing.T) {
+	var mutex sync.Mutex
+	created := make(map[string]string)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		descriptor := &v3.MetricDescriptor{}
+		if err := json.NewDecoder(r.Body).Decode(descriptor); err != nil {
+			t.Errorf("Failed to decode metric descriptor: %v", err)
+		}
+		mutex.Lock()
+		created[descriptor.Type] = descriptor.Description
+		mutex.Unlock()
+		json.NewEncoder(w).Encode(descriptor)
+	}))
+	defer server.Close()
+	service, err := v3.New(server.Client())
+	if err != nil {
+		t.Fatalf("Failed to create Stackdriver client: %v", err)
+	}
+	service.BasePath = server.URL + "/"
+
+	sourceConfig := *commonConfig.SourceConfig
+	sourceConfig.Component = "helpcomponent"
+	sourceConfig.MetricsPrefix = "custom.googleapis.com"
+	helpConfig := *commonConfig
+	helpConfig.SourceConfig = &sourceConfig
+	cache := NewMetricDescriptorCache(service, &helpConfig)
+	cache.fresh = true
+
+	// The multi-byte rune crossing the limit shouldn't be cut in the middle.
+	longHelp := strings.Repeat("a", maxDescriptionLength-4) + "é" + strings.Repeat("b", 100)
+	assert.NoError(t, cache.UpdateMetricDescriptors(map[string]*dto.MetricFamily{
+		"requests": {Name: stringPtr("requests"), Help: stringPtr("Number of requests."), Type: &metricTypeCounter},
+		"verbose":  {Name: stringPtr("verbose"), Help: stringPtr(longHelp), Type: &metricTypeGauge},
+	}, nil))
+
+	assert.Equal(t, "Number of requests.", created["custom.googleapis.com/helpcomponent/requests"], "help text should be the description")
+	truncated := created["custom.googleapis.com/helpcomponent/verbose"]
+	assert.Equal(t, strings.Repeat("a", maxDescriptionLength-4)+"...", truncated)
+	assert.True(t, len(truncated) <= maxDescriptionLength)
+	assert.Equal(t, truncated, cache.descriptors["verbose"].Description)
+
+	created = make(map[string]string)
+	cache.fresh = true
+	assert.NoError(t, cache.UpdateMetricDescriptors(map[string]*dto.MetricFamily{
+		"verbose": {Name: stringPtr("verbose"), Help: stringPtr(longHelp), Type: &metricTypeGauge},
+	}, nil))
+	assert.Empty(t, created, "truncated description shouldn't be seen as changed")
+}
+
+func TestUpdateMetricDescriptorsUnit(t *testing.T) {
+	var created []*v3.MetricDescriptor
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		descriptor := &v3.MetricDescriptor{}
+		if err := json.NewDecoder(r.Body).Decode(descriptor); err != nil {
+			t.Errorf("Failed to decode metric descriptor: %v", err)
+		}
+		created = append(created, descriptor)
+		json.NewEncoder(w).Encode(descriptor)
+	}))
+	defer server.Close()
+	service, err := v3.New(server.Client())
+	if err != nil {
+		t.Fatalf("Failed to create Stackdriver client: %v", err)
+	}
+	service.BasePath = server.URL + "/"
+
+	sourceConfig := *commonConfig.SourceConfig
+	sourceConfig.Component = "unitcomponent"
+	sourceConfig.MetricsPrefix = "custom.googleapis.com"
+	unitConfig := *commonConfig
+	unitConfig.SourceConfig = &sourceConfig
+	cache := NewMetricDescriptorCache(service, &unitConfig)
+	cache.descriptors["latency_seconds"] = &v3.MetricDescriptor{
+		Type:        "custom.googleapis.com/unitcomponent/latency_seconds",
+		Description: "Latency.",
+		MetricKind:  "GAUGE",
+		ValueType:   "INT64",
+	}
+	cache.fresh = true
+
+	assert.NoError(t, cache.UpdateMetricDescriptors(map[string]*dto.MetricFamily{
+		"latency_seconds": {Name: stringPtr("latency_seconds"), Help: stringPtr("Latency."), Type: &metricTypeGauge},
+	}, nil))
+	if assert.Equal(t, 1, len(created), "descriptor with a changed unit should be updated") {
+		assert.Equal(t, "s", created[0].Unit)
+	}
+	assert.Equal(t, "s", cache.descriptors["latency_seconds"].Unit)
+
+	created = nil
+	assert.NoError(t, cache.UpdateMetricDescriptors(map[string]*dto.MetricFamily{
+		"latency_seconds": {Name: stringPtr("latency_seconds"), Help: stringPtr("Latency."), Type: &metricTypeGauge},
+	}, nil))
+	assert.Empty(t, created, "unchanged descriptor shouldn't be updated")
+}
@@ -52,6 +52,118 @@ var (
 		},
 		[]string{"component_name", "metric_name"},
 	)
+
+	scrapeDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name: "scrape_duration_seconds",
+			Help: "Time of scraping the /metrics endpoint of the component, including reading of the response body",
+		},
+		[]string{"component_name"},
+	)
+
+	samplesDroppedInvalid = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "samples_dropped_invalid_total",
+			Help: "Number of samples dropped because their value was NaN or infinite, which Stackdriver doesn't accept",
+		},
+		[]string{"component_name"},
+	)
+
+	staleSamplesDropped = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "stale_samples_dropped_total",
+			Help: "Number of samples dropped because their value was the Prometheus stale marker",
+		},
+		[]string{"component_name"},
+	)
+
+	scrapeParseErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "scrape_parse_errors_total",
+			Help: "Number of malformed metric families skipped while parsing scraped responses",
+		},
+		[]string{"component_name"},
+	)
+
+	seriesTruncated = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "series_truncated_total",
+			Help: "Number of series dropped because the metric exceeded the limit of series per metric",
+		},
+		[]string{"component_name", "metric_name"},
+	)
+
+	metricFamiliesTruncated = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "metric_families_truncated_total",
+			Help: "Number of metric families dropped because the scrape exceeded the limit of metric families",
+		},
+		[]string{"component_name"},
+	)
+
+	labelValuesTruncated = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "label_values_truncated_total",
+			Help: "Number of label values truncated because they exceeded the maximal length",
+		},
+		[]string{"component_name"},
+	)
+
+	descriptorCacheLookups = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "descriptor_cache_lookups_total",
+			Help: "Number of lookups of metric descriptors in the cache, by result: hit, miss or refresh of an expired descriptor",
+		},
+		[]string{"component_name", "result"},
+	)
+
+	descriptorCacheEntries = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "descriptor_cache_entries",
+			Help: "Number of metric descriptors of the component kept in the cache",
+		},
+		[]string{"component_name"},
+	)
+
+	descriptorAPICalls = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "descriptor_api_calls_total",
+			Help: "Number of Stackdriver API calls made by the metric descriptor cache, by operation: list, get, create or delete",
+		},
+		[]string{"component_name", "operation"},
+	)
+
+	descriptorAPIErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "descriptor_api_errors_total",
+			Help: "Number of failed Stackdriver API calls made by the metric descriptor cache, by operation",
+		},
+		[]string{"component_name", "operation"},
+	)
+
+	scrapesServed = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "scrapes_served_total",
+			Help: "Number of successful scrapes of the component by the endpoint that served them, primary or fallback",
+		},
+		[]string{"component_name", "endpoint"},
+	)
+
+	servedStale = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "served_stale_total",
+			Help: "Number of failed scrapes replaced with the last successful response of the component",
+		},
+		[]string{"component_name"},
+	)
+
+	scrapePayloadBytes = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "scrape_payload_bytes",
+			Help: "Size of the last response body scraped from the /metrics endpoint of the component",
+		},
+		[]string{"component_name"},
+	)
 )
 
 func init() {
@@ -59,4 +171,18 @@ func init() {
 	prometheus.MustRegister(timeseriesPushed)
 	prometheus.MustRegister(timeseriesDropped)
 	prometheus.MustRegister(metricFamilyDropped)
+	prometheus.MustRegister(scrapeDuration)
+	prometheus.MustRegister(descriptorCacheLookups)
+	prometheus.MustRegister(descriptorCacheEntries)
+	prometheus.MustRegister(descriptorAPICalls)
+	prometheus.MustRegister(descriptorAPIErrors)
+	prometheus.MustRegister(servedStale)
+	prometheus.MustRegister(scrapesServed)
+	prometheus.MustRegister(scrapePayloadBytes)
+	prometheus.MustRegister(samplesDroppedInvalid)
+	prometheus.MustRegister(staleSamplesDropped)
+	prometheus.MustRegister(scrapeParseErrors)
+	prometheus.MustRegister(seriesTruncated)
+	prometheus.MustRegister(metricFamiliesTruncated)
+	prometheus.MustRegister(labelValuesTruncated)
 }
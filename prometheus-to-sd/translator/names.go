@@ -0,0 +1,123 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package translator
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/golang/glog"
+	"github.com/golang/protobuf/proto"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/GoogleCloudPlatform/k8s-stackdriver/prometheus-to-sd/config"
+)
+
+var (
+	// validName matches metric names and label keys accepted by Stackdriver.
+	validName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+	// invalidNameChars matches characters which are not allowed in metric names and label keys.
+	invalidNameChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+)
+
+// ValidateNames checks that metric names and label keys are accepted by Stackdriver. If sanitize is set,
+// invalid characters are replaced with "_", otherwise metrics and labels with invalid names are dropped.
+// Sanitized label keys colliding with another label of the series are handled according to the collision mode.
+func ValidateNames(metricFamilies map[string]*dto.MetricFamily, sanitize bool, collisions config.LabelCollisionMode) map[string]*dto.MetricFamily {
+	validate := func(kind, name string) string {
+		if validName.MatchString(name) {
+			return name
+		}
+		if sanitize {
+			return sanitizeName(name)
+		}
+		glog.Warningf("Dropping %s %q, its name is not accepted by Stackdriver", kind, name)
+		return ""
+	}
+	metricFamilies, _ = renameMetricFamilies(metricFamilies, func(name string) string {
+		return validate("metric", name)
+	})
+	delete(metricFamilies, "")
+	for name, family := range metricFamilies {
+		if !sanitize {
+			renameFamilyLabels(family, func(name string) string {
+				return validate("label", name)
+			})
+		} else if !sanitizeLabels(family, collisions) {
+			delete(metricFamilies, name)
+		}
+	}
+	return metricFamilies
+}
+
+// sanitizeLabels replaces invalid characters in the label keys of every series of the family. Returns false
+// if the family has to be dropped, because sanitized keys collide in the LabelCollisionDropMetric mode.
+func sanitizeLabels(family *dto.MetricFamily, collisions config.LabelCollisionMode) bool {
+	for _, metric := range family.Metric {
+		// Valid keys are kept as they are, so they take precedence over the sanitized ones.
+		taken := make(map[string]bool, len(metric.Label))
+		for _, label := range metric.Label {
+			if validName.MatchString(label.GetName()) {
+				taken[label.GetName()] = true
+			}
+		}
+		labels := make([]*dto.LabelPair, 0, len(metric.Label))
+		for _, label := range metric.Label {
+			name := label.GetName()
+			if !validName.MatchString(name) {
+				name = sanitizeName(name)
+				if taken[name] {
+					switch collisions {
+					case config.LabelCollisionDropMetric:
+						glog.Warningf("Dropping metric %s, its label %q collides with another label after sanitization to %s", family.GetName(), label.GetName(), name)
+						return false
+					case config.LabelCollisionSuffix:
+						suffixed := suffixedName(name, taken)
+						glog.Warningf("Label %q of metric %s collides with another label after sanitization to %s, renaming it to %s", label.GetName(), family.GetName(), name, suffixed)
+						name = suffixed
+					default:
+						glog.Warningf("Label %q of metric %s collides with another label after sanitization to %s, dropping it", label.GetName(), family.GetName(), name)
+						continue
+					}
+				}
+				taken[name] = true
+			}
+			labels = append(labels, &dto.LabelPair{Name: proto.String(name), Value: label.Value})
+		}
+		metric.Label = labels
+	}
+	return true
+}
+
+// suffixedName returns the name with the lowest numeric suffix, like "name_1", which isn't taken.
+func suffixedName(name string, taken map[string]bool) string {
+	for i := 1; ; i++ {
+		if suffixed := fmt.Sprintf("%s_%d", name, i); !taken[suffixed] {
+			return suffixed
+		}
+	}
+}
+
+// sanitizeName replaces characters not allowed by Stackdriver with "_". Names starting with a digit
+// are prefixed with "_".
+func sanitizeName(name string) string {
+	sanitized := invalidNameChars.ReplaceAllString(name, "_")
+	if sanitized == "" || (sanitized[0] >= '0' && sanitized[0] <= '9') {
+		sanitized = "_" + sanitized
+	}
+	return sanitized
+}
@@ -0,0 +1,149 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package translator
+
+import (
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/GoogleCloudPlatform/k8s-stackdriver/prometheus-to-sd/config"
+)
+
+// familiesWithInvalidNames creates metric families with names and label keys not accepted by Stackdriver.
+func familiesWithInvalidNames() map[string]*dto.MetricFamily {
+	families := familiesWithNames("valid_metric", "http.requests", "cache-hits", "5xx_errors")
+	families["valid_metric"].Metric = []*dto.Metric{
+		{
+			Label: []*dto.LabelPair{
+				{Name: stringPtr("code"), Value: stringPtr("200")},
+				{Name: stringPtr("k8s.pod"), Value: stringPtr("pod-1")},
+				{Name: stringPtr("1st-label"), Value: stringPtr("value")},
+			},
+		},
+	}
+	return families
+}
+
+func TestValidateNamesDropsInvalid(t *testing.T) {
+	metrics := ValidateNames(familiesWithInvalidNames(), false, config.LabelCollisionDropLabel)
+	assert.Equal(t, []string{"valid_metric"}, sortedNames(metrics))
+	assert.Equal(t, map[string]string{"code": "200"}, labelsOf(metrics["valid_metric"].Metric[0]))
+}
+
+func TestValidateNamesSanitizes(t *testing.T) {
+	metrics := ValidateNames(familiesWithInvalidNames(), true, config.LabelCollisionDropLabel)
+	assert.Equal(t, []string{"_5xx_errors", "cache_hits", "http_requests", "valid_metric"}, sortedNames(metrics))
+	assert.Equal(t, "http_requests", metrics["http_requests"].GetName())
+	assert.Equal(t, map[string]string{"code": "200", "k8s_pod": "pod-1", "_1st_label": "value"}, labelsOf(metrics["valid_metric"].Metric[0]))
+}
+
+// familiesWithCollidingLabels creates the metric family with label keys colliding after sanitization.
+func familiesWithCollidingLabels() map[string]*dto.MetricFamily {
+	families := familiesWithNames("requests", "latency")
+	families["requests"].Metric = []*dto.Metric{
+		{
+			Label: []*dto.LabelPair{
+				{Name: stringPtr("a-b"), Value: stringPtr("first")},
+				{Name: stringPtr("a.b"), Value: stringPtr("second")},
+				{Name: stringPtr("a_b_1"), Value: stringPtr("valid")},
+			},
+		},
+	}
+	families["latency"].Metric = []*dto.Metric{
+		{Label: []*dto.LabelPair{{Name: stringPtr("k8s.pod"), Value: stringPtr("pod-1")}}},
+	}
+	return families
+}
+
+func TestValidateNamesLabelCollisions(t *testing.T) {
+	testcases := []struct {
+		description string
+		mode        config.LabelCollisionMode
+		metrics     []string
+		labels      map[string]string
+	}{
+		{
+			description: "colliding label should be dropped by default",
+			mode:        "",
+			metrics:     []string{"latency", "requests"},
+			labels:      map[string]string{"a_b": "first", "a_b_1": "valid"},
+		},
+		{
+			description: "colliding label should be dropped",
+			mode:        config.LabelCollisionDropLabel,
+			metrics:     []string{"latency", "requests"},
+			labels:      map[string]string{"a_b": "first", "a_b_1": "valid"},
+		},
+		{
+			description: "metric with colliding labels should be dropped",
+			mode:        config.LabelCollisionDropMetric,
+			metrics:     []string{"latency"},
+		},
+		{
+			description: "colliding label should get the first free suffix",
+			mode:        config.LabelCollisionSuffix,
+			metrics:     []string{"latency", "requests"},
+			labels:      map[string]string{"a_b": "first", "a_b_2": "second", "a_b_1": "valid"},
+		},
+	}
+	for _, tc := range testcases {
+		metrics := ValidateNames(familiesWithCollidingLabels(), true, tc.mode)
+		assert.Equal(t, tc.metrics, sortedNames(metrics), tc.description)
+		assert.Equal(t, map[string]string{"k8s_pod": "pod-1"}, labelsOf(metrics["latency"].Metric[0]), tc.description)
+		if tc.labels != nil {
+			assert.Equal(t, tc.labels, labelsOf(metrics["requests"].Metric[0]), tc.description)
+		}
+	}
+}
+
+func TestValidateNamesSanitizedCollidingWithValid(t *testing.T) {
+	families := familiesWithNames("requests")
+	families["requests"].Metric = []*dto.Metric{
+		{
+			Label: []*dto.LabelPair{
+				{Name: stringPtr("a.b"), Value: stringPtr("sanitized")},
+				{Name: stringPtr("a_b"), Value: stringPtr("valid")},
+			},
+		},
+	}
+	metrics := ValidateNames(families, true, config.LabelCollisionSuffix)
+	assert.Equal(t, map[string]string{"a_b": "valid", "a_b_1": "sanitized"}, labelsOf(metrics["requests"].Metric[0]),
+		"valid label key should be kept even if it comes after the sanitized one")
+}
+
+func TestBuildKeepsNamesWithoutSanitizing(t *testing.T) {
+	response := &PrometheusResponse{rawResponse: `
+# TYPE job:requests:rate5m gauge
+job:requests:rate5m{code="200"} 3
+`}
+	sourceConfig := *commonConfig.SourceConfig
+	sourceConfig.Whitelisted = nil
+	cfg := *commonConfig
+	cfg.SourceConfig = &sourceConfig
+	metrics, err := response.Build(&cfg, buildCacheForTesting())
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"job:requests:rate5m"}, sortedNames(metrics), "names should be kept unless sanitizing is enabled")
+	}
+
+	cfg.SanitizeNames = true
+	metrics, err = response.Build(&cfg, buildCacheForTesting())
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"job_requests_rate5m"}, sortedNames(metrics))
+	}
+}
@@ -0,0 +1,567 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package translator
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/golang/protobuf/proto"
+	dto "github.com/prometheus/client_model/go"
+)
+
+const (
+	// openMetricsMediaType is the media type of the OpenMetrics text exposition format.
+	openMetricsMediaType = "application/openmetrics-text"
+	openMetricsEOF       = "# EOF"
+)
+
+// openMetricsSuffixes lists suffixes of the sample names allowed for each OpenMetrics metric type.
+var openMetricsSuffixes = map[string][]string{
+	"counter":        {"_total", "_created"},
+	"gauge":          {""},
+	"unknown":        {""},
+	"histogram":      {"_bucket", "_count", "_sum", "_created"},
+	"gaugehistogram": {"_bucket", "_gcount", "_gsum"},
+	"summary":        {"", "_count", "_sum", "_created"},
+	"info":           {"_info"},
+	"stateset":       {""},
+}
+
+// openMetricsFamily keeps the state of the metric family which is currently parsed.
+type openMetricsFamily struct {
+	name       string
+	metricType string
+	help       string
+	unit       string
+	// metrics are indexed by the label set signature, so histogram and summary samples
+	// with the same labels end up in one metric.
+	metrics map[string]*dto.Metric
+	order   []string
+	// exemplars of the histogram buckets of this family.
+	exemplars map[*dto.Bucket]*Exemplar
+}
+
+// openMetricsSample is a single parsed sample line.
+type openMetricsSample struct {
+	name        string
+	labels      []*dto.LabelPair
+	value       float64
+	timestampMs *int64
+	exemplar    *Exemplar
+}
+
+// Exemplar is an example observation attached to the sample, usually referring to a trace.
+type Exemplar struct {
+	Labels map[string]string
+	Value  float64
+	// TimestampMs is nil if the timestamp of the exemplar is not exposed.
+	TimestampMs *int64
+}
+
+// parseOpenMetrics parses metrics in the OpenMetrics text exposition format into metric families.
+// Counter families get the "_total" suffix, so they are named in the same way as in the Prometheus
+// text format. Info metrics, which get the "_info" suffix, become gauges of 1 with their labels, and
+// stateset metrics become gauges with a series per state.
+func parseOpenMetrics(in io.Reader) (map[string]*dto.MetricFamily, error) {
+	result, _, _, err := parseOpenMetricsWithMetadata(in)
+	return result, err
+}
+
+// parseOpenMetricsWithMetadata parses metrics in the OpenMetrics text exposition format, additionally returning
+// units of the metric families, converted to the Stackdriver notation, indexed by the family name, and
+// exemplars of the histogram buckets. Exemplars of other samples are not retained.
+func parseOpenMetricsWithMetadata(in io.Reader) (map[string]*dto.MetricFamily, map[string]string, map[*dto.Bucket]*Exemplar, error) {
+	result := make(map[string]*dto.MetricFamily)
+	units := make(map[string]string)
+	exemplars := make(map[*dto.Bucket]*Exemplar)
+	var current *openMetricsFamily
+	finish := func() error {
+		if current == nil {
+			return nil
+		}
+		family := current.toMetricFamily()
+		unit, familyExemplars := current.unit, current.exemplars
+		current = nil
+		if family == nil {
+			return nil
+		}
+		if _, found := result[family.GetName()]; found {
+			return fmt.Errorf("metric family %s is defined more than once", family.GetName())
+		}
+		result[family.GetName()] = family
+		if unit != "" {
+			units[family.GetName()] = stackdriverUnit(unit)
+		}
+		for bucket, exemplar := range familyExemplars {
+			exemplars[bucket] = exemplar
+		}
+		return nil
+	}
+
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	lineNum := 0
+	sawEOF := false
+	for scanner.Scan() {
+		lineNum++
+		line := scanner.Text()
+		if sawEOF {
+			return nil, nil, nil, fmt.Errorf("line %d: unexpected content after %q", lineNum, openMetricsEOF)
+		}
+		if line == openMetricsEOF {
+			sawEOF = true
+			continue
+		}
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			keyword, name, value, ok := parseOpenMetricsMetadata(line)
+			if !ok {
+				continue
+			}
+			if current == nil || current.name != name {
+				if err := finish(); err != nil {
+					return nil, nil, nil, err
+				}
+				current = newOpenMetricsFamily(name, "unknown")
+			}
+			switch keyword {
+			case "TYPE":
+				if _, found := openMetricsSuffixes[value]; !found {
+					return nil, nil, nil, fmt.Errorf("line %d: unknown metric type %q", lineNum, value)
+				}
+				current.metricType = value
+			case "HELP":
+				current.help = unescapeOpenMetrics(value)
+			case "UNIT":
+				current.unit = value
+			}
+			continue
+		}
+		sample, err := parseOpenMetricsSample(line)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("line %d: %v", lineNum, err)
+		}
+		if current == nil || !current.owns(sample.name) {
+			if err := finish(); err != nil {
+				return nil, nil, nil, err
+			}
+			current = newOpenMetricsFamily(sample.name, "unknown")
+		}
+		if err := current.addSample(sample); err != nil {
+			return nil, nil, nil, fmt.Errorf("line %d: %v", lineNum, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, nil, err
+	}
+	if !sawEOF {
+		return nil, nil, nil, fmt.Errorf("missing %q at the end of the OpenMetrics exposition", openMetricsEOF)
+	}
+	if err := finish(); err != nil {
+		return nil, nil, nil, err
+	}
+	return result, units, exemplars, nil
+}
+
+// openMetricsUnits maps the base units used by OpenMetrics to the UCUM notation used by Stackdriver.
+var openMetricsUnits = map[string]string{
+	"seconds": "s",
+	"bytes":   "By",
+	"meters":  "m",
+	"grams":   "g",
+	"joules":  "J",
+	"volts":   "V",
+	"amperes": "A",
+	"celsius": "Cel",
+	"ratio":   "1",
+}
+
+// stackdriverUnit converts the OpenMetrics unit, units without a known mapping are used as they are.
+func stackdriverUnit(unit string) string {
+	if converted, found := openMetricsUnits[unit]; found {
+		return converted
+	}
+	return unit
+}
+
+func newOpenMetricsFamily(name, metricType string) *openMetricsFamily {
+	return &openMetricsFamily{
+		name:       name,
+		metricType: metricType,
+		metrics:    make(map[string]*dto.Metric),
+		exemplars:  make(map[*dto.Bucket]*Exemplar),
+	}
+}
+
+// parseOpenMetricsMetadata parses "# KEYWORD name value" line. Lines which are not HELP, TYPE
+// or UNIT metadata are reported as not ok.
+func parseOpenMetricsMetadata(line string) (keyword, name, value string, ok bool) {
+	parts := strings.SplitN(strings.TrimPrefix(line, "# "), " ", 3)
+	if len(parts) < 2 {
+		return "", "", "", false
+	}
+	switch parts[0] {
+	case "HELP", "TYPE", "UNIT":
+	default:
+		return "", "", "", false
+	}
+	if len(parts) == 3 {
+		value = parts[2]
+	}
+	return parts[0], parts[1], value, true
+}
+
+// owns returns true if the sample with the given name belongs to this family.
+func (f *openMetricsFamily) owns(sampleName string) bool {
+	if !strings.HasPrefix(sampleName, f.name) {
+		return false
+	}
+	suffix := strings.TrimPrefix(sampleName, f.name)
+	for _, allowed := range openMetricsSuffixes[f.metricType] {
+		if suffix == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *openMetricsFamily) addSample(sample *openMetricsSample) error {
+	suffix := strings.TrimPrefix(sample.name, f.name)
+	labels := sample.labels
+	switch f.metricType {
+	case "counter":
+		if suffix == "_created" {
+			return nil
+		}
+		f.getMetric(labels, sample.timestampMs).Counter = &dto.Counter{Value: proto.Float64(sample.value)}
+	case "gauge":
+		f.getMetric(labels, sample.timestampMs).Gauge = &dto.Gauge{Value: proto.Float64(sample.value)}
+	case "unknown":
+		f.getMetric(labels, sample.timestampMs).Untyped = &dto.Untyped{Value: proto.Float64(sample.value)}
+	case "info":
+		// Info metrics carry the information in the labels, their value is always 1.
+		f.getMetric(labels, sample.timestampMs).Gauge = &dto.Gauge{Value: proto.Float64(1)}
+	case "stateset":
+		// Every state is a separate series, with the state in the label named like the family.
+		if _, _, found := extractLabel(labels, f.name); !found {
+			return fmt.Errorf("sample of stateset %s is missing the %s label", f.name, f.name)
+		}
+		f.getMetric(labels, sample.timestampMs).Gauge = &dto.Gauge{Value: proto.Float64(sample.value)}
+	case "histogram":
+		if suffix == "_created" {
+			return nil
+		}
+		var le string
+		if suffix == "_bucket" {
+			var found bool
+			if le, labels, found = extractLabel(labels, "le"); !found {
+				return fmt.Errorf("bucket of histogram %s is missing the le label", f.name)
+			}
+		}
+		metric := f.getMetric(labels, sample.timestampMs)
+		if metric.Histogram == nil {
+			metric.Histogram = &dto.Histogram{}
+		}
+		switch suffix {
+		case "_bucket":
+			upperBound, err := parseFloatLabel(le)
+			if err != nil {
+				return fmt.Errorf("invalid le label %q of histogram %s", le, f.name)
+			}
+			bucket := &dto.Bucket{
+				UpperBound:      proto.Float64(upperBound),
+				CumulativeCount: proto.Uint64(uint64(sample.value)),
+			}
+			metric.Histogram.Bucket = append(metric.Histogram.Bucket, bucket)
+			if sample.exemplar != nil {
+				f.exemplars[bucket] = sample.exemplar
+			}
+		case "_count":
+			metric.Histogram.SampleCount = proto.Uint64(uint64(sample.value))
+		case "_sum":
+			metric.Histogram.SampleSum = proto.Float64(sample.value)
+		}
+	case "summary":
+		if suffix == "_created" {
+			return nil
+		}
+		var quantile string
+		if suffix == "" {
+			var found bool
+			if quantile, labels, found = extractLabel(labels, "quantile"); !found {
+				return fmt.Errorf("sample of summary %s is missing the quantile label", f.name)
+			}
+		}
+		metric := f.getMetric(labels, sample.timestampMs)
+		if metric.Summary == nil {
+			metric.Summary = &dto.Summary{}
+		}
+		switch suffix {
+		case "":
+			q, err := parseFloatLabel(quantile)
+			if err != nil {
+				return fmt.Errorf("invalid quantile label %q of summary %s", quantile, f.name)
+			}
+			metric.Summary.Quantile = append(metric.Summary.Quantile, &dto.Quantile{
+				Quantile: proto.Float64(q),
+				Value:    proto.Float64(sample.value),
+			})
+		case "_count":
+			metric.Summary.SampleCount = proto.Uint64(uint64(sample.value))
+		case "_sum":
+			metric.Summary.SampleSum = proto.Float64(sample.value)
+		}
+	}
+	return nil
+}
+
+// getMetric returns the metric with the given label set, creating it if needed.
+func (f *openMetricsFamily) getMetric(labels []*dto.LabelPair, timestampMs *int64) *dto.Metric {
+	signature := labelsSignature(labels)
+	metric, found := f.metrics[signature]
+	if !found {
+		metric = &dto.Metric{Label: labels}
+		f.metrics[signature] = metric
+		f.order = append(f.order, signature)
+	}
+	if timestampMs != nil {
+		metric.TimestampMs = timestampMs
+	}
+	return metric
+}
+
+// toMetricFamily converts parsed family to the MetricFamily. Returns nil for families without
+// samples and families of types that can't be represented as MetricFamily.
+func (f *openMetricsFamily) toMetricFamily() *dto.MetricFamily {
+	if len(f.order) == 0 {
+		return nil
+	}
+	name := f.name
+	var metricType dto.MetricType
+	switch f.metricType {
+	case "counter":
+		name += "_total"
+		metricType = dto.MetricType_COUNTER
+	case "gauge", "stateset":
+		metricType = dto.MetricType_GAUGE
+	case "info":
+		// Named like info metrics exposed in the Prometheus text format.
+		name += "_info"
+		metricType = dto.MetricType_GAUGE
+	case "unknown":
+		metricType = dto.MetricType_UNTYPED
+	case "histogram":
+		metricType = dto.MetricType_HISTOGRAM
+	case "summary":
+		metricType = dto.MetricType_SUMMARY
+	default:
+		glog.V(2).Infof("Metric %s of OpenMetrics type %s is not supported, ignoring", f.name, f.metricType)
+		return nil
+	}
+	family := &dto.MetricFamily{
+		Name: &name,
+		Type: &metricType,
+	}
+	if f.help != "" {
+		help := f.help
+		family.Help = &help
+	}
+	for _, signature := range f.order {
+		family.Metric = append(family.Metric, f.metrics[signature])
+	}
+	return family
+}
+
+// parseOpenMetricsSample parses a sample line in format `name{labels} value [timestamp] [# exemplar]`.
+func parseOpenMetricsSample(line string) (*openMetricsSample, error) {
+	sample := &openMetricsSample{}
+	end := strings.IndexAny(line, "{ ")
+	if end <= 0 {
+		return nil, fmt.Errorf("invalid sample %q", line)
+	}
+	sample.name = line[:end]
+	rest := line[end:]
+	if strings.HasPrefix(rest, "{") {
+		labels, remaining, err := parseOpenMetricsLabels(rest)
+		if err != nil {
+			return nil, err
+		}
+		sample.labels = labels
+		rest = remaining
+	}
+	if !strings.HasPrefix(rest, " ") {
+		return nil, fmt.Errorf("missing value of sample %s", sample.name)
+	}
+	if i := strings.Index(rest, " # "); i >= 0 {
+		exemplar, err := parseOpenMetricsExemplar(rest[i+len(" # "):])
+		if err != nil {
+			return nil, fmt.Errorf("invalid exemplar of sample %s: %v", sample.name, err)
+		}
+		sample.exemplar = exemplar
+		rest = rest[:i]
+	}
+	fields := strings.Fields(rest)
+	if len(fields) < 1 || len(fields) > 2 {
+		return nil, fmt.Errorf("invalid value of sample %s: %q", sample.name, rest)
+	}
+	value, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value of sample %s: %v", sample.name, err)
+	}
+	sample.value = value
+	if len(fields) == 2 {
+		timestampMs, err := parseOpenMetricsTimestamp(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid timestamp of sample %s: %q", sample.name, fields[1])
+		}
+		sample.timestampMs = &timestampMs
+	}
+	return sample, nil
+}
+
+// parseOpenMetricsExemplar parses an exemplar in format `{labels} value [timestamp]`.
+func parseOpenMetricsExemplar(in string) (*Exemplar, error) {
+	if !strings.HasPrefix(in, "{") {
+		return nil, fmt.Errorf("missing label set in %q", in)
+	}
+	labels, rest, err := parseOpenMetricsLabels(in)
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(rest)
+	if len(fields) < 1 || len(fields) > 2 {
+		return nil, fmt.Errorf("invalid value %q", rest)
+	}
+	exemplar := &Exemplar{Labels: make(map[string]string, len(labels))}
+	for _, label := range labels {
+		exemplar.Labels[label.GetName()] = label.GetValue()
+	}
+	if exemplar.Value, err = strconv.ParseFloat(fields[0], 64); err != nil {
+		return nil, fmt.Errorf("invalid value %q", fields[0])
+	}
+	if len(fields) == 2 {
+		timestampMs, err := parseOpenMetricsTimestamp(fields[1])
+		if err != nil {
+			return nil, err
+		}
+		exemplar.TimestampMs = &timestampMs
+	}
+	return exemplar, nil
+}
+
+// parseOpenMetricsTimestamp parses timestamp expressed in seconds and returns it in milliseconds.
+func parseOpenMetricsTimestamp(in string) (int64, error) {
+	seconds, err := strconv.ParseFloat(in, 64)
+	if err != nil || math.IsNaN(seconds) || math.IsInf(seconds, 0) {
+		return 0, fmt.Errorf("invalid timestamp %q", in)
+	}
+	return int64(math.Round(seconds * 1000)), nil
+}
+
+// parseOpenMetricsLabels parses label set in format `{name="value",...}` at the beginning
+// of the input. Returns parsed labels and the remaining part of the input.
+func parseOpenMetricsLabels(in string) ([]*dto.LabelPair, string, error) {
+	var labels []*dto.LabelPair
+	i := 1
+	for {
+		if i >= len(in) {
+			return nil, "", fmt.Errorf("unterminated label set %q", in)
+		}
+		if in[i] == '}' {
+			return labels, in[i+1:], nil
+		}
+		eq := strings.IndexByte(in[i:], '=')
+		if eq <= 0 || i+eq+1 >= len(in) || in[i+eq+1] != '"' {
+			return nil, "", fmt.Errorf("invalid label set %q", in)
+		}
+		name := in[i : i+eq]
+		i += eq + 2
+		var value strings.Builder
+		for ; i < len(in) && in[i] != '"'; i++ {
+			if in[i] == '\\' && i+1 < len(in) {
+				i++
+				switch in[i] {
+				case 'n':
+					value.WriteByte('\n')
+				default:
+					value.WriteByte(in[i])
+				}
+				continue
+			}
+			value.WriteByte(in[i])
+		}
+		if i >= len(in) {
+			return nil, "", fmt.Errorf("unterminated value of label %s", name)
+		}
+		labels = append(labels, &dto.LabelPair{Name: proto.String(name), Value: proto.String(value.String())})
+		i++
+		if i < len(in) && in[i] == ',' {
+			i++
+		}
+	}
+}
+
+// parseFloatLabel parses the value of the le or quantile label. Parsing doesn't depend on the locale,
+// so only "." is accepted as the decimal separator, and it handles "+Inf" of the last histogram bucket
+// as well as the scientific notation. NaN is rejected, as it can't be used as a bound.
+func parseFloatLabel(value string) (float64, error) {
+	result, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil {
+		return 0, err
+	}
+	if math.IsNaN(result) {
+		return 0, fmt.Errorf("NaN is not a valid bound")
+	}
+	return result, nil
+}
+
+// extractLabel removes the label with the given name from the label set and returns its value.
+func extractLabel(labels []*dto.LabelPair, name string) (string, []*dto.LabelPair, bool) {
+	var remaining []*dto.LabelPair
+	value, found := "", false
+	for _, label := range labels {
+		if label.GetName() == name {
+			value, found = label.GetValue(), true
+		} else {
+			remaining = append(remaining, label)
+		}
+	}
+	return value, remaining, found
+}
+
+// labelsSignature returns the string uniquely identifying the label set.
+func labelsSignature(labels []*dto.LabelPair) string {
+	pairs := make([]string, 0, len(labels))
+	for _, label := range labels {
+		pairs = append(pairs, label.GetName()+"\xff"+label.GetValue())
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "\xfe")
+}
+
+func unescapeOpenMetrics(s string) string {
+	return strings.NewReplacer(`\\`, `\`, `\n`, "\n", `\"`, `"`).Replace(s)
+}
@@ -0,0 +1,376 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package translator
+
+import (
+	"math"
+	"strings"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/GoogleCloudPlatform/k8s-stackdriver/prometheus-to-sd/config"
+)
+
+const openMetricsResponse = `# TYPE requests counter
+# HELP requests Number of requests.
+requests_total{code="200"} 42.0 1520879607.789 # {trace_id="KOO5S4vxi0o"} 0.67
+requests_created{code="200"} 1520872607.123
+requests_total{code="500"} 3
+# TYPE temperature gauge
+temperature{room="kitchen \"main\""} -3.5
+# TYPE latency histogram
+latency_bucket{le="0.1"} 8 # {trace_id="oHg5SJYRHA0"} 0.05 1520879607.1
+latency_bucket{le="1.0"} 10
+latency_bucket{le="+Inf"} 11
+latency_count 11
+latency_sum 3.2
+# TYPE rpc summary
+rpc{quantile="0.5"} 0.2
+rpc{quantile="0.99"} 0.9
+rpc_count 17
+rpc_sum 5.1
+untyped_metric 7
+# EOF
+`
+
+func TestParseOpenMetrics(t *testing.T) {
+	families, err := parseOpenMetrics(strings.NewReader(openMetricsResponse))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, 5, len(families))
+
+	requests := families["requests_total"]
+	if assert.NotNil(t, requests, "counter family should have the _total suffix") {
+		assert.Equal(t, dto.MetricType_COUNTER, requests.GetType())
+		assert.Equal(t, "Number of requests.", requests.GetHelp())
+		assert.Equal(t, 2, len(requests.Metric))
+		assert.Equal(t, 42.0, requests.Metric[0].GetCounter().GetValue())
+		assert.Equal(t, int64(1520879607789), requests.Metric[0].GetTimestampMs())
+		assert.Equal(t, "200", requests.Metric[0].Label[0].GetValue())
+		assert.Equal(t, 3.0, requests.Metric[1].GetCounter().GetValue())
+		assert.Nil(t, requests.Metric[1].TimestampMs)
+	}
+
+	temperature := families["temperature"]
+	if assert.NotNil(t, temperature) {
+		assert.Equal(t, dto.MetricType_GAUGE, temperature.GetType())
+		assert.Equal(t, -3.5, temperature.Metric[0].GetGauge().GetValue())
+		assert.Equal(t, `kitchen "main"`, temperature.Metric[0].Label[0].GetValue())
+	}
+
+	latency := families["latency"]
+	if assert.NotNil(t, latency) {
+		assert.Equal(t, dto.MetricType_HISTOGRAM, latency.GetType())
+		assert.Equal(t, 1, len(latency.Metric))
+		histogram := latency.Metric[0].GetHistogram()
+		assert.Equal(t, uint64(11), histogram.GetSampleCount())
+		assert.Equal(t, 3.2, histogram.GetSampleSum())
+		assert.Equal(t, 3, len(histogram.Bucket))
+		assert.Equal(t, 0.1, histogram.Bucket[0].GetUpperBound())
+		assert.Equal(t, uint64(8), histogram.Bucket[0].GetCumulativeCount())
+		assert.True(t, math.IsInf(histogram.Bucket[2].GetUpperBound(), 1))
+		assert.Empty(t, latency.Metric[0].Label, "le label should be removed")
+	}
+
+	rpc := families["rpc"]
+	if assert.NotNil(t, rpc) {
+		assert.Equal(t, dto.MetricType_SUMMARY, rpc.GetType())
+		summary := rpc.Metric[0].GetSummary()
+		assert.Equal(t, uint64(17), summary.GetSampleCount())
+		assert.Equal(t, 5.1, summary.GetSampleSum())
+		assert.Equal(t, 2, len(summary.Quantile))
+	}
+
+	untyped := families["untyped_metric"]
+	if assert.NotNil(t, untyped) {
+		assert.Equal(t, dto.MetricType_UNTYPED, untyped.GetType())
+		assert.Equal(t, 7.0, untyped.Metric[0].GetUntyped().GetValue())
+	}
+}
+
+func TestParseOpenMetricsInfoAndStateset(t *testing.T) {
+	families, err := parseOpenMetrics(strings.NewReader(`# TYPE build info
+# HELP build Build information.
+build_info{version="1.2.3",revision="abc"} 1
+# TYPE feature stateset
+feature{env="prod",feature="enabled"} 1
+feature{env="prod",feature="disabled"} 0
+# EOF
+`))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, []string{"build_info", "feature"}, sortedNames(families))
+
+	build := families["build_info"]
+	assert.Equal(t, "build_info", build.GetName(), "info family should have the _info suffix")
+	assert.Equal(t, dto.MetricType_GAUGE, build.GetType())
+	assert.Equal(t, "Build information.", build.GetHelp())
+	if assert.Equal(t, 1, len(build.Metric)) {
+		assert.Equal(t, 1.0, build.Metric[0].GetGauge().GetValue())
+		assert.Equal(t, map[string]string{"version": "1.2.3", "revision": "abc"}, labelsOf(build.Metric[0]))
+	}
+
+	feature := families["feature"]
+	assert.Equal(t, dto.MetricType_GAUGE, feature.GetType())
+	if assert.Equal(t, 2, len(feature.Metric), "every state should be a separate series") {
+		assert.Equal(t, map[string]string{"env": "prod", "feature": "enabled"}, labelsOf(feature.Metric[0]))
+		assert.Equal(t, 1.0, feature.Metric[0].GetGauge().GetValue())
+		assert.Equal(t, map[string]string{"env": "prod", "feature": "disabled"}, labelsOf(feature.Metric[1]))
+		assert.Equal(t, 0.0, feature.Metric[1].GetGauge().GetValue())
+	}
+}
+
+func TestBuildOpenMetricsInfo(t *testing.T) {
+	response := &PrometheusResponse{
+		rawResponse: "# TYPE build info\nbuild_info{version=\"1.2.3\"} 1\n# EOF\n",
+		contentType: "application/openmetrics-text; version=0.0.1; charset=utf-8",
+	}
+	families, err := response.Build(commonConfig, buildCacheForTesting())
+	if assert.NoError(t, err) && assert.Contains(t, families, "build_info") {
+		assert.Equal(t, map[string]string{"version": "1.2.3"}, labelsOf(families["build_info"].Metric[0]))
+	}
+}
+
+func TestParseOpenMetricsFormatOverridesContentType(t *testing.T) {
+	response := &PrometheusResponse{rawResponse: openMetricsResponse, contentType: "text/plain; version=0.0.4", format: config.FormatOpenMetrics}
+	metrics, err := response.parse()
+	if assert.NoError(t, err) {
+		assert.Equal(t, dto.MetricType_COUNTER, metrics["requests"].GetType(), "response should be parsed as OpenMetrics")
+	}
+}
+
+func TestParseOpenMetricsErrors(t *testing.T) {
+	testcases := map[string]string{
+		"missing EOF":            "# TYPE a gauge\na 1\n",
+		"content after EOF":      "# TYPE a gauge\na 1\n# EOF\nb 2\n",
+		"unknown type":           "# TYPE a foo\na 1\n# EOF\n",
+		"invalid value":          "# TYPE a gauge\na abc\n# EOF\n",
+		"bucket without le":      "# TYPE a histogram\na_bucket 1\n# EOF\n",
+		"unterminated labels":    "# TYPE a gauge\na{b=\"c\" 1\n# EOF\n",
+		"duplicated family":      "# TYPE a gauge\na 1\n# TYPE b gauge\nb 1\n# TYPE a gauge\na 2\n# EOF\n",
+		"invalid timestamp":      "# TYPE a gauge\na 1 abc\n# EOF\n",
+		"summary missing label":  "# TYPE a summary\na 1\n# EOF\n",
+		"stateset missing state": "# TYPE a stateset\na{b=\"c\"} 1\n# EOF\n",
+	}
+	for description, input := range testcases {
+		t.Run(description, func(t *testing.T) {
+			_, err := parseOpenMetrics(strings.NewReader(input))
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestBuildOpenMetrics(t *testing.T) {
+	response := &PrometheusResponse{
+		rawResponse: openMetricsResponse,
+		contentType: "application/openmetrics-text; version=0.0.1; charset=utf-8",
+	}
+	families, err := response.Build(commonConfig, buildCacheForTesting())
+	if assert.NoError(t, err) {
+		assert.Contains(t, families, "requests_total")
+		assert.Contains(t, families, "latency")
+	}
+
+	response.contentType = "text/plain; version=0.0.4"
+	_, _, parseErrors, err := response.parsePartially()
+	assert.True(t, err != nil || parseErrors > 0, "OpenMetrics response should not be fully accepted by the Prometheus text parser")
+}
+
+func TestOpenMetricsUnits(t *testing.T) {
+	response := &PrometheusResponse{
+		rawResponse: `# TYPE request_duration_seconds histogram
+# UNIT request_duration_seconds seconds
+request_duration_seconds_bucket{le="+Inf"} 1
+request_duration_seconds_count 1
+request_duration_seconds_sum 0.5
+# TYPE memory gauge
+# UNIT memory bytes
+memory 1024
+# TYPE queue_fill gauge
+# UNIT queue_fill ratio
+queue_fill 0.3
+# TYPE temperature gauge
+# UNIT temperature kelvin
+temperature 300
+# TYPE uptime_seconds gauge
+uptime_seconds 10
+# EOF
+`,
+		contentType: "application/openmetrics-text; version=0.0.1",
+	}
+	sourceConfig := *commonConfig.SourceConfig
+	sourceConfig.Whitelisted = nil
+	config := *commonConfig
+	config.SourceConfig = &sourceConfig
+	config.OmitComponentName = true
+	sourceConfig.Component = "request"
+
+	cache := NewMetricDescriptorCache(nil, &config)
+	descriptors, err := response.PlanMetricDescriptors(&config, cache)
+	if !assert.NoError(t, err) {
+		return
+	}
+	units := make(map[string]string)
+	for _, descriptor := range descriptors {
+		units[descriptor.Type] = descriptor.Unit
+	}
+	assert.Equal(t, map[string]string{
+		// Explicit unit is kept although the family was renamed.
+		"container.googleapis.com/master/request/duration_seconds": "s",
+		"container.googleapis.com/master/request/memory":           "By",
+		"container.googleapis.com/master/request/queue_fill":       "1",
+		"container.googleapis.com/master/request/temperature":      "kelvin",
+		// Unit inferred from the name.
+		"container.googleapis.com/master/request/uptime_seconds": "s",
+	}, units)
+}
+
+func TestParseOpenMetricsExemplars(t *testing.T) {
+	families, _, exemplars, err := parseOpenMetricsWithMetadata(strings.NewReader(openMetricsResponse))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, 1, len(exemplars), "only exemplars of histogram buckets should be retained")
+	buckets := families["latency"].Metric[0].GetHistogram().Bucket
+	timestampMs := int64(1520879607100)
+	assert.Equal(t, &Exemplar{
+		Labels:      map[string]string{"trace_id": "oHg5SJYRHA0"},
+		Value:       0.05,
+		TimestampMs: &timestampMs,
+	}, exemplars[buckets[0]])
+	assert.Nil(t, exemplars[buckets[1]])
+}
+
+func TestParseOpenMetricsInvalidExemplars(t *testing.T) {
+	testcases := map[string]string{
+		"missing labels":      "# TYPE a histogram\na_bucket{le=\"+Inf\"} 1 # 0.5\na_count 1\n# EOF\n",
+		"missing value":       "# TYPE a histogram\na_bucket{le=\"+Inf\"} 1 # {trace_id=\"x\"}\na_count 1\n# EOF\n",
+		"invalid value":       "# TYPE a histogram\na_bucket{le=\"+Inf\"} 1 # {trace_id=\"x\"} abc\na_count 1\n# EOF\n",
+		"invalid timestamp":   "# TYPE a histogram\na_bucket{le=\"+Inf\"} 1 # {trace_id=\"x\"} 1 abc\na_count 1\n# EOF\n",
+		"unterminated labels": "# TYPE a histogram\na_bucket{le=\"+Inf\"} 1 # {trace_id=\"x 1\na_count 1\n# EOF\n",
+	}
+	for description, input := range testcases {
+		t.Run(description, func(t *testing.T) {
+			_, err := parseOpenMetrics(strings.NewReader(input))
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestBuildRetainsExemplars(t *testing.T) {
+	response := &PrometheusResponse{
+		rawResponse: `# TYPE latency histogram
+latency_bucket{le="0.1"} 1 # {trace_id="KOO5S4vxi0o"} 0.07
+latency_bucket{le="+Inf"} 2
+latency_count 2
+latency_sum 0.6
+# EOF
+`,
+		contentType: "application/openmetrics-text; version=0.0.1",
+	}
+	sourceConfig := *commonConfig.SourceConfig
+	sourceConfig.Whitelisted = nil
+	config := *commonConfig
+	config.SourceConfig = &sourceConfig
+	config.DryRun = true
+
+	families, err := response.Build(&config, buildCacheForTesting())
+	if !assert.NoError(t, err) || !assert.Contains(t, families, "latency") {
+		return
+	}
+	bucket := families["latency"].Metric[0].GetHistogram().Bucket[0]
+	if exemplar := response.Exemplars()[bucket]; assert.NotNil(t, exemplar) {
+		assert.Equal(t, "KOO5S4vxi0o", exemplar.Labels["trace_id"])
+		assert.Equal(t, 0.07, exemplar.Value)
+		assert.Nil(t, exemplar.TimestampMs)
+	}
+}
+
+func TestParseFloatLabel(t *testing.T) {
+	testcases := map[string]float64{
+		"+Inf":    math.Inf(1),
+		"-Inf":    math.Inf(-1),
+		"0.99":    0.99,
+		"1e-3":    0.001,
+		"2.5E+02": 250,
+		" 0.5 ":   0.5,
+		"10":      10,
+	}
+	for value, want := range testcases {
+		got, err := parseFloatLabel(value)
+		if assert.NoError(t, err, value) {
+			assert.Equal(t, want, got, value)
+		}
+	}
+	for _, value := range []string{"0,99", "NaN", "", "1e"} {
+		_, err := parseFloatLabel(value)
+		assert.Error(t, err, value)
+	}
+}
+
+func TestParseBucketAndQuantileLabels(t *testing.T) {
+	const openMetrics = `# TYPE latency histogram
+latency_bucket{le="1e-3"} 1
+latency_bucket{le="0.99"} 2
+latency_bucket{le="2.5e+01"} 3
+latency_bucket{le="+Inf"} 4
+latency_count 4
+latency_sum 30
+# TYPE rpc summary
+rpc{quantile="0.99"} 0.9
+rpc{quantile="9.9e-1"} 0.9
+rpc_count 1
+rpc_sum 0.9
+# EOF
+`
+	const text = `# TYPE latency histogram
+latency_bucket{le="1e-3"} 1
+latency_bucket{le="0.99"} 2
+latency_bucket{le="2.5e+01"} 3
+latency_bucket{le="+Inf"} 4
+latency_count 4
+latency_sum 30
+# TYPE rpc summary
+rpc{quantile="0.99"} 0.9
+rpc_count 1
+rpc_sum 0.9
+`
+	responses := map[string]*PrometheusResponse{
+		"openmetrics": {rawResponse: openMetrics, contentType: "application/openmetrics-text; version=0.0.1"},
+		"text":        {rawResponse: text, contentType: "text/plain; version=0.0.4"},
+	}
+	for format, response := range responses {
+		t.Run(format, func(t *testing.T) {
+			families, err := response.parse()
+			if !assert.NoError(t, err) {
+				return
+			}
+			var bounds []float64
+			for _, bucket := range families["latency"].Metric[0].GetHistogram().Bucket {
+				bounds = append(bounds, bucket.GetUpperBound())
+			}
+			assert.Equal(t, []float64{0.001, 0.99, 25, math.Inf(1)}, bounds)
+			for _, quantile := range families["rpc"].Metric[0].GetSummary().Quantile {
+				assert.Equal(t, 0.99, quantile.GetQuantile())
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package translator
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/k8s-stackdriver/prometheus-to-sd/config"
+)
+
+// resolver resolves hosts of the sources scraped with PinResolvedHost.
+type resolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+var hostResolver resolver = net.DefaultResolver
+
+// pinnedHostKey is the context key of the pinnedHost used by the scrape.
+type pinnedHostKey struct{}
+
+// pinnedHost is the address the host was resolved to at the beginning of the scrape.
+type pinnedHost struct {
+	host    string
+	address string
+}
+
+// withPinnedHost resolves the host of the source once, so that all attempts of the scrape connect to the same
+// address even if the host resolves to several ones. The context is returned unchanged if pinning is disabled
+// or the host is an IP address.
+func withPinnedHost(ctx context.Context, config *config.SourceConfig) (context.Context, error) {
+	host := strings.Trim(config.Host, "[]")
+	if _, ok := config.UnixSocket(); !config.PinResolvedHost || ok || net.ParseIP(host) != nil {
+		return ctx, nil
+	}
+	addresses, err := lookupHost(ctx, host)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve host %s of component %v: %v", host, config.Component, err)
+	}
+	if len(addresses) == 0 {
+		return nil, fmt.Errorf("host %s of component %v resolved to no addresses", host, config.Component)
+	}
+	loggerFor(config).Debug(4, "Host pinned for the scrape", "component", config.Component, "host", host, "address", addresses[0])
+	return context.WithValue(ctx, pinnedHostKey{}, pinnedHost{host: host, address: addresses[0]}), nil
+}
+
+// pinningDialContext dials the address pinned for the scrape instead of resolving the host again.
+// Connections to other hosts, e.g. to the proxy, are dialed as usual, through the DNS cache if it's enabled.
+func pinningDialContext(dialer *net.Dialer) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if pinned, ok := ctx.Value(pinnedHostKey{}).(pinnedHost); ok {
+			if host, port, err := net.SplitHostPort(addr); err == nil && host == pinned.host {
+				return dialer.DialContext(ctx, network, net.JoinHostPort(pinned.address, port))
+			}
+		}
+		return dialCached(ctx, dialer, network, addr)
+	}
+}
@@ -0,0 +1,108 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package translator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/GoogleCloudPlatform/k8s-stackdriver/prometheus-to-sd/config"
+)
+
+// stubResolver resolves every host to the configured addresses and counts the lookups.
+type stubResolver struct {
+	addresses []string
+	err       error
+	lookups   int
+}
+
+func (r *stubResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	r.lookups++
+	return r.addresses, r.err
+}
+
+func withStubResolver(t *testing.T, stub *stubResolver) {
+	original := hostResolver
+	hostResolver = stub
+	t.Cleanup(func() { hostResolver = original })
+}
+
+func TestGetPrometheusMetricsPinResolvedHost(t *testing.T) {
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, testMetricsBody)
+	}))
+	defer server.Close()
+	// Only the first address accepts connections, the test server listens on 127.0.0.1.
+	stub := &stubResolver{addresses: []string{"127.0.0.1", "127.0.0.2"}}
+	withStubResolver(t, stub)
+
+	sourceConfig := sourceConfigForServer(t, server, "pinned-host")
+	sourceConfig.Host = "metrics.pinned.test"
+	sourceConfig.PinResolvedHost = true
+	sourceConfig.ScrapeRetries = 2
+	sourceConfig.ScrapeRetryBackoff = time.Millisecond
+	response, err := GetPrometheusMetrics(sourceConfig)
+	if assert.NoError(t, err) {
+		assert.Equal(t, testMetricsBody, response.Raw())
+	}
+	assert.Equal(t, 2, attempts)
+	assert.Equal(t, 1, stub.lookups, "host should be resolved once per scrape")
+	assert.Equal(t, 1.0, componentMetricsAvailableValue(t, "pinned-host"))
+}
+
+func TestGetPrometheusMetricsPinResolvedHostFailure(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, testMetricsBody)
+	}))
+	defer server.Close()
+	withStubResolver(t, &stubResolver{err: errors.New("no such host")})
+
+	sourceConfig := sourceConfigForServer(t, server, "pinned-host-failure")
+	sourceConfig.Host = "metrics.pinned.test"
+	sourceConfig.PinResolvedHost = true
+	_, err := GetPrometheusMetrics(sourceConfig)
+	assert.Error(t, err)
+	assert.Equal(t, 0.0, componentMetricsAvailableValue(t, "pinned-host-failure"))
+
+	withStubResolver(t, &stubResolver{})
+	_, err = GetPrometheusMetrics(sourceConfig)
+	assert.Error(t, err, "host resolved to no addresses should fail the scrape")
+}
+
+func TestWithPinnedHostSkipsIPAddresses(t *testing.T) {
+	stub := &stubResolver{addresses: []string{"10.0.0.1"}}
+	withStubResolver(t, stub)
+
+	sourceConfig := &config.SourceConfig{Component: "ip", Host: "::1", PinResolvedHost: true}
+	ctx, err := withPinnedHost(context.Background(), sourceConfig)
+	assert.NoError(t, err)
+	assert.Nil(t, ctx.Value(pinnedHostKey{}))
+	assert.Equal(t, 0, stub.lookups)
+}
@@ -0,0 +1,73 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package translator
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/k8s-stackdriver/prometheus-to-sd/config"
+)
+
+// defaultProbeTimeout is used when the source config doesn't specify its own probe timeout.
+const defaultProbeTimeout = time.Second
+
+// probeTarget connects to the target of the source, and performs the TLS handshake for https sources, to check
+// that it's reachable before the scrape. The probe is skipped for sources scraped through a proxy, as the target
+// may not be reachable directly.
+func probeTarget(ctx context.Context, config *config.SourceConfig) error {
+	if config.ProxyURL != "" {
+		loggerFor(config).Debug(4, "Skipping connectivity probe of the target scraped through a proxy", "component", config.Component)
+		return nil
+	}
+	timeout := config.ProbeTimeout
+	if timeout == 0 {
+		timeout = defaultProbeTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	host := strings.Trim(config.Host, "[]")
+	network, addr := "tcp", net.JoinHostPort(host, strconv.FormatUint(uint64(config.Port), 10))
+	if socket, ok := config.UnixSocket(); ok {
+		network, addr = "unix", socket
+	}
+	conn, err := pinningDialContext(&net.Dialer{})(ctx, network, addr)
+	if err != nil {
+		return fmt.Errorf("target %s of component %v unreachable: %v", addr, config.Component, err)
+	}
+	defer conn.Close()
+	if config.Scheme != "https" {
+		return nil
+	}
+	tlsConfig, err := newTLSConfig(config)
+	if err != nil {
+		return err
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = host
+	}
+	if err := tls.Client(conn, tlsConfig).HandshakeContext(ctx); err != nil {
+		return fmt.Errorf("TLS handshake with target %s of component %v failed: %v", addr, config.Component, err)
+	}
+	return nil
+}
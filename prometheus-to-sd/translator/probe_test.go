@@ -0,0 +1,82 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package translator
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetPrometheusMetricsProbeReachable(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, testMetricsBody)
+	}))
+	defer server.Close()
+
+	sourceConfig := sourceConfigForServer(t, server, "probe-reachable")
+	sourceConfig.ProbeBeforeScrape = true
+	response, err := GetPrometheusMetrics(sourceConfig)
+	if assert.NoError(t, err) {
+		assert.Equal(t, testMetricsBody, response.rawResponse)
+	}
+	assert.Equal(t, 1.0, componentMetricsAvailableValue(t, "probe-reachable"))
+}
+
+func TestGetPrometheusMetricsProbeUnreachable(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	sourceConfig := sourceConfigForServer(t, server, "probe-unreachable")
+	server.Close()
+
+	sourceConfig.ProbeBeforeScrape = true
+	sourceConfig.ProbeTimeout = 100 * time.Millisecond
+	sourceConfig.ScrapeRetries = 3
+	_, err := GetPrometheusMetrics(sourceConfig)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "unreachable")
+		assert.NotContains(t, err.Error(), "attempts", "unreachable target shouldn't be scraped")
+	}
+	assert.Equal(t, 0.0, componentMetricsAvailableValue(t, "probe-unreachable"))
+}
+
+func TestGetPrometheusMetricsProbeTLS(t *testing.T) {
+	var scrapes int32
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&scrapes, 1)
+		fmt.Fprint(w, testMetricsBody)
+	}))
+	defer server.Close()
+
+	sourceConfig := sourceConfigForServer(t, server, "probe-tls")
+	sourceConfig.Scheme = "https"
+	sourceConfig.ProbeBeforeScrape = true
+	_, err := GetPrometheusMetrics(sourceConfig)
+	if assert.Error(t, err, "self-signed certificate should be rejected by the probe") {
+		assert.Contains(t, err.Error(), "TLS handshake")
+	}
+	assert.Equal(t, int32(0), atomic.LoadInt32(&scrapes))
+
+	sourceConfig.InsecureSkipVerify = true
+	_, err = GetPrometheusMetrics(sourceConfig)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&scrapes))
+}
@@ -0,0 +1,94 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package translator
+
+import (
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/GoogleCloudPlatform/k8s-stackdriver/prometheus-to-sd/config"
+)
+
+// OmitComponentNameProcessor returns the processor removing the component name prefix from the metric names.
+func OmitComponentNameProcessor(componentName string) config.FamilyProcessor {
+	return config.FamilyProcessorFunc(func(metrics map[string]*dto.MetricFamily) (map[string]*dto.MetricFamily, error) {
+		return OmitComponentName(metrics, componentName), nil
+	})
+}
+
+// OmitDerivedComponentNameProcessor is the processor removing the component name derived from the metric
+// names by DeriveComponentName, for sources with an unknown component name.
+var OmitDerivedComponentNameProcessor config.FamilyProcessor = config.FamilyProcessorFunc(
+	func(metrics map[string]*dto.MetricFamily) (map[string]*dto.MetricFamily, error) {
+		return OmitComponentName(metrics, DeriveComponentName(metrics)), nil
+	})
+
+// StripPrefixAndSuffixProcessor returns the processor removing the prefix and the suffix from the metric names.
+func StripPrefixAndSuffixProcessor(prefix, suffix string) config.FamilyProcessor {
+	return config.FamilyProcessorFunc(func(metrics map[string]*dto.MetricFamily) (map[string]*dto.MetricFamily, error) {
+		return StripPrefixAndSuffix(metrics, prefix, suffix), nil
+	})
+}
+
+// DowncaseMetricNamesProcessor is the processor downcasing the metric names.
+var DowncaseMetricNamesProcessor config.FamilyProcessor = config.FamilyProcessorFunc(
+	func(metrics map[string]*dto.MetricFamily) (map[string]*dto.MetricFamily, error) {
+		return DowncaseMetricNames(metrics), nil
+	})
+
+// FlattenSummaryProcessor is the processor flattening summary metric families into counters and
+// a gauge per quantile.
+var FlattenSummaryProcessor config.FamilyProcessor = config.FamilyProcessorFunc(
+	func(metrics map[string]*dto.MetricFamily) (map[string]*dto.MetricFamily, error) {
+		return FlattenSummaryMetricFamilies(metrics), nil
+	})
+
+// FlattenSummaryQuantileAsLabelProcessor is the processor flattening summary metric families into counters,
+// keeping the quantiles in a single gauge with the quantile label.
+var FlattenSummaryQuantileAsLabelProcessor config.FamilyProcessor = config.FamilyProcessorFunc(
+	func(metrics map[string]*dto.MetricFamily) (map[string]*dto.MetricFamily, error) {
+		return FlattenSummaryMetricFamiliesQuantileAsLabel(metrics), nil
+	})
+
+// nameProcessors returns the built-in processors of the metric names enabled in the config.
+func nameProcessors(commonConfig *config.CommonConfig) []config.FamilyProcessor {
+	var processors []config.FamilyProcessor
+	if commonConfig.OmitComponentName {
+		if commonConfig.SourceConfig.Component == "" && commonConfig.DeriveComponentName {
+			processors = append(processors, OmitDerivedComponentNameProcessor)
+		} else {
+			processors = append(processors, OmitComponentNameProcessor(commonConfig.SourceConfig.Component))
+		}
+	}
+	if commonConfig.StripPrefix != "" || commonConfig.StripSuffix != "" {
+		processors = append(processors, StripPrefixAndSuffixProcessor(commonConfig.StripPrefix, commonConfig.StripSuffix))
+	}
+	if commonConfig.DowncaseMetricNames {
+		processors = append(processors, DowncaseMetricNamesProcessor)
+	}
+	return processors
+}
+
+// runFamilyProcessors runs the processors in order, passing the result of each one to the next.
+func runFamilyProcessors(metrics map[string]*dto.MetricFamily, processors []config.FamilyProcessor) (map[string]*dto.MetricFamily, error) {
+	for _, processor := range processors {
+		var err error
+		if metrics, err = processor.Process(metrics); err != nil {
+			return nil, err
+		}
+	}
+	return metrics, nil
+}
@@ -0,0 +1,93 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package translator
+
+import (
+	"errors"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/GoogleCloudPlatform/k8s-stackdriver/prometheus-to-sd/config"
+)
+
+// errorRatio computes the ratio of failed requests from the requests and errors counters.
+var errorRatio = config.FamilyProcessorFunc(func(metrics map[string]*dto.MetricFamily) (map[string]*dto.MetricFamily, error) {
+	requests, errs := metrics["requests"], metrics["errors"]
+	if requests == nil || errs == nil {
+		return metrics, nil
+	}
+	ratio := errs.Metric[0].GetCounter().GetValue() / requests.Metric[0].GetCounter().GetValue()
+	metrics["error_ratio"] = &dto.MetricFamily{
+		Name:   stringPtr("error_ratio"),
+		Type:   dto.MetricType_GAUGE.Enum(),
+		Metric: []*dto.Metric{{Gauge: &dto.Gauge{Value: &ratio}}},
+	}
+	return metrics, nil
+})
+
+func TestBuildFamilyProcessors(t *testing.T) {
+	sourceConfig := *commonConfig.SourceConfig
+	sourceConfig.Whitelisted = nil
+	processorsConfig := *commonConfig
+	processorsConfig.SourceConfig = &sourceConfig
+	processorsConfig.DowncaseMetricNames = true
+	processorsConfig.FamilyProcessors = []config.FamilyProcessor{errorRatio}
+
+	response := &PrometheusResponse{rawResponse: `
+# TYPE Requests counter
+Requests 200
+# TYPE Errors counter
+Errors 5
+`}
+	metrics, err := response.Build(&processorsConfig, NewMetricDescriptorCache(nil, &processorsConfig))
+	if assert.NoError(t, err) && assert.Contains(t, metrics, "error_ratio", "processor should run after the built-in transformations") {
+		assert.Equal(t, 0.025, metrics["error_ratio"].Metric[0].GetGauge().GetValue())
+	}
+
+	planned, err := response.PlanMetricDescriptors(&processorsConfig, NewMetricDescriptorCache(nil, &processorsConfig))
+	if assert.NoError(t, err) && assert.Equal(t, 3, len(planned)) {
+		assert.Equal(t, "container.googleapis.com/master/testcomponent/error_ratio", planned[0].Type)
+		assert.Equal(t, "GAUGE", planned[0].MetricKind)
+	}
+}
+
+func TestBuildFamilyProcessorError(t *testing.T) {
+	processorsConfig := *commonConfig
+	processorsConfig.FamilyProcessors = []config.FamilyProcessor{
+		config.FamilyProcessorFunc(func(metrics map[string]*dto.MetricFamily) (map[string]*dto.MetricFamily, error) {
+			return nil, errors.New("processor failed")
+		}),
+		errorRatio,
+	}
+	response := &PrometheusResponse{rawResponse: "# TYPE requests counter\nrequests 1\n"}
+	_, err := response.Build(&processorsConfig, NewMetricDescriptorCache(nil, &processorsConfig))
+	assert.EqualError(t, err, "processor failed")
+}
+
+func TestDefaultFamilyProcessors(t *testing.T) {
+	metrics, err := runFamilyProcessors(familiesWithNames("testcomponent_Requests"), []config.FamilyProcessor{
+		OmitComponentNameProcessor("testcomponent"),
+		DowncaseMetricNamesProcessor,
+		FlattenSummaryProcessor,
+	})
+	if assert.NoError(t, err) {
+		assert.Contains(t, metrics, "requests")
+		assert.Equal(t, 1, len(metrics))
+	}
+}
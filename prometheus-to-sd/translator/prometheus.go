@@ -17,73 +17,886 @@ limitations under the License.
 package translator
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"mime"
+	"net"
 	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/golang/glog"
 	dto "github.com/prometheus/client_model/go"
 	"github.com/prometheus/common/expfmt"
+	v3 "google.golang.org/api/monitoring/v3"
 
 	"github.com/GoogleCloudPlatform/k8s-stackdriver/prometheus-to-sd/config"
 )
 
-const customMetricsPrefix = "custom.googleapis.com"
+const (
+	// customMetricsPrefix is the prefix of the metrics with descriptors managed by prometheus-to-sd, unless
+	// other prefixes are configured.
+	customMetricsPrefix = "custom.googleapis.com"
+
+	// defaultScrapeTimeout is used when the source config doesn't specify its own scrape timeout.
+	defaultScrapeTimeout = 10 * time.Second
+	// defaultScrapeRetryBackoff is the delay before the first retry of a failed scrape, it's doubled
+	// after each consecutive failure.
+	defaultScrapeRetryBackoff = time.Second
+
+	// protobufAcceptHeader asks for the protobuf exposition format, falling back to the text one.
+	protobufAcceptHeader = string(expfmt.FmtProtoDelim) + ";q=0.7," + string(expfmt.FmtText) + ";q=0.3"
+)
+
+// acceptFormatMediaTypes are the media types of the exposition formats of the acceptFormats option.
+var acceptFormatMediaTypes = map[string]string{
+	"protobuf":    string(expfmt.FmtProtoDelim),
+	"openmetrics": openMetricsMediaType + "; version=0.0.1",
+	"text":        string(expfmt.FmtText),
+}
+
+// acceptHeader returns the Accept header asking for the formats, with quality values decreasing in their order.
+func acceptHeader(formats []string) string {
+	accepted := make([]string, 0, len(formats))
+	for i, format := range formats {
+		quality := 1 - float64(i)/float64(len(formats))
+		accepted = append(accepted, fmt.Sprintf("%s;q=%.2g", acceptFormatMediaTypes[format], quality))
+	}
+	return strings.Join(accepted, ",")
+}
+
+// Version of prometheus-to-sd, sent in the User-Agent header of the scrapes. It's set at build time.
+var Version = "unknown"
 
 // PrometheusResponse represents unprocessed response from Prometheus endpoint.
 type PrometheusResponse struct {
 	rawResponse string
+	// contentType is the Content-Type of the scraped response, it determines the exposition format
+	// unless format is set.
+	contentType string
+	// format is the config.SourceConfig.Format of the source.
+	format string
+	// exemplars of the histogram buckets, set when the response is parsed.
+	exemplars map[*dto.Bucket]*Exemplar
+	// additional are responses of the additional paths and ports of the source, merged with this one when parsed.
+	additional []*PrometheusResponse
+	// port is the value of the port label added to the series of the response, if the source has additional ports.
+	port string
+	// stale is set if the response was scraped before and is served because the last scrape failed.
+	stale bool
+	// failed is set for the response standing for a failed scrape, see FailedScrapeResponse.
+	failed bool
+	// streamed is set if the body was parsed while it was read, see config.SourceConfig.StreamResponse.
+	// Such responses keep the parsed families and units instead of the body.
+	streamed bool
+	families map[string]*dto.MetricFamily
+	units    map[string]string
 }
 
 // GetPrometheusMetrics scrapes metrics from the given host and port using /metrics handler.
 func GetPrometheusMetrics(config *config.SourceConfig) (*PrometheusResponse, error) {
-	res, err := getPrometheusMetrics(config)
+	return GetPrometheusMetricsContext(context.Background(), config)
+}
+
+// GetPrometheusMetricsContext scrapes metrics like GetPrometheusMetrics, aborting the scrape when the context
+// is done. Errors caused by the context wrap the context error.
+func GetPrometheusMetricsContext(ctx context.Context, config *config.SourceConfig) (*PrometheusResponse, error) {
+	res, err := getPrometheusMetricsWithFallback(ctx, config)
+	now := time.Now()
+	scrapeHealth.record(config.Component, err == nil, now)
+	res, err = staleResponses.withStaleFallback(config, res, err, now)
 	if err != nil {
 		componentMetricsAvailable.WithLabelValues(config.Component).Set(0.0)
+		reportScrapeError(config, err)
 	} else {
 		componentMetricsAvailable.WithLabelValues(config.Component).Set(1.0)
 	}
 	return res, err
 }
 
-func getPrometheusMetrics(config *config.SourceConfig) (*PrometheusResponse, error) {
-	url := fmt.Sprintf("http://%s:%d%s", config.Host, config.Port, config.Path)
-	resp, err := http.Get(url)
+// reportScrapeError passes the scrape failure to the error sink of the source, if it's set.
+func reportScrapeError(config *config.SourceConfig, err error) {
+	if config.ScrapeErrorSink == nil {
+		return
+	}
+	url, urlErr := scrapeURL(config, config.Path)
+	if urlErr != nil {
+		url = ""
+	}
+	config.ScrapeErrorSink.ScrapeFailed(config.Component, url, err)
+}
+
+// getPrometheusMetricsWithFallback scrapes the fallback endpoint of the source if the scrape of the primary
+// one fails.
+func getPrometheusMetricsWithFallback(ctx context.Context, config *config.SourceConfig) (*PrometheusResponse, error) {
+	res, err := getPrometheusMetrics(ctx, config)
+	if err == nil {
+		scrapesServed.WithLabelValues(config.Component, "primary").Inc()
+		return res, nil
+	}
+	fallback, ok := config.FallbackConfig()
+	if !ok || ctx.Err() != nil {
+		return nil, err
+	}
+	loggerFor(config).Warning("Scrape failed, scraping fallback endpoint", "component", config.Component,
+		"fallback", net.JoinHostPort(fallback.Host, strconv.FormatUint(uint64(fallback.Port), 10)), "error", err)
+	res, fallbackErr := getPrometheusMetrics(ctx, fallback)
+	if fallbackErr != nil {
+		return nil, fmt.Errorf("%w; scrape of fallback endpoint %s:%d failed: %v", err, fallback.Host, fallback.Port, fallbackErr)
+	}
+	scrapesServed.WithLabelValues(config.Component, "fallback").Inc()
+	return res, nil
+}
+
+func getPrometheusMetrics(ctx context.Context, config *config.SourceConfig) (*PrometheusResponse, error) {
+	timeout := config.ScrapeTimeout
+	if timeout == 0 {
+		timeout = defaultScrapeTimeout
+	}
+	client, err := httpClients.get(config, timeout)
+	if err != nil {
+		return nil, err
+	}
+	ctx, err = withPinnedHost(ctx, config)
 	if err != nil {
-		return nil, fmt.Errorf("request %s failed: %v", url, err)
+		return nil, err
+	}
+	if config.ProbeBeforeScrape {
+		if err := probeTarget(ctx, config); err != nil {
+			return nil, err
+		}
+	}
+	url, err := scrapeURL(config, config.Path)
+	if err != nil {
+		return nil, err
+	}
+	res, err := scrapeWithRetries(ctx, client, config, url, timeout)
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range config.AdditionalPaths {
+		url, err := scrapeURL(config, path)
+		if err != nil {
+			return nil, err
+		}
+		additional, err := scrapeWithRetries(ctx, client, config, url, timeout)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scrape path %s: %w", path, err)
+		}
+		res.additional = append(res.additional, additional)
+	}
+	if len(config.AdditionalPorts) > 0 {
+		if err := scrapeAdditionalPorts(ctx, client, config, timeout, res); err != nil {
+			return nil, err
+		}
+	}
+	if config.FailOnEmptyScrape && res.empty() {
+		return nil, fmt.Errorf("scrape of component %s returned no metrics", config.Component)
+	}
+	return res, nil
+}
+
+// scrapeAdditionalPorts scrapes the path of the source on its additional ports, adding the responses to the
+// additional ones of res. All the responses are labeled with their ports.
+func scrapeAdditionalPorts(ctx context.Context, client *http.Client, config *config.SourceConfig, timeout time.Duration, res *PrometheusResponse) error {
+	primaryPort := strconv.FormatUint(uint64(config.Port), 10)
+	res.port = primaryPort
+	for _, additional := range res.additional {
+		additional.port = primaryPort
+	}
+	for _, port := range config.AdditionalPorts {
+		portConfig := *config
+		portConfig.Port = port
+		url, err := scrapeURL(&portConfig, config.Path)
+		if err != nil {
+			return err
+		}
+		additional, err := scrapeWithRetries(ctx, client, &portConfig, url, timeout)
+		if err != nil {
+			return fmt.Errorf("failed to scrape port %d: %w", port, err)
+		}
+		additional.port = strconv.FormatUint(uint64(port), 10)
+		res.additional = append(res.additional, additional)
+	}
+	return nil
+}
+
+// scrapeWithRetries scrapes the given url, retrying transient failures as configured for the source.
+func scrapeWithRetries(ctx context.Context, client *http.Client, config *config.SourceConfig, url string, timeout time.Duration) (*PrometheusResponse, error) {
+	backoff := config.ScrapeRetryBackoff
+	if backoff == 0 {
+		backoff = defaultScrapeRetryBackoff
+	}
+	logger := loggerFor(config)
+	for attempt := 1; ; attempt++ {
+		res, retryable, err := scrapeOnce(ctx, client, config, url, timeout)
+		if err == nil {
+			return res, nil
+		}
+		fields := []interface{}{"component", config.Component, "url", url, "attempt", attempt}
+		var statusErr *httpStatusError
+		if errors.As(err, &statusErr) {
+			fields = append(fields, "status", statusErr.code)
+		}
+		fields = append(fields, "error", err)
+		if !retryable || attempt > config.ScrapeRetries {
+			logger.Debug(2, "Scrape failed", fields...)
+			if attempt > 1 {
+				return nil, fmt.Errorf("scrape failed after %d attempts: %v", attempt, err)
+			}
+			return nil, err
+		}
+		logger.Debug(2, "Scrape attempt failed, retrying", append(fields, "backoff", backoff)...)
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("scrape of component %v aborted: %w", config.Component, ctx.Err())
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// scrapeURL returns the url of the metrics endpoint of the source with the given path. Query parameters
+// can be passed both in the path and separately, in which case the latter take precedence.
+func scrapeURL(config *config.SourceConfig, metricsPath string) (string, error) {
+	scheme := config.Scheme
+	if scheme == "" {
+		scheme = "http"
+	}
+	path, err := url.Parse(metricsPath)
+	if err != nil {
+		return "", fmt.Errorf("invalid metrics path %q of component %v: %v", metricsPath, config.Component, err)
+	}
+	if path.Path == "" {
+		path.Path = "/metrics"
+	}
+	query := path.Query()
+	for name, value := range config.Query {
+		query.Set(name, value)
+	}
+	// JoinHostPort puts IPv6 literals in brackets.
+	host := net.JoinHostPort(strings.Trim(config.Host, "[]"), strconv.FormatUint(uint64(config.Port), 10))
+	if _, ok := config.UnixSocket(); ok {
+		// Connections are made to the socket, the host is only sent in the Host header.
+		host = "localhost"
+	}
+	endpoint := url.URL{
+		Scheme:   scheme,
+		Host:     host,
+		Path:     path.Path,
+		RawPath:  path.RawPath,
+		RawQuery: query.Encode(),
+	}
+	return endpoint.String(), nil
+}
+
+// scrapeOnce performs a single attempt to scrape the given url. It also returns whether the attempt
+// failed because of the transient problem (connection error or server error) and could be retried.
+func scrapeOnce(ctx context.Context, client *http.Client, config *config.SourceConfig, url string, timeout time.Duration) (*PrometheusResponse, bool, error) {
+	var trace *scrapeTrace
+	if config.TraceScrapes {
+		var hooks *httptrace.ClientTrace
+		trace, hooks = newScrapeTrace()
+		ctx = httptrace.WithClientTrace(ctx, hooks)
+	}
+	req, err := newScrapeRequest(ctx, config, url)
+	if err != nil {
+		return nil, false, err
+	}
+	start := time.Now()
+	resp, err := client.Do(req)
+	if trace != nil {
+		loggerFor(config).Debug(4, "Scrape traced", "component", config.Component, "url", url, "trace", trace)
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, false, fmt.Errorf("scrape of %s aborted: %w", url, ctx.Err())
+		}
+		// Timeouts of the connection stages end the request before the scrape timeout, their errors tell
+		// which stage timed out.
+		if isTimeout(err) && time.Since(start) >= timeout {
+			return nil, true, fmt.Errorf("scrape of %s timed out after %v", url, timeout)
+		}
+		return nil, true, fmt.Errorf("request %s failed: %v", url, err)
 	}
 	defer resp.Body.Close()
 
-	body, err := ioutil.ReadAll(resp.Body)
+	// Content-Encoding of some servers doesn't match the body, so the body is sniffed for the gzip header.
+	buffered := bufio.NewReader(resp.Body)
+	var reader io.Reader = buffered
+	compressed := isGzipped(buffered)
+	declared := resp.Header.Get("Content-Encoding") == "gzip"
+	if declared && !compressed {
+		loggerFor(config).Warning("Response declares gzip Content-Encoding, but the body isn't compressed, reading it as plain",
+			"component", config.Component, "url", url)
+	} else if !declared && compressed {
+		loggerFor(config).Warning("Response is gzipped without declaring it in Content-Encoding, decompressing it",
+			"component", config.Component, "url", url)
+	}
+	if compressed {
+		gzipReader, err := gzip.NewReader(buffered)
+		if err != nil {
+			return nil, true, fmt.Errorf("failed to decompress response body - %v", err)
+		}
+		defer gzipReader.Close()
+		reader = gzipReader
+	}
+	if config.MaxBodyBytes > 0 {
+		// Read one byte more than allowed to tell apart a body of the maximal size from a bigger one.
+		reader = io.LimitReader(reader, config.MaxBodyBytes+1)
+	}
+	if config.StreamResponse && resp.StatusCode == http.StatusOK {
+		body := &countingReader{reader: reader}
+		res, err := streamResponse(config, resp.Header.Get("Content-Type"), body)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, false, fmt.Errorf("scrape of %s aborted: %w", url, ctx.Err())
+			}
+			if isTimeout(body.err) {
+				return nil, true, fmt.Errorf("scrape of %s timed out after %v", url, timeout)
+			}
+			if body.err != nil {
+				return nil, true, fmt.Errorf("failed to read response body - %v", body.err)
+			}
+			return nil, false, fmt.Errorf("invalid response of %s: %v", url, err)
+		}
+		scrapeDuration.WithLabelValues(config.Component).Observe(time.Since(start).Seconds())
+		scrapePayloadBytes.WithLabelValues(config.Component).Set(float64(body.bytes))
+		return res, false, nil
+	}
+	body, err := ioutil.ReadAll(reader)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read response body - %v", err)
+		if ctx.Err() != nil {
+			return nil, false, fmt.Errorf("scrape of %s aborted: %w", url, ctx.Err())
+		}
+		if isTimeout(err) {
+			return nil, true, fmt.Errorf("scrape of %s timed out after %v", url, timeout)
+		}
+		return nil, true, fmt.Errorf("failed to read response body - %v", err)
+	}
+	if config.MaxBodyBytes > 0 && int64(len(body)) > config.MaxBodyBytes {
+		return nil, false, fmt.Errorf("response of component %s exceeds the limit of %d bytes", config.Component, config.MaxBodyBytes)
 	}
+	scrapeDuration.WithLabelValues(config.Component).Observe(time.Since(start).Seconds())
+	scrapePayloadBytes.WithLabelValues(config.Component).Set(float64(len(body)))
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("request failed - %q, response: %q", resp.Status, string(body))
+		return nil, resp.StatusCode >= http.StatusInternalServerError, &httpStatusError{code: resp.StatusCode, status: resp.Status, body: string(body)}
+	}
+	contentType := resp.Header.Get("Content-Type")
+	if err := validateContentType(config.Format, contentType, body); err != nil {
+		return nil, false, fmt.Errorf("invalid response of %s: %v", url, err)
+	}
+	return &PrometheusResponse{rawResponse: string(body), contentType: contentType, format: config.Format}, false, nil
+}
+
+// httpStatusError is returned when the scraped endpoint responds with a status other than 200 OK.
+type httpStatusError struct {
+	code   int
+	status string
+	body   string
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("request failed - %q, response: %q", e.status, e.body)
+}
+
+// gzipMagic are the first bytes of the gzip stream.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// isGzipped returns true if the body starts with the gzip header, without consuming it.
+func isGzipped(body *bufio.Reader) bool {
+	magic, err := body.Peek(len(gzipMagic))
+	return err == nil && bytes.Equal(magic, gzipMagic)
+}
+
+// contentTypePrefixBytes is the number of bytes of the body included in the error about an unexpected content type.
+const contentTypePrefixBytes = 128
+
+// validateContentType checks that the response is in one of the exposition formats supported for the format
+// of the source, so that e.g. a login page served instead of the metrics is reported clearly rather than as
+// a parse error. Responses without the content type are parsed in the format of the source, or as text.
+func validateContentType(format, contentType string, body []byte) error {
+	if contentType == "" {
+		return nil
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	expected := "Prometheus or OpenMetrics exposition format"
+	if format == config.FormatJSON {
+		if err == nil && mediaType == jsonMediaType {
+			return nil
+		}
+		expected = jsonMediaType
+	} else if err == nil {
+		switch mediaType {
+		case "text/plain", openMetricsMediaType, expfmt.ProtoType:
+			return nil
+		}
+	}
+	prefix := body
+	if len(prefix) > contentTypePrefixBytes {
+		prefix = prefix[:contentTypePrefixBytes]
 	}
-	return &PrometheusResponse{rawResponse: string(body)}, nil
+	return fmt.Errorf("unexpected content type %q, expected %s, body starts with %q", contentType, expected, prefix)
 }
 
-// Build performs parsing and processing of the prometheus metrics response.
+// newScrapeRequest creates a GET request for the given url with authentication configured by the source config.
+func newScrapeRequest(ctx context.Context, config *config.SourceConfig, url string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request for %s: %v", url, err)
+	}
+	// Setting the header explicitly disables transparent decompression of the transport,
+	// response body is decompressed by getPrometheusMetrics instead.
+	req.Header.Set("Accept-Encoding", "gzip")
+	userAgent := config.UserAgent
+	if userAgent == "" {
+		userAgent = "prometheus-to-sd/" + Version
+	}
+	req.Header.Set("User-Agent", userAgent)
+	if len(config.AcceptFormats) > 0 {
+		req.Header.Set("Accept", acceptHeader(config.AcceptFormats))
+	} else if config.PreferProtobuf {
+		req.Header.Set("Accept", protobufAcceptHeader)
+	}
+	if config.BasicAuthUsername != "" {
+		password, err := getBasicAuthPassword(config)
+		if err != nil {
+			return nil, err
+		}
+		req.SetBasicAuth(config.BasicAuthUsername, password)
+	}
+	token, err := getBearerToken(config)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	for name, value := range config.Headers {
+		// Conflicts with the authentication configured by the options are reported when they are parsed.
+		if http.CanonicalHeaderKey(name) == "Authorization" && req.Header.Get("Authorization") != "" {
+			continue
+		}
+		req.Header.Set(name, value)
+	}
+	return req, nil
+}
+
+// getBearerToken returns the token used to authorize scrapes. Token file is re-read on every call,
+// so rotated tokens are picked up, and takes precedence over the token set directly.
+func getBearerToken(config *config.SourceConfig) (string, error) {
+	if config.BearerTokenFile == "" {
+		return config.BearerToken, nil
+	}
+	token, err := ioutil.ReadFile(config.BearerTokenFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to read bearer token file %s: %v", config.BearerTokenFile, err)
+	}
+	return strings.TrimSpace(string(token)), nil
+}
+
+// getBasicAuthPassword returns the password used for basic authentication. Similarly to the bearer
+// token, the password file is re-read on every call and takes precedence over the password set directly.
+func getBasicAuthPassword(config *config.SourceConfig) (string, error) {
+	if config.BasicAuthPasswordFile == "" {
+		return config.BasicAuthPassword, nil
+	}
+	password, err := ioutil.ReadFile(config.BasicAuthPasswordFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to read basic auth password file %s: %v", config.BasicAuthPasswordFile, err)
+	}
+	return strings.TrimSpace(string(password)), nil
+}
+
+// isTimeout returns true if the error was caused by exceeding the client timeout.
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+// Build performs parsing and processing of the prometheus metrics response. In the dry run mode metric
+// descriptors that would be created or validated are only logged.
 func (p *PrometheusResponse) Build(config *config.CommonConfig, metricDescriptorCache *MetricDescriptorCache) (map[string]*dto.MetricFamily, error) {
-	parser := &expfmt.TextParser{}
-	metrics, err := parser.TextToMetricFamilies(strings.NewReader(p.rawResponse))
+	metrics, units, err := p.process(config)
 	if err != nil {
 		return nil, err
 	}
-	if config.OmitComponentName {
-		metrics = OmitComponentName(metrics, config.SourceConfig.Component)
+	whitelisted, err := filterWhitelistedSource(metrics, config.SourceConfig)
+	if err != nil {
+		return nil, err
 	}
-	if config.DowncaseMetricNames {
-		metrics = DowncaseMetricNames(metrics)
+	// Descriptors of custom metrics are managed by prometheus-to-sd, other ones can be only validated.
+	custom := make(map[string]*dto.MetricFamily)
+	other := make(map[string]*dto.MetricFamily)
+	for name, family := range whitelisted {
+		if isCustomMetricsPrefix(config, config.SourceConfig.MetricsPrefixFor(name)) {
+			custom[name] = family
+		} else {
+			other[name] = family
+		}
 	}
-	// Convert summary metrics into metric family types we can easily import, since summary types
-	// map to multiple stackdriver metrics.
-	metrics = FlattenSummaryMetricFamilies(metrics)
-	if strings.HasPrefix(config.SourceConfig.MetricsPrefix, customMetricsPrefix) {
-		metricDescriptorCache.UpdateMetricDescriptors(metrics, config.SourceConfig.Whitelisted)
+	if config.DryRun {
+		for _, descriptor := range metricDescriptorCache.PlannedMetricDescriptors(whitelisted, nil, units) {
+			loggerFor(config.SourceConfig).Info("Dry run: metric descriptor", "component", config.SourceConfig.Component,
+				"type", descriptor.Type, "kind", descriptor.MetricKind, "valueType", descriptor.ValueType)
+		}
 	} else {
-		metricDescriptorCache.ValidateMetricDescriptors(metrics, config.SourceConfig.Whitelisted)
+		// Metrics excluded by the whitelist are still present in the response, so their descriptors aren't stale.
+		metricDescriptorCache.markSeen(metrics)
+		if err := metricDescriptorCache.updateMetricDescriptors(custom, nil, units); err != nil {
+			loggerFor(config.SourceConfig).Warning("Failed to update metric descriptors", "component", config.SourceConfig.Component, "error", err)
+		}
+		metricDescriptorCache.ValidateMetricDescriptors(other, nil)
 	}
 	return metrics, nil
 }
+
+// isCustomMetricsPrefix returns true if descriptors of the metrics with the given prefix are managed by
+// prometheus-to-sd, i.e. it starts with one of the configured custom metrics prefixes.
+func isCustomMetricsPrefix(config *config.CommonConfig, prefix string) bool {
+	customPrefixes := config.CustomMetricsPrefixes
+	if len(customPrefixes) == 0 {
+		customPrefixes = []string{customMetricsPrefix}
+	}
+	for _, customPrefix := range customPrefixes {
+		if strings.HasPrefix(prefix, customPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Stale returns true if the response is the last successful one, served because the scrape failed.
+func (p *PrometheusResponse) Stale() bool {
+	return p.stale
+}
+
+// Raw returns the body of the response exactly as it was scraped, after decompression. Bodies
+// of the additional paths of the source are not included. Streamed responses keep no body.
+func (p *PrometheusResponse) Raw() string {
+	return p.rawResponse
+}
+
+// WriteTo writes the raw body of the response to the writer, avoiding a copy of a possibly large payload.
+func (p *PrometheusResponse) WriteTo(w io.Writer) (int64, error) {
+	n, err := io.WriteString(w, p.rawResponse)
+	return int64(n), err
+}
+
+// Exemplars returns exemplars of the histogram buckets of the families returned by Build, indexed by the bucket.
+// Exemplars are retained only for the OpenMetrics exposition format. When series are merged, e.g. after
+// dropping labels, only exemplars of the buckets of the first merged series are kept.
+func (p *PrometheusResponse) Exemplars() map[*dto.Bucket]*Exemplar {
+	return p.exemplars
+}
+
+// PlanMetricDescriptors returns metric descriptors that Build would create or validate for the response,
+// without modifying the cache.
+func (p *PrometheusResponse) PlanMetricDescriptors(config *config.CommonConfig, metricDescriptorCache *MetricDescriptorCache) ([]*v3.MetricDescriptor, error) {
+	metrics, units, err := p.process(config)
+	if err != nil {
+		return nil, err
+	}
+	whitelisted, err := filterWhitelistedSource(metrics, config.SourceConfig)
+	if err != nil {
+		return nil, err
+	}
+	return metricDescriptorCache.PlannedMetricDescriptors(whitelisted, nil, units), nil
+}
+
+// process parses the response and applies all the transformations configured for the source.
+// Units exposed with the metrics are returned indexed by the final names of the families.
+func (p *PrometheusResponse) process(config *config.CommonConfig) (map[string]*dto.MetricFamily, map[string]string, error) {
+	emitMetadata := config.SourceConfig.EmitScrapeMetadata
+	if p.failed {
+		metrics := make(map[string]*dto.MetricFamily)
+		if emitMetadata {
+			metrics = AddScrapeMetadata(metrics, config.SourceConfig.Component, false, 0)
+		}
+		return metrics, nil, nil
+	}
+	metrics, units, parseErrors, err := p.parsePartially()
+	if parseErrors > 0 {
+		scrapeParseErrors.WithLabelValues(config.SourceConfig.Component).Add(float64(parseErrors))
+	}
+	if err != nil || parseErrors > 0 {
+		p.logRaw(config)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	// Families can be renamed by the transformations below, so units are tracked by the family itself.
+	familyUnits := make(map[*dto.MetricFamily]string)
+	for name, unit := range units {
+		if family, found := metrics[name]; found {
+			familyUnits[family] = unit
+		}
+	}
+	samples := countSamples(metrics)
+	if len(p.additional) > 0 {
+		// Several endpoints of the source can expose the same series, Stackdriver rejects duplicated ones.
+		for _, family := range metrics {
+			family.Metric = mergeDuplicateSeries(family, aggregationStrategy(family, config.AggregationStrategies))
+		}
+	}
+	// Transformations modify the families in place, so the parsed ones are copied to log the changes.
+	var parsed map[string]*dto.MetricFamily
+	if glog.V(4) {
+		parsed, _ = cloneFamilies(metrics, nil)
+	}
+	metrics, err = transformMetrics(config, metrics)
+	if err != nil {
+		return nil, nil, err
+	}
+	if parsed != nil {
+		if diff := DiffFamilies(parsed, metrics); diff != "" {
+			glog.Infof("Transformations changed metrics of component %s:\n%s", config.SourceConfig.Component, diff)
+		}
+	}
+	if emitMetadata {
+		// Stale response is served because the last scrape failed.
+		metrics = AddScrapeMetadata(metrics, config.SourceConfig.Component, !p.stale, samples)
+	}
+	units = make(map[string]string)
+	for name, family := range metrics {
+		if unit, found := familyUnits[family]; found {
+			units[name] = unit
+		}
+	}
+	return metrics, units, nil
+}
+
+// logRaw logs the raw body of the response, truncated to the configured size, to help diagnose parse errors.
+func (p *PrometheusResponse) logRaw(config *config.CommonConfig) {
+	if config.LogRawResponseBytes <= 0 || !glog.V(4) {
+		return
+	}
+	if p.streamed {
+		glog.Infof("Failed to parse streamed response of component %s, its body isn't kept", config.SourceConfig.Component)
+		return
+	}
+	raw := p.rawResponse
+	if len(raw) > config.LogRawResponseBytes {
+		raw = raw[:config.LogRawResponseBytes]
+	}
+	glog.Infof("Failed to parse response of component %s, first %d of %d bytes of the body:\n%s", config.SourceConfig.Component, len(raw), len(p.rawResponse), raw)
+}
+
+// transformMetrics applies all the transformations configured for the source to the parsed metric families.
+func transformMetrics(config *config.CommonConfig, metrics map[string]*dto.MetricFamily) (map[string]*dto.MetricFamily, error) {
+	var err error
+	if !config.SourceConfig.HonorTimestamps {
+		metrics = DropTimestamps(metrics)
+	}
+	// Dropping untyped metrics takes precedence over converting them.
+	if config.DropUntyped {
+		metrics = DropUntypedMetrics(metrics, config.SourceConfig.Component)
+	} else if config.TreatUntypedAsGauge {
+		metrics = UntypedMetricsToGauges(metrics)
+	}
+	metrics = RenameLabels(metrics, config.SourceConfig.LabelRename, config.AggregationStrategies)
+	metrics = KeepLabels(metrics, config.SourceConfig.LabelKeep, config.AggregationStrategies)
+	metrics = DropLabels(metrics, config.SourceConfig.LabelDrop, config.AggregationStrategies)
+	metrics = AddStaticLabels(metrics, config.SourceConfig.StaticLabels, config.SourceConfig.OverwriteStaticLabels)
+	if metrics, err = Relabel(metrics, config.RelabelRules, config.AggregationStrategies); err != nil {
+		return nil, err
+	}
+	// Aggregation strategies are configured by the names before the renames below.
+	strategies := familyStrategies(metrics, config.AggregationStrategies)
+	if metrics, err = runFamilyProcessors(metrics, nameProcessors(config)); err != nil {
+		return nil, err
+	}
+	metrics, err = RewriteMetricNames(metrics, config.MetricNameRewrites)
+	if err != nil {
+		return nil, err
+	}
+	if config.SanitizeNames {
+		metrics = ValidateNames(metrics, true, config.LabelCollisionMode)
+	}
+	metrics = TruncateLabelValues(metrics, config.SourceConfig.Component, config.MaxLabelValueLength)
+	// Convert summary metrics into metric family types we can easily import, since summary types
+	// map to multiple stackdriver metrics.
+	flattenSummary := FlattenSummaryProcessor
+	if config.SummaryQuantileAsLabel {
+		flattenSummary = FlattenSummaryQuantileAsLabelProcessor
+	}
+	if metrics, err = flattenSummary.Process(metrics); err != nil {
+		return nil, err
+	}
+	metrics = DropInvalidSamples(metrics, config.SourceConfig.Component)
+	if config.HistogramsAsDistributions {
+		metrics = RoundBucketBounds(metrics, config.BucketBoundPrecision)
+		metrics = ConvertHistogramsToDistributions(metrics)
+	}
+	metrics, err = FilterMetricNames(metrics, config.SourceConfig.MetricNameInclude, config.SourceConfig.MetricNameExclude)
+	if err != nil {
+		return nil, err
+	}
+	metrics = TruncateSeries(metrics, config.SourceConfig.Component, config.MaxSeriesPerMetric)
+	metrics = LimitLabels(metrics, config.SourceConfig.Component, config.MaxLabelsPerMetric, config.LabelPriority, config.DropMetricsAboveLabelLimit, renamedStrategies(metrics, strategies))
+	if metrics, err = LimitMetricFamilies(metrics, config.SourceConfig.Component, config.MaxMetricFamilies, config.TruncateMetricFamilies); err != nil {
+		return nil, err
+	}
+	return runFamilyProcessors(metrics, config.FamilyProcessors)
+}
+
+// parse converts the raw response into metric families using parser matching its content type.
+func (p *PrometheusResponse) parse() (map[string]*dto.MetricFamily, error) {
+	metrics, _, _, err := p.parsePartially()
+	return metrics, err
+}
+
+// parsePartially parses the response skipping malformed metric families, if the format allows that.
+// It returns the number of skipped families and the units of the families, if the format exposes them.
+// Responses of the additional paths and ports are parsed as well and merged into the result.
+func (p *PrometheusResponse) parsePartially() (map[string]*dto.MetricFamily, map[string]string, int, error) {
+	metrics, units, parseErrors, err := p.parseOwn()
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	addPortLabel(metrics, p.port)
+	for _, additional := range p.additional {
+		additionalMetrics, additionalUnits, additionalParseErrors, err := additional.parseOwn()
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		addPortLabel(additionalMetrics, additional.port)
+		names := make([]string, 0, len(additionalMetrics))
+		for name := range additionalMetrics {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			mergeMetricFamily(metrics, name, additionalMetrics[name])
+		}
+		if units == nil {
+			units = make(map[string]string)
+		}
+		for name, unit := range additionalUnits {
+			if _, found := units[name]; !found {
+				units[name] = unit
+			}
+		}
+		if p.exemplars == nil {
+			p.exemplars = make(map[*dto.Bucket]*Exemplar)
+		}
+		for bucket, exemplar := range additional.exemplars {
+			p.exemplars[bucket] = exemplar
+		}
+		parseErrors += additionalParseErrors
+	}
+	return metrics, units, parseErrors, nil
+}
+
+// portLabel holds the port of the series scraped from sources with additional ports.
+const portLabel = "port"
+
+// addPortLabel sets the port label of all the series to the port, unless it's empty. The label exposed
+// by the target, if any, is overwritten.
+func addPortLabel(metrics map[string]*dto.MetricFamily, port string) {
+	if port == "" {
+		return
+	}
+	for _, family := range metrics {
+		for _, metric := range family.Metric {
+			setLabel(metric, portLabel, port, true)
+		}
+	}
+}
+
+// Formats of the OpenMetrics text exposition format, which aren't defined by expfmt.
+const (
+	fmtOpenMetrics001 expfmt.Format = openMetricsMediaType + "; version=0.0.1"
+	fmtOpenMetrics100 expfmt.Format = openMetricsMediaType + "; version=1.0.0"
+)
+
+// responseFormat returns the exposition format of the response with the given content type, using its version
+// parameter. Responses without a valid content type or the version of the text format are assumed to use
+// the classic text format, as well as these with an unknown version of it.
+func responseFormat(contentType string) (expfmt.Format, error) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return expfmt.FmtText, nil
+	}
+	switch mediaType {
+	case openMetricsMediaType:
+		switch params["version"] {
+		case "0.0.1":
+			return fmtOpenMetrics001, nil
+		case "", "1.0.0":
+			return fmtOpenMetrics100, nil
+		default:
+			return expfmt.FmtUnknown, fmt.Errorf("unsupported OpenMetrics version %q", params["version"])
+		}
+	case expfmt.ProtoType:
+		format := expfmt.ResponseFormat(http.Header{"Content-Type": []string{contentType}})
+		if format == expfmt.FmtUnknown {
+			return format, fmt.Errorf("unsupported protobuf exposition format %q", contentType)
+		}
+		return format, nil
+	default:
+		if version, found := params["version"]; found && mediaType == "text/plain" && version != expfmt.TextVersion {
+			glog.Warningf("Unknown text format version %q, parsing the response as version %s", version, expfmt.TextVersion)
+		}
+		return expfmt.FmtText, nil
+	}
+}
+
+// parseOwn parses the response, ignoring the additional ones, using parser matching its content type.
+func (p *PrometheusResponse) parseOwn() (map[string]*dto.MetricFamily, map[string]string, int, error) {
+	if p.streamed {
+		metrics, units, err := p.takeStreamed()
+		return metrics, units, 0, err
+	}
+	if decode, found := decoders[p.format]; found {
+		metrics, units, exemplars, err := decode(p.contentType, strings.NewReader(p.rawResponse))
+		p.exemplars = exemplars
+		return metrics, units, 0, err
+	}
+	format, err := responseFormat(p.contentType)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	switch format {
+	case fmtOpenMetrics001, fmtOpenMetrics100:
+		metrics, units, exemplars, err := parseOpenMetricsWithMetadata(strings.NewReader(p.rawResponse))
+		p.exemplars = exemplars
+		return metrics, units, 0, err
+	case expfmt.FmtProtoDelim:
+		metrics, err := parseProtobuf(p.contentType, strings.NewReader(p.rawResponse))
+		return metrics, nil, 0, err
+	default:
+		metrics, parseErrors, err := parseText(p.rawResponse)
+		return metrics, nil, parseErrors, err
+	}
+}
+
+// parseProtobuf decodes metric families in the delimited protobuf exposition format.
+func parseProtobuf(contentType string, in io.Reader) (map[string]*dto.MetricFamily, error) {
+	format := expfmt.ResponseFormat(http.Header{"Content-Type": []string{contentType}})
+	if format != expfmt.FmtProtoDelim {
+		return nil, fmt.Errorf("unsupported protobuf exposition format %q", contentType)
+	}
+	decoder := expfmt.NewDecoder(in, format)
+	metrics := make(map[string]*dto.MetricFamily)
+	for {
+		family := &dto.MetricFamily{}
+		if err := decoder.Decode(family); err != nil {
+			if err == io.EOF {
+				return metrics, nil
+			}
+			return nil, fmt.Errorf("failed to decode protobuf metric family: %v", err)
+		}
+		metrics[family.GetName()] = family
+	}
+}
@@ -0,0 +1,1221 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package translator
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/GoogleCloudPlatform/k8s-stackdriver/prometheus-to-sd/config"
+)
+
+const testMetricsBody = `# TYPE test_name counter
+test_name{labelName="labelValue1"} 42.0
+`
+
+// sourceConfigForServer creates a source config pointing at the given test server.
+func sourceConfigForServer(t testing.TB, server *httptest.Server, component string) *config.SourceConfig {
+	host, port, err := net.SplitHostPort(server.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to parse test server address: %v", err)
+	}
+	portNum, err := strconv.ParseUint(port, 10, 32)
+	if err != nil {
+		t.Fatalf("Failed to parse test server port: %v", err)
+	}
+	return &config.SourceConfig{
+		Component: component,
+		Host:      host,
+		Port:      uint(portNum),
+		Path:      "/metrics",
+		PodConfig: config.NewPodConfig("machine", "", "", "", ""),
+	}
+}
+
+// writeTempFile writes the content to the file with given name in the directory and returns its path.
+func writeTempFile(t *testing.T, dir, name string, content []byte) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, content, 0600); err != nil {
+		t.Fatalf("Failed to write %s: %v", path, err)
+	}
+	return path
+}
+
+// writeServerCertificate stores the certificate of the TLS test server in the PEM encoded file.
+func writeServerCertificate(t *testing.T, server *httptest.Server, dir string) string {
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	return writeTempFile(t, dir, "server-ca.pem", certPEM)
+}
+
+// generateClientCertificate creates a self-signed client certificate and stores it with its key
+// in the PEM encoded files.
+func generateClientCertificate(t *testing.T, dir string) (certFile, keyFile string, cert *x509.Certificate) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "prometheus-to-sd-test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	cert, err = x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Failed to parse certificate: %v", err)
+	}
+	certFile = writeTempFile(t, dir, "client.crt", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	keyFile = writeTempFile(t, dir, "client.key", pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}))
+	return certFile, keyFile, cert
+}
+
+func componentMetricsAvailableValue(t *testing.T, component string) float64 {
+	metric := &dto.Metric{}
+	if err := componentMetricsAvailable.WithLabelValues(component).Write(metric); err != nil {
+		t.Fatalf("Failed to read componentMetricsAvailable: %v", err)
+	}
+	return metric.GetGauge().GetValue()
+}
+
+func TestGetPrometheusMetricsSelfMetrics(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(10 * time.Millisecond)
+		fmt.Fprint(w, testMetricsBody)
+	}))
+	defer server.Close()
+
+	_, err := GetPrometheusMetrics(sourceConfigForServer(t, server, "self-metrics"))
+	assert.NoError(t, err)
+
+	duration := &dto.Metric{}
+	if err := scrapeDuration.WithLabelValues("self-metrics").(prometheus.Histogram).Write(duration); err != nil {
+		t.Fatalf("Failed to read scrapeDuration: %v", err)
+	}
+	assert.Equal(t, uint64(1), duration.GetHistogram().GetSampleCount())
+	assert.True(t, duration.GetHistogram().GetSampleSum() >= 0.01, "scrape duration %v is too short", duration.GetHistogram().GetSampleSum())
+
+	payload := &dto.Metric{}
+	if err := scrapePayloadBytes.WithLabelValues("self-metrics").Write(payload); err != nil {
+		t.Fatalf("Failed to read scrapePayloadBytes: %v", err)
+	}
+	assert.Equal(t, float64(len(testMetricsBody)), payload.GetGauge().GetValue())
+}
+
+func TestGetPrometheusMetrics(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		fmt.Fprint(w, testMetricsBody)
+	}))
+	defer server.Close()
+
+	sourceConfig := sourceConfigForServer(t, server, "scrape-ok")
+	response, err := GetPrometheusMetrics(sourceConfig)
+	if assert.NoError(t, err) {
+		assert.Equal(t, testMetricsBody, response.rawResponse)
+		assert.Equal(t, "text/plain; version=0.0.4", response.contentType)
+	}
+	assert.Equal(t, 1.0, componentMetricsAvailableValue(t, "scrape-ok"))
+}
+
+func TestScrapeURL(t *testing.T) {
+	testcases := []struct {
+		description string
+		config      config.SourceConfig
+		want        string
+	}{
+		{
+			description: "plain path",
+			config:      config.SourceConfig{Host: "localhost", Port: 8080, Path: "/metrics"},
+			want:        "http://localhost:8080/metrics",
+		},
+		{
+			description: "empty path",
+			config:      config.SourceConfig{Host: "localhost", Port: 8080},
+			want:        "http://localhost:8080/metrics",
+		},
+		{
+			description: "path with query",
+			config:      config.SourceConfig{Scheme: "https", Host: "localhost", Port: 8080, Path: "/metrics?format=prometheus"},
+			want:        "https://localhost:8080/metrics?format=prometheus",
+		},
+		{
+			description: "only query in path",
+			config:      config.SourceConfig{Host: "localhost", Port: 8080, Path: "?format=prometheus"},
+			want:        "http://localhost:8080/metrics?format=prometheus",
+		},
+		{
+			description: "query needing escaping",
+			config: config.SourceConfig{Host: "localhost", Port: 8080, Path: "/federate?format=text",
+				Query: map[string]string{"match[]": `up{job="api server"}`, "format": "prometheus"}},
+			want: "http://localhost:8080/federate?format=prometheus&match%5B%5D=up%7Bjob%3D%22api+server%22%7D",
+		},
+		{
+			description: "path needing escaping",
+			config:      config.SourceConfig{Host: "localhost", Port: 8080, Path: "/metrics/my component"},
+			want:        "http://localhost:8080/metrics/my%20component",
+		},
+		{
+			description: "escaped path segment",
+			config:      config.SourceConfig{Host: "localhost", Port: 8080, Path: "/metrics%2Fraw"},
+			want:        "http://localhost:8080/metrics%2Fraw",
+		},
+		{
+			description: "IPv4 address",
+			config:      config.SourceConfig{Host: "10.0.0.1", Port: 9090, Path: "/metrics"},
+			want:        "http://10.0.0.1:9090/metrics",
+		},
+		{
+			description: "IPv6 address",
+			config:      config.SourceConfig{Host: "::1", Port: 9090, Path: "/metrics"},
+			want:        "http://[::1]:9090/metrics",
+		},
+		{
+			description: "IPv6 address in brackets",
+			config:      config.SourceConfig{Host: "[fe80::1]", Port: 9090, Path: "/metrics"},
+			want:        "http://[fe80::1]:9090/metrics",
+		},
+		{
+			description: "hostname",
+			config:      config.SourceConfig{Host: "kube-state-metrics.kube-system", Port: 8080, Path: "/metrics"},
+			want:        "http://kube-state-metrics.kube-system:8080/metrics",
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			scraped, err := scrapeURL(&tc.config, tc.config.Path)
+			if assert.NoError(t, err) {
+				assert.Equal(t, tc.want, scraped)
+				parsed, err := url.Parse(scraped)
+				if assert.NoError(t, err, "url should be well-formed") {
+					assert.Equal(t, strconv.Itoa(int(tc.config.Port)), parsed.Port())
+				}
+			}
+		})
+	}
+}
+
+func TestGetPrometheusMetricsPathQuery(t *testing.T) {
+	var query string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.RawQuery
+		fmt.Fprint(w, testMetricsBody)
+	}))
+	defer server.Close()
+
+	sourceConfig := sourceConfigForServer(t, server, "path-query")
+	sourceConfig.Path = "/metrics?format=prometheus"
+	_, err := GetPrometheusMetrics(sourceConfig)
+	assert.NoError(t, err)
+	assert.Equal(t, "format=prometheus", query)
+}
+
+func TestGetPrometheusMetricsTimeout(t *testing.T) {
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+		}
+		fmt.Fprint(w, testMetricsBody)
+	}))
+	defer server.Close()
+	defer close(done)
+
+	sourceConfig := sourceConfigForServer(t, server, "scrape-timeout")
+	sourceConfig.ScrapeTimeout = 50 * time.Millisecond
+	_, err := GetPrometheusMetrics(sourceConfig)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "timed out after 50ms")
+	}
+	assert.Equal(t, 0.0, componentMetricsAvailableValue(t, "scrape-timeout"))
+}
+
+func TestGetPrometheusMetricsUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "unix-socket")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "metrics.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("Failed to listen on unix socket: %v", err)
+	}
+	var path string
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.RequestURI()
+		fmt.Fprint(w, testMetricsBody)
+	}))
+	server.Listener = listener
+	server.Start()
+	defer server.Close()
+
+	sourceConfig := &config.SourceConfig{
+		Component: "unix-socket",
+		Host:      "unix://" + socket,
+		Port:      1234,
+		Path:      "/metrics/sidecar?format=text",
+	}
+	response, err := GetPrometheusMetrics(sourceConfig)
+	if assert.NoError(t, err) {
+		assert.Equal(t, testMetricsBody, response.Raw())
+	}
+	assert.Equal(t, "/metrics/sidecar?format=text", path)
+}
+
+func TestGetPrometheusMetricsUserAgent(t *testing.T) {
+	var userAgent string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userAgent = r.UserAgent()
+		fmt.Fprint(w, testMetricsBody)
+	}))
+	defer server.Close()
+
+	sourceConfig := sourceConfigForServer(t, server, "user-agent")
+	_, err := GetPrometheusMetrics(sourceConfig)
+	assert.NoError(t, err)
+	assert.Equal(t, "prometheus-to-sd/"+Version, userAgent)
+
+	sourceConfig.UserAgent = "monitoring-agent/1.0"
+	_, err = GetPrometheusMetrics(sourceConfig)
+	assert.NoError(t, err)
+	assert.Equal(t, "monitoring-agent/1.0", userAgent)
+}
+
+func TestPrometheusResponseRaw(t *testing.T) {
+	body := "# HELP test_name Test metric.\n# TYPE test_name counter\ntest_name{labelName=\"labelValue1\"} 42.0\n\n"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, body)
+	}))
+	defer server.Close()
+
+	response, err := GetPrometheusMetrics(sourceConfigForServer(t, server, "raw"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, body, response.Raw())
+
+	var buffer bytes.Buffer
+	n, err := response.WriteTo(&buffer)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(body)), n)
+	assert.Equal(t, body, buffer.String())
+}
+
+func TestGetPrometheusMetricsContextCanceled(t *testing.T) {
+	done := make(chan struct{})
+	requested := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(requested)
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+		}
+		fmt.Fprint(w, testMetricsBody)
+	}))
+	defer server.Close()
+	defer close(done)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-requested
+		cancel()
+	}()
+	sourceConfig := sourceConfigForServer(t, server, "context-canceled")
+	sourceConfig.ScrapeRetries = 3
+	start := time.Now()
+	_, err := GetPrometheusMetricsContext(ctx, sourceConfig)
+	if assert.Error(t, err) {
+		assert.True(t, errors.Is(err, context.Canceled), "error should wrap the context error, got: %v", err)
+	}
+	assert.True(t, time.Since(start) < time.Second, "scrape should be aborted promptly")
+	assert.Equal(t, 0.0, componentMetricsAvailableValue(t, "context-canceled"))
+}
+
+func TestGetPrometheusMetricsBearerToken(t *testing.T) {
+	var authorization string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+		fmt.Fprint(w, testMetricsBody)
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "bearer-token")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("file-token\n"), 0600); err != nil {
+		t.Fatalf("Failed to write token file: %v", err)
+	}
+
+	testcases := []struct {
+		description     string
+		bearerToken     string
+		bearerTokenFile string
+		want            string
+	}{
+		{"no token", "", "", ""},
+		{"token set directly", "direct-token", "", "Bearer direct-token"},
+		{"token read from file", "", tokenFile, "Bearer file-token"},
+		{"file takes precedence", "direct-token", tokenFile, "Bearer file-token"},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			authorization = ""
+			sourceConfig := sourceConfigForServer(t, server, "bearer-token")
+			sourceConfig.BearerToken = tc.bearerToken
+			sourceConfig.BearerTokenFile = tc.bearerTokenFile
+			_, err := GetPrometheusMetrics(sourceConfig)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, authorization)
+		})
+	}
+
+	sourceConfig := sourceConfigForServer(t, server, "bearer-token")
+	sourceConfig.BearerTokenFile = filepath.Join(dir, "missing")
+	_, err = GetPrometheusMetrics(sourceConfig)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), sourceConfig.BearerTokenFile)
+	}
+}
+
+func TestGetPrometheusMetricsBasicAuth(t *testing.T) {
+	var authorization string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+		fmt.Fprint(w, testMetricsBody)
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "basic-auth")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	passwordFile := writeTempFile(t, dir, "password", []byte("file-password\n"))
+
+	testcases := []struct {
+		description  string
+		username     string
+		password     string
+		passwordFile string
+		want         string
+	}{
+		{"no credentials", "", "", "", ""},
+		{"password set directly", "admin", "secret", "", "Basic YWRtaW46c2VjcmV0"},
+		{"password read from file", "admin", "", passwordFile, "Basic YWRtaW46ZmlsZS1wYXNzd29yZA=="},
+		{"file takes precedence", "admin", "secret", passwordFile, "Basic YWRtaW46ZmlsZS1wYXNzd29yZA=="},
+		{"password without username", "", "secret", "", ""},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			authorization = ""
+			sourceConfig := sourceConfigForServer(t, server, "basic-auth")
+			sourceConfig.BasicAuthUsername = tc.username
+			sourceConfig.BasicAuthPassword = tc.password
+			sourceConfig.BasicAuthPasswordFile = tc.passwordFile
+			_, err := GetPrometheusMetrics(sourceConfig)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, authorization)
+		})
+	}
+}
+
+func TestGetPrometheusMetricsProxy(t *testing.T) {
+	var proxiedURL string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxiedURL = r.URL.String()
+		fmt.Fprint(w, testMetricsBody)
+	}))
+	defer proxy.Close()
+
+	sourceConfig := &config.SourceConfig{
+		Component: "proxied",
+		Host:      "exporter.invalid",
+		Port:      9090,
+		Path:      "/metrics",
+		ProxyURL:  proxy.URL,
+	}
+	response, err := GetPrometheusMetrics(sourceConfig)
+	if assert.NoError(t, err) {
+		assert.Equal(t, testMetricsBody, response.rawResponse)
+	}
+	assert.Equal(t, "http://exporter.invalid:9090/metrics", proxiedURL)
+
+	sourceConfig.ProxyURL = "http://[::1"
+	_, err = GetPrometheusMetrics(sourceConfig)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "invalid proxy url")
+	}
+}
+
+func TestGetPrometheusMetricsHeaders(t *testing.T) {
+	var headers http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers = r.Header
+		fmt.Fprint(w, testMetricsBody)
+	}))
+	defer server.Close()
+
+	sourceConfig := sourceConfigForServer(t, server, "headers")
+	sourceConfig.BearerToken = "token"
+	sourceConfig.Headers = map[string]string{
+		"X-Scope-OrgID": "tenant-1",
+		"X-Api-Version": "2; format=\"text\"",
+		"Authorization": "Basic c3B5OnNweQ==",
+	}
+	_, err := GetPrometheusMetrics(sourceConfig)
+	assert.NoError(t, err)
+	assert.Equal(t, "tenant-1", headers.Get("X-Scope-OrgID"))
+	assert.Equal(t, "2; format=\"text\"", headers.Get("X-Api-Version"))
+	assert.Equal(t, "Bearer token", headers.Get("Authorization"), "configured authentication should not be overridden")
+}
+
+func TestGetPrometheusMetricsClientCertificate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "client-cert")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile, clientCert := generateClientCertificate(t, dir)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, testMetricsBody)
+	}))
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert)
+	server.TLS = &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  clientCAs,
+	}
+	server.StartTLS()
+	defer server.Close()
+	caFile := writeServerCertificate(t, server, dir)
+
+	sourceConfig := sourceConfigForServer(t, server, "client-cert")
+	sourceConfig.Scheme = "https"
+	sourceConfig.CACertFiles = []string{caFile}
+	_, err = GetPrometheusMetrics(sourceConfig)
+	assert.Error(t, err, "scrape without client certificate should fail")
+
+	sourceConfig.ClientCertFile = certFile
+	sourceConfig.ClientKeyFile = keyFile
+	response, err := GetPrometheusMetrics(sourceConfig)
+	if assert.NoError(t, err) {
+		assert.Equal(t, testMetricsBody, response.rawResponse)
+	}
+
+	sourceConfig.ClientKeyFile = filepath.Join(dir, "missing.key")
+	_, err = GetPrometheusMetrics(sourceConfig)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "failed to load client certificate")
+	}
+}
+
+func TestGetPrometheusMetricsInsecureSkipVerify(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, testMetricsBody)
+	}))
+	defer server.Close()
+
+	sourceConfig := sourceConfigForServer(t, server, "insecure-skip-verify")
+	sourceConfig.Scheme = "https"
+	_, err := GetPrometheusMetrics(sourceConfig)
+	assert.Error(t, err, "self-signed certificate should be rejected")
+
+	sourceConfig.InsecureSkipVerify = true
+	response, err := GetPrometheusMetrics(sourceConfig)
+	if assert.NoError(t, err) {
+		assert.Equal(t, testMetricsBody, response.rawResponse)
+	}
+
+	sourceConfig.CACertFiles = []string{"/nonexistent/ca.pem"}
+	_, err = GetPrometheusMetrics(sourceConfig)
+	assert.NoError(t, err, "CA certificates should be ignored when verification is skipped")
+}
+
+func TestGetPrometheusMetricsTLSServerName(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls-server-name")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	var serverName string
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serverName = r.TLS.ServerName
+		fmt.Fprint(w, testMetricsBody)
+	}))
+	defer server.Close()
+	caFile := writeServerCertificate(t, server, dir)
+
+	// Certificate of the test server names example.com, the server is scraped by IP.
+	sourceConfig := sourceConfigForServer(t, server, "tls-server-name")
+	sourceConfig.Scheme = "https"
+	sourceConfig.CACertFiles = []string{caFile}
+	sourceConfig.TLSServerName = "example.com"
+	response, err := GetPrometheusMetrics(sourceConfig)
+	if assert.NoError(t, err) {
+		assert.Equal(t, testMetricsBody, response.rawResponse)
+	}
+	assert.Equal(t, "example.com", serverName, "server name should be sent with SNI")
+
+	sourceConfig.TLSServerName = "metrics.example.org"
+	_, err = GetPrometheusMetrics(sourceConfig)
+	assert.Error(t, err, "certificate should be verified against the server name")
+}
+
+func TestGetPrometheusMetricsMinTLSVersion(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, testMetricsBody)
+	}))
+	server.TLS = &tls.Config{MinVersion: tls.VersionTLS10, MaxVersion: tls.VersionTLS10}
+	server.StartTLS()
+	defer server.Close()
+
+	sourceConfig := sourceConfigForServer(t, server, "min-tls-version")
+	sourceConfig.Scheme = "https"
+	sourceConfig.InsecureSkipVerify = true
+	_, err := GetPrometheusMetrics(sourceConfig)
+	assert.Error(t, err, "TLS 1.0 should be rejected by default")
+
+	sourceConfig.MinTLSVersion = "1.2"
+	_, err = GetPrometheusMetrics(sourceConfig)
+	assert.Error(t, err, "TLS 1.0 should be rejected when the minimal version is 1.2")
+
+	sourceConfig.MinTLSVersion = "1.0"
+	_, err = GetPrometheusMetrics(sourceConfig)
+	assert.NoError(t, err, "TLS 1.0 should be accepted when explicitly allowed")
+}
+
+func TestGetPrometheusMetricsContentType(t *testing.T) {
+	testcases := []struct {
+		contentType string
+		body        string
+		wantErr     bool
+	}{
+		{contentType: "text/plain; version=0.0.4", body: testMetricsBody},
+		{contentType: "text/plain; version=0.0.4; charset=utf-8", body: testMetricsBody},
+		{contentType: "application/openmetrics-text; version=1.0.0; charset=utf-8", body: testMetricsBody + "# EOF\n"},
+		{contentType: "text/html; charset=utf-8", body: "<html><body>Please log in</body></html>", wantErr: true},
+		{contentType: "application/json", body: "[1, 2, 3, 4, 5]", wantErr: true},
+	}
+	for _, tc := range testcases {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", tc.contentType)
+			fmt.Fprint(w, tc.body)
+		}))
+		_, err := GetPrometheusMetrics(sourceConfigForServer(t, server, "content-type"))
+		server.Close()
+		if !tc.wantErr {
+			assert.NoError(t, err, "response of type %q should be accepted", tc.contentType)
+			continue
+		}
+		if assert.Error(t, err, "response of type %q should be rejected", tc.contentType) {
+			assert.Contains(t, err.Error(), tc.contentType)
+			assert.Contains(t, err.Error(), tc.body[:10])
+		}
+	}
+}
+
+func TestGetPrometheusMetricsGzip(t *testing.T) {
+	var acceptEncoding string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		acceptEncoding = r.Header.Get("Accept-Encoding")
+		if r.URL.Query().Get("compress") != "true" {
+			fmt.Fprint(w, testMetricsBody)
+			return
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		gzipWriter := gzip.NewWriter(w)
+		defer gzipWriter.Close()
+		fmt.Fprint(gzipWriter, testMetricsBody)
+	}))
+	defer server.Close()
+
+	sourceConfig := sourceConfigForServer(t, server, "gzip")
+	plain, err := GetPrometheusMetrics(sourceConfig)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "gzip", acceptEncoding)
+
+	sourceConfig.Path = "/metrics?compress=true"
+	compressed, err := GetPrometheusMetrics(sourceConfig)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, plain.rawResponse, compressed.rawResponse)
+
+	parser := &expfmt.TextParser{}
+	plainMetrics, err := parser.TextToMetricFamilies(strings.NewReader(plain.rawResponse))
+	assert.NoError(t, err)
+	compressedMetrics, err := parser.TextToMetricFamilies(strings.NewReader(compressed.rawResponse))
+	assert.NoError(t, err)
+	assert.Equal(t, plainMetrics, compressedMetrics)
+}
+
+func TestGetPrometheusMetricsFailOnEmptyScrape(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	sourceConfig := sourceConfigForServer(t, server, "empty-scrape")
+	_, err := GetPrometheusMetrics(sourceConfig)
+	assert.NoError(t, err, "empty scrape should succeed by default")
+	assert.Equal(t, 1.0, componentMetricsAvailableValue(t, "empty-scrape"))
+
+	sourceConfig.FailOnEmptyScrape = true
+	_, err = GetPrometheusMetrics(sourceConfig)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "returned no metrics")
+	}
+	assert.Equal(t, 0.0, componentMetricsAvailableValue(t, "empty-scrape"))
+}
+
+func TestGetPrometheusMetricsFallback(t *testing.T) {
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "primary is down", http.StatusServiceUnavailable)
+	}))
+	defer primary.Close()
+	fallback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, testMetricsBody)
+	}))
+	defer fallback.Close()
+
+	sourceConfig := sourceConfigForServer(t, primary, "fallback")
+	fallbackConfig := sourceConfigForServer(t, fallback, "fallback")
+	sourceConfig.FallbackPort = fallbackConfig.Port
+	fallbackBefore := scrapesServedValue(t, "fallback", "fallback")
+	response, err := GetPrometheusMetrics(sourceConfig)
+	if assert.NoError(t, err) {
+		assert.Equal(t, testMetricsBody, response.rawResponse)
+	}
+	assert.Equal(t, 1.0, componentMetricsAvailableValue(t, "fallback"))
+	assert.Equal(t, 1.0, scrapesServedValue(t, "fallback", "fallback")-fallbackBefore)
+	assert.Equal(t, 0.0, scrapesServedValue(t, "fallback", "primary"))
+
+	fallback.Close()
+	_, err = GetPrometheusMetrics(sourceConfig)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "503")
+		assert.Contains(t, err.Error(), "scrape of fallback endpoint")
+	}
+	assert.Equal(t, 0.0, componentMetricsAvailableValue(t, "fallback"))
+}
+
+func scrapesServedValue(t *testing.T, component, endpoint string) float64 {
+	metric := &dto.Metric{}
+	if err := scrapesServed.WithLabelValues(component, endpoint).Write(metric); err != nil {
+		t.Fatalf("Failed to read scrapesServed: %v", err)
+	}
+	return metric.GetCounter().GetValue()
+}
+
+func TestGetPrometheusMetricsScrapeErrorSink(t *testing.T) {
+	failing := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, testMetricsBody)
+	}))
+	defer server.Close()
+
+	type scrapeFailure struct {
+		component, url string
+		err            error
+	}
+	var failures []scrapeFailure
+	sourceConfig := sourceConfigForServer(t, server, "error-sink")
+	sourceConfig.ScrapeErrorSink = config.ScrapeErrorSinkFunc(func(component, url string, err error) {
+		failures = append(failures, scrapeFailure{component: component, url: url, err: err})
+	})
+
+	_, err := GetPrometheusMetrics(sourceConfig)
+	assert.NoError(t, err)
+	assert.Empty(t, failures, "sink shouldn't be called on success")
+
+	failing = true
+	_, err = GetPrometheusMetrics(sourceConfig)
+	assert.Error(t, err)
+	if assert.Equal(t, 1, len(failures)) {
+		assert.Equal(t, "error-sink", failures[0].component)
+		assert.Equal(t, server.URL+"/metrics", failures[0].url)
+		assert.Equal(t, err, failures[0].err)
+	}
+
+	sourceConfig.ScrapeErrorSink = nil
+	_, err = GetPrometheusMetrics(sourceConfig)
+	assert.Error(t, err, "failure without the sink should be reported as usual")
+}
+
+func TestGetPrometheusMetricsGzipMismatch(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("body") {
+		case "plain":
+			// Header claims gzip, but the body is sent as is.
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+			fmt.Fprint(w, testMetricsBody)
+		case "gzipped":
+			// Body is gzipped without the header.
+			w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+			gzipWriter := gzip.NewWriter(w)
+			defer gzipWriter.Close()
+			fmt.Fprint(gzipWriter, testMetricsBody)
+		}
+	}))
+	defer server.Close()
+
+	sourceConfig := sourceConfigForServer(t, server, "gzip-mismatch")
+	for _, body := range []string{"plain", "gzipped"} {
+		sourceConfig.Path = "/metrics?body=" + body
+		response, err := GetPrometheusMetrics(sourceConfig)
+		if assert.NoError(t, err, "scrape of %s body failed", body) {
+			assert.Equal(t, testMetricsBody, response.rawResponse, "unexpected %s body", body)
+		}
+	}
+}
+
+func TestGetPrometheusMetricsMaxBodyBytes(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 1000; i++ {
+			fmt.Fprintf(w, "metric_%d %d\n", i, i)
+		}
+	}))
+	defer server.Close()
+
+	sourceConfig := sourceConfigForServer(t, server, "too-big")
+	sourceConfig.MaxBodyBytes = 1024
+	_, err := GetPrometheusMetrics(sourceConfig)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "too-big")
+		assert.Contains(t, err.Error(), "1024 bytes")
+	}
+
+	sourceConfig.MaxBodyBytes = 1 << 20
+	_, err = GetPrometheusMetrics(sourceConfig)
+	assert.NoError(t, err)
+}
+
+func TestGetPrometheusMetricsRetries(t *testing.T) {
+	testcases := []struct {
+		description string
+		failures    int
+		status      int
+		retries     int
+		wantErr     bool
+		wantCalls   int
+	}{
+		{"succeeds after server errors", 2, http.StatusServiceUnavailable, 2, false, 3},
+		{"fails when retries are exhausted", 3, http.StatusInternalServerError, 2, true, 3},
+		{"client errors are not retried", 1, http.StatusNotFound, 2, true, 1},
+		{"no retries by default", 1, http.StatusInternalServerError, 0, true, 1},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			calls := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls++
+				if calls <= tc.failures {
+					w.WriteHeader(tc.status)
+					return
+				}
+				fmt.Fprint(w, testMetricsBody)
+			}))
+			defer server.Close()
+
+			sourceConfig := sourceConfigForServer(t, server, "retries")
+			sourceConfig.ScrapeRetries = tc.retries
+			sourceConfig.ScrapeRetryBackoff = time.Millisecond
+			response, err := GetPrometheusMetrics(sourceConfig)
+			if tc.wantErr {
+				assert.Error(t, err)
+				if tc.wantCalls > 1 {
+					assert.Contains(t, err.Error(), fmt.Sprintf("after %d attempts", tc.wantCalls))
+				}
+			} else if assert.NoError(t, err) {
+				assert.Equal(t, testMetricsBody, response.rawResponse)
+			}
+			assert.Equal(t, tc.wantCalls, calls)
+		})
+	}
+}
+
+func TestGetPrometheusMetricsRetriesConnectionErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	sourceConfig := sourceConfigForServer(t, server, "retries-connection")
+	server.Close()
+
+	sourceConfig.ScrapeRetries = 1
+	sourceConfig.ScrapeRetryBackoff = time.Millisecond
+	_, err := GetPrometheusMetrics(sourceConfig)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "after 2 attempts")
+	}
+}
+
+func TestGetPrometheusMetricsProtobuf(t *testing.T) {
+	parser := &expfmt.TextParser{}
+	textMetrics, err := parser.TextToMetricFamilies(strings.NewReader(metricsResponse.rawResponse))
+	if !assert.NoError(t, err) {
+		return
+	}
+	var encoded bytes.Buffer
+	encoder := expfmt.NewEncoder(&encoded, expfmt.FmtProtoDelim)
+	for _, family := range textMetrics {
+		if err := encoder.Encode(family); err != nil {
+			t.Fatalf("Failed to encode metric family: %v", err)
+		}
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		format := expfmt.Negotiate(r.Header)
+		w.Header().Set("Content-Type", string(format))
+		if format == expfmt.FmtProtoDelim {
+			w.Write(encoded.Bytes())
+		} else {
+			fmt.Fprint(w, metricsResponse.rawResponse)
+		}
+	}))
+	defer server.Close()
+
+	sourceConfig := sourceConfigForServer(t, server, "protobuf")
+	sourceConfig.PreferProtobuf = true
+	response, err := GetPrometheusMetrics(sourceConfig)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, string(expfmt.FmtProtoDelim), response.contentType)
+	protobufMetrics, err := response.parse()
+	if assert.NoError(t, err) {
+		assert.Equal(t, textMetrics, protobufMetrics)
+	}
+
+	sourceConfig.PreferProtobuf = false
+	response, err = GetPrometheusMetrics(sourceConfig)
+	if assert.NoError(t, err) {
+		assert.Equal(t, string(expfmt.FmtText), response.contentType)
+	}
+}
+
+func TestAcceptHeader(t *testing.T) {
+	assert.Equal(t, string(expfmt.FmtText)+";q=1", acceptHeader([]string{"text"}))
+	assert.Equal(t,
+		string(expfmt.FmtProtoDelim)+";q=1,application/openmetrics-text; version=0.0.1;q=0.67,"+string(expfmt.FmtText)+";q=0.33",
+		acceptHeader([]string{"protobuf", "openmetrics", "text"}))
+}
+
+func TestGetPrometheusMetricsAcceptFormats(t *testing.T) {
+	parser := &expfmt.TextParser{}
+	textMetrics, err := parser.TextToMetricFamilies(strings.NewReader(metricsResponse.rawResponse))
+	if !assert.NoError(t, err) {
+		return
+	}
+	var encoded bytes.Buffer
+	encoder := expfmt.NewEncoder(&encoded, expfmt.FmtProtoDelim)
+	for _, family := range textMetrics {
+		if err := encoder.Encode(family); err != nil {
+			t.Fatalf("Failed to encode metric family: %v", err)
+		}
+	}
+
+	var accept string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		accept = r.Header.Get("Accept")
+		format := expfmt.Negotiate(r.Header)
+		w.Header().Set("Content-Type", string(format))
+		if format == expfmt.FmtProtoDelim {
+			w.Write(encoded.Bytes())
+		} else {
+			fmt.Fprint(w, metricsResponse.rawResponse)
+		}
+	}))
+	defer server.Close()
+
+	sourceConfig := sourceConfigForServer(t, server, "accept-formats")
+	sourceConfig.AcceptFormats = []string{"protobuf", "text"}
+	response, err := GetPrometheusMetrics(sourceConfig)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, acceptHeader(sourceConfig.AcceptFormats), accept)
+	assert.Equal(t, string(expfmt.FmtProtoDelim), response.contentType)
+	protobufMetrics, err := response.parse()
+	if assert.NoError(t, err) {
+		assert.Equal(t, textMetrics, protobufMetrics)
+	}
+
+	sourceConfig.AcceptFormats = []string{"text", "protobuf"}
+	sourceConfig.PreferProtobuf = true
+	response, err = GetPrometheusMetrics(sourceConfig)
+	if assert.NoError(t, err) {
+		assert.Equal(t, string(expfmt.FmtText), response.contentType, "acceptFormats should override preferProtobuf")
+	}
+}
+
+func TestResponseFormat(t *testing.T) {
+	testcases := []struct {
+		contentType string
+		want        expfmt.Format
+	}{
+		{contentType: "", want: expfmt.FmtText},
+		{contentType: "text/plain", want: expfmt.FmtText},
+		{contentType: "text/plain; version=0.0.4; charset=utf-8", want: expfmt.FmtText},
+		{contentType: "text/plain; version=0.0.3", want: expfmt.FmtText},
+		{contentType: "application/openmetrics-text; version=1.0.0; charset=utf-8", want: fmtOpenMetrics100},
+		{contentType: "application/openmetrics-text; version=0.0.1", want: fmtOpenMetrics001},
+		{contentType: "application/openmetrics-text", want: fmtOpenMetrics100},
+		{contentType: string(expfmt.FmtProtoDelim), want: expfmt.FmtProtoDelim},
+	}
+	for _, tc := range testcases {
+		format, err := responseFormat(tc.contentType)
+		if assert.NoError(t, err, "content type %q", tc.contentType) {
+			assert.Equal(t, tc.want, format, "content type %q", tc.contentType)
+		}
+	}
+
+	for _, contentType := range []string{"application/openmetrics-text; version=2.0.0", string(expfmt.FmtProtoCompact)} {
+		_, err := responseFormat(contentType)
+		assert.Error(t, err, "content type %q", contentType)
+	}
+}
+
+func TestParseByContentTypeVersion(t *testing.T) {
+	body := `# TYPE requests counter
+requests_total{code="200"} 10
+# EOF
+`
+	response := &PrometheusResponse{contentType: "application/openmetrics-text; version=1.0.0", rawResponse: body}
+	metrics, err := response.parse()
+	if assert.NoError(t, err) && assert.Contains(t, metrics, "requests_total") {
+		assert.Equal(t, 10.0, metrics["requests_total"].Metric[0].Counter.GetValue())
+	}
+
+	response = &PrometheusResponse{contentType: "text/plain; version=0.0.4", rawResponse: body}
+	metrics, err = response.parse()
+	if assert.NoError(t, err) {
+		assert.Equal(t, dto.MetricType_UNTYPED, metrics["requests_total"].GetType(), "classic text format has no _total suffix handling")
+	}
+}
+
+func TestParseProtobufUnsupportedEncoding(t *testing.T) {
+	response := &PrometheusResponse{contentType: string(expfmt.FmtProtoText)}
+	_, err := response.parse()
+	assert.Error(t, err)
+}
+
+func TestGetPrometheusMetricsAdditionalPaths(t *testing.T) {
+	bodies := map[string]string{
+		"/metrics": `# TYPE requests_total counter
+requests_total{code="200"} 5
+# TYPE up gauge
+up 1
+`,
+		"/metrics/cadvisor": `# TYPE container_cpu_usage_seconds_total counter
+container_cpu_usage_seconds_total{container="app"} 12
+`,
+		"/metrics/resource": `# TYPE requests_total counter
+requests_total{code="500"} 2
+# TYPE up counter
+up 1
+`,
+		"/metrics/copy": `# TYPE requests_total counter
+requests_total{code="200"} 3
+`,
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, found := bodies[r.URL.Path]
+		if !found {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, body)
+	}))
+	defer server.Close()
+
+	sourceConfig := sourceConfigForServer(t, server, "paths")
+
+	t.Run("disjoint", func(t *testing.T) {
+		sourceConfig.AdditionalPaths = []string{"/metrics/cadvisor"}
+		response, err := GetPrometheusMetrics(sourceConfig)
+		if !assert.NoError(t, err) {
+			return
+		}
+		metrics, err := response.parse()
+		if assert.NoError(t, err) {
+			assert.Equal(t, []string{"container_cpu_usage_seconds_total", "requests_total", "up"}, sortedNames(metrics))
+		}
+	})
+
+	t.Run("overlapping", func(t *testing.T) {
+		sourceConfig.AdditionalPaths = []string{"/metrics/resource"}
+		response, err := GetPrometheusMetrics(sourceConfig)
+		if !assert.NoError(t, err) {
+			return
+		}
+		metrics, err := response.parse()
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, []string{"requests_total", "up"}, sortedNames(metrics))
+		requests := metrics["requests_total"].Metric
+		if assert.Equal(t, 2, len(requests)) {
+			assert.Equal(t, "200", requests[0].Label[0].GetValue())
+			assert.Equal(t, "500", requests[1].Label[0].GetValue())
+		}
+		assert.Equal(t, dto.MetricType_GAUGE, metrics["up"].GetType(), "family of conflicting type should be dropped")
+		assert.Equal(t, 1, len(metrics["up"].Metric))
+	})
+
+	t.Run("duplicated", func(t *testing.T) {
+		sourceConfig.AdditionalPaths = []string{"/metrics/copy"}
+		response, err := GetPrometheusMetrics(sourceConfig)
+		if !assert.NoError(t, err) {
+			return
+		}
+		cfg := *commonConfig
+		cfg.SourceConfig = sourceConfig
+		for _, tc := range []struct {
+			strategies config.AggregationStrategies
+			want       float64
+		}{
+			{nil, 8},
+			{config.AggregationStrategies{"requests_total": config.AggregateMax}, 5},
+		} {
+			cfg.AggregationStrategies = tc.strategies
+			metrics, err := response.Build(&cfg, buildCacheForTesting())
+			if assert.NoError(t, err) && assert.Equal(t, 1, len(metrics["requests_total"].Metric), "series exposed by both paths should be merged") {
+				assert.Equal(t, tc.want, metrics["requests_total"].Metric[0].Counter.GetValue())
+			}
+		}
+	})
+
+	t.Run("failing", func(t *testing.T) {
+		sourceConfig.AdditionalPaths = []string{"/metrics/missing"}
+		_, err := GetPrometheusMetrics(sourceConfig)
+		if assert.Error(t, err) {
+			assert.Contains(t, err.Error(), "/metrics/missing")
+		}
+	})
+}
+
+func TestGetPrometheusMetricsAdditionalPorts(t *testing.T) {
+	newServer := func(body string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, body)
+		}))
+	}
+	primary := newServer(`# TYPE requests_total counter
+requests_total{code="200"} 5
+# TYPE up gauge
+up 1
+`)
+	defer primary.Close()
+	sidecar := newServer(`# TYPE requests_total counter
+requests_total{code="200"} 7
+# TYPE proxy_connections gauge
+proxy_connections{port="ignored"} 3
+`)
+	defer sidecar.Close()
+
+	sourceConfig := sourceConfigForServer(t, primary, "ports")
+	sidecarPort := sourceConfigForServer(t, sidecar, "ports").Port
+	sourceConfig.AdditionalPorts = []uint{sidecarPort}
+	response, err := GetPrometheusMetrics(sourceConfig)
+	if !assert.NoError(t, err) {
+		return
+	}
+	metrics, err := response.parse()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	primaryLabel, sidecarLabel := fmt.Sprint(sourceConfig.Port), fmt.Sprint(sidecarPort)
+	assert.Equal(t, []string{"proxy_connections", "requests_total", "up"}, sortedNames(metrics))
+	values := make(map[string]float64)
+	for _, metric := range metrics["requests_total"].Metric {
+		labels := labelsOf(metric)
+		assert.Equal(t, "200", labels["code"])
+		values[labels["port"]] = metric.GetCounter().GetValue()
+	}
+	assert.Equal(t, map[string]float64{primaryLabel: 5, sidecarLabel: 7}, values, "port label should tell apart series of both ports")
+	assert.Equal(t, map[string]string{"port": primaryLabel}, labelsOf(metrics["up"].Metric[0]))
+	assert.Equal(t, map[string]string{"port": sidecarLabel}, labelsOf(metrics["proxy_connections"].Metric[0]), "port label should be overwritten")
+
+	sidecar.Close()
+	_, err = GetPrometheusMetrics(sourceConfig)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "failed to scrape port "+sidecarLabel)
+	}
+}
+
+func TestGetPrometheusMetricsWithoutAdditionalPorts(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, testMetricsBody)
+	}))
+	defer server.Close()
+
+	response, err := GetPrometheusMetrics(sourceConfigForServer(t, server, "single-port"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	metrics, err := response.parse()
+	if assert.NoError(t, err) {
+		for _, family := range metrics {
+			for _, metric := range family.Metric {
+				assert.NotContains(t, labelsOf(metric), "port", "port label should be added only for sources with additional ports")
+			}
+		}
+	}
+}
@@ -0,0 +1,162 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package translator
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/golang/protobuf/proto"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/GoogleCloudPlatform/k8s-stackdriver/prometheus-to-sd/config"
+)
+
+// metricNameLabel holds the metric name during relabeling.
+const metricNameLabel = "__name__"
+
+// compiledRelabelRule is the relabeling rule with the compiled regex.
+type compiledRelabelRule struct {
+	config.RelabelRule
+	regex *regexp.Regexp
+}
+
+// Relabel applies the relabeling rules in order to the labels of every series, with the metric name available
+// as the __name__ label. Series dropped by the keep or drop rules are removed, and the series whose __name__
+// was changed are moved to the family with the new name. Labels starting with "__" are removed afterwards.
+// Series that become indistinguishable are merged like by DropLabels.
+func Relabel(metricFamilies map[string]*dto.MetricFamily, rules []config.RelabelRule, strategies config.AggregationStrategies) (map[string]*dto.MetricFamily, error) {
+	if len(rules) == 0 {
+		return metricFamilies, nil
+	}
+	compiled := make([]compiledRelabelRule, 0, len(rules))
+	for _, rule := range rules {
+		// Like in Prometheus, the regex has to match the whole value.
+		regexps, err := compileRegexps([]string{"^(?:" + rule.Regex + ")$"})
+		if err != nil {
+			return nil, err
+		}
+		compiled = append(compiled, compiledRelabelRule{RelabelRule: rule, regex: regexps[0]})
+	}
+
+	// Families are processed in the order of names, so that the result doesn't depend on the map iteration order.
+	names := make([]string, 0, len(metricFamilies))
+	for name := range metricFamilies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	result := make(map[string]*dto.MetricFamily)
+	for _, name := range names {
+		family := metricFamilies[name]
+		for _, metric := range family.Metric {
+			labels := relabelSeries(metricLabels(name, metric), compiled)
+			if labels == nil {
+				continue
+			}
+			newName := labels[metricNameLabel]
+			if newName == "" {
+				glog.V(4).Infof("Dropping series of metric %s left without the name after relabeling", name)
+				continue
+			}
+			target, found := result[newName]
+			if !found {
+				target = &dto.MetricFamily{Name: proto.String(newName), Help: family.Help, Type: family.Type}
+				result[newName] = target
+			} else if target.GetType() != family.GetType() {
+				glog.Warningf("Dropping series of metric %s relabeled to %s of a different type", name, newName)
+				continue
+			}
+			metric.Label = labelPairs(labels)
+			target.Metric = append(target.Metric, metric)
+		}
+	}
+	for _, family := range result {
+		family.Metric = mergeDuplicateSeries(family, aggregationStrategy(family, strategies))
+	}
+	return result, nil
+}
+
+// metricLabels returns the labels of the metric, including the __name__ label.
+func metricLabels(name string, metric *dto.Metric) map[string]string {
+	labels := make(map[string]string, len(metric.Label)+1)
+	for _, label := range metric.Label {
+		labels[label.GetName()] = label.GetValue()
+	}
+	labels[metricNameLabel] = name
+	return labels
+}
+
+// relabelSeries applies the rules to the labels of the series. Returns nil if the series is dropped.
+func relabelSeries(labels map[string]string, rules []compiledRelabelRule) map[string]string {
+	for _, rule := range rules {
+		values := make([]string, 0, len(rule.SourceLabels))
+		for _, source := range rule.SourceLabels {
+			values = append(values, labels[source])
+		}
+		value := strings.Join(values, rule.Separator)
+		switch rule.Action {
+		case config.RelabelKeep:
+			if !rule.regex.MatchString(value) {
+				return nil
+			}
+		case config.RelabelDrop:
+			if rule.regex.MatchString(value) {
+				return nil
+			}
+		case config.RelabelReplace:
+			match := rule.regex.FindStringSubmatchIndex(value)
+			if match == nil {
+				continue
+			}
+			replaced := string(rule.regex.ExpandString(nil, rule.Replacement, value, match))
+			if replaced == "" {
+				delete(labels, rule.TargetLabel)
+			} else {
+				labels[rule.TargetLabel] = replaced
+			}
+		case config.RelabelLabelMap:
+			mapped := make(map[string]string)
+			for name, labelValue := range labels {
+				if match := rule.regex.FindStringSubmatchIndex(name); match != nil {
+					mapped[string(rule.regex.ExpandString(nil, rule.Replacement, name, match))] = labelValue
+				}
+			}
+			for name, labelValue := range mapped {
+				labels[name] = labelValue
+			}
+		}
+	}
+	return labels
+}
+
+// labelPairs returns the labels sorted by name, without the ones starting with "__".
+func labelPairs(labels map[string]string) []*dto.LabelPair {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		if !strings.HasPrefix(name, "__") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	pairs := make([]*dto.LabelPair, 0, len(names))
+	for _, name := range names {
+		pairs = append(pairs, &dto.LabelPair{Name: proto.String(name), Value: proto.String(labels[name])})
+	}
+	return pairs
+}
@@ -0,0 +1,131 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package translator
+
+import (
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/GoogleCloudPlatform/k8s-stackdriver/prometheus-to-sd/config"
+)
+
+var relabelResponse = &PrometheusResponse{rawResponse: `
+# TYPE requests counter
+requests{code="200",k8s_pod="web-1",k8s_namespace="default"} 10
+requests{code="500",k8s_pod="web-1",k8s_namespace="default"} 2
+requests{code="200",k8s_pod="web-2",k8s_namespace="kube-system"} 5
+# TYPE go_goroutines gauge
+go_goroutines 12
+`}
+
+// relabel parses the relabel response and relabels it with the rules in the flag format.
+func relabel(t *testing.T, rules ...string) map[string]*dto.MetricFamily {
+	var parsed config.RelabelRules
+	for _, rule := range rules {
+		if err := parsed.Set(rule); err != nil {
+			t.Fatalf("Invalid rule %s: %v", rule, err)
+		}
+	}
+	metrics, err := relabelResponse.parse()
+	if err != nil {
+		t.Fatalf("Failed to parse the response: %v", err)
+	}
+	relabeled, err := Relabel(metrics, parsed, nil)
+	if err != nil {
+		t.Fatalf("Failed to relabel: %v", err)
+	}
+	return relabeled
+}
+
+// seriesLabels returns labels of all the series of the family.
+func seriesLabels(family *dto.MetricFamily) []map[string]string {
+	var result []map[string]string
+	for _, metric := range family.Metric {
+		result = append(result, labelsOf(metric))
+	}
+	return result
+}
+
+func TestRelabelReplace(t *testing.T) {
+	metrics := relabel(t, `{"source_labels": ["k8s_namespace", "k8s_pod"], "separator": "/", "regex": "(.*)/web-(.*)", "target_label": "instance", "replacement": "$1-$2"}`)
+	assert.ElementsMatch(t, []map[string]string{
+		{"code": "200", "k8s_pod": "web-1", "k8s_namespace": "default", "instance": "default-1"},
+		{"code": "500", "k8s_pod": "web-1", "k8s_namespace": "default", "instance": "default-1"},
+		{"code": "200", "k8s_pod": "web-2", "k8s_namespace": "kube-system", "instance": "kube-system-2"},
+	}, seriesLabels(metrics["requests"]))
+	assert.Equal(t, []map[string]string{{}}, seriesLabels(metrics["go_goroutines"]), "series not matching the regex should be left untouched")
+}
+
+func TestRelabelReplaceMetricName(t *testing.T) {
+	metrics := relabel(t, `{"source_labels": ["__name__"], "regex": "go_(.*)", "target_label": "__name__", "replacement": "runtime_$1"}`)
+	assert.Equal(t, []string{"requests", "runtime_goroutines"}, sortedNames(metrics))
+	assert.Equal(t, "runtime_goroutines", metrics["runtime_goroutines"].GetName())
+	assert.Equal(t, dto.MetricType_GAUGE, metrics["runtime_goroutines"].GetType())
+	assert.Equal(t, 12.0, metrics["runtime_goroutines"].Metric[0].GetGauge().GetValue())
+}
+
+func TestRelabelKeep(t *testing.T) {
+	metrics := relabel(t, `{"action": "keep", "source_labels": ["k8s_namespace"], "regex": "default"}`)
+	assert.Equal(t, []string{"requests"}, sortedNames(metrics), "families without kept series should be removed")
+	assert.Equal(t, 2, len(metrics["requests"].Metric))
+	for _, labels := range seriesLabels(metrics["requests"]) {
+		assert.Equal(t, "default", labels["k8s_namespace"])
+	}
+}
+
+func TestRelabelDrop(t *testing.T) {
+	metrics := relabel(t,
+		`{"action": "drop", "source_labels": ["__name__"], "regex": "go_.*"}`,
+		`{"action": "drop", "source_labels": ["__name__", "code"], "regex": "requests;5.."}`)
+	assert.Equal(t, []string{"requests"}, sortedNames(metrics))
+	assert.ElementsMatch(t, []string{"200", "200"}, []string{labelsOf(metrics["requests"].Metric[0])["code"], labelsOf(metrics["requests"].Metric[1])["code"]})
+}
+
+func TestRelabelLabelMap(t *testing.T) {
+	metrics := relabel(t, `{"action": "labelmap", "regex": "k8s_(.+)"}`)
+	assert.Contains(t, seriesLabels(metrics["requests"]), map[string]string{
+		"code": "500", "k8s_pod": "web-1", "k8s_namespace": "default", "pod": "web-1", "namespace": "default",
+	})
+}
+
+func TestRelabelMergesSeries(t *testing.T) {
+	// Overwriting the pod and the namespace makes series of the same code indistinguishable, while the pod
+	// copied to the temporary label is removed after relabeling.
+	metrics := relabel(t,
+		`{"action": "labelmap", "regex": "k8s_(pod)", "replacement": "__tmp_$1"}`,
+		`{"source_labels": ["k8s_namespace"], "regex": ".*", "target_label": "k8s_pod", "replacement": "any"}`,
+		`{"source_labels": ["__name__"], "target_label": "k8s_namespace", "replacement": "all"}`)
+	values := make(map[string]float64)
+	for _, metric := range metrics["requests"].Metric {
+		labels := labelsOf(metric)
+		assert.NotContains(t, labels, "__tmp_pod", "labels starting with __ should be removed")
+		values[labels["code"]] = metric.GetCounter().GetValue()
+	}
+	assert.Equal(t, map[string]float64{"200": 15, "500": 2}, values)
+}
+
+func TestRelabelWithoutRules(t *testing.T) {
+	metrics, err := relabelResponse.parse()
+	if !assert.NoError(t, err) {
+		return
+	}
+	relabeled, err := Relabel(metrics, nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, metrics, relabeled)
+}
@@ -0,0 +1,68 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package translator
+
+import (
+	"sync"
+
+	"github.com/golang/glog"
+
+	"github.com/GoogleCloudPlatform/k8s-stackdriver/prometheus-to-sd/config"
+)
+
+// ScrapeAll scrapes all the sources concurrently, using at most concurrency parallel scrapes, and returns
+// the responses and the errors keyed by the component name. A failure of one source doesn't affect the others.
+// caCerts are used to verify the endpoints of sources that don't configure their own CA certificates.
+func ScrapeAll(configs []*config.SourceConfig, caCerts []string, concurrency int) (map[string]*PrometheusResponse, map[string]error) {
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	responses := make(map[string]*PrometheusResponse)
+	errors := make(map[string]error)
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+
+	sources := make(chan *config.SourceConfig)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for source := range sources {
+				response, err := GetPrometheusMetrics(source)
+				mutex.Lock()
+				if err != nil {
+					glog.V(2).Infof("Error while getting Prometheus metrics for component %v: %v", source.Component, err)
+					errors[source.Component] = err
+				} else {
+					responses[source.Component] = response
+				}
+				mutex.Unlock()
+			}
+		}()
+	}
+	for _, source := range configs {
+		if len(source.CACertFiles) == 0 && len(caCerts) > 0 {
+			withCACerts := *source
+			withCACerts.CACertFiles = caCerts
+			source = &withCACerts
+		}
+		sources <- source
+	}
+	close(sources)
+	wg.Wait()
+	return responses, errors
+}
@@ -0,0 +1,86 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package translator
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/GoogleCloudPlatform/k8s-stackdriver/prometheus-to-sd/config"
+)
+
+func TestScrapeAll(t *testing.T) {
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "fast_metric 1\n")
+	}))
+	defer fast.Close()
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		fmt.Fprint(w, "slow_metric 1\n")
+	}))
+	defer slow.Close()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+	}))
+	defer failing.Close()
+
+	configs := []*config.SourceConfig{
+		sourceConfigForServer(t, slow, "slow-1"),
+		sourceConfigForServer(t, slow, "slow-2"),
+		sourceConfigForServer(t, failing, "failing"),
+		sourceConfigForServer(t, fast, "fast"),
+	}
+	start := time.Now()
+	responses, errors := ScrapeAll(configs, nil, 2)
+	// Slow sources are scraped in parallel.
+	assert.True(t, time.Since(start) < 400*time.Millisecond, "scrapes took %v", time.Since(start))
+
+	assert.Equal(t, 3, len(responses))
+	assert.Equal(t, "fast_metric 1\n", responses["fast"].rawResponse)
+	assert.Equal(t, "slow_metric 1\n", responses["slow-1"].rawResponse)
+	assert.Equal(t, "slow_metric 1\n", responses["slow-2"].rawResponse)
+	assert.Equal(t, 1, len(errors))
+	assert.Error(t, errors["failing"])
+}
+
+func TestScrapeAllCACerts(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, testMetricsBody)
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "scrape-all")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	caCert := writeServerCertificate(t, server, dir)
+	sourceConfig := sourceConfigForServer(t, server, "tls")
+	sourceConfig.Scheme = "https"
+
+	responses, errors := ScrapeAll([]*config.SourceConfig{sourceConfig}, []string{caCert}, 0)
+	assert.Empty(t, errors)
+	assert.Contains(t, responses, "tls")
+	assert.Empty(t, sourceConfig.CACertFiles, "passed config should not be modified")
+}
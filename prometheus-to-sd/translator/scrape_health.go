@@ -0,0 +1,108 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package translator
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// scrapeHealth keeps the results of the scrapes of all components.
+var scrapeHealth = newScrapeHealthRegistry()
+
+// scrapeHealthRegistry tracks the state of the last scrapes, the same as the componentMetricsAvailable metric.
+type scrapeHealthRegistry struct {
+	mutex      sync.Mutex
+	components map[string]*ComponentScrapeHealth
+}
+
+// ComponentScrapeHealth describes the state of the scrapes of a single component.
+type ComponentScrapeHealth struct {
+	// Available is true if the last scrape of the component succeeded.
+	Available bool `json:"available"`
+	// LastSuccess is the time of the last successful scrape, nil if the component was never scraped successfully.
+	LastSuccess *time.Time `json:"lastSuccess"`
+}
+
+// scrapeHealthStatus is the body of the scrape health response.
+type scrapeHealthStatus struct {
+	Healthy    bool                              `json:"healthy"`
+	Components map[string]*ComponentScrapeHealth `json:"components"`
+}
+
+func newScrapeHealthRegistry() *scrapeHealthRegistry {
+	return &scrapeHealthRegistry{components: make(map[string]*ComponentScrapeHealth)}
+}
+
+// record stores the result of the scrape of the component finished at the given time.
+func (r *scrapeHealthRegistry) record(component string, success bool, now time.Time) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	health, found := r.components[component]
+	if !found {
+		health = &ComponentScrapeHealth{}
+		r.components[component] = health
+	}
+	health.Available = success
+	if success {
+		health.LastSuccess = &now
+	}
+}
+
+// status returns the state of all components. Components are healthy if they were scraped successfully
+// within the window before now.
+func (r *scrapeHealthRegistry) status(window time.Duration, now time.Time) *scrapeHealthStatus {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	status := &scrapeHealthStatus{
+		Healthy:    true,
+		Components: make(map[string]*ComponentScrapeHealth, len(r.components)),
+	}
+	for component, health := range r.components {
+		copied := *health
+		status.Components[component] = &copied
+		if health.LastSuccess == nil || now.Sub(*health.LastSuccess) > window {
+			status.Healthy = false
+		}
+	}
+	return status
+}
+
+// ScrapeHealthHandler returns the handler responding with 200 if all components were scraped successfully
+// within the window and with 503 otherwise. Response body lists the last successful scrape of each component.
+func ScrapeHealthHandler(window time.Duration) http.Handler {
+	return newScrapeHealthHandler(scrapeHealth, window, time.Now)
+}
+
+func newScrapeHealthHandler(registry *scrapeHealthRegistry, window time.Duration, now func() time.Time) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status := registry.status(window, now())
+		w.Header().Set("Content-Type", "application/json")
+		if status.Healthy {
+			w.WriteHeader(http.StatusOK)
+		} else {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		if err := json.NewEncoder(w).Encode(status); err != nil {
+			glog.Warningf("Failed to write scrape health response: %v", err)
+		}
+	})
+}
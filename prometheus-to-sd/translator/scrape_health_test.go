@@ -0,0 +1,97 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package translator
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScrapeHealthHandler(t *testing.T) {
+	now := time.Date(2018, 3, 1, 12, 0, 0, 0, time.UTC)
+	window := time.Minute
+	testcases := []struct {
+		description string
+		record      func(registry *scrapeHealthRegistry)
+		wantCode    int
+	}{
+		{
+			description: "all healthy",
+			record: func(registry *scrapeHealthRegistry) {
+				registry.record("kubelet", true, now.Add(-10*time.Second))
+				registry.record("kube-proxy", true, now.Add(-50*time.Second))
+			},
+			wantCode: http.StatusOK,
+		},
+		{
+			description: "one stale",
+			record: func(registry *scrapeHealthRegistry) {
+				registry.record("kubelet", true, now.Add(-10*time.Second))
+				registry.record("kube-proxy", true, now.Add(-2*time.Minute))
+			},
+			wantCode: http.StatusServiceUnavailable,
+		},
+		{
+			description: "one failing",
+			record: func(registry *scrapeHealthRegistry) {
+				registry.record("kubelet", true, now.Add(-10*time.Second))
+				registry.record("kube-proxy", false, now.Add(-10*time.Second))
+			},
+			wantCode: http.StatusServiceUnavailable,
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			registry := newScrapeHealthRegistry()
+			tc.record(registry)
+			handler := newScrapeHealthHandler(registry, window, func() time.Time { return now })
+
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/healthz/scrape", nil))
+			assert.Equal(t, tc.wantCode, recorder.Code)
+			assert.Equal(t, "application/json", recorder.Header().Get("Content-Type"))
+
+			var status scrapeHealthStatus
+			if !assert.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &status)) {
+				return
+			}
+			assert.Equal(t, tc.wantCode == http.StatusOK, status.Healthy)
+			if assert.Contains(t, status.Components, "kubelet") {
+				assert.True(t, status.Components["kubelet"].Available)
+				assert.True(t, now.Add(-10*time.Second).Equal(*status.Components["kubelet"].LastSuccess))
+			}
+			assert.Contains(t, status.Components, "kube-proxy")
+		})
+	}
+}
+
+func TestScrapeHealthKeepsLastSuccess(t *testing.T) {
+	now := time.Date(2018, 3, 1, 12, 0, 0, 0, time.UTC)
+	registry := newScrapeHealthRegistry()
+	registry.record("kubelet", true, now.Add(-30*time.Second))
+	registry.record("kubelet", false, now)
+
+	status := registry.status(time.Minute, now)
+	assert.True(t, status.Healthy, "failed scrape shouldn't make the component unhealthy within the window")
+	assert.False(t, status.Components["kubelet"].Available)
+	assert.True(t, now.Add(-30*time.Second).Equal(*status.Components["kubelet"].LastSuccess))
+}
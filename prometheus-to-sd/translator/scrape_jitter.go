@@ -0,0 +1,34 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package translator
+
+import (
+	"hash/fnv"
+	"time"
+)
+
+// ScrapeJitter returns the offset by which scrapes of the component are delayed, so that instances started
+// at the same time don't scrape on aligned intervals. The offset is derived from the component name, hence
+// it's stable across restarts, and is in the range [0, maxJitter).
+func ScrapeJitter(component string, maxJitter time.Duration) time.Duration {
+	if maxJitter <= 0 {
+		return 0
+	}
+	hash := fnv.New64a()
+	hash.Write([]byte(component))
+	return time.Duration(hash.Sum64() % uint64(maxJitter))
+}
@@ -0,0 +1,42 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package translator
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScrapeJitter(t *testing.T) {
+	maxJitter := 10 * time.Second
+	kubelet := ScrapeJitter("kubelet", maxJitter)
+	kubeProxy := ScrapeJitter("kube-proxy", maxJitter)
+
+	assert.NotEqual(t, kubelet, kubeProxy, "different components should get different offsets")
+	assert.Equal(t, kubelet, ScrapeJitter("kubelet", maxJitter), "offset should be stable")
+	assert.Equal(t, kubeProxy, ScrapeJitter("kube-proxy", maxJitter), "offset should be stable")
+	for _, offset := range []time.Duration{kubelet, kubeProxy} {
+		assert.True(t, offset >= 0 && offset < maxJitter, "offset %v should be within [0, %v)", offset, maxJitter)
+	}
+}
+
+func TestScrapeJitterDisabled(t *testing.T) {
+	assert.Equal(t, time.Duration(0), ScrapeJitter("kubelet", 0))
+	assert.Equal(t, time.Duration(0), ScrapeJitter("kubelet", -time.Second))
+}
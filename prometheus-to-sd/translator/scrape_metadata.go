@@ -0,0 +1,97 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package translator
+
+import (
+	"github.com/golang/glog"
+	"github.com/golang/protobuf/proto"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/GoogleCloudPlatform/k8s-stackdriver/prometheus-to-sd/config"
+)
+
+const (
+	// upMetric is 1 if the last scrape of the source succeeded, 0 otherwise.
+	upMetric = "up"
+	// scrapeSamplesScrapedMetric is the number of samples exposed by the source in the last scrape.
+	scrapeSamplesScrapedMetric = "scrape_samples_scraped"
+)
+
+// FailedScrapeResponse returns the response standing for a failed scrape. It contains no metrics, only the scrape
+// metadata families are built from it if the source emits them.
+func FailedScrapeResponse() *PrometheusResponse {
+	return &PrometheusResponse{failed: true}
+}
+
+// AddScrapeMetadata adds the up and scrape_samples_scraped gauges describing the scrape, like the ones added by
+// the Prometheus server to the scraped targets. Families with these names exposed by the source are kept.
+func AddScrapeMetadata(metricFamilies map[string]*dto.MetricFamily, component string, up bool, samples int) map[string]*dto.MetricFamily {
+	upValue := 0.0
+	if up {
+		upValue = 1.0
+	}
+	values := map[string]float64{
+		upMetric:                   upValue,
+		scrapeSamplesScrapedMetric: float64(samples),
+	}
+	for name, value := range values {
+		if _, found := metricFamilies[name]; found {
+			glog.Warningf("Component %s exposes metric %s, not replacing it with the scrape metadata", component, name)
+			continue
+		}
+		metricFamilies[name] = &dto.MetricFamily{
+			Name:   proto.String(name),
+			Type:   dto.MetricType_GAUGE.Enum(),
+			Metric: []*dto.Metric{{Gauge: &dto.Gauge{Value: proto.Float64(value)}}},
+		}
+	}
+	return metricFamilies
+}
+
+// filterWhitelistedSource returns the families whitelisted for the source, see filterWhitelisted. The scrape
+// metadata families are kept regardless of the whitelist if the source emits them.
+func filterWhitelistedSource(metricFamilies map[string]*dto.MetricFamily, source *config.SourceConfig) (map[string]*dto.MetricFamily, error) {
+	whitelisted, err := filterWhitelisted(metricFamilies, source.Whitelisted, source.WhitelistedRegex)
+	if err != nil || !source.EmitScrapeMetadata {
+		return whitelisted, err
+	}
+	for _, name := range []string{upMetric, scrapeSamplesScrapedMetric} {
+		if family, found := metricFamilies[name]; found {
+			whitelisted[name] = family
+		}
+	}
+	return whitelisted, nil
+}
+
+// countSamples returns the number of samples of the metric families, as they are counted in the text format:
+// histograms and summaries have a sample for every bucket or quantile, the sum and the count.
+func countSamples(metricFamilies map[string]*dto.MetricFamily) int {
+	samples := 0
+	for _, family := range metricFamilies {
+		for _, metric := range family.Metric {
+			switch family.GetType() {
+			case dto.MetricType_HISTOGRAM:
+				samples += len(metric.GetHistogram().GetBucket()) + 2
+			case dto.MetricType_SUMMARY:
+				samples += len(metric.GetSummary().GetQuantile()) + 2
+			default:
+				samples++
+			}
+		}
+	}
+	return samples
+}
@@ -0,0 +1,138 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package translator
+
+import (
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/GoogleCloudPlatform/k8s-stackdriver/prometheus-to-sd/config"
+)
+
+func scrapeMetadataConfig(emit bool) *config.CommonConfig {
+	sourceConfig := *commonConfig.SourceConfig
+	sourceConfig.Whitelisted = nil
+	sourceConfig.EmitScrapeMetadata = emit
+	cfg := *commonConfig
+	cfg.SourceConfig = &sourceConfig
+	return &cfg
+}
+
+func gaugeValue(t *testing.T, metrics map[string]*dto.MetricFamily, name string) float64 {
+	family, found := metrics[name]
+	if !assert.True(t, found, "metric %s should be present", name) || !assert.Equal(t, 1, len(family.Metric)) {
+		return -1
+	}
+	assert.Equal(t, dto.MetricType_GAUGE, family.GetType())
+	return family.Metric[0].GetGauge().GetValue()
+}
+
+func TestBuildScrapeMetadata(t *testing.T) {
+	response := &PrometheusResponse{rawResponse: `
+# TYPE requests counter
+requests{code="200"} 10
+requests{code="500"} 1
+# TYPE latency histogram
+latency_bucket{le="1"} 1
+latency_bucket{le="+Inf"} 2
+latency_sum 3
+latency_count 2
+`}
+	cfg := scrapeMetadataConfig(true)
+	metrics, err := response.Build(cfg, NewMetricDescriptorCache(nil, cfg))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, 1.0, gaugeValue(t, metrics, "up"))
+	assert.Equal(t, 6.0, gaugeValue(t, metrics, "scrape_samples_scraped"))
+
+	cfg = scrapeMetadataConfig(false)
+	metrics, err = response.Build(cfg, NewMetricDescriptorCache(nil, cfg))
+	if assert.NoError(t, err) {
+		assert.NotContains(t, metrics, "up")
+		assert.NotContains(t, metrics, "scrape_samples_scraped")
+	}
+}
+
+func TestBuildScrapeMetadataFailedScrape(t *testing.T) {
+	cfg := scrapeMetadataConfig(true)
+	metrics, err := FailedScrapeResponse().Build(cfg, NewMetricDescriptorCache(nil, cfg))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, 2, len(metrics))
+	assert.Equal(t, 0.0, gaugeValue(t, metrics, "up"))
+	assert.Equal(t, 0.0, gaugeValue(t, metrics, "scrape_samples_scraped"))
+
+	stale := &PrometheusResponse{rawResponse: "requests 10\n", stale: true}
+	metrics, err = stale.Build(cfg, NewMetricDescriptorCache(nil, cfg))
+	if assert.NoError(t, err) {
+		assert.Equal(t, 0.0, gaugeValue(t, metrics, "up"), "stale response is served because the scrape failed")
+		assert.Equal(t, 1.0, gaugeValue(t, metrics, "scrape_samples_scraped"))
+	}
+
+	cfg = scrapeMetadataConfig(false)
+	metrics, err = FailedScrapeResponse().Build(cfg, NewMetricDescriptorCache(nil, cfg))
+	if assert.NoError(t, err) {
+		assert.Empty(t, metrics)
+	}
+}
+
+func TestAddScrapeMetadataKeepsExposedMetrics(t *testing.T) {
+	metrics := AddScrapeMetadata(familiesWithNames("up"), "exposes-up", true, 3)
+	assert.Empty(t, metrics["up"].Metric, "exposed metric should not be replaced")
+	assert.Equal(t, 3.0, gaugeValue(t, metrics, "scrape_samples_scraped"))
+}
+
+func TestScrapeMetadataOfWhitelistedSource(t *testing.T) {
+	response := &PrometheusResponse{rawResponse: `
+# TYPE requests counter
+requests 10
+# TYPE ignored gauge
+ignored 1
+`}
+	cfg := scrapeMetadataConfig(true)
+	cfg.SourceConfig.Whitelisted = []string{"requests"}
+	cache := NewMetricDescriptorCache(nil, cfg)
+	cache.fresh = true
+
+	descriptors, err := response.PlanMetricDescriptors(cfg, cache)
+	if !assert.NoError(t, err) {
+		return
+	}
+	want := []string{getMetricType(cfg, "requests"), getMetricType(cfg, "up"), getMetricType(cfg, "scrape_samples_scraped")}
+	var described []string
+	for _, descriptor := range descriptors {
+		described = append(described, descriptor.Type)
+	}
+	assert.ElementsMatch(t, want, described)
+
+	tsb := NewTimeSeriesBuilder(cfg, cache)
+	tsb.Update(response, time.Now())
+	ts, err := tsb.Build()
+	if !assert.NoError(t, err) {
+		return
+	}
+	var exported []string
+	for _, series := range ts {
+		exported = append(exported, series.Metric.Type)
+	}
+	assert.ElementsMatch(t, want, exported)
+}
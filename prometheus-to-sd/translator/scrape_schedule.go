@@ -0,0 +1,58 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package translator
+
+import (
+	"time"
+
+	"github.com/GoogleCloudPlatform/k8s-stackdriver/prometheus-to-sd/config"
+)
+
+// ScrapeSchedule determines when the source is scraped. Scrapes are due at fixed intervals from the start.
+type ScrapeSchedule struct {
+	interval time.Duration
+	next     time.Time
+}
+
+// ScrapeInterval returns the time between the scrapes of the source, which is its ScrapeInterval or
+// defaultInterval if it's not set.
+func ScrapeInterval(source *config.SourceConfig, defaultInterval time.Duration) time.Duration {
+	if source.ScrapeInterval > 0 {
+		return source.ScrapeInterval
+	}
+	return defaultInterval
+}
+
+// NewScrapeSchedule creates the schedule of the source with the first scrape due one interval after start.
+func NewScrapeSchedule(source *config.SourceConfig, defaultInterval time.Duration, start time.Time) *ScrapeSchedule {
+	interval := ScrapeInterval(source, defaultInterval)
+	return &ScrapeSchedule{
+		interval: interval,
+		next:     start.Add(interval),
+	}
+}
+
+// Wait returns the time remaining until the next scrape and advances the schedule to the one after it.
+// Like with time.Ticker, the scrapes missed because the previous one took too long are skipped.
+func (schedule *ScrapeSchedule) Wait(now time.Time) time.Duration {
+	for schedule.next.Before(now) {
+		schedule.next = schedule.next.Add(schedule.interval)
+	}
+	wait := schedule.next.Sub(now)
+	schedule.next = schedule.next.Add(schedule.interval)
+	return wait
+}
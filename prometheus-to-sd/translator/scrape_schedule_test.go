@@ -0,0 +1,65 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package translator
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/GoogleCloudPlatform/k8s-stackdriver/prometheus-to-sd/config"
+)
+
+// countScrapes returns the number of scrapes of the schedule due within the duration from start,
+// assuming every scrape takes scrapeTime.
+func countScrapes(schedule *ScrapeSchedule, start time.Time, duration, scrapeTime time.Duration) int {
+	end := start.Add(duration)
+	scrapes := 0
+	for now := start; ; {
+		now = now.Add(schedule.Wait(now))
+		if now.After(end) {
+			return scrapes
+		}
+		scrapes++
+		now = now.Add(scrapeTime)
+	}
+}
+
+func TestScrapeInterval(t *testing.T) {
+	assert.Equal(t, time.Minute, ScrapeInterval(&config.SourceConfig{}, time.Minute))
+	assert.Equal(t, 5*time.Minute, ScrapeInterval(&config.SourceConfig{ScrapeInterval: 5 * time.Minute}, time.Minute))
+}
+
+func TestScrapeSchedule(t *testing.T) {
+	start := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	requests := NewScrapeSchedule(&config.SourceConfig{Component: "requests"}, time.Minute, start)
+	configs := NewScrapeSchedule(&config.SourceConfig{Component: "configs", ScrapeInterval: 5 * time.Minute}, time.Minute, start)
+
+	assert.Equal(t, 60, countScrapes(requests, start, time.Hour, time.Second))
+	assert.Equal(t, 12, countScrapes(configs, start, time.Hour, time.Second))
+}
+
+func TestScrapeScheduleSkipsMissedScrapes(t *testing.T) {
+	start := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	schedule := NewScrapeSchedule(&config.SourceConfig{}, time.Minute, start)
+
+	assert.Equal(t, time.Minute, schedule.Wait(start))
+	// The scrape due at 1m took until 3m30s, so the ones due at 2m and 3m are skipped.
+	assert.Equal(t, 30*time.Second, schedule.Wait(start.Add(3*time.Minute+30*time.Second)))
+	assert.Equal(t, time.Minute, schedule.Wait(start.Add(4*time.Minute)))
+}
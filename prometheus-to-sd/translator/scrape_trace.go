@@ -0,0 +1,86 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package translator
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// scrapeTrace records timings of a single scrape request. Durations are zero for phases that didn't happen,
+// e.g. when the connection was reused.
+type scrapeTrace struct {
+	mutex        sync.Mutex
+	start        time.Time
+	dnsStart     time.Time
+	connectStart time.Time
+	tlsStart     time.Time
+	dns          time.Duration
+	connect      time.Duration
+	tlsHandshake time.Duration
+	firstByte    time.Duration
+	reused       bool
+}
+
+// newScrapeTrace returns the trace and the hooks recording the timings into it.
+func newScrapeTrace() (*scrapeTrace, *httptrace.ClientTrace) {
+	trace := &scrapeTrace{start: time.Now()}
+	hooks := &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			trace.record(func() { trace.dnsStart = time.Now() })
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			trace.record(func() { trace.dns = time.Since(trace.dnsStart) })
+		},
+		ConnectStart: func(string, string) {
+			trace.record(func() { trace.connectStart = time.Now() })
+		},
+		ConnectDone: func(string, string, error) {
+			trace.record(func() { trace.connect = time.Since(trace.connectStart) })
+		},
+		TLSHandshakeStart: func() {
+			trace.record(func() { trace.tlsStart = time.Now() })
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			trace.record(func() { trace.tlsHandshake = time.Since(trace.tlsStart) })
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			trace.record(func() { trace.reused = info.Reused })
+		},
+		GotFirstResponseByte: func() {
+			trace.record(func() { trace.firstByte = time.Since(trace.start) })
+		},
+	}
+	return trace, hooks
+}
+
+// record updates the trace, hooks can be called concurrently, e.g. when dialing several addresses.
+func (t *scrapeTrace) record(update func()) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	update()
+}
+
+func (t *scrapeTrace) String() string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return fmt.Sprintf("dns %v, connect %v, tls handshake %v, first byte %v, connection reused: %v",
+		t.dns, t.connect, t.tlsHandshake, t.firstByte, t.reused)
+}
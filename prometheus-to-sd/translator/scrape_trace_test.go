@@ -0,0 +1,76 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package translator
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScrapeTrace(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(10 * time.Millisecond)
+		fmt.Fprint(w, testMetricsBody)
+	}))
+	defer server.Close()
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	// Use the host name, so that it has to be resolved.
+	url := strings.Replace(server.URL, "127.0.0.1", "localhost", 1)
+
+	trace, hooks := newScrapeTrace()
+	req, err := http.NewRequestWithContext(httptrace.WithClientTrace(context.Background(), hooks), http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+
+	assert.Contains(t, trace.String(), "connection reused: false")
+	trace.mutex.Lock()
+	defer trace.mutex.Unlock()
+	assert.True(t, trace.dns > 0, "dns lookup should be recorded")
+	assert.True(t, trace.connect > 0, "connect should be recorded")
+	assert.True(t, trace.tlsHandshake > 0, "tls handshake should be recorded")
+	assert.True(t, trace.firstByte >= 10*time.Millisecond, "first byte should be recorded")
+	assert.False(t, trace.reused)
+}
+
+func TestGetPrometheusMetricsTraceScrapes(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, testMetricsBody)
+	}))
+	defer server.Close()
+
+	sourceConfig := sourceConfigForServer(t, server, "trace-scrapes")
+	sourceConfig.TraceScrapes = true
+	response, err := GetPrometheusMetrics(sourceConfig)
+	if assert.NoError(t, err) {
+		assert.Equal(t, testMetricsBody, response.Raw())
+	}
+}
@@ -0,0 +1,168 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package translator
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/GoogleCloudPlatform/k8s-stackdriver/prometheus-to-sd/config"
+)
+
+// SourceWorker scrapes the source, e.g. with GetPrometheusMetricsContext, until the context is done.
+type SourceWorker func(ctx context.Context, source *config.SourceConfig)
+
+// ScrapeWorker returns the worker scraping the source with GetPrometheusMetricsContext on its scrape schedule,
+// see NewScrapeSchedule, and passing the results to the handler.
+func ScrapeWorker(defaultInterval time.Duration, handle func(source *config.SourceConfig, response *PrometheusResponse, err error)) SourceWorker {
+	return func(ctx context.Context, source *config.SourceConfig) {
+		schedule := NewScrapeSchedule(source, defaultInterval, time.Now())
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(schedule.Wait(time.Now())):
+			}
+			response, err := GetPrometheusMetricsContext(ctx, source)
+			if ctx.Err() != nil {
+				return
+			}
+			handle(source, response, err)
+		}
+	}
+}
+
+// activeSource is a source with the running worker.
+type activeSource struct {
+	config *config.SourceConfig
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// SourceReconciler keeps a worker running for every source returned by the provider. Sources are identified
+// by the component name: workers of the sources that are gone are stopped, and workers of the sources whose
+// config changed, as reported by config.SourceConfig.Equal, are restarted.
+type SourceReconciler struct {
+	provider config.SourceConfigProvider
+	worker   SourceWorker
+	mutex    sync.Mutex
+	active   map[string]*activeSource
+}
+
+// NewSourceReconciler creates a reconciler running the worker for the sources of the provider.
+func NewSourceReconciler(provider config.SourceConfigProvider, worker SourceWorker) *SourceReconciler {
+	return &SourceReconciler{
+		provider: provider,
+		worker:   worker,
+		active:   make(map[string]*activeSource),
+	}
+}
+
+// Reconcile reads the current sources from the provider once, starting workers of the new sources and stopping
+// workers of the removed ones. Workers are started with contexts derived from ctx. If the provider fails, or returns
+// several sources with the same component name, the running workers are left untouched.
+func (r *SourceReconciler) Reconcile(ctx context.Context) error {
+	sources, err := r.provider.SourceConfigs()
+	if err != nil {
+		return fmt.Errorf("failed to get source configs: %v", err)
+	}
+	current := make(map[string]*config.SourceConfig, len(sources))
+	for _, source := range sources {
+		if _, found := current[source.Component]; found {
+			return fmt.Errorf("duplicated source of component %v", source.Component)
+		}
+		current[source.Component] = source
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for component, active := range r.active {
+		if source, found := current[component]; found && source.Equal(active.config) {
+			continue
+		}
+		glog.V(2).Infof("Stopping scrapes of component %v", component)
+		active.stop()
+		delete(r.active, component)
+	}
+	for component, source := range current {
+		if _, found := r.active[component]; found {
+			continue
+		}
+		glog.V(2).Infof("Starting scrapes of component %v", component)
+		r.active[component] = r.start(ctx, source)
+	}
+	return nil
+}
+
+// Run reconciles the sources every interval until the context is done, then stops all the workers.
+func (r *SourceReconciler) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := r.Reconcile(ctx); err != nil {
+			glog.Warningf("Failed to reconcile sources, keeping the current ones: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			r.stopAll()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Components returns the sorted names of the components with running workers.
+func (r *SourceReconciler) Components() []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	components := make([]string, 0, len(r.active))
+	for component := range r.active {
+		components = append(components, component)
+	}
+	sort.Strings(components)
+	return components
+}
+
+func (r *SourceReconciler) start(ctx context.Context, source *config.SourceConfig) *activeSource {
+	ctx, cancel := context.WithCancel(ctx)
+	active := &activeSource{config: source, cancel: cancel, done: make(chan struct{})}
+	go func() {
+		defer close(active.done)
+		r.worker(ctx, source)
+	}()
+	return active
+}
+
+func (r *SourceReconciler) stopAll() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for component, active := range r.active {
+		active.stop()
+		delete(r.active, component)
+	}
+}
+
+// stop cancels the worker and waits until it returns.
+func (s *activeSource) stop() {
+	s.cancel()
+	<-s.done
+}
@@ -0,0 +1,209 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package translator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/GoogleCloudPlatform/k8s-stackdriver/prometheus-to-sd/config"
+)
+
+// stubProvider returns the sources set by the test.
+type stubProvider struct {
+	sources []*config.SourceConfig
+	err     error
+}
+
+func (p *stubProvider) SourceConfigs() ([]*config.SourceConfig, error) {
+	return p.sources, p.err
+}
+
+// workerRecorder records starts and stops of the workers, as "+component" and "-component" events.
+type workerRecorder struct {
+	mutex  sync.Mutex
+	events []string
+}
+
+func (w *workerRecorder) worker(ctx context.Context, source *config.SourceConfig) {
+	w.record("+" + source.Component)
+	<-ctx.Done()
+	w.record("-" + source.Component)
+}
+
+func (w *workerRecorder) record(event string) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.events = append(w.events, event)
+}
+
+func (w *workerRecorder) takeEvents() []string {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	events := w.events
+	w.events = nil
+	return events
+}
+
+// waitForEvents waits until the number of recorded events reaches n, as workers are started asynchronously.
+func (w *workerRecorder) waitForEvents(t *testing.T, n int) []string {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		w.mutex.Lock()
+		count := len(w.events)
+		w.mutex.Unlock()
+		if count >= n {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return w.takeEvents()
+}
+
+func sources(components ...string) []*config.SourceConfig {
+	var result []*config.SourceConfig
+	for _, component := range components {
+		result = append(result, &config.SourceConfig{Component: component, Host: "localhost", Port: 8080})
+	}
+	return result
+}
+
+func TestSourceReconcilerAddsAndRemoves(t *testing.T) {
+	provider := &stubProvider{sources: sources("a", "b")}
+	recorder := &workerRecorder{}
+	reconciler := NewSourceReconciler(provider, recorder.worker)
+	ctx := context.Background()
+
+	assert.NoError(t, reconciler.Reconcile(ctx))
+	assert.Equal(t, []string{"a", "b"}, reconciler.Components())
+	assert.ElementsMatch(t, []string{"+a", "+b"}, recorder.waitForEvents(t, 2))
+
+	assert.NoError(t, reconciler.Reconcile(ctx))
+	assert.Empty(t, recorder.takeEvents(), "unchanged sources should keep running")
+
+	provider.sources = sources("b", "c")
+	assert.NoError(t, reconciler.Reconcile(ctx))
+	assert.Equal(t, []string{"b", "c"}, reconciler.Components())
+	assert.ElementsMatch(t, []string{"-a", "+c"}, recorder.waitForEvents(t, 2))
+
+	provider.sources = sources("b", "c")
+	provider.sources[0].Port = 9090
+	assert.NoError(t, reconciler.Reconcile(ctx))
+	assert.Equal(t, []string{"-b", "+b"}, recorder.waitForEvents(t, 2), "changed source should be restarted")
+
+	reconciler.stopAll()
+	assert.Empty(t, reconciler.Components())
+	assert.ElementsMatch(t, []string{"-b", "-c"}, recorder.takeEvents())
+}
+
+func TestSourceReconcilerKeepsSourcesWithFunctions(t *testing.T) {
+	withFunctions := func() []*config.SourceConfig {
+		result := sources("a")
+		result[0].ScrapeErrorSink = config.ScrapeErrorSinkFunc(func(component, url string, err error) {})
+		return result
+	}
+	provider := &stubProvider{sources: withFunctions()}
+	recorder := &workerRecorder{}
+	reconciler := NewSourceReconciler(provider, recorder.worker)
+	defer reconciler.stopAll()
+	ctx := context.Background()
+
+	assert.NoError(t, reconciler.Reconcile(ctx))
+	assert.Equal(t, []string{"+a"}, recorder.waitForEvents(t, 1))
+	for i := 0; i < 3; i++ {
+		provider.sources = withFunctions()
+		assert.NoError(t, reconciler.Reconcile(ctx))
+	}
+	assert.Empty(t, recorder.takeEvents(), "sources with an error sink should keep running")
+}
+
+func TestSourceReconcilerKeepsSourcesOnErrors(t *testing.T) {
+	provider := &stubProvider{sources: sources("a")}
+	recorder := &workerRecorder{}
+	reconciler := NewSourceReconciler(provider, recorder.worker)
+	defer reconciler.stopAll()
+	ctx := context.Background()
+
+	assert.NoError(t, reconciler.Reconcile(ctx))
+	recorder.waitForEvents(t, 1)
+
+	provider.sources, provider.err = nil, errors.New("discovery unavailable")
+	assert.Error(t, reconciler.Reconcile(ctx))
+	assert.Equal(t, []string{"a"}, reconciler.Components())
+
+	provider.sources, provider.err = sources("b", "b"), nil
+	if err := reconciler.Reconcile(ctx); assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "duplicated")
+	}
+	assert.Equal(t, []string{"a"}, reconciler.Components())
+	assert.Empty(t, recorder.takeEvents())
+}
+
+func TestSourceReconcilerRun(t *testing.T) {
+	provider := &stubProvider{sources: sources("a")}
+	recorder := &workerRecorder{}
+	reconciler := NewSourceReconciler(provider, recorder.worker)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		reconciler.Run(ctx, time.Millisecond)
+	}()
+
+	assert.Equal(t, []string{"+a"}, recorder.waitForEvents(t, 1))
+	cancel()
+	<-done
+	assert.Equal(t, []string{"-a"}, recorder.takeEvents(), "workers should be stopped when the context is done")
+	assert.Empty(t, reconciler.Components())
+}
+
+func TestScrapeWorker(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, testMetricsBody)
+	}))
+	defer server.Close()
+
+	results := make(chan error, 10)
+	worker := ScrapeWorker(time.Millisecond, func(source *config.SourceConfig, response *PrometheusResponse, err error) {
+		if err == nil && response.rawResponse != testMetricsBody {
+			err = fmt.Errorf("unexpected body %q", response.rawResponse)
+		}
+		select {
+		case results <- err:
+		default:
+		}
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		worker(ctx, sourceConfigForServer(t, server, "scrape-worker"))
+	}()
+
+	assert.NoError(t, <-results)
+	assert.NoError(t, <-results, "source should be scraped repeatedly")
+	cancel()
+	<-done
+}
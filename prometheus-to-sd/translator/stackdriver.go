@@ -18,11 +18,13 @@ package translator
 
 import (
 	"fmt"
+	"net/http"
 	"strings"
 	"sync"
 	"sync/atomic"
 
 	"github.com/golang/glog"
+	"google.golang.org/api/googleapi"
 	v3 "google.golang.org/api/monitoring/v3"
 
 	"github.com/GoogleCloudPlatform/k8s-stackdriver/prometheus-to-sd/config"
@@ -88,18 +90,52 @@ func getMetricDescriptors(service *v3.Service, config *config.CommonConfig) (map
 }
 
 // updateMetricDescriptorInStackdriver writes metric descriptor to the stackdriver.
-func updateMetricDescriptorInStackdriver(service *v3.Service, config *config.GceConfig, metricDescriptor *v3.MetricDescriptor) bool {
+func updateMetricDescriptorInStackdriver(service *v3.Service, config *config.GceConfig, metricDescriptor *v3.MetricDescriptor) error {
 	glog.V(4).Infof("Updating metric descriptor: %+v", metricDescriptor)
 
 	projectName := createProjectName(config)
 	_, err := service.Projects.MetricDescriptors.Create(projectName, metricDescriptor).Do()
 	if err != nil {
 		glog.Errorf("Error in attempt to update metric descriptor %v", err)
+		return err
+	}
+	return nil
+}
+
+// getMetricDescriptorFromStackdriver fetches the current version of the metric descriptor from the stackdriver.
+// Returns false if the descriptor doesn't exist.
+func getMetricDescriptorFromStackdriver(service *v3.Service, config *config.GceConfig, metricDescriptor *v3.MetricDescriptor) (*v3.MetricDescriptor, bool, error) {
+	descriptor, err := service.Projects.MetricDescriptors.Get(metricDescriptorName(config, metricDescriptor)).Do()
+	if err != nil {
+		if apiErr, ok := err.(*googleapi.Error); ok && apiErr.Code == http.StatusNotFound {
+			return nil, false, nil
+		}
+		glog.Errorf("Error in attempt to fetch metric descriptor %v", err)
+		return nil, false, err
+	}
+	return descriptor, true, nil
+}
+
+// deleteMetricDescriptorInStackdriver deletes metric descriptor from the stackdriver.
+func deleteMetricDescriptorInStackdriver(service *v3.Service, config *config.GceConfig, metricDescriptor *v3.MetricDescriptor) bool {
+	glog.V(2).Infof("Deleting metric descriptor %s", metricDescriptor.Type)
+
+	_, err := service.Projects.MetricDescriptors.Delete(metricDescriptorName(config, metricDescriptor)).Do()
+	if err != nil {
+		glog.Errorf("Error in attempt to delete metric descriptor %v", err)
 		return false
 	}
 	return true
 }
 
+// metricDescriptorName returns the resource name of the metric descriptor.
+func metricDescriptorName(config *config.GceConfig, metricDescriptor *v3.MetricDescriptor) string {
+	if strings.HasPrefix(metricDescriptor.Name, "projects/") {
+		return metricDescriptor.Name
+	}
+	return fmt.Sprintf("%s/metricDescriptors/%s", createProjectName(config), metricDescriptor.Type)
+}
+
 // parseMetricType extracts component and metricName from Metric.Type (e.g. output of getMetricType).
 func parseMetricType(config *config.CommonConfig, metricType string) (component, metricName string, err error) {
 	if !strings.HasPrefix(metricType, fmt.Sprintf("%s/", config.SourceConfig.MetricsPrefix)) {
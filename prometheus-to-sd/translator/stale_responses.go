@@ -0,0 +1,68 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package translator
+
+import (
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/k8s-stackdriver/prometheus-to-sd/config"
+)
+
+// staleResponses keeps the last successful responses of the sources with the stale window configured.
+var staleResponses = newStaleResponseCache()
+
+type cachedResponse struct {
+	response *PrometheusResponse
+	scraped  time.Time
+}
+
+// staleResponseCache keeps the last successful response of every component, so that it can be served
+// instead of the failed scrape.
+type staleResponseCache struct {
+	mutex     sync.Mutex
+	responses map[string]cachedResponse
+}
+
+func newStaleResponseCache() *staleResponseCache {
+	return &staleResponseCache{responses: make(map[string]cachedResponse)}
+}
+
+// withStaleFallback stores the successful response of the scrape finished at the given time, or replaces
+// the error of the failed scrape with the last successful response, if it's not older than the stale window
+// of the source. The served response is marked as stale.
+func (c *staleResponseCache) withStaleFallback(config *config.SourceConfig, response *PrometheusResponse, err error, now time.Time) (*PrometheusResponse, error) {
+	if config.StaleWindow <= 0 {
+		return response, err
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if err == nil {
+		c.responses[config.Component] = cachedResponse{response: response.retained(), scraped: now}
+		return response, nil
+	}
+	cached, found := c.responses[config.Component]
+	if !found || now.Sub(cached.scraped) > config.StaleWindow {
+		delete(c.responses, config.Component)
+		return nil, err
+	}
+	loggerFor(config).Warning("Scrape failed, serving stale response", "component", config.Component, "scraped", cached.scraped, "error", err)
+	servedStale.WithLabelValues(config.Component).Inc()
+	stale := cached.response.retained()
+	stale.stale = true
+	return stale, nil
+}
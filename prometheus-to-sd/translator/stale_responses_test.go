@@ -0,0 +1,101 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package translator
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/GoogleCloudPlatform/k8s-stackdriver/prometheus-to-sd/config"
+)
+
+func servedStaleValue(t *testing.T, component string) float64 {
+	metric := &dto.Metric{}
+	if err := servedStale.WithLabelValues(component).Write(metric); err != nil {
+		t.Fatalf("Failed to read servedStale: %v", err)
+	}
+	return metric.GetCounter().GetValue()
+}
+
+func TestWithStaleFallback(t *testing.T) {
+	cache := newStaleResponseCache()
+	sourceConfig := &config.SourceConfig{Component: "stale-fallback", StaleWindow: time.Minute}
+	scraped := time.Unix(1500000000, 0)
+	errScrape := errors.New("connection refused")
+
+	fresh := &PrometheusResponse{rawResponse: testMetricsBody}
+	response, err := cache.withStaleFallback(sourceConfig, fresh, nil, scraped)
+	if assert.NoError(t, err) {
+		assert.False(t, response.Stale(), "fresh response should not be marked stale")
+	}
+
+	response, err = cache.withStaleFallback(sourceConfig, nil, errScrape, scraped.Add(time.Minute))
+	if assert.NoError(t, err, "response within the stale window should be served") {
+		assert.True(t, response.Stale())
+		assert.Equal(t, testMetricsBody, response.Raw())
+		assert.False(t, fresh.Stale(), "cached response should not be modified")
+	}
+	assert.Equal(t, 1.0, servedStaleValue(t, "stale-fallback"))
+
+	_, err = cache.withStaleFallback(sourceConfig, nil, errScrape, scraped.Add(time.Minute+time.Second))
+	assert.Equal(t, errScrape, err, "response older than the stale window should not be served")
+	_, err = cache.withStaleFallback(sourceConfig, nil, errScrape, scraped.Add(time.Second))
+	assert.Equal(t, errScrape, err, "expired response should be forgotten")
+	assert.Equal(t, 1.0, servedStaleValue(t, "stale-fallback"))
+}
+
+func TestWithStaleFallbackDisabled(t *testing.T) {
+	cache := newStaleResponseCache()
+	sourceConfig := &config.SourceConfig{Component: "stale-fallback-disabled"}
+	now := time.Unix(1500000000, 0)
+	cache.withStaleFallback(sourceConfig, &PrometheusResponse{rawResponse: testMetricsBody}, nil, now)
+	_, err := cache.withStaleFallback(sourceConfig, nil, errors.New("connection refused"), now)
+	assert.Error(t, err)
+	assert.Empty(t, cache.responses)
+}
+
+func TestGetPrometheusMetricsServesStale(t *testing.T) {
+	failing := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprint(w, testMetricsBody)
+	}))
+	defer server.Close()
+
+	sourceConfig := sourceConfigForServer(t, server, "served-stale")
+	sourceConfig.StaleWindow = time.Hour
+	_, err := GetPrometheusMetrics(sourceConfig)
+	assert.NoError(t, err)
+
+	failing = true
+	response, err := GetPrometheusMetrics(sourceConfig)
+	if assert.NoError(t, err) {
+		assert.True(t, response.Stale())
+	}
+	assert.Equal(t, 1.0, componentMetricsAvailableValue(t, "served-stale"), "component serving stale response should be available")
+	assert.Equal(t, 1.0, servedStaleValue(t, "served-stale"))
+}
@@ -0,0 +1,160 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package translator
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+
+	"github.com/golang/protobuf/proto"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+
+	"github.com/GoogleCloudPlatform/k8s-stackdriver/prometheus-to-sd/config"
+)
+
+// countingReader counts the bytes read from the underlying reader and keeps the last error other than io.EOF,
+// so that the errors of the connection can be told apart from the parse errors.
+type countingReader struct {
+	reader io.Reader
+	bytes  int64
+	err    error
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.bytes += int64(n)
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return n, err
+}
+
+// streamResponse parses the body while it's read, so that it's never buffered as a whole.
+func streamResponse(config *config.SourceConfig, contentType string, body *countingReader) (*PrometheusResponse, error) {
+	buffered := bufio.NewReader(body)
+	// Peek returns fewer bytes together with an error if the body is shorter.
+	prefix, _ := buffered.Peek(contentTypePrefixBytes)
+	if err := validateContentType(config.Format, contentType, prefix); err != nil {
+		return nil, err
+	}
+	families, units, exemplars, err := parseStream(config.Format, contentType, buffered)
+	if config.MaxBodyBytes > 0 && body.bytes > config.MaxBodyBytes {
+		return nil, fmt.Errorf("response of component %s exceeds the limit of %d bytes", config.Component, config.MaxBodyBytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &PrometheusResponse{
+		contentType: contentType,
+		streamed:    true,
+		families:    families,
+		units:       units,
+		exemplars:   exemplars,
+	}, nil
+}
+
+// parseStream parses the metric families using the decoder of the format, or parser matching the content type.
+// Unlike the buffered responses, malformed families of the text format can't be skipped.
+func parseStream(sourceFormat, contentType string, in io.Reader) (map[string]*dto.MetricFamily, map[string]string, map[*dto.Bucket]*Exemplar, error) {
+	if decode, found := decoders[sourceFormat]; found {
+		return decode(contentType, in)
+	}
+	format, err := responseFormat(contentType)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	switch format {
+	case fmtOpenMetrics001, fmtOpenMetrics100:
+		return parseOpenMetricsWithMetadata(in)
+	case expfmt.FmtProtoDelim:
+		metrics, err := parseProtobuf(contentType, in)
+		return metrics, nil, nil, err
+	default:
+		parser := &expfmt.TextParser{}
+		metrics, err := parser.TextToMetricFamilies(in)
+		return metrics, nil, nil, err
+	}
+}
+
+// takeStreamed returns the metric families of the streamed response. They are modified when processed,
+// hence they can be taken only once, use retained to parse the response again.
+func (p *PrometheusResponse) takeStreamed() (map[string]*dto.MetricFamily, map[string]string, error) {
+	if p.families == nil {
+		return nil, nil, fmt.Errorf("streamed response can be parsed only once")
+	}
+	families := p.families
+	p.families = nil
+	return families, p.units, nil
+}
+
+// retained returns the copy of the response that can be parsed independently of it. Metric families
+// of the streamed responses are deep copied, bodies of other ones are shared.
+func (p *PrometheusResponse) retained() *PrometheusResponse {
+	retained := *p
+	if p.streamed {
+		retained.families, retained.exemplars = cloneFamilies(p.families, p.exemplars)
+	}
+	retained.additional = make([]*PrometheusResponse, 0, len(p.additional))
+	for _, additional := range p.additional {
+		retained.additional = append(retained.additional, additional.retained())
+	}
+	return &retained
+}
+
+// cloneFamilies deep copies the metric families together with the exemplars of their buckets.
+func cloneFamilies(families map[string]*dto.MetricFamily, exemplars map[*dto.Bucket]*Exemplar) (map[string]*dto.MetricFamily, map[*dto.Bucket]*Exemplar) {
+	if families == nil {
+		return nil, nil
+	}
+	clones := make(map[string]*dto.MetricFamily, len(families))
+	var clonedExemplars map[*dto.Bucket]*Exemplar
+	if exemplars != nil {
+		clonedExemplars = make(map[*dto.Bucket]*Exemplar, len(exemplars))
+	}
+	for name, family := range families {
+		clone := proto.Clone(family).(*dto.MetricFamily)
+		clones[name] = clone
+		for i, metric := range family.Metric {
+			for j, bucket := range metric.GetHistogram().GetBucket() {
+				if exemplar, found := exemplars[bucket]; found {
+					clonedExemplars[clone.Metric[i].Histogram.Bucket[j]] = exemplar
+				}
+			}
+		}
+	}
+	return clones, clonedExemplars
+}
+
+// empty returns true if the response contains no metric families. Streamed responses aren't consumed.
+func (p *PrometheusResponse) empty() bool {
+	if !p.streamed {
+		metrics, err := p.parse()
+		// Malformed responses are reported when they are parsed again during the export.
+		return err == nil && len(metrics) == 0
+	}
+	if len(p.families) > 0 {
+		return false
+	}
+	for _, additional := range p.additional {
+		if !additional.empty() {
+			return false
+		}
+	}
+	return true
+}
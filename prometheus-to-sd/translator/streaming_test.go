@@ -0,0 +1,177 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package translator
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetPrometheusMetricsStreamResponse(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, testMetricsBody)
+	}))
+	defer server.Close()
+
+	sourceConfig := sourceConfigForServer(t, server, "stream-response")
+	buffered, err := GetPrometheusMetrics(sourceConfig)
+	if !assert.NoError(t, err) {
+		return
+	}
+	want, err := buffered.parse()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	sourceConfig.StreamResponse = true
+	streamed, err := GetPrometheusMetrics(sourceConfig)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "", streamed.Raw(), "streamed response should keep no body")
+	retained := streamed.retained()
+	metrics, err := streamed.parse()
+	if assert.NoError(t, err) {
+		assert.Equal(t, want, metrics)
+	}
+	_, err = streamed.parse()
+	assert.Error(t, err, "streamed response should be parsed only once")
+	metrics, err = retained.parse()
+	if assert.NoError(t, err) {
+		assert.Equal(t, want, metrics, "retained copy should be parsed independently")
+	}
+}
+
+func TestGetPrometheusMetricsStreamResponseErrors(t *testing.T) {
+	body := testMetricsBody
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, body)
+	}))
+	defer server.Close()
+
+	sourceConfig := sourceConfigForServer(t, server, "stream-response-errors")
+	sourceConfig.StreamResponse = true
+	sourceConfig.MaxBodyBytes = 10
+	_, err := GetPrometheusMetrics(sourceConfig)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "exceeds the limit of 10 bytes")
+	}
+
+	sourceConfig.MaxBodyBytes = 0
+	body = "test_name{ 42\n"
+	_, err = GetPrometheusMetrics(sourceConfig)
+	assert.Error(t, err, "malformed streamed response should fail the scrape")
+}
+
+func TestStreamResponseServedStale(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, testMetricsBody)
+	}))
+	defer server.Close()
+	sourceConfig := sourceConfigForServer(t, server, "stream-response-stale")
+	sourceConfig.StreamResponse = true
+	sourceConfig.StaleWindow = time.Minute
+
+	cache := newStaleResponseCache()
+	fresh, err := GetPrometheusMetrics(sourceConfig)
+	if !assert.NoError(t, err) {
+		return
+	}
+	scraped := time.Now()
+	fresh, _ = cache.withStaleFallback(sourceConfig, fresh, nil, scraped)
+	_, err = fresh.parse()
+	assert.NoError(t, err)
+
+	errScrape := errors.New("connection refused")
+	for i := 0; i < 2; i++ {
+		stale, err := cache.withStaleFallback(sourceConfig, nil, errScrape, scraped.Add(time.Second))
+		if !assert.NoError(t, err) {
+			return
+		}
+		metrics, err := stale.parse()
+		if assert.NoError(t, err, "stale response should be parsed every time it's served") {
+			assert.Contains(t, metrics, "test_name")
+		}
+	}
+}
+
+func TestCloneFamiliesExemplars(t *testing.T) {
+	response := &PrometheusResponse{contentType: openMetricsMediaType, rawResponse: `# TYPE latency histogram
+latency_bucket{le="1"} 1 # {trace_id="abc"} 0.5
+latency_bucket{le="+Inf"} 2
+latency_sum 3
+latency_count 2
+# EOF
+`}
+	metrics, err := response.parse()
+	if !assert.NoError(t, err) {
+		return
+	}
+	clones, exemplars := cloneFamilies(metrics, response.Exemplars())
+	original := metrics["latency"].Metric[0].Histogram.Bucket[0]
+	cloned := clones["latency"].Metric[0].Histogram.Bucket[0]
+	assert.Equal(t, metrics, clones)
+	assert.False(t, original == cloned, "buckets should be copied")
+	if assert.Contains(t, exemplars, cloned) {
+		assert.Equal(t, response.Exemplars()[original], exemplars[cloned])
+	}
+}
+
+// scrapeAllocatedBytes returns the number of bytes allocated while scraping and parsing the source.
+func scrapeAllocatedBytes(t *testing.T, server *httptest.Server, stream bool) uint64 {
+	sourceConfig := sourceConfigForServer(t, server, "stream-response-allocations")
+	sourceConfig.StreamResponse = stream
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	response, err := GetPrometheusMetrics(sourceConfig)
+	if err != nil {
+		t.Fatalf("Failed to scrape: %v", err)
+	}
+	if _, err := response.parse(); err != nil {
+		t.Fatalf("Failed to parse: %v", err)
+	}
+	runtime.ReadMemStats(&after)
+	return after.TotalAlloc - before.TotalAlloc
+}
+
+func TestStreamResponseAllocations(t *testing.T) {
+	var payload bytes.Buffer
+	payload.WriteString("# TYPE requests counter\n")
+	for i := 0; i < 20000; i++ {
+		fmt.Fprintf(&payload, "requests{path=\"/api/v1/resources/%d\",code=\"200\",method=\"GET\"} %d\n", i, i)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(payload.Bytes())
+	}))
+	defer server.Close()
+
+	// Warm up the connection and the client cache, so that they don't count towards the first measurement.
+	scrapeAllocatedBytes(t, server, false)
+	buffered := scrapeAllocatedBytes(t, server, false)
+	streamed := scrapeAllocatedBytes(t, server, true)
+	t.Logf("Payload of %d bytes, allocated %d bytes buffered and %d bytes streamed", payload.Len(), buffered, streamed)
+	assert.True(t, streamed+uint64(payload.Len()) < buffered, "streamed scrape should allocate at least the payload size less than the buffered one")
+}
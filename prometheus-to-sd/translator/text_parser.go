@@ -0,0 +1,110 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package translator
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/golang/glog"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// parseText parses metric families in the Prometheus text format. The text parser stops at the first
+// malformed line, so if the whole payload can't be parsed, each family is parsed separately and only
+// the malformed ones are skipped. Returns the number of skipped families, and an error if none parsed.
+func parseText(raw string) (map[string]*dto.MetricFamily, int, error) {
+	parser := &expfmt.TextParser{}
+	metrics, err := parser.TextToMetricFamilies(strings.NewReader(raw))
+	if err == nil {
+		return metrics, 0, nil
+	}
+	glog.V(2).Infof("Failed to parse the whole response, parsing metric families separately: %v", err)
+
+	metrics = make(map[string]*dto.MetricFamily)
+	parseErrors := 0
+	var lastErr error
+	for _, chunk := range splitTextFamilies(raw) {
+		parser := &expfmt.TextParser{}
+		families, err := parser.TextToMetricFamilies(strings.NewReader(chunk))
+		if err != nil {
+			glog.Warningf("Skipping malformed metric family: %v", err)
+			parseErrors++
+			lastErr = err
+			continue
+		}
+		for name, family := range families {
+			existing, found := metrics[name]
+			if !found {
+				metrics[name] = family
+			} else if existing.GetType() == family.GetType() {
+				existing.Metric = append(existing.Metric, family.Metric...)
+			}
+		}
+	}
+	if len(metrics) == 0 {
+		return nil, parseErrors, fmt.Errorf("no metric family could be parsed: %v", lastErr)
+	}
+	return metrics, parseErrors, nil
+}
+
+// splitTextFamilies splits the text format payload into chunks containing a single metric family each:
+// its HELP and TYPE lines followed by the samples.
+func splitTextFamilies(raw string) []string {
+	var chunks []string
+	var current []string
+	currentName := ""
+	// Metadata lines of the family start a new chunk only if they don't follow other metadata of it.
+	inMetadata := false
+	flush := func() {
+		if len(current) > 0 {
+			chunks = append(chunks, strings.Join(current, "\n")+"\n")
+		}
+		current = nil
+	}
+	for _, line := range strings.Split(raw, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" {
+			continue
+		}
+		if strings.HasPrefix(trimmed, "#") {
+			fields := strings.Fields(trimmed)
+			if len(fields) >= 3 && (fields[1] == "HELP" || fields[1] == "TYPE") {
+				if !inMetadata || fields[2] != currentName {
+					flush()
+				}
+				currentName = fields[2]
+				inMetadata = true
+			}
+			current = append(current, line)
+			continue
+		}
+		inMetadata = false
+		name := trimmed
+		if i := strings.IndexAny(name, "{ \t"); i >= 0 {
+			name = name[:i]
+		}
+		if currentName == "" || (name != currentName && !strings.HasPrefix(name, currentName+"_")) {
+			flush()
+			currentName = name
+		}
+		current = append(current, line)
+	}
+	flush()
+	return chunks
+}
@@ -0,0 +1,74 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package translator
+
+import (
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+)
+
+const partiallyMalformedResponse = `# HELP requests Number of requests.
+# TYPE requests counter
+requests{code="200"} 10
+requests{code="500"} 1
+# HELP temperature Temperature.
+# TYPE temperature gauge
+temperature{sensor="1" 20
+# TYPE latency histogram
+latency_bucket{le="1"} 1
+latency_bucket{le="+Inf"} 2
+latency_sum 3
+latency_count 2
+untyped_metric 5
+`
+
+func TestParseTextSkipsMalformedFamilies(t *testing.T) {
+	metrics, parseErrors, err := parseText(partiallyMalformedResponse)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, 1, parseErrors)
+	assert.Equal(t, []string{"latency", "requests", "untyped_metric"}, sortedNames(metrics))
+	assert.Equal(t, 2, len(metrics["requests"].Metric))
+	assert.Equal(t, "Number of requests.", metrics["requests"].GetHelp())
+	assert.Equal(t, dto.MetricType_HISTOGRAM, metrics["latency"].GetType())
+	assert.Equal(t, uint64(2), metrics["latency"].Metric[0].GetHistogram().GetSampleCount())
+}
+
+func TestParseTextNothingParsed(t *testing.T) {
+	_, parseErrors, err := parseText("# TYPE broken counter\nbroken{ 1\n")
+	assert.Error(t, err)
+	assert.Equal(t, 1, parseErrors)
+}
+
+func TestBuildCountsParseErrors(t *testing.T) {
+	before := scrapeParseErrorsValue(t, "testcomponent")
+	metrics, err := (&PrometheusResponse{rawResponse: partiallyMalformedResponse}).Build(commonConfig, buildCacheForTesting())
+	assert.NoError(t, err)
+	assert.Contains(t, metrics, "requests")
+	assert.Equal(t, 1.0, scrapeParseErrorsValue(t, "testcomponent")-before)
+}
+
+func scrapeParseErrorsValue(t *testing.T, component string) float64 {
+	metric := &dto.Metric{}
+	if err := scrapeParseErrors.WithLabelValues(component).Write(metric); err != nil {
+		t.Fatalf("Failed to read scrapeParseErrors: %v", err)
+	}
+	return metric.GetCounter().GetValue()
+}
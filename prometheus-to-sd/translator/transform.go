@@ -0,0 +1,714 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package translator
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/golang/glog"
+	"github.com/golang/protobuf/proto"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/GoogleCloudPlatform/k8s-stackdriver/prometheus-to-sd/config"
+)
+
+var (
+	compiledRegexpsMutex sync.Mutex
+	// compiledRegexps caches regular expressions from the configs, so they are compiled only once.
+	compiledRegexps = make(map[string]*regexp.Regexp)
+
+	droppedUntypedMutex sync.Mutex
+	// droppedUntyped contains untyped metrics that were already reported as dropped.
+	droppedUntyped = make(map[string]bool)
+
+	ignoredDeltaOverridesMutex sync.Mutex
+	// ignoredDeltaOverrides contains metrics whose DELTA kind override was already reported as ignored.
+	ignoredDeltaOverrides = make(map[string]bool)
+)
+
+// compileRegexps returns compiled regular expressions for the given patterns.
+func compileRegexps(patterns []string) ([]*regexp.Regexp, error) {
+	compiledRegexpsMutex.Lock()
+	defer compiledRegexpsMutex.Unlock()
+	result := make([]*regexp.Regexp, 0, len(patterns))
+	for _, pattern := range patterns {
+		re, found := compiledRegexps[pattern]
+		if !found {
+			var err error
+			if re, err = regexp.Compile(pattern); err != nil {
+				return nil, err
+			}
+			compiledRegexps[pattern] = re
+		}
+		result = append(result, re)
+	}
+	return result, nil
+}
+
+func matchesAny(name string, regexps []*regexp.Regexp) bool {
+	for _, re := range regexps {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// FilterMetricNames drops metric families with names matching any of the exclude patterns and,
+// if include patterns are provided, families not matching any of them. Exclude patterns take
+// precedence over include patterns. Patterns are not anchored.
+func FilterMetricNames(metricFamilies map[string]*dto.MetricFamily, include, exclude []string) (map[string]*dto.MetricFamily, error) {
+	if len(include) == 0 && len(exclude) == 0 {
+		return metricFamilies, nil
+	}
+	includeRegexps, err := compileRegexps(include)
+	if err != nil {
+		return nil, err
+	}
+	excludeRegexps, err := compileRegexps(exclude)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]*dto.MetricFamily)
+	for metricName, metricFamily := range metricFamilies {
+		if matchesAny(metricName, excludeRegexps) {
+			glog.V(4).Infof("Metric %s dropped, it matches exclude patterns", metricName)
+			continue
+		}
+		if len(includeRegexps) > 0 && !matchesAny(metricName, includeRegexps) {
+			glog.V(4).Infof("Metric %s dropped, it doesn't match include patterns", metricName)
+			continue
+		}
+		result[metricName] = metricFamily
+	}
+	return result, nil
+}
+
+// AddStaticLabels adds the given labels to every metric. Labels already present on the metric
+// are kept unless overwrite is set.
+func AddStaticLabels(metricFamilies map[string]*dto.MetricFamily, labels map[string]string, overwrite bool) map[string]*dto.MetricFamily {
+	if len(labels) == 0 {
+		return metricFamilies
+	}
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, family := range metricFamilies {
+		for _, metric := range family.Metric {
+			for _, name := range names {
+				setLabel(metric, name, labels[name], overwrite)
+			}
+		}
+	}
+	return metricFamilies
+}
+
+// setLabel sets value of the metric label, adding the label if it's missing. Value of the existing
+// label is changed only if overwrite is set.
+func setLabel(metric *dto.Metric, name, value string, overwrite bool) {
+	for _, label := range metric.Label {
+		if label.GetName() == name {
+			if overwrite {
+				label.Value = proto.String(value)
+			}
+			return
+		}
+	}
+	metric.Label = append(metric.Label, &dto.LabelPair{Name: proto.String(name), Value: proto.String(value)})
+}
+
+// RenameLabels renames labels of every metric according to the given mapping. If several labels
+// of a metric end up with the same name, only the first of them is kept. Metrics of the family that
+// become indistinguishable are merged like by DropLabels.
+func RenameLabels(metricFamilies map[string]*dto.MetricFamily, renames map[string]string, strategies config.AggregationStrategies) map[string]*dto.MetricFamily {
+	if len(renames) == 0 {
+		return metricFamilies
+	}
+	for _, family := range metricFamilies {
+		renameFamilyLabels(family, func(name string) string {
+			if newName, found := renames[name]; found {
+				return newName
+			}
+			return name
+		})
+		family.Metric = mergeDuplicateSeries(family, aggregationStrategy(family, strategies))
+	}
+	return metricFamilies
+}
+
+// renameFamilyLabels renames labels of all metrics of the family using the rename function. Labels renamed
+// to an empty name are removed. If two labels of a metric end up with the same name, the first one is kept.
+func renameFamilyLabels(family *dto.MetricFamily, rename func(string) string) {
+	for _, metric := range family.Metric {
+		seen := make(map[string]bool)
+		labels := make([]*dto.LabelPair, 0, len(metric.Label))
+		for _, label := range metric.Label {
+			name := rename(label.GetName())
+			if name == "" {
+				continue
+			}
+			if seen[name] {
+				glog.Warningf("Label %s of metric %s collides with another label after renaming, dropping it", label.GetName(), family.GetName())
+				continue
+			}
+			seen[name] = true
+			labels = append(labels, &dto.LabelPair{Name: proto.String(name), Value: label.Value})
+		}
+		metric.Label = labels
+	}
+}
+
+// DropLabels removes the given labels from every metric. As dropping a label can make several
+// metrics of the family indistinguishable, such duplicates are merged: values of counters and gauges
+// are aggregated using the strategy configured for the metric, by default counters are summed and
+// for gauges the last value wins. Histogram and summary counts and sums are always summed.
+func DropLabels(metricFamilies map[string]*dto.MetricFamily, labels []string, strategies config.AggregationStrategies) map[string]*dto.MetricFamily {
+	if len(labels) == 0 {
+		return metricFamilies
+	}
+	dropped := make(map[string]bool)
+	for _, label := range labels {
+		dropped[label] = true
+	}
+	return removeLabels(metricFamilies, func(name string) bool { return dropped[name] }, strategies)
+}
+
+// KeepLabels removes from every metric all labels except the given ones. Metrics of the family that
+// become indistinguishable are merged like by DropLabels.
+func KeepLabels(metricFamilies map[string]*dto.MetricFamily, labels []string, strategies config.AggregationStrategies) map[string]*dto.MetricFamily {
+	if len(labels) == 0 {
+		return metricFamilies
+	}
+	kept := make(map[string]bool)
+	for _, label := range labels {
+		kept[label] = true
+	}
+	return removeLabels(metricFamilies, func(name string) bool { return !kept[name] }, strategies)
+}
+
+// removeLabels removes the labels matching the predicate from every metric and merges the resulting duplicates.
+func removeLabels(metricFamilies map[string]*dto.MetricFamily, removed func(string) bool, strategies config.AggregationStrategies) map[string]*dto.MetricFamily {
+	for _, family := range metricFamilies {
+		for _, metric := range family.Metric {
+			var kept []*dto.LabelPair
+			for _, label := range metric.Label {
+				if !removed(label.GetName()) {
+					kept = append(kept, label)
+				}
+			}
+			if len(kept) != len(metric.Label) {
+				metric.Label = kept
+			}
+		}
+		family.Metric = mergeDuplicateSeries(family, aggregationStrategy(family, strategies))
+	}
+	return metricFamilies
+}
+
+// aggregationStrategy returns the strategy configured for the metric family, or the default one for its type.
+func aggregationStrategy(family *dto.MetricFamily, strategies config.AggregationStrategies) config.AggregationStrategy {
+	if strategy, found := strategies[family.GetName()]; found {
+		return strategy
+	}
+	if family.GetType() == dto.MetricType_COUNTER {
+		return config.AggregateSum
+	}
+	return config.AggregateLast
+}
+
+// familyStrategies returns the strategies configured for the families by their current names, indexed by the
+// family, so that they can be tracked across renames of the families.
+func familyStrategies(metricFamilies map[string]*dto.MetricFamily, strategies config.AggregationStrategies) map[*dto.MetricFamily]config.AggregationStrategy {
+	result := make(map[*dto.MetricFamily]config.AggregationStrategy)
+	for name, family := range metricFamilies {
+		if strategy, found := strategies[name]; found {
+			result[family] = strategy
+		}
+	}
+	return result
+}
+
+// renamedStrategies returns the strategies of the families tracked by familyStrategies, indexed by their current names.
+func renamedStrategies(metricFamilies map[string]*dto.MetricFamily, strategies map[*dto.MetricFamily]config.AggregationStrategy) config.AggregationStrategies {
+	result := make(config.AggregationStrategies)
+	for name, family := range metricFamilies {
+		if strategy, found := strategies[family]; found {
+			result[name] = strategy
+		}
+	}
+	return result
+}
+
+// aggregate merges the value into the target value using the strategy.
+func aggregate(strategy config.AggregationStrategy, target, value float64) float64 {
+	switch strategy {
+	case config.AggregateSum:
+		return target + value
+	case config.AggregateMax:
+		return math.Max(target, value)
+	case config.AggregateMin:
+		return math.Min(target, value)
+	default:
+		return value
+	}
+}
+
+// mergeDuplicateSeries merges metrics of the family having the same label set.
+func mergeDuplicateSeries(family *dto.MetricFamily, strategy config.AggregationStrategy) []*dto.Metric {
+	merged := make(map[string]*dto.Metric)
+	result := make([]*dto.Metric, 0, len(family.Metric))
+	for _, metric := range family.Metric {
+		signature := labelsSignature(metric.Label)
+		existing, found := merged[signature]
+		if !found {
+			merged[signature] = metric
+			result = append(result, metric)
+			continue
+		}
+		glog.V(4).Infof("Merging duplicated series of metric %s with labels %v", family.GetName(), metric.Label)
+		mergeMetric(family.GetType(), strategy, existing, metric)
+	}
+	return result
+}
+
+// mergeMetric merges value of the metric into the target metric.
+func mergeMetric(metricType dto.MetricType, strategy config.AggregationStrategy, target, metric *dto.Metric) {
+	switch metricType {
+	case dto.MetricType_COUNTER:
+		target.Counter.Value = proto.Float64(aggregate(strategy, target.Counter.GetValue(), metric.Counter.GetValue()))
+	case dto.MetricType_HISTOGRAM:
+		target.Histogram.SampleCount = proto.Uint64(target.Histogram.GetSampleCount() + metric.Histogram.GetSampleCount())
+		target.Histogram.SampleSum = proto.Float64(target.Histogram.GetSampleSum() + metric.Histogram.GetSampleSum())
+		for _, bucket := range metric.Histogram.Bucket {
+			mergeBucket(target.Histogram, bucket)
+		}
+	case dto.MetricType_SUMMARY:
+		target.Summary.SampleCount = proto.Uint64(target.Summary.GetSampleCount() + metric.Summary.GetSampleCount())
+		target.Summary.SampleSum = proto.Float64(target.Summary.GetSampleSum() + metric.Summary.GetSampleSum())
+		// Quantiles can't be aggregated, the last value wins.
+		target.Summary.Quantile = metric.Summary.Quantile
+	case dto.MetricType_GAUGE:
+		target.Gauge = &dto.Gauge{Value: proto.Float64(aggregate(strategy, target.Gauge.GetValue(), metric.Gauge.GetValue()))}
+	default:
+		target.Untyped = &dto.Untyped{Value: proto.Float64(aggregate(strategy, target.Untyped.GetValue(), metric.Untyped.GetValue()))}
+	}
+	if metric.TimestampMs != nil {
+		target.TimestampMs = metric.TimestampMs
+	}
+}
+
+// mergeBucket adds the count of the bucket to the bucket of the histogram with the same upper bound.
+func mergeBucket(histogram *dto.Histogram, bucket *dto.Bucket) {
+	for _, existing := range histogram.Bucket {
+		if existing.GetUpperBound() == bucket.GetUpperBound() {
+			existing.CumulativeCount = proto.Uint64(existing.GetCumulativeCount() + bucket.GetCumulativeCount())
+			return
+		}
+	}
+	glog.Warningf("Bucket with upper bound %v is missing in the merged histogram, ignoring it", bucket.GetUpperBound())
+}
+
+// DropTimestamps removes timestamps exposed with the samples, so that the scrape time is used instead.
+func DropTimestamps(metricFamilies map[string]*dto.MetricFamily) map[string]*dto.MetricFamily {
+	for _, family := range metricFamilies {
+		for _, metric := range family.Metric {
+			metric.TimestampMs = nil
+		}
+	}
+	return metricFamilies
+}
+
+// ConvertHistogramsToDistributions normalizes buckets of histogram metrics, so that they map directly to
+// Stackdriver distributions with explicit buckets: buckets are sorted by upper bound, duplicated bounds are
+// removed and the +Inf bucket holding all observations is added if the exporter didn't expose it.
+func ConvertHistogramsToDistributions(metricFamilies map[string]*dto.MetricFamily) map[string]*dto.MetricFamily {
+	for _, family := range metricFamilies {
+		if family.GetType() != dto.MetricType_HISTOGRAM {
+			continue
+		}
+		for _, metric := range family.Metric {
+			if metric.Histogram == nil {
+				metric.Histogram = &dto.Histogram{}
+			}
+			metric.Histogram.Bucket = distributionBuckets(metric.Histogram)
+		}
+	}
+	return metricFamilies
+}
+
+func distributionBuckets(histogram *dto.Histogram) []*dto.Bucket {
+	buckets := make([]*dto.Bucket, 0, len(histogram.Bucket)+1)
+	for _, bucket := range histogram.Bucket {
+		if !math.IsNaN(bucket.GetUpperBound()) {
+			buckets = append(buckets, bucket)
+		}
+	}
+	sort.SliceStable(buckets, func(i, j int) bool {
+		return buckets[i].GetUpperBound() < buckets[j].GetUpperBound()
+	})
+	result := buckets[:0]
+	for _, bucket := range buckets {
+		if len(result) > 0 && result[len(result)-1].GetUpperBound() == bucket.GetUpperBound() {
+			glog.V(4).Infof("Ignoring duplicated bucket with upper bound %v", bucket.GetUpperBound())
+			continue
+		}
+		result = append(result, bucket)
+	}
+	if len(result) == 0 || !math.IsInf(result[len(result)-1].GetUpperBound(), 1) {
+		result = append(result, &dto.Bucket{
+			UpperBound:      proto.Float64(math.Inf(1)),
+			CumulativeCount: proto.Uint64(histogram.GetSampleCount()),
+		})
+	}
+	return result
+}
+
+// RoundBucketBounds rounds upper bounds of the histogram buckets to the given number of significant digits,
+// so that bounds differing only by the floating point representation, like 0.1 and 0.10000000001, are
+// merged by ConvertHistogramsToDistributions. Non-positive precision leaves the bounds untouched.
+func RoundBucketBounds(metricFamilies map[string]*dto.MetricFamily, precision int) map[string]*dto.MetricFamily {
+	if precision <= 0 {
+		return metricFamilies
+	}
+	for _, family := range metricFamilies {
+		if family.GetType() != dto.MetricType_HISTOGRAM {
+			continue
+		}
+		for _, metric := range family.Metric {
+			for _, bucket := range metric.GetHistogram().GetBucket() {
+				bucket.UpperBound = proto.Float64(roundSignificant(bucket.GetUpperBound(), precision))
+			}
+		}
+	}
+	return metricFamilies
+}
+
+// roundSignificant rounds the value to the given number of significant digits. Infinities and NaN are
+// returned unchanged.
+func roundSignificant(value float64, precision int) float64 {
+	if math.IsInf(value, 0) || math.IsNaN(value) {
+		return value
+	}
+	rounded, err := strconv.ParseFloat(strconv.FormatFloat(value, 'g', precision, 64), 64)
+	if err != nil {
+		return value
+	}
+	return rounded
+}
+
+// DropUntypedMetrics removes families of untyped metrics, i.e. metrics exposed without the TYPE line.
+// Each dropped metric is logged only once.
+func DropUntypedMetrics(metricFamilies map[string]*dto.MetricFamily, component string) map[string]*dto.MetricFamily {
+	result := make(map[string]*dto.MetricFamily)
+	for name, family := range metricFamilies {
+		if family.GetType() != dto.MetricType_UNTYPED {
+			result[name] = family
+			continue
+		}
+		droppedUntypedMutex.Lock()
+		key := component + "/" + name
+		if !droppedUntyped[key] {
+			droppedUntyped[key] = true
+			glog.Infof("Dropping untyped metric %s of component %s", name, component)
+		}
+		droppedUntypedMutex.Unlock()
+	}
+	return result
+}
+
+// UntypedMetricsToGauges converts families of untyped metrics into gauges.
+func UntypedMetricsToGauges(metricFamilies map[string]*dto.MetricFamily) map[string]*dto.MetricFamily {
+	for _, family := range metricFamilies {
+		if family.GetType() != dto.MetricType_UNTYPED {
+			continue
+		}
+		family.Type = dto.MetricType_GAUGE.Enum()
+		for _, metric := range family.Metric {
+			metric.Gauge = &dto.Gauge{Value: proto.Float64(metric.GetUntyped().GetValue())}
+			metric.Untyped = nil
+		}
+	}
+	return metricFamilies
+}
+
+// DropInvalidSamples removes samples with NaN or infinite values, as well as histograms with such sums,
+// because Stackdriver rejects the whole write request containing them. Prometheus stale markers are
+// dropped as well, but counted separately, as they mark series that disappeared rather than invalid data.
+func DropInvalidSamples(metricFamilies map[string]*dto.MetricFamily, component string) map[string]*dto.MetricFamily {
+	for name, family := range metricFamilies {
+		valid := family.Metric[:0]
+		for _, metric := range family.Metric {
+			value := sampleValue(family.GetType(), metric)
+			if isFinite(value) {
+				valid = append(valid, metric)
+				continue
+			}
+			if isStaleMarker(value) {
+				glog.V(4).Infof("Dropping stale marker of metric %s with labels %v of component %s", name, metric.Label, component)
+				staleSamplesDropped.WithLabelValues(component).Inc()
+				continue
+			}
+			glog.V(2).Infof("Dropping sample of metric %s with labels %v of component %s, its value is not finite", name, metric.Label, component)
+			samplesDroppedInvalid.WithLabelValues(component).Inc()
+		}
+		family.Metric = valid
+	}
+	return metricFamilies
+}
+
+// staleMarkerBits is the bit pattern of the NaN used by Prometheus to mark series as stale.
+const staleMarkerBits uint64 = 0x7ff0000000000002
+
+// isStaleMarker returns true if the value is the Prometheus stale marker, distinct from the ordinary NaN.
+func isStaleMarker(value float64) bool {
+	return math.Float64bits(value) == staleMarkerBits
+}
+
+// TruncateSeries keeps at most maxSeries first series of every metric family, protecting Stackdriver quota
+// from metrics with unbounded label cardinality. Zero maxSeries means no limit.
+func TruncateSeries(metricFamilies map[string]*dto.MetricFamily, component string, maxSeries int) map[string]*dto.MetricFamily {
+	if maxSeries <= 0 {
+		return metricFamilies
+	}
+	for name, family := range metricFamilies {
+		if len(family.Metric) <= maxSeries {
+			continue
+		}
+		truncated := len(family.Metric) - maxSeries
+		glog.Warningf("Metric %s of component %s has %d series, dropping %d of them above the limit of %d", name, component, len(family.Metric), truncated, maxSeries)
+		seriesTruncated.WithLabelValues(component, name).Add(float64(truncated))
+		family.Metric = family.Metric[:maxSeries]
+	}
+	return metricFamilies
+}
+
+// LimitMetricFamilies protects Stackdriver quota from runaway exporters by limiting the number of metric families
+// of a single scrape to maxFamilies. If truncate is set, families above the limit are dropped in the order of their
+// names, otherwise an error is returned. Zero maxFamilies means no limit.
+func LimitMetricFamilies(metricFamilies map[string]*dto.MetricFamily, component string, maxFamilies int, truncate bool) (map[string]*dto.MetricFamily, error) {
+	if maxFamilies <= 0 || len(metricFamilies) <= maxFamilies {
+		return metricFamilies, nil
+	}
+	if !truncate {
+		return nil, fmt.Errorf("component %s exposes %d metric families, more than the limit of %d", component, len(metricFamilies), maxFamilies)
+	}
+	names := make([]string, 0, len(metricFamilies))
+	for name := range metricFamilies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	dropped := names[maxFamilies:]
+	glog.Warningf("Component %s exposes %d metric families, dropping %d of them above the limit of %d: %s", component, len(metricFamilies), len(dropped), maxFamilies, strings.Join(dropped, ", "))
+	metricFamiliesTruncated.WithLabelValues(component).Add(float64(len(dropped)))
+	result := make(map[string]*dto.MetricFamily, maxFamilies)
+	for _, name := range names[:maxFamilies] {
+		result[name] = metricFamilies[name]
+	}
+	return result, nil
+}
+
+// LimitLabels protects Stackdriver writes from failing on metrics with more than maxLabels label keys. Labels of
+// such metrics are ordered by their position in the priority list, the ones not listed after them by name, and
+// the labels above the limit are dropped, merging series that became indistinguishable like DropLabels. If
+// dropMetric is set, such metrics are dropped instead. Zero maxLabels means no limit.
+func LimitLabels(metricFamilies map[string]*dto.MetricFamily, component string, maxLabels int, priority []string, dropMetric bool, strategies config.AggregationStrategies) map[string]*dto.MetricFamily {
+	if maxLabels <= 0 {
+		return metricFamilies
+	}
+	rank := make(map[string]int, len(priority))
+	for i, label := range priority {
+		if _, found := rank[label]; !found {
+			rank[label] = i
+		}
+	}
+	rankOf := func(label string) int {
+		if i, found := rank[label]; found {
+			return i
+		}
+		return len(priority)
+	}
+	for name, family := range metricFamilies {
+		labelSet := make(map[string]bool)
+		for _, metric := range family.Metric {
+			for _, label := range metric.Label {
+				labelSet[label.GetName()] = true
+			}
+		}
+		if len(labelSet) <= maxLabels {
+			continue
+		}
+		if dropMetric {
+			glog.Warningf("Metric %s of component %s has %d labels, dropping it above the limit of %d", name, component, len(labelSet), maxLabels)
+			delete(metricFamilies, name)
+			continue
+		}
+		labels := make([]string, 0, len(labelSet))
+		for label := range labelSet {
+			labels = append(labels, label)
+		}
+		sort.Strings(labels)
+		sort.SliceStable(labels, func(i, j int) bool { return rankOf(labels[i]) < rankOf(labels[j]) })
+		dropped := make(map[string]bool)
+		for _, label := range labels[maxLabels:] {
+			dropped[label] = true
+		}
+		glog.Warningf("Metric %s of component %s has %d labels, dropping %s above the limit of %d", name, component, len(labels), strings.Join(labels[maxLabels:], ", "), maxLabels)
+		removeLabels(map[string]*dto.MetricFamily{name: family}, func(label string) bool { return dropped[label] }, strategies)
+	}
+	return metricFamilies
+}
+
+// truncatedLabelValueSuffix marks label values truncated by TruncateLabelValues.
+const truncatedLabelValueSuffix = "..."
+
+// TruncateLabelValues shortens label values longer than maxLength bytes, which Stackdriver rejects, marking
+// them with "...". Values are cut on the UTF-8 rune boundary. Zero maxLength means no limit.
+func TruncateLabelValues(metricFamilies map[string]*dto.MetricFamily, component string, maxLength int) map[string]*dto.MetricFamily {
+	if maxLength <= 0 {
+		return metricFamilies
+	}
+	for name, family := range metricFamilies {
+		for _, metric := range family.Metric {
+			for _, label := range metric.Label {
+				if len(label.GetValue()) <= maxLength {
+					continue
+				}
+				glog.V(2).Infof("Truncating value of label %s of metric %s of component %s, it's longer than %d bytes", label.GetName(), name, component, maxLength)
+				label.Value = proto.String(truncateLabelValue(label.GetValue(), maxLength))
+				labelValuesTruncated.WithLabelValues(component).Inc()
+			}
+		}
+	}
+	return metricFamilies
+}
+
+// truncateLabelValue returns the prefix of the value not longer than maxLength bytes, including the suffix.
+func truncateLabelValue(value string, maxLength int) string {
+	suffix := truncatedLabelValueSuffix
+	if maxLength <= len(suffix) {
+		suffix = ""
+	}
+	end := maxLength - len(suffix)
+	for end > 0 && !utf8.RuneStart(value[end]) {
+		end--
+	}
+	return value[:end] + suffix
+}
+
+// sampleValue returns the value of the metric sample, for histograms and summaries it's the sum of observations.
+func sampleValue(metricType dto.MetricType, metric *dto.Metric) float64 {
+	switch metricType {
+	case dto.MetricType_COUNTER:
+		return metric.GetCounter().GetValue()
+	case dto.MetricType_GAUGE:
+		return metric.GetGauge().GetValue()
+	case dto.MetricType_HISTOGRAM:
+		return metric.GetHistogram().GetSampleSum()
+	case dto.MetricType_SUMMARY:
+		return metric.GetSummary().GetSampleSum()
+	}
+	return metric.GetUntyped().GetValue()
+}
+
+func isFinite(value float64) bool {
+	return !math.IsNaN(value) && !math.IsInf(value, 0)
+}
+
+// RewriteMetricNames renames metrics using the first matching rewrite. Rewrites resulting in an empty name
+// are ignored.
+func RewriteMetricNames(metricFamilies map[string]*dto.MetricFamily, rewrites []config.MetricNameRewrite) (map[string]*dto.MetricFamily, error) {
+	if len(rewrites) == 0 {
+		return metricFamilies, nil
+	}
+	patterns := make([]string, 0, len(rewrites))
+	for _, rewrite := range rewrites {
+		patterns = append(patterns, rewrite.Match)
+	}
+	regexps, err := compileRegexps(patterns)
+	if err != nil {
+		return nil, err
+	}
+	result, _ := renameMetricFamilies(metricFamilies, func(name string) string {
+		for i, re := range regexps {
+			if !re.MatchString(name) {
+				continue
+			}
+			if rewritten := re.ReplaceAllString(name, rewrites[i].Replace); rewritten != "" {
+				return rewritten
+			}
+			glog.Warningf("Ignoring rewrite %q of metric %s resulting in an empty name", rewrites[i].Match, name)
+			break
+		}
+		return name
+	})
+	return result, nil
+}
+
+// renameMetricFamilies renames metric families using the rename function. Families that end up with
+// the same name are merged if their types match, otherwise the first of them, in the order of the
+// original names, is kept. Returns the renamed families and the number of merges.
+func renameMetricFamilies(metricFamilies map[string]*dto.MetricFamily, rename func(string) string) (map[string]*dto.MetricFamily, int) {
+	names := make([]string, 0, len(metricFamilies))
+	for name := range metricFamilies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	merges := 0
+	result := make(map[string]*dto.MetricFamily)
+	for _, name := range names {
+		family := metricFamilies[name]
+		newName := rename(name)
+		if newName != name {
+			family.Name = proto.String(newName)
+		}
+		if mergeMetricFamily(result, newName, family) {
+			merges++
+		}
+	}
+	if merges > 0 {
+		glog.V(2).Infof("Merged %d metric families with colliding names", merges)
+	}
+	return result, merges
+}
+
+// mergeMetricFamily adds the family to metricFamilies under the given name. If a family with the name
+// already exists, metrics of the same type are merged into it and metrics of other type are dropped.
+// Returns true if the family was merged.
+func mergeMetricFamily(metricFamilies map[string]*dto.MetricFamily, name string, family *dto.MetricFamily) bool {
+	existing, found := metricFamilies[name]
+	if !found {
+		metricFamilies[name] = family
+		return false
+	}
+	if existing.GetType() != family.GetType() {
+		glog.Warningf("Metric %s of type %v collides with metric of type %v, dropping it", family.GetName(), family.GetType(), existing.GetType())
+		return false
+	}
+	glog.V(2).Infof("Merging metric %s into %s", family.GetName(), name)
+	existing.Metric = append(existing.Metric, family.Metric...)
+	return true
+}
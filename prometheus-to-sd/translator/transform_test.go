@@ -0,0 +1,795 @@
+/*
+Copyright 2018 Google Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package translator
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/api/googleapi"
+
+	"github.com/GoogleCloudPlatform/k8s-stackdriver/prometheus-to-sd/config"
+)
+
+// familiesWithNames creates metric families with the given names and no metrics.
+func familiesWithNames(names ...string) map[string]*dto.MetricFamily {
+	result := make(map[string]*dto.MetricFamily)
+	for _, name := range names {
+		result[name] = &dto.MetricFamily{Name: stringPtr(name)}
+	}
+	return result
+}
+
+func sortedNames(metricFamilies map[string]*dto.MetricFamily) []string {
+	names := make([]string, 0, len(metricFamilies))
+	for name := range metricFamilies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestFilterMetricNames(t *testing.T) {
+	testcases := []struct {
+		description string
+		include     []string
+		exclude     []string
+		want        []string
+	}{
+		{"no patterns", nil, nil, []string{"go_goroutines", "http_requests_total", "my_http_errors"}},
+		{"unanchored include", []string{"http"}, nil, []string{"http_requests_total", "my_http_errors"}},
+		{"anchored include", []string{"^http_"}, nil, []string{"http_requests_total"}},
+		{"exclude only", nil, []string{"^go_"}, []string{"http_requests_total", "my_http_errors"}},
+		{"exclude wins over include", []string{"http"}, []string{"errors$"}, []string{"http_requests_total"}},
+		{"multiple include", []string{"^go_", "^my_"}, nil, []string{"go_goroutines", "my_http_errors"}},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			metrics := familiesWithNames("go_goroutines", "http_requests_total", "my_http_errors")
+			filtered, err := FilterMetricNames(metrics, tc.include, tc.exclude)
+			if assert.NoError(t, err) {
+				assert.Equal(t, tc.want, sortedNames(filtered))
+			}
+		})
+	}
+
+	_, err := FilterMetricNames(familiesWithNames("a"), []string{"("}, nil)
+	assert.Error(t, err)
+}
+
+func labelsOf(metric *dto.Metric) map[string]string {
+	labels := make(map[string]string)
+	for _, label := range metric.Label {
+		labels[label.GetName()] = label.GetValue()
+	}
+	return labels
+}
+
+func TestAddStaticLabels(t *testing.T) {
+	response := &PrometheusResponse{rawResponse: `
+# TYPE requests counter
+requests{code="200",zone="local"} 42.0
+# TYPE temperature gauge
+temperature 21.5
+# TYPE latency summary
+latency{quantile="0.99"} 0.5
+latency_sum 3.0
+latency_count 7
+`}
+	staticLabels := map[string]string{"cluster": "prod", "zone": "us-east1-b"}
+	testcases := []struct {
+		overwrite    bool
+		requestsZone string
+	}{
+		{false, "local"},
+		{true, "us-east1-b"},
+	}
+	for _, tc := range testcases {
+		sourceConfig := *commonConfig.SourceConfig
+		sourceConfig.StaticLabels = staticLabels
+		sourceConfig.OverwriteStaticLabels = tc.overwrite
+		commonConfigCopy := *commonConfig
+		commonConfigCopy.SourceConfig = &sourceConfig
+
+		metrics, err := response.Build(&commonConfigCopy, NewMetricDescriptorCache(nil, &commonConfigCopy))
+		if !assert.NoError(t, err) {
+			continue
+		}
+		assert.Equal(t, map[string]string{"code": "200", "cluster": "prod", "zone": tc.requestsZone},
+			labelsOf(metrics["requests"].Metric[0]))
+		assert.Equal(t, staticLabels, labelsOf(metrics["temperature"].Metric[0]))
+		assert.Equal(t, staticLabels, labelsOf(metrics["latency_sum"].Metric[0]))
+		assert.Equal(t, staticLabels, labelsOf(metrics["latency_count"].Metric[0]))
+
+		ts := translateOne(&commonConfigCopy, "temperature", dto.MetricType_GAUGE, metrics["temperature"].Metric[0],
+			time.Now(), time.Now(), NewMetricDescriptorCache(nil, &commonConfigCopy))
+		assert.Equal(t, staticLabels, ts.Metric.Labels)
+	}
+}
+
+func TestRenameLabels(t *testing.T) {
+	metric := func(labels ...string) *dto.Metric {
+		m := &dto.Metric{}
+		for i := 0; i < len(labels); i += 2 {
+			m.Label = append(m.Label, &dto.LabelPair{Name: stringPtr(labels[i]), Value: stringPtr(labels[i+1])})
+		}
+		return m
+	}
+	testcases := []struct {
+		description string
+		metric      *dto.Metric
+		want        map[string]string
+	}{
+		{"rename", metric("pod_name", "a", "le", "1"), map[string]string{"pod": "a", "le": "1"}},
+		{"absent source label", metric("code", "200"), map[string]string{"code": "200"}},
+		{"collision keeps first", metric("pod_name", "a", "pod_id", "b"), map[string]string{"pod": "a"}},
+		{"collision with existing label", metric("pod", "x", "pod_name", "a"), map[string]string{"pod": "x"}},
+	}
+	renames := map[string]string{"pod_name": "pod", "pod_id": "pod"}
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			metrics := map[string]*dto.MetricFamily{"m": {Name: stringPtr("m"), Metric: []*dto.Metric{tc.metric}}}
+			renamed := RenameLabels(metrics, renames, nil)
+			assert.Equal(t, tc.want, labelsOf(renamed["m"].Metric[0]))
+		})
+	}
+}
+
+func TestDropLabels(t *testing.T) {
+	response := &PrometheusResponse{rawResponse: `
+# TYPE requests counter
+requests{code="200",id="1"} 10
+requests{code="200",id="2"} 5
+requests{code="500",id="3"} 1
+# TYPE queue_length gauge
+queue_length{id="1"} 3
+queue_length{id="2"} 7
+# TYPE latency histogram
+latency_bucket{id="1",le="1"} 1
+latency_bucket{id="1",le="+Inf"} 2
+latency_sum{id="1"} 3
+latency_count{id="1"} 2
+latency_bucket{id="2",le="1"} 4
+latency_bucket{id="2",le="+Inf"} 4
+latency_sum{id="2"} 1
+latency_count{id="2"} 4
+`}
+	metrics, err := response.parse()
+	if !assert.NoError(t, err) {
+		return
+	}
+	metrics = DropLabels(metrics, []string{"id", "nonexistent"}, nil)
+
+	requests := metrics["requests"].Metric
+	if assert.Equal(t, 2, len(requests)) {
+		assert.Equal(t, map[string]string{"code": "200"}, labelsOf(requests[0]))
+		assert.Equal(t, 15.0, requests[0].Counter.GetValue(), "counters should be summed")
+		assert.Equal(t, 1.0, requests[1].Counter.GetValue())
+	}
+	queueLength := metrics["queue_length"].Metric
+	if assert.Equal(t, 1, len(queueLength)) {
+		assert.Equal(t, 7.0, queueLength[0].Gauge.GetValue(), "last gauge value should win")
+	}
+	latency := metrics["latency"].Metric
+	if assert.Equal(t, 1, len(latency)) {
+		assert.Equal(t, uint64(6), latency[0].Histogram.GetSampleCount())
+		assert.Equal(t, 4.0, latency[0].Histogram.GetSampleSum())
+		assert.Equal(t, uint64(5), latency[0].Histogram.Bucket[0].GetCumulativeCount())
+		assert.Equal(t, uint64(6), latency[0].Histogram.Bucket[1].GetCumulativeCount())
+	}
+}
+
+func TestKeepLabels(t *testing.T) {
+	response := &PrometheusResponse{rawResponse: `
+# TYPE requests counter
+requests{code="200",id="1",method="GET"} 10
+requests{code="200",id="2",method="GET"} 5
+requests{code="500",id="3",method="POST"} 1
+# TYPE queue_length gauge
+queue_length{id="1"} 3
+queue_length{id="2"} 7
+`}
+	metrics, err := response.parse()
+	if !assert.NoError(t, err) {
+		return
+	}
+	metrics = KeepLabels(metrics, []string{"code", "method"}, nil)
+
+	requests := metrics["requests"].Metric
+	if assert.Equal(t, 2, len(requests)) {
+		assert.Equal(t, map[string]string{"code": "200", "method": "GET"}, labelsOf(requests[0]))
+		assert.Equal(t, 15.0, requests[0].Counter.GetValue(), "counters should be summed")
+		assert.Equal(t, map[string]string{"code": "500", "method": "POST"}, labelsOf(requests[1]))
+	}
+	queueLength := metrics["queue_length"].Metric
+	if assert.Equal(t, 1, len(queueLength)) {
+		assert.Equal(t, map[string]string{}, labelsOf(queueLength[0]))
+		assert.Equal(t, 7.0, queueLength[0].Gauge.GetValue(), "last gauge value should win")
+	}
+}
+
+func TestKeepAndDropLabels(t *testing.T) {
+	response := &PrometheusResponse{rawResponse: `
+# TYPE requests counter
+requests{code="200",id="1",method="GET"} 10
+requests{code="500",id="2",method="GET"} 5
+requests{code="200",id="3",method="POST"} 1
+`}
+	metrics, err := response.parse()
+	if !assert.NoError(t, err) {
+		return
+	}
+	metrics = KeepLabels(metrics, []string{"code", "method"}, nil)
+	metrics = DropLabels(metrics, []string{"code"}, nil)
+
+	requests := metrics["requests"].Metric
+	if assert.Equal(t, 2, len(requests)) {
+		assert.Equal(t, map[string]string{"method": "GET"}, labelsOf(requests[0]))
+		assert.Equal(t, 15.0, requests[0].Counter.GetValue())
+		assert.Equal(t, map[string]string{"method": "POST"}, labelsOf(requests[1]))
+		assert.Equal(t, 1.0, requests[1].Counter.GetValue())
+	}
+}
+
+func TestDropLabelsAggregationStrategies(t *testing.T) {
+	response := &PrometheusResponse{rawResponse: `
+# TYPE requests counter
+requests{id="1"} 10
+requests{id="2"} 30
+requests{id="3"} 20
+# TYPE queue_length gauge
+queue_length{id="1"} 3
+queue_length{id="2"} 9
+queue_length{id="3"} 7
+`}
+	testcases := []struct {
+		strategy    config.AggregationStrategy
+		requests    float64
+		queueLength float64
+	}{
+		{strategy: "", requests: 60, queueLength: 7},
+		{strategy: config.AggregateSum, requests: 60, queueLength: 19},
+		{strategy: config.AggregateMax, requests: 30, queueLength: 9},
+		{strategy: config.AggregateMin, requests: 10, queueLength: 3},
+		{strategy: config.AggregateLast, requests: 20, queueLength: 7},
+	}
+	for _, tc := range testcases {
+		metrics, err := response.parse()
+		if !assert.NoError(t, err) {
+			return
+		}
+		strategies := config.AggregationStrategies{}
+		if tc.strategy != "" {
+			strategies["requests"] = tc.strategy
+			strategies["queue_length"] = tc.strategy
+		}
+		metrics = DropLabels(metrics, []string{"id"}, strategies)
+		if assert.Equal(t, 1, len(metrics["requests"].Metric)) && assert.Equal(t, 1, len(metrics["queue_length"].Metric)) {
+			assert.Equal(t, tc.requests, metrics["requests"].Metric[0].Counter.GetValue(), "unexpected counter for strategy %q", tc.strategy)
+			assert.Equal(t, tc.queueLength, metrics["queue_length"].Metric[0].Gauge.GetValue(), "unexpected gauge for strategy %q", tc.strategy)
+		}
+	}
+}
+
+func TestRenameLabelsMergesCollapsedSeries(t *testing.T) {
+	response := &PrometheusResponse{rawResponse: `
+# TYPE queue_length gauge
+queue_length{pod="a"} 3
+queue_length{pod_name="a"} 9
+`}
+	metrics, err := response.parse()
+	if !assert.NoError(t, err) {
+		return
+	}
+	metrics = RenameLabels(metrics, map[string]string{"pod_name": "pod"}, config.AggregationStrategies{"queue_length": config.AggregateMax})
+	if assert.Equal(t, 1, len(metrics["queue_length"].Metric)) {
+		assert.Equal(t, 9.0, metrics["queue_length"].Metric[0].Gauge.GetValue())
+	}
+}
+
+func TestDropNonexistentLabel(t *testing.T) {
+	metrics, err := metricsResponse.parse()
+	if !assert.NoError(t, err) {
+		return
+	}
+	expected, _ := metricsResponse.parse()
+	assert.Equal(t, expected, DropLabels(metrics, []string{"nonexistent"}, nil))
+}
+
+func TestConvertHistogramsToDistributions(t *testing.T) {
+	response := &PrometheusResponse{rawResponse: `
+# TYPE latency histogram
+latency_bucket{le="5"} 3
+latency_bucket{le="1"} 1
+latency_bucket{le="+Inf"} 4
+latency_sum 12
+latency_count 4
+# TYPE empty histogram
+empty_bucket{le="1"} 0
+empty_bucket{le="+Inf"} 0
+empty_sum 0
+empty_count 0
+# TYPE truncated histogram
+truncated_bucket{le="1"} 2
+truncated_sum 10
+truncated_count 5
+`}
+	metrics, err := response.parse()
+	if !assert.NoError(t, err) {
+		return
+	}
+	metrics = ConvertHistogramsToDistributions(metrics)
+
+	latency := metrics["latency"].Metric[0].Histogram
+	assert.Equal(t, []float64{1, 5, math.Inf(1)}, bucketBounds(latency))
+	distribution := convertToDistributionValue(latency)
+	assert.Equal(t, []float64{1, 5}, distribution.BucketOptions.ExplicitBuckets.Bounds)
+	assert.Equal(t, googleapi.Int64s{1, 2, 1}, distribution.BucketCounts)
+	assert.Equal(t, int64(4), distribution.Count)
+	assert.Equal(t, 3.0, distribution.Mean)
+
+	empty := convertToDistributionValue(metrics["empty"].Metric[0].Histogram)
+	assert.Equal(t, int64(0), empty.Count)
+	assert.Equal(t, 0.0, empty.Mean)
+	assert.Equal(t, []float64{1}, empty.BucketOptions.ExplicitBuckets.Bounds)
+	assert.Equal(t, googleapi.Int64s{0, 0}, empty.BucketCounts)
+
+	truncated := convertToDistributionValue(metrics["truncated"].Metric[0].Histogram)
+	assert.Equal(t, []float64{1}, truncated.BucketOptions.ExplicitBuckets.Bounds)
+	assert.Equal(t, googleapi.Int64s{2, 3}, truncated.BucketCounts, "missing +Inf bucket should hold the remaining observations")
+}
+
+func TestRoundBucketBounds(t *testing.T) {
+	response := &PrometheusResponse{rawResponse: `
+# TYPE latency histogram
+latency_bucket{le="0.1"} 1
+latency_bucket{le="0.10000000001"} 1
+latency_bucket{le="0.30000000000000004"} 2
+latency_bucket{le="0.3"} 2
+latency_bucket{le="1"} 3
+latency_bucket{le="+Inf"} 4
+latency_sum 2
+latency_count 4
+`}
+	metrics, err := response.parse()
+	if !assert.NoError(t, err) {
+		return
+	}
+	unrounded, _ := response.parse()
+	unrounded = ConvertHistogramsToDistributions(RoundBucketBounds(unrounded, 0))
+	assert.Equal(t, 6, len(unrounded["latency"].Metric[0].Histogram.Bucket), "zero precision shouldn't merge bounds")
+
+	metrics = ConvertHistogramsToDistributions(RoundBucketBounds(metrics, 10))
+	latency := metrics["latency"].Metric[0].Histogram
+	assert.Equal(t, []float64{0.1, 0.3, 1, math.Inf(1)}, bucketBounds(latency), "near-equal bounds should collapse")
+	distribution := convertToDistributionValue(latency)
+	assert.Equal(t, []float64{0.1, 0.3, 1}, distribution.BucketOptions.ExplicitBuckets.Bounds)
+	assert.Equal(t, googleapi.Int64s{1, 1, 1, 1}, distribution.BucketCounts)
+}
+
+func TestRoundSignificant(t *testing.T) {
+	assert.Equal(t, 0.1, roundSignificant(0.10000000001, 10))
+	assert.Equal(t, 0.10000000001, roundSignificant(0.10000000001, 12))
+	assert.Equal(t, 1200.0, roundSignificant(1234.5, 2))
+	assert.True(t, math.IsInf(roundSignificant(math.Inf(1), 3), 1))
+}
+
+func bucketBounds(histogram *dto.Histogram) []float64 {
+	var bounds []float64
+	for _, bucket := range histogram.Bucket {
+		bounds = append(bounds, bucket.GetUpperBound())
+	}
+	return bounds
+}
+
+func TestDropUntypedMetrics(t *testing.T) {
+	response := &PrometheusResponse{rawResponse: `
+# TYPE requests counter
+requests 10
+# TYPE temperature gauge
+temperature 20
+untyped_metric 1
+legacy_metric{code="200"} 2
+`}
+	metrics, err := response.parse()
+	if !assert.NoError(t, err) {
+		return
+	}
+	metrics = DropUntypedMetrics(metrics, "testcomponent")
+	assert.Equal(t, []string{"requests", "temperature"}, sortedNames(metrics))
+
+	// Dropped metrics are reported only once.
+	metrics, _ = response.parse()
+	metrics = DropUntypedMetrics(metrics, "testcomponent")
+	assert.Equal(t, []string{"requests", "temperature"}, sortedNames(metrics))
+	assert.True(t, droppedUntyped["testcomponent/untyped_metric"])
+}
+
+func TestUntypedMetricsToGauges(t *testing.T) {
+	response := &PrometheusResponse{rawResponse: `
+# TYPE requests counter
+requests 10
+untyped_metric{code="200"} 2.5
+`}
+	metrics, err := response.parse()
+	if !assert.NoError(t, err) {
+		return
+	}
+	metrics = UntypedMetricsToGauges(metrics)
+
+	untyped := metrics["untyped_metric"]
+	assert.Equal(t, dto.MetricType_GAUGE, untyped.GetType())
+	assert.Equal(t, 2.5, untyped.Metric[0].GetGauge().GetValue())
+	assert.Nil(t, untyped.Metric[0].Untyped)
+	assert.Equal(t, dto.MetricType_COUNTER, metrics["requests"].GetType())
+
+	descriptor := MetricFamilyToMetricDescriptor(commonConfig, untyped, nil)
+	assert.Equal(t, "GAUGE", descriptor.MetricKind)
+}
+
+func TestBuildUntypedMetrics(t *testing.T) {
+	response := &PrometheusResponse{rawResponse: "untyped_metric 2.5\n"}
+	testcases := []struct {
+		description         string
+		dropUntyped         bool
+		treatUntypedAsGauge bool
+		wantType            *dto.MetricType
+	}{
+		{"untyped kept by default", false, false, dto.MetricType_UNTYPED.Enum()},
+		{"untyped converted to gauge", false, true, dto.MetricType_GAUGE.Enum()},
+		{"dropping takes precedence", true, true, nil},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			commonConfigCopy := *commonConfig
+			commonConfigCopy.DropUntyped = tc.dropUntyped
+			commonConfigCopy.TreatUntypedAsGauge = tc.treatUntypedAsGauge
+			metrics, err := response.Build(&commonConfigCopy, buildCacheForTesting())
+			if !assert.NoError(t, err) {
+				return
+			}
+			if tc.wantType == nil {
+				assert.NotContains(t, metrics, "untyped_metric")
+			} else if assert.Contains(t, metrics, "untyped_metric") {
+				assert.Equal(t, *tc.wantType, metrics["untyped_metric"].GetType())
+			}
+		})
+	}
+}
+
+func TestDropInvalidSamples(t *testing.T) {
+	response := &PrometheusResponse{rawResponse: `
+# TYPE temperature gauge
+temperature{sensor="1"} 20
+temperature{sensor="2"} NaN
+temperature{sensor="3"} +Inf
+temperature{sensor="4"} -Inf
+# TYPE requests counter
+requests{code="200"} 10
+requests{code="500"} +Inf
+# TYPE latency histogram
+latency_bucket{path="/",le="+Inf"} 2
+latency_sum{path="/"} 3
+latency_count{path="/"} 2
+latency_bucket{path="/broken",le="+Inf"} 2
+latency_sum{path="/broken"} +Inf
+latency_count{path="/broken"} 2
+`}
+	metrics, err := response.parse()
+	if !assert.NoError(t, err) {
+		return
+	}
+	before := samplesDroppedInvalidValue(t, "invalid-samples")
+	metrics = DropInvalidSamples(metrics, "invalid-samples")
+
+	if assert.Equal(t, 1, len(metrics["temperature"].Metric)) {
+		assert.Equal(t, 20.0, metrics["temperature"].Metric[0].GetGauge().GetValue())
+	}
+	if assert.Equal(t, 1, len(metrics["requests"].Metric)) {
+		assert.Equal(t, 10.0, metrics["requests"].Metric[0].GetCounter().GetValue())
+	}
+	if assert.Equal(t, 1, len(metrics["latency"].Metric)) {
+		assert.Equal(t, map[string]string{"path": "/"}, labelsOf(metrics["latency"].Metric[0]))
+	}
+	assert.Equal(t, 5.0, samplesDroppedInvalidValue(t, "invalid-samples")-before)
+}
+
+func TestDropInvalidSamplesStaleMarkers(t *testing.T) {
+	newGauge := func(sensor string, value float64) *dto.Metric {
+		return &dto.Metric{
+			Label: []*dto.LabelPair{{Name: stringPtr("sensor"), Value: stringPtr(sensor)}},
+			Gauge: &dto.Gauge{Value: floatPtr(value)},
+		}
+	}
+	gaugeType := dto.MetricType_GAUGE
+	metrics := map[string]*dto.MetricFamily{
+		"temperature": {
+			Name: stringPtr("temperature"),
+			Type: &gaugeType,
+			Metric: []*dto.Metric{
+				newGauge("1", 20),
+				newGauge("2", math.Float64frombits(staleMarkerBits)),
+				newGauge("3", math.NaN()),
+			},
+		},
+	}
+	assert.True(t, isStaleMarker(math.Float64frombits(staleMarkerBits)))
+	assert.False(t, isStaleMarker(math.NaN()))
+
+	invalidBefore := samplesDroppedInvalidValue(t, "stale-markers")
+	metrics = DropInvalidSamples(metrics, "stale-markers")
+	if assert.Equal(t, 1, len(metrics["temperature"].Metric)) {
+		assert.Equal(t, 20.0, metrics["temperature"].Metric[0].GetGauge().GetValue())
+	}
+	stale := &dto.Metric{}
+	if err := staleSamplesDropped.WithLabelValues("stale-markers").Write(stale); err != nil {
+		t.Fatalf("Failed to read staleSamplesDropped: %v", err)
+	}
+	assert.Equal(t, 1.0, stale.GetCounter().GetValue())
+	assert.Equal(t, 1.0, samplesDroppedInvalidValue(t, "stale-markers")-invalidBefore, "ordinary NaN should be counted as invalid")
+}
+
+func samplesDroppedInvalidValue(t *testing.T, component string) float64 {
+	metric := &dto.Metric{}
+	if err := samplesDroppedInvalid.WithLabelValues(component).Write(metric); err != nil {
+		t.Fatalf("Failed to read samplesDroppedInvalid: %v", err)
+	}
+	return metric.GetCounter().GetValue()
+}
+
+func TestRewriteMetricNames(t *testing.T) {
+	rewrites := []config.MetricNameRewrite{
+		{Match: "^prometheus_(.*)$", Replace: "$1"},
+		{Match: "^(.*)_seconds_(.*)$", Replace: "${1}_${2}_s"},
+		{Match: "^empty$", Replace: ""},
+		{Match: "requests", Replace: "never_applied"},
+	}
+	metrics, err := RewriteMetricNames(familiesWithNames("prometheus_requests", "latency_seconds_total", "empty", "other"), rewrites)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, []string{"empty", "latency_total_s", "other", "requests"}, sortedNames(metrics))
+	assert.Equal(t, "requests", metrics["requests"].GetName(), "only the first matching rewrite should be applied")
+	assert.Equal(t, "latency_total_s", metrics["latency_total_s"].GetName())
+	assert.Equal(t, "empty", metrics["empty"].GetName(), "rewrite to an empty name should be rejected")
+
+	_, err = RewriteMetricNames(familiesWithNames("metric"), []config.MetricNameRewrite{{Match: "(", Replace: ""}})
+	assert.Error(t, err)
+}
+
+func TestRenameMetricFamiliesMerge(t *testing.T) {
+	response := &PrometheusResponse{rawResponse: `
+# TYPE REQUESTS counter
+REQUESTS{code="200"} 10
+# TYPE requests counter
+requests{code="500"} 1
+# TYPE Temperature gauge
+Temperature 20
+# TYPE temperature counter
+temperature 5
+`}
+	metrics, err := response.parse()
+	if !assert.NoError(t, err) {
+		return
+	}
+	metrics, merges := renameMetricFamilies(metrics, strings.ToLower)
+	assert.Equal(t, 1, merges)
+	assert.Equal(t, []string{"requests", "temperature"}, sortedNames(metrics))
+
+	requests := metrics["requests"]
+	assert.Equal(t, "requests", requests.GetName())
+	if assert.Equal(t, 2, len(requests.Metric)) {
+		assert.Equal(t, map[string]string{"code": "200"}, labelsOf(requests.Metric[0]))
+		assert.Equal(t, map[string]string{"code": "500"}, labelsOf(requests.Metric[1]))
+	}
+	// Types differ, so the first family is kept.
+	temperature := metrics["temperature"]
+	assert.Equal(t, dto.MetricType_GAUGE, temperature.GetType())
+	assert.Equal(t, 20.0, temperature.Metric[0].GetGauge().GetValue())
+}
+
+func TestTruncateSeries(t *testing.T) {
+	newFamilies := func() map[string]*dto.MetricFamily {
+		families := familiesWithNames("truncated_metric", "small_metric")
+		for i := 0; i < 5; i++ {
+			families["truncated_metric"].Metric = append(families["truncated_metric"].Metric, &dto.Metric{
+				Label: []*dto.LabelPair{{Name: stringPtr("id"), Value: stringPtr(strconv.Itoa(i))}},
+			})
+		}
+		families["small_metric"].Metric = []*dto.Metric{{}, {}}
+		return families
+	}
+
+	metrics := TruncateSeries(newFamilies(), "truncation-test", 0)
+	assert.Equal(t, 5, len(metrics["truncated_metric"].Metric))
+
+	metrics = TruncateSeries(newFamilies(), "truncation-test", 3)
+	assert.Equal(t, 3, len(metrics["truncated_metric"].Metric))
+	assert.Equal(t, "2", metrics["truncated_metric"].Metric[2].Label[0].GetValue(), "first series should be kept")
+	assert.Equal(t, 2, len(metrics["small_metric"].Metric))
+	assert.Equal(t, 2.0, seriesTruncatedValue(t, "truncation-test", "truncated_metric"))
+	assert.Equal(t, 0.0, seriesTruncatedValue(t, "truncation-test", "small_metric"))
+}
+
+func TestLimitMetricFamilies(t *testing.T) {
+	metrics, err := LimitMetricFamilies(familiesWithNames("a", "b", "c"), "families-limit-test", 0, false)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"a", "b", "c"}, sortedNames(metrics))
+	}
+	metrics, err = LimitMetricFamilies(familiesWithNames("a", "b", "c"), "families-limit-test", 3, false)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"a", "b", "c"}, sortedNames(metrics))
+	}
+
+	_, err = LimitMetricFamilies(familiesWithNames("a", "b", "c"), "families-limit-test", 2, false)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "3 metric families")
+	}
+}
+
+var labelLimitResponse = &PrometheusResponse{rawResponse: `
+# TYPE requests counter
+requests{method="GET",code="200",pod="web-1",zone="a"} 10
+requests{method="GET",code="200",pod="web-1",zone="b"} 5
+requests{method="POST",code="500",pod="web-2",zone="a"} 2
+# TYPE go_goroutines gauge
+go_goroutines{pod="web-1"} 12
+`}
+
+func TestLimitLabels(t *testing.T) {
+	metrics, err := labelLimitResponse.parse()
+	if !assert.NoError(t, err) {
+		return
+	}
+	metrics = LimitLabels(metrics, "labels-limit-test", 2, nil, false, nil)
+	assert.Equal(t, []string{"go_goroutines", "requests"}, sortedNames(metrics))
+	values := make(map[string]float64)
+	for _, metric := range metrics["requests"].Metric {
+		labels := labelsOf(metric)
+		assert.Equal(t, 2, len(labels), "labels above the limit should be dropped by name")
+		values[labels["code"]+"/"+labels["method"]] = metric.GetCounter().GetValue()
+	}
+	assert.Equal(t, map[string]float64{"200/GET": 15, "500/POST": 2}, values, "indistinguishable series should be merged")
+	assert.Equal(t, []map[string]string{{"pod": "web-1"}}, seriesLabels(metrics["go_goroutines"]))
+}
+
+func TestLimitLabelsPriority(t *testing.T) {
+	metrics, err := labelLimitResponse.parse()
+	if !assert.NoError(t, err) {
+		return
+	}
+	metrics = LimitLabels(metrics, "labels-limit-test", 3, []string{"zone", "pod"}, false, nil)
+	values := make(map[string]float64)
+	for _, metric := range metrics["requests"].Metric {
+		labels := labelsOf(metric)
+		values[labels["zone"]+"/"+labels["pod"]+"/"+labels["code"]] = metric.GetCounter().GetValue()
+		assert.NotContains(t, labels, "method")
+	}
+	assert.Equal(t, map[string]float64{"a/web-1/200": 10, "b/web-1/200": 5, "a/web-2/500": 2}, values)
+}
+
+func TestLimitLabelsDropMetric(t *testing.T) {
+	metrics, err := labelLimitResponse.parse()
+	if !assert.NoError(t, err) {
+		return
+	}
+	metrics = LimitLabels(metrics, "labels-limit-test", 3, nil, true, nil)
+	assert.Equal(t, []string{"go_goroutines"}, sortedNames(metrics), "metric with too many labels should be dropped")
+
+	metrics, _ = labelLimitResponse.parse()
+	assert.Equal(t, []string{"go_goroutines", "requests"}, sortedNames(LimitLabels(metrics, "labels-limit-test", 0, nil, true, nil)))
+}
+
+func TestAggregationStrategiesOfRenamedMetrics(t *testing.T) {
+	response := &PrometheusResponse{rawResponse: `
+# TYPE app_queue_length gauge
+app_queue_length{queue="a",shard="1"} 3
+app_queue_length{queue="a",shard="2"} 5
+# TYPE app_workers gauge
+app_workers{pool="a"} 4
+app_workers{pool="b"} 2
+`}
+	sourceConfig := *commonConfig.SourceConfig
+	sourceConfig.LabelDrop = []string{"pool"}
+	cfg := *commonConfig
+	cfg.SourceConfig = &sourceConfig
+	cfg.StripPrefix = "app_"
+	cfg.MaxLabelsPerMetric = 1
+	cfg.AggregationStrategies = config.AggregationStrategies{"app_queue_length": config.AggregateMin, "app_workers": config.AggregateMax}
+	metrics, err := response.Build(&cfg, buildCacheForTesting())
+	if !assert.NoError(t, err) || !assert.Equal(t, []string{"queue_length", "workers"}, sortedNames(metrics)) {
+		return
+	}
+	if assert.Equal(t, 1, len(metrics["queue_length"].Metric)) {
+		assert.Equal(t, 3.0, metrics["queue_length"].Metric[0].GetGauge().GetValue(), "strategy should apply after the metric was renamed")
+	}
+	if assert.Equal(t, 1, len(metrics["workers"].Metric)) {
+		assert.Equal(t, 4.0, metrics["workers"].Metric[0].GetGauge().GetValue())
+	}
+}
+
+func TestLimitMetricFamiliesTruncate(t *testing.T) {
+	metrics, err := LimitMetricFamilies(familiesWithNames("c", "a", "d", "b"), "families-truncate-test", 2, true)
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"a", "b"}, sortedNames(metrics))
+	}
+	metric := &dto.Metric{}
+	if err := metricFamiliesTruncated.WithLabelValues("families-truncate-test").Write(metric); err != nil {
+		t.Fatalf("Failed to read metricFamiliesTruncated: %v", err)
+	}
+	assert.Equal(t, 2.0, metric.GetCounter().GetValue())
+}
+
+func seriesTruncatedValue(t *testing.T, component, metricName string) float64 {
+	metric := &dto.Metric{}
+	if err := seriesTruncated.WithLabelValues(component, metricName).Write(metric); err != nil {
+		t.Fatalf("Failed to read seriesTruncated: %v", err)
+	}
+	return metric.GetCounter().GetValue()
+}
+
+func TestTruncateLabelValues(t *testing.T) {
+	newFamilies := func() map[string]*dto.MetricFamily {
+		families := familiesWithNames("requests")
+		families["requests"].Metric = []*dto.Metric{
+			{
+				Label: []*dto.LabelPair{
+					{Name: stringPtr("path"), Value: stringPtr("/api/v1/namespaces/default/pods")},
+					{Name: stringPtr("code"), Value: stringPtr("200")},
+					{Name: stringPtr("city"), Value: stringPtr("Zürich-Genève")},
+				},
+			},
+		}
+		return families
+	}
+
+	metrics := TruncateLabelValues(newFamilies(), "truncate-labels", 0)
+	assert.Equal(t, "/api/v1/namespaces/default/pods", labelsOf(metrics["requests"].Metric[0])["path"])
+
+	metrics = TruncateLabelValues(newFamilies(), "truncate-labels", 11)
+	labels := labelsOf(metrics["requests"].Metric[0])
+	assert.Equal(t, "/api/v1/...", labels["path"])
+	assert.Equal(t, "200", labels["code"])
+	assert.Equal(t, "Zürich-...", labels["city"], "multi-byte runes should be counted in bytes")
+	assert.Equal(t, 2.0, labelValuesTruncatedValue(t, "truncate-labels"))
+}
+
+func TestTruncateLabelValueOnRuneBoundary(t *testing.T) {
+	// "ü" takes two bytes, only the first of them would fit.
+	assert.Equal(t, "Z...", truncateLabelValue("Zürich", 5))
+	assert.Equal(t, "Zü...", truncateLabelValue("Zürich", 6))
+	assert.Equal(t, "日", truncateLabelValue("日本語", 3))
+	assert.Equal(t, "", truncateLabelValue("日本語", 2))
+	for _, value := range []string{truncateLabelValue("Zürich", 5), truncateLabelValue("日本語日本語", 8)} {
+		assert.True(t, utf8.ValidString(value), "%q should be a valid UTF-8 string", value)
+	}
+}
+
+func labelValuesTruncatedValue(t *testing.T, component string) float64 {
+	metric := &dto.Metric{}
+	if err := labelValuesTruncated.WithLabelValues(component).Write(metric); err != nil {
+		t.Fatalf("Failed to read labelValuesTruncated: %v", err)
+	}
+	return metric.GetCounter().GetValue()
+}
@@ -19,10 +19,13 @@ package translator
 import (
 	"fmt"
 	"math"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/golang/glog"
+	"github.com/golang/protobuf/proto"
 	dto "github.com/prometheus/client_model/go"
 	v3 "google.golang.org/api/monitoring/v3"
 
@@ -48,6 +51,10 @@ type TimeSeriesBuilder struct {
 	config *config.CommonConfig
 	cache  *MetricDescriptorCache
 	batch  *batchWithTimestamp
+	resets *counterResetCache
+	// firstScrape is the time of the first batch, used as the start time of cumulative metrics
+	// if the source doesn't expose its start time.
+	firstScrape time.Time
 }
 
 type batchWithTimestamp struct {
@@ -60,6 +67,7 @@ func NewTimeSeriesBuilder(commonConfig *config.CommonConfig, cache *MetricDescri
 	return &TimeSeriesBuilder{
 		config: commonConfig,
 		cache:  cache,
+		resets: newCounterResetCache(commonConfig.CounterResetCacheSize),
 	}
 }
 
@@ -81,14 +89,21 @@ func (t *TimeSeriesBuilder) Build() ([]*v3.TimeSeries, error) {
 	}
 	// Get start time before whitelisting, because process start time
 	// metric is likely not to be whitelisted.
-	startTime := getStartTime(metricFamilies)
-	metricFamilies = filterWhitelisted(metricFamilies, t.config.SourceConfig.Whitelisted)
+	if t.firstScrape.IsZero() {
+		// Stackdriver requires a non-zero interval of cumulative points, also the first one.
+		t.firstScrape = t.batch.timestamp.Add(-time.Second)
+	}
+	startTime := getStartTime(metricFamilies, t.config.SourceConfig.StartTimeMetric, t.firstScrape)
+	metricFamilies, err = filterWhitelistedSource(metricFamilies, t.config.SourceConfig)
+	if err != nil {
+		return ts, err
+	}
 
 	for name, metric := range metricFamilies {
 		if t.cache.IsMetricBroken(name) {
 			continue
 		}
-		f, err := translateFamily(t.config, metric, t.batch.timestamp, startTime, t.cache)
+		f, err := translateFamily(t.config, metric, t.batch.timestamp, startTime, t.cache, t.resets)
 		if err != nil {
 			glog.Warningf("Error while processing metric %s: %v", name, err)
 		} else {
@@ -99,30 +114,78 @@ func (t *TimeSeriesBuilder) Build() ([]*v3.TimeSeries, error) {
 }
 
 // OmitComponentName removes from the metric names prefix that is equal to component name.
+// The prefix is removed only if it's a leading token of the name, followed by "_" and the rest
+// of the name, other metrics are left untouched.
 func OmitComponentName(metricFamilies map[string]*dto.MetricFamily, componentName string) map[string]*dto.MetricFamily {
-	result := make(map[string]*dto.MetricFamily)
-	for metricName, metricFamily := range metricFamilies {
-		newMetricName := strings.TrimPrefix(metricName, fmt.Sprintf("%s_", componentName))
-		metricFamily.Name = &newMetricName
-		result[newMetricName] = metricFamily
-	}
+	prefix := fmt.Sprintf("%s_", componentName)
+	result, _ := renameMetricFamilies(metricFamilies, func(name string) string {
+		if componentName != "" && strings.HasPrefix(name, prefix) && len(name) > len(prefix) {
+			return strings.TrimPrefix(name, prefix)
+		}
+		return name
+	})
+	return result
+}
+
+// DeriveComponentName returns the longest common prefix of the metric names, up to its last "_", which is
+// assumed to be the component name, e.g. "etcd" for etcd_requests and etcd_errors. Empty string is returned
+// if there are less than two metrics or they don't share such a prefix.
+func DeriveComponentName(metricFamilies map[string]*dto.MetricFamily) string {
+	if len(metricFamilies) < 2 {
+		return ""
+	}
+	names := make([]string, 0, len(metricFamilies))
+	for name := range metricFamilies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	// The common prefix of the first and the last sorted names is shared by all of them.
+	first, last := names[0], names[len(names)-1]
+	common := 0
+	for common < len(first) && common < len(last) && first[common] == last[common] {
+		common++
+	}
+	end := strings.LastIndex(first[:common], "_")
+	if end <= 0 {
+		return ""
+	}
+	return first[:end]
+}
+
+// StripPrefixAndSuffix removes the prefix and the suffix from the metric names. Names that would become
+// empty are left untouched.
+func StripPrefixAndSuffix(metricFamilies map[string]*dto.MetricFamily, prefix, suffix string) map[string]*dto.MetricFamily {
+	result, _ := renameMetricFamilies(metricFamilies, func(name string) string {
+		stripped := strings.TrimSuffix(strings.TrimPrefix(name, prefix), suffix)
+		if stripped == "" {
+			glog.Warningf("Stripping prefix %q and suffix %q would leave metric %s without a name, keeping it unchanged", prefix, suffix, name)
+			return name
+		}
+		return stripped
+	})
 	return result
 }
 
 // DowncaseMetricNames downcases metric names.
 func DowncaseMetricNames(metricFamilies map[string]*dto.MetricFamily) map[string]*dto.MetricFamily {
-	result := make(map[string]*dto.MetricFamily)
-	for metricName, metricFamily := range metricFamilies {
-		newMetricName := strings.ToLower(metricName)
-		metricFamily.Name = &newMetricName
-		result[newMetricName] = metricFamily
-	}
+	result, _ := renameMetricFamilies(metricFamilies, strings.ToLower)
 	return result
 }
 
 // FlattenSummaryMetricFamilies flattens summary metric families into two counter metrics,
-// one for the running sum and count, respectively
+// one for the running sum and count, respectively, and a gauge metric for each quantile,
+// named like <name>_p99.
 func FlattenSummaryMetricFamilies(metricFamilies map[string]*dto.MetricFamily) map[string]*dto.MetricFamily {
+	return flattenSummaryMetricFamilies(metricFamilies, false)
+}
+
+// FlattenSummaryMetricFamiliesQuantileAsLabel flattens summary metric families like FlattenSummaryMetricFamilies,
+// but exports all the quantiles in a single gauge metric with the summary name and the quantile label.
+func FlattenSummaryMetricFamiliesQuantileAsLabel(metricFamilies map[string]*dto.MetricFamily) map[string]*dto.MetricFamily {
+	return flattenSummaryMetricFamilies(metricFamilies, true)
+}
+
+func flattenSummaryMetricFamilies(metricFamilies map[string]*dto.MetricFamily, quantileAsLabel bool) map[string]*dto.MetricFamily {
 	result := make(map[string]*dto.MetricFamily)
 	for metricName, family := range metricFamilies {
 		switch family.GetType() {
@@ -133,6 +196,13 @@ func FlattenSummaryMetricFamilies(metricFamilies map[string]*dto.MetricFamily) m
 			}
 			result[metricName+"_sum"] = sumMetricFromSummary(family.GetName(), family.Metric)
 			result[metricName+"_count"] = countMetricFromSummary(family.GetName(), family.Metric)
+			if quantileAsLabel {
+				result[metricName] = quantileMetricFromSummary(family.GetName(), family.Metric)
+			} else {
+				for _, quantileFamily := range quantileMetricsFromSummary(family.GetName(), family.Metric) {
+					result[quantileFamily.GetName()] = quantileFamily
+				}
+			}
 		default:
 			result[metricName] = family
 		}
@@ -152,6 +222,7 @@ func sumMetricFromSummary(name string, metrics []*dto.Metric) *dto.MetricFamily
 			Counter: &dto.Counter{
 				Value: &s,
 			},
+			TimestampMs: m.TimestampMs,
 		}
 		newMetrics = append(newMetrics, newMetric)
 	}
@@ -175,6 +246,7 @@ func countMetricFromSummary(name string, metrics []*dto.Metric) *dto.MetricFamil
 			Counter: &dto.Counter{
 				Value: &c,
 			},
+			TimestampMs: m.TimestampMs,
 		}
 		newMetrics = append(newMetrics, newMetric)
 	}
@@ -185,27 +257,107 @@ func countMetricFromSummary(name string, metrics []*dto.Metric) *dto.MetricFamil
 	}
 }
 
-func getStartTime(metrics map[string]*dto.MetricFamily) time.Time {
-	// For cumulative metrics we need to know process start time.
-	// If the process start time is not specified, assuming it's
-	// the unix 1 second, because Stackdriver can't handle
-	// unix zero or unix negative number.
-	startTime := time.Unix(1, 0)
-	if family, found := metrics[processStartTimeMetric]; found && family.GetType() == dto.MetricType_GAUGE && len(family.GetMetric()) == 1 {
+// quantileMetricFromSummary manipulates a Summary to extract out a single MetricType_GAUGE metric
+// with all the quantiles, distinguished by the quantile label.
+func quantileMetricFromSummary(name string, metrics []*dto.Metric) *dto.MetricFamily {
+	t := dto.MetricType_GAUGE
+	var newMetrics []*dto.Metric
+	for _, m := range metrics {
+		for _, q := range m.Summary.GetQuantile() {
+			label := &dto.LabelPair{
+				Name:  proto.String("quantile"),
+				Value: proto.String(strconv.FormatFloat(q.GetQuantile(), 'g', -1, 64)),
+			}
+			labels := append(append([]*dto.LabelPair{}, m.Label...), label)
+			newMetrics = append(newMetrics, quantileMetric(labels, q, m.TimestampMs))
+		}
+	}
+	return &dto.MetricFamily{
+		Type:   &t,
+		Name:   &name,
+		Metric: newMetrics,
+	}
+}
+
+// quantileMetricsFromSummary manipulates a Summary to extract out a MetricType_GAUGE metric for each
+// quantile, named like <name>_p99.
+func quantileMetricsFromSummary(name string, metrics []*dto.Metric) []*dto.MetricFamily {
+	t := dto.MetricType_GAUGE
+	var families []*dto.MetricFamily
+	byName := make(map[string]*dto.MetricFamily)
+	for _, m := range metrics {
+		for _, q := range m.Summary.GetQuantile() {
+			n := name + "_" + quantileSuffix(q.GetQuantile())
+			family, found := byName[n]
+			if !found {
+				family = &dto.MetricFamily{
+					Type: &t,
+					Name: proto.String(n),
+				}
+				byName[n] = family
+				families = append(families, family)
+			}
+			family.Metric = append(family.Metric, quantileMetric(m.Label, q, m.TimestampMs))
+		}
+	}
+	return families
+}
+
+func quantileMetric(labels []*dto.LabelPair, q *dto.Quantile, timestampMs *int64) *dto.Metric {
+	v := q.GetValue()
+	return &dto.Metric{
+		Label: labels,
+		Gauge: &dto.Gauge{
+			Value: &v,
+		},
+		TimestampMs: timestampMs,
+	}
+}
+
+// quantileSuffix returns the metric name suffix of the quantile, e.g. p99 for 0.99 or p99_9 for 0.999.
+func quantileSuffix(quantile float64) string {
+	// Rounding avoids the floating point artifacts like 99.89999999999999 for 0.999.
+	percentile := math.Round(quantile*1e6) / 1e4
+	return "p" + strings.Replace(strconv.FormatFloat(percentile, 'f', -1, 64), ".", "_", -1)
+}
+
+// getStartTime returns the start time of cumulative metrics, exposed by the source in the gauge metric
+// with the given name, process_start_time_seconds by default. If the metric is not exposed, the fallback
+// is used, or the unix 1 second if it's not set, because Stackdriver can't handle unix zero or unix
+// negative number.
+func getStartTime(metrics map[string]*dto.MetricFamily, startTimeMetric string, fallback time.Time) time.Time {
+	if startTimeMetric == "" {
+		startTimeMetric = processStartTimeMetric
+	}
+	startTime := fallback
+	if startTime.IsZero() {
+		startTime = time.Unix(1, 0)
+	}
+	if family, found := metrics[startTimeMetric]; found && family.GetType() == dto.MetricType_GAUGE && len(family.GetMetric()) == 1 {
 		startSec := family.Metric[0].Gauge.Value
 		startTime = time.Unix(int64(*startSec), 0)
 		glog.V(4).Infof("Monitored process start time: %v", startTime)
 	} else {
-		glog.Warningf("Metric %s invalid or not defined. Using %v instead. Cumulative metrics might be inaccurate.", processStartTimeMetric, startTime)
+		glog.Warningf("Metric %s invalid or not defined. Using %v instead. Cumulative metrics might be inaccurate.", startTimeMetric, startTime)
 	}
 	return startTime
 }
 
-func filterWhitelisted(allMetrics map[string]*dto.MetricFamily, whitelisted []string) map[string]*dto.MetricFamily {
-	if len(whitelisted) == 0 {
-		return allMetrics
+// filterWhitelisted returns metric families listed in whitelisted or with names fully matching any
+// of the whitelistedRegex patterns. If both are empty all metric families are returned.
+func filterWhitelisted(allMetrics map[string]*dto.MetricFamily, whitelisted, whitelistedRegex []string) (map[string]*dto.MetricFamily, error) {
+	if len(whitelisted) == 0 && len(whitelistedRegex) == 0 {
+		return allMetrics, nil
 	}
-	glog.V(4).Infof("Exporting only whitelisted metrics: %v", whitelisted)
+	anchored := make([]string, 0, len(whitelistedRegex))
+	for _, pattern := range whitelistedRegex {
+		anchored = append(anchored, "^(?:"+pattern+")$")
+	}
+	regexps, err := compileRegexps(anchored)
+	if err != nil {
+		return nil, err
+	}
+	glog.V(4).Infof("Exporting only whitelisted metrics: %v, %v", whitelisted, whitelistedRegex)
 	res := map[string]*dto.MetricFamily{}
 	for _, w := range whitelisted {
 		if family, found := allMetrics[w]; found {
@@ -214,22 +366,42 @@ func filterWhitelisted(allMetrics map[string]*dto.MetricFamily, whitelisted []st
 			glog.V(3).Infof("Whitelisted metric %s not present in Prometheus endpoint.", w)
 		}
 	}
-	return res
+	if len(regexps) > 0 {
+		for name, family := range allMetrics {
+			if matchesAny(name, regexps) {
+				res[name] = family
+			}
+		}
+	}
+	return res, nil
 }
 
 func translateFamily(config *config.CommonConfig,
 	family *dto.MetricFamily,
 	timestamp time.Time,
 	startTime time.Time,
-	cache *MetricDescriptorCache) ([]*v3.TimeSeries, error) {
+	cache *MetricDescriptorCache,
+	resets *counterResetCache) ([]*v3.TimeSeries, error) {
 
 	glog.V(3).Infof("Translating metric family %v from component %v", family.GetName(), config.SourceConfig.Component)
 	var ts []*v3.TimeSeries
 	if _, found := supportedMetricTypes[family.GetType()]; !found {
 		return ts, fmt.Errorf("metric type %v of family %s not supported", family.GetType(), family.GetName())
 	}
+	delta := isDeltaCounter(config, family.GetName(), family.GetType())
 	for _, metric := range family.GetMetric() {
-		t := translateOne(config, family.GetName(), family.GetType(), metric, startTime, timestamp, cache)
+		var start time.Time
+		if delta {
+			increase, previous, ok := resets.delta(family.GetName(), metric, sampleTime(metric, timestamp))
+			if !ok {
+				continue
+			}
+			metric = &dto.Metric{Label: metric.Label, Counter: &dto.Counter{Value: proto.Float64(increase)}, TimestampMs: metric.TimestampMs}
+			start = previous
+		} else {
+			start = resets.startTime(family.GetName(), family.GetType(), metric, startTime, sampleTime(metric, timestamp))
+		}
+		t := translateOne(config, family.GetName(), family.GetType(), metric, start, timestamp, cache)
 		ts = append(ts, t)
 		glog.V(4).Infof("%+v\nMetric: %+v, Interval: %+v", *t, *(t.Metric), t.Points[0].Interval)
 	}
@@ -238,10 +410,11 @@ func translateFamily(config *config.CommonConfig,
 
 // getMetricType creates metric type name base on the metric prefix, component name and metric name.
 func getMetricType(config *config.CommonConfig, name string) string {
+	prefix := config.SourceConfig.MetricsPrefixFor(name)
 	if config.SourceConfig.Component == "" {
-		return fmt.Sprintf("%s/%s", config.SourceConfig.MetricsPrefix, name)
+		return fmt.Sprintf("%s/%s", prefix, name)
 	}
-	return fmt.Sprintf("%s/%s/%s", config.SourceConfig.MetricsPrefix, config.SourceConfig.Component, name)
+	return fmt.Sprintf("%s/%s/%s", prefix, config.SourceConfig.Component, name)
 }
 
 // assumes that mType is Counter, Gauge or Histogram
@@ -252,11 +425,12 @@ func translateOne(config *config.CommonConfig,
 	start time.Time,
 	end time.Time,
 	cache *MetricDescriptorCache) *v3.TimeSeries {
+	end = sampleTime(metric, end)
 	interval := &v3.TimeInterval{
 		EndTime: end.UTC().Format(time.RFC3339),
 	}
-	metricKind := extractMetricKind(mType)
-	if metricKind == "CUMULATIVE" {
+	metricKind := getMetricKind(config, name, mType)
+	if metricKind != "GAUGE" {
 		interval.StartTime = start.UTC().Format(time.RFC3339)
 	}
 	valueType := extractValueType(mType, cache.getMetricDescriptor(name))
@@ -280,6 +454,15 @@ func translateOne(config *config.CommonConfig,
 	}
 }
 
+// sampleTime returns the timestamp of the metric sample, or the scrape time if the sample has none.
+func sampleTime(metric *dto.Metric, scrapeTime time.Time) time.Time {
+	if metric.TimestampMs == nil {
+		return scrapeTime
+	}
+	ms := metric.GetTimestampMs()
+	return time.Unix(ms/1000, (ms%1000)*int64(time.Millisecond))
+}
+
 func setValue(mType dto.MetricType, valueType string, metric *dto.Metric, point *v3.Point) {
 	if mType == dto.MetricType_GAUGE {
 		setValueBaseOnSimpleType(metric.GetGauge().GetValue(), valueType, point)
@@ -366,14 +549,76 @@ func getMetricLabels(config *config.CommonConfig, labels []*dto.LabelPair) map[s
 func MetricFamilyToMetricDescriptor(config *config.CommonConfig,
 	family *dto.MetricFamily, originalDescriptor *v3.MetricDescriptor) *v3.MetricDescriptor {
 	return &v3.MetricDescriptor{
-		Description: family.GetHelp(),
+		Description: metricDescription(family),
 		Type:        getMetricType(config, family.GetName()),
-		MetricKind:  extractMetricKind(family.GetType()),
+		MetricKind:  getMetricKind(config, family.GetName(), family.GetType()),
 		ValueType:   extractValueType(family.GetType(), originalDescriptor),
 		Labels:      extractAllLabels(family, originalDescriptor),
+		Unit:        inferUnit(family.GetName()),
 	}
 }
 
+// maxDescriptionLength is the maximal length in bytes of the metric descriptor description accepted by Stackdriver.
+const maxDescriptionLength = 8192
+
+// metricDescription returns the help text of the metric family, truncated to the length accepted by Stackdriver.
+func metricDescription(family *dto.MetricFamily) string {
+	help := family.GetHelp()
+	if len(help) <= maxDescriptionLength {
+		return help
+	}
+	glog.V(4).Infof("Truncating help text of metric %s, it's longer than %d bytes", family.GetName(), maxDescriptionLength)
+	return truncateLabelValue(help, maxDescriptionLength)
+}
+
+// unitSuffixes maps the suffixes of the metric names recommended by Prometheus to the units.
+var unitSuffixes = map[string]string{
+	"_seconds": "s",
+	"_bytes":   "By",
+}
+
+// inferUnit returns the unit based on the suffix of the metric name, or an empty string if it's unknown.
+func inferUnit(name string) string {
+	name = strings.TrimSuffix(strings.TrimSuffix(name, "_total"), "_sum")
+	for suffix, unit := range unitSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			return unit
+		}
+	}
+	return ""
+}
+
+// getMetricKind returns the metric kind configured for the metric, or the one derived from its type.
+// Only counters can be overridden to DELTA, as deltas are computed only for them.
+func getMetricKind(config *config.CommonConfig, name string, mType dto.MetricType) string {
+	if kind, found := config.SourceConfig.MetricKindOverride[name]; found {
+		if kind != "DELTA" || mType == dto.MetricType_COUNTER {
+			return kind
+		}
+		ignoredDeltaOverridesMutex.Lock()
+		key := config.SourceConfig.Component + "/" + name
+		if !ignoredDeltaOverrides[key] {
+			ignoredDeltaOverrides[key] = true
+			glog.Warningf("Ignoring DELTA kind override of metric %s of component %s, only counters can be exported as DELTA", name, config.SourceConfig.Component)
+		}
+		ignoredDeltaOverridesMutex.Unlock()
+	}
+	if mType == dto.MetricType_COUNTER {
+		for _, counter := range config.SourceConfig.DeltaCounters {
+			if counter == name {
+				return "DELTA"
+			}
+		}
+	}
+	return extractMetricKind(mType)
+}
+
+// isDeltaCounter returns true if the metric is a counter exported as DELTA, either listed in DeltaCounters
+// or overridden in MetricKindOverride. Points of such counters carry the increase since the previous scrape.
+func isDeltaCounter(config *config.CommonConfig, name string, mType dto.MetricType) bool {
+	return mType == dto.MetricType_COUNTER && getMetricKind(config, name, mType) == "DELTA"
+}
+
 func extractMetricKind(mType dto.MetricType) string {
 	if mType == dto.MetricType_COUNTER || mType == dto.MetricType_HISTOGRAM {
 		return "CUMULATIVE"
@@ -25,6 +25,7 @@ import (
 	"time"
 
 	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
 	"github.com/stretchr/testify/assert"
 	v3 "google.golang.org/api/monitoring/v3"
 
@@ -240,6 +241,7 @@ var metricDescriptors = map[string]*v3.MetricDescriptor{
 		Type:       "container.googleapis.com/master/testcomponent/process_start_time_seconds",
 		MetricKind: "GAUGE",
 		ValueType:  "INT64",
+		Unit:       "s",
 	},
 	unrelatedMetric: {
 		Type:       "container.googleapis.com/master/testcomponent/unrelated_metric",
@@ -619,6 +621,93 @@ int_summary_metric_count{label="l2"} 10
 	}
 }
 
+const labeledSummary = `
+# TYPE latency summary
+latency{quantile="0.5",label="l1"} 1
+latency{quantile="0.999",label="l1"} 3
+latency{quantile="0.5",label="l2"} 2
+latency{quantile="0.999",label="l2"} 4
+latency_sum{label="l1"} 7
+latency_sum{label="l2"} 8
+latency_count{label="l1"} 9
+latency_count{label="l2"} 10
+`
+
+func parseSummaryForTesting(t *testing.T) map[string]*dto.MetricFamily {
+	parser := &expfmt.TextParser{}
+	metrics, err := parser.TextToMetricFamilies(strings.NewReader(labeledSummary))
+	if err != nil {
+		t.Fatalf("Failed to parse the summary: %v", err)
+	}
+	return metrics
+}
+
+// gaugeValues returns values of the gauge metric keyed by the label values, joined with commas.
+func gaugeValues(family *dto.MetricFamily) map[string]float64 {
+	values := make(map[string]float64)
+	for _, metric := range family.Metric {
+		var labels []string
+		for _, label := range metric.Label {
+			labels = append(labels, label.GetName()+"="+label.GetValue())
+		}
+		sort.Strings(labels)
+		values[strings.Join(labels, ",")] = metric.GetGauge().GetValue()
+	}
+	return values
+}
+
+func TestFlattenSummaryQuantilesAsNames(t *testing.T) {
+	metrics := FlattenSummaryMetricFamilies(parseSummaryForTesting(t))
+	assert.Equal(t, []string{"latency_count", "latency_p50", "latency_p99_9", "latency_sum"}, sortedNames(metrics))
+
+	assert.Equal(t, dto.MetricType_GAUGE, metrics["latency_p50"].GetType())
+	assert.Equal(t, map[string]float64{"label=l1": 1, "label=l2": 2}, gaugeValues(metrics["latency_p50"]))
+	assert.Equal(t, dto.MetricType_GAUGE, metrics["latency_p99_9"].GetType())
+	assert.Equal(t, map[string]float64{"label=l1": 3, "label=l2": 4}, gaugeValues(metrics["latency_p99_9"]))
+}
+
+func TestFlattenSummaryQuantilesAsLabel(t *testing.T) {
+	metrics := FlattenSummaryMetricFamiliesQuantileAsLabel(parseSummaryForTesting(t))
+	assert.Equal(t, []string{"latency", "latency_count", "latency_sum"}, sortedNames(metrics))
+
+	assert.Equal(t, dto.MetricType_GAUGE, metrics["latency"].GetType())
+	assert.Equal(t, map[string]float64{
+		"label=l1,quantile=0.5":   1,
+		"label=l1,quantile=0.999": 3,
+		"label=l2,quantile=0.5":   2,
+		"label=l2,quantile=0.999": 4,
+	}, gaugeValues(metrics["latency"]))
+}
+
+func TestFlattenSummarySumAndCount(t *testing.T) {
+	for name, flatten := range map[string]func(map[string]*dto.MetricFamily) map[string]*dto.MetricFamily{
+		"quantiles as names": FlattenSummaryMetricFamilies,
+		"quantile as label":  FlattenSummaryMetricFamiliesQuantileAsLabel,
+	} {
+		t.Run(name, func(t *testing.T) {
+			metrics := flatten(parseSummaryForTesting(t))
+			for suffix, want := range map[string][]float64{"_sum": {7, 8}, "_count": {9, 10}} {
+				family := metrics["latency"+suffix]
+				if assert.NotNil(t, family, suffix) {
+					assert.Equal(t, dto.MetricType_COUNTER, family.GetType())
+					var got []float64
+					for _, metric := range family.Metric {
+						assert.Empty(t, metric.Gauge)
+						got = append(got, metric.GetCounter().GetValue())
+					}
+					assert.Equal(t, want, got)
+				}
+			}
+		})
+	}
+}
+
+func TestQuantileSuffix(t *testing.T) {
+	for quantile, want := range map[float64]string{0.5: "p50", 0.9: "p90", 0.99: "p99", 0.999: "p99_9", 0.05: "p5", 1: "p100"} {
+		assert.Equal(t, want, quantileSuffix(quantile))
+	}
+}
+
 func createInterval(start time.Time, end time.Time) *v3.TimeInterval {
 	return &v3.TimeInterval{
 		StartTime: start.UTC().Format(time.RFC3339),
@@ -658,6 +747,34 @@ func createDoublePoint(d float64, start time.Time, end time.Time) *v3.Point {
 	return createPoint(createDoubleValue(d), "DoubleValue", start, end)
 }
 
+func TestBuildNegativeGauges(t *testing.T) {
+	tsb := NewTimeSeriesBuilder(CommonConfigWithMetrics([]string{unrelatedMetric, floatMetricName, booleanMetricName, "queue_drain_rate"}), buildCacheForTesting())
+	tsb.Update(&PrometheusResponse{rawResponse: `
+# TYPE unrelated_metric gauge
+unrelated_metric -42
+# TYPE float_metric gauge
+float_metric -3.25
+# TYPE boolean_metric gauge
+boolean_metric{labelName="labelValue"} -1
+# TYPE queue_drain_rate gauge
+queue_drain_rate -7.0
+`}, time.Now())
+	ts, err := tsb.Build()
+	assert.NoError(t, err)
+	values := make(map[string]*v3.TypedValue)
+	for _, series := range ts {
+		assert.Equal(t, "GAUGE", series.MetricKind)
+		values[series.Metric.Type] = series.Points[0].Value
+	}
+	prefix := "container.googleapis.com/master/testcomponent/"
+	if assert.Equal(t, 4, len(values)) {
+		assert.Equal(t, int64(-42), *values[prefix+unrelatedMetric].Int64Value)
+		assert.Equal(t, -3.25, *values[prefix+floatMetricName].DoubleValue)
+		assert.Equal(t, true, *values[prefix+booleanMetricName].BoolValue, "negative values should be true")
+		assert.Equal(t, int64(-7), *values[prefix+"queue_drain_rate"].Int64Value, "gauge without descriptor should default to INT64")
+	}
+}
+
 func TestUpdateScrapes(t *testing.T) {
 	tsb := NewTimeSeriesBuilder(CommonConfigWithMetrics([]string{testMetricName, floatMetricName}), buildCacheForTesting())
 	scrape := &PrometheusResponse{rawResponse: `
@@ -747,6 +864,107 @@ func TestOmitComponentName(t *testing.T) {
 	}
 }
 
+func TestOmitComponentNameLeadingToken(t *testing.T) {
+	metrics := familiesWithNames("mycomp_requests", "other_requests", "mycompany_requests", "mycomp_", "requests_mycomp_total")
+	processedMetrics := OmitComponentName(metrics, "mycomp")
+	assert.Equal(t, []string{"mycomp_", "mycompany_requests", "other_requests", "requests", "requests_mycomp_total"}, sortedNames(processedMetrics))
+	assert.Equal(t, "requests", processedMetrics["requests"].GetName())
+	assert.Equal(t, "other_requests", processedMetrics["other_requests"].GetName())
+
+	processedMetrics = OmitComponentName(familiesWithNames("_internal_metric"), "")
+	assert.Equal(t, []string{"_internal_metric"}, sortedNames(processedMetrics), "empty component name should not strip anything")
+}
+
+func TestDeriveComponentName(t *testing.T) {
+	testcases := []struct {
+		names []string
+		want  string
+	}{
+		{names: []string{"etcd_requests", "etcd_errors", "etcd_db_size"}, want: "etcd"},
+		{names: []string{"etcd_server_requests", "etcd_server_errors"}, want: "etcd_server"},
+		{names: []string{"etcd_requests", "etcdctl_calls"}, want: ""},
+		{names: []string{"etcd_requests", "go_goroutines"}, want: ""},
+		{names: []string{"_a", "_b"}, want: ""},
+		{names: []string{"etcd_requests"}, want: ""},
+		{names: nil, want: ""},
+	}
+	for _, tc := range testcases {
+		assert.Equal(t, tc.want, DeriveComponentName(familiesWithNames(tc.names...)), "names %v", tc.names)
+	}
+}
+
+func TestOmitDerivedComponentName(t *testing.T) {
+	sourceConfig := *commonConfig.SourceConfig
+	sourceConfig.Component = ""
+	cfg := *commonConfig
+	cfg.SourceConfig = &sourceConfig
+	cfg.OmitComponentName = true
+
+	metrics, err := runFamilyProcessors(familiesWithNames("etcd_requests", "etcd_errors"), nameProcessors(&cfg))
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"etcd_errors", "etcd_requests"}, sortedNames(metrics), "empty component name should not strip anything")
+	}
+
+	cfg.DeriveComponentName = true
+	metrics, err = runFamilyProcessors(familiesWithNames("etcd_requests", "etcd_errors", "etcd_"), nameProcessors(&cfg))
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"errors", "etcd_", "requests"}, sortedNames(metrics))
+	}
+
+	sourceConfig.Component = "etcd_requests"
+	metrics, err = runFamilyProcessors(familiesWithNames("etcd_requests_total", "etcd_errors"), nameProcessors(&cfg))
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{"etcd_errors", "total"}, sortedNames(metrics), "known component name should take precedence")
+	}
+}
+
+func TestStripPrefixAndSuffix(t *testing.T) {
+	testcases := []struct {
+		description string
+		prefix      string
+		suffix      string
+		want        []string
+	}{
+		{
+			description: "prefix only",
+			prefix:      "app_",
+			want:        []string{"errors_count", "other_requests", "requests_count"},
+		},
+		{
+			description: "suffix only",
+			suffix:      "_count",
+			want:        []string{"app_errors", "app_requests", "other_requests"},
+		},
+		{
+			description: "prefix and suffix",
+			prefix:      "app_",
+			suffix:      "_count",
+			want:        []string{"errors", "other_requests", "requests"},
+		},
+		{
+			description: "no match",
+			prefix:      "db_",
+			suffix:      "_total",
+			want:        []string{"app_errors_count", "app_requests_count", "other_requests"},
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			metrics := familiesWithNames("app_requests_count", "app_errors_count", "other_requests")
+			processedMetrics := StripPrefixAndSuffix(metrics, tc.prefix, tc.suffix)
+			assert.Equal(t, tc.want, sortedNames(processedMetrics))
+			for name, family := range processedMetrics {
+				assert.Equal(t, name, family.GetName())
+			}
+		})
+	}
+}
+
+func TestStripPrefixAndSuffixKeepsEmptiedNames(t *testing.T) {
+	processedMetrics := StripPrefixAndSuffix(familiesWithNames("app_", "app_requests"), "app_", "")
+	assert.Equal(t, []string{"app_", "requests"}, sortedNames(processedMetrics))
+}
+
 func TestBuildWithoutUpdate(t *testing.T) {
 	cache := buildCacheForTesting()
 
@@ -835,3 +1053,231 @@ func TestDowncaseMetricNames(t *testing.T) {
 		})
 	}
 }
+
+func TestBuildHonorTimestamps(t *testing.T) {
+	scrape := `
+# TYPE test_name counter
+test_name{labelName="labelValue1"} 42.0 1500000000000
+test_name{labelName="labelValue2"} 106.0
+# TYPE process_start_time_seconds gauge
+process_start_time_seconds 1234567890.0
+`
+	scrapeTime := time.Unix(1600000000, 0)
+	for _, honorTimestamps := range []bool{true, false} {
+		sourceConfig := *commonConfig.SourceConfig
+		sourceConfig.Whitelisted = []string{testMetricName}
+		sourceConfig.HonorTimestamps = honorTimestamps
+		commonConfigCopy := *commonConfig
+		commonConfigCopy.SourceConfig = &sourceConfig
+
+		tsb := NewTimeSeriesBuilder(&commonConfigCopy, buildCacheForTesting())
+		tsb.Update(&PrometheusResponse{rawResponse: scrape}, scrapeTime)
+		ts, err := tsb.Build()
+		assert.NoError(t, err)
+		assert.Equal(t, 2, len(ts))
+
+		for _, metric := range ts {
+			endTime := metric.Points[0].Interval.EndTime
+			if metric.Metric.Labels["labelName"] == "labelValue1" && honorTimestamps {
+				assert.Equal(t, "2017-07-14T02:40:00Z", endTime)
+			} else {
+				assert.Equal(t, "2020-09-13T12:26:40Z", endTime)
+			}
+		}
+	}
+}
+
+func TestInferUnit(t *testing.T) {
+	testcases := map[string]string{
+		"request_duration_seconds":     "s",
+		"cpu_usage_seconds_total":      "s",
+		"rpc_latency_seconds_sum":      "s",
+		"rpc_latency_seconds_count":    "",
+		"response_size_bytes":          "By",
+		"network_transmit_bytes_total": "By",
+		"requests_total":               "",
+		"seconds_since_start":          "",
+	}
+	for name, unit := range testcases {
+		assert.Equal(t, unit, inferUnit(name), "unit of %s", name)
+	}
+}
+
+func TestFilterWhitelisted(t *testing.T) {
+	metrics := familiesWithNames("http_requests_total", "http_request_duration_seconds", "grpc_calls_total", "process_start_time_seconds", "xhttp_errors")
+	testcases := []struct {
+		description      string
+		whitelisted      []string
+		whitelistedRegex []string
+		want             []string
+	}{
+		{
+			description: "no whitelist",
+			want:        []string{"grpc_calls_total", "http_request_duration_seconds", "http_requests_total", "process_start_time_seconds", "xhttp_errors"},
+		},
+		{
+			description: "exact",
+			whitelisted: []string{"grpc_calls_total", "missing_metric"},
+			want:        []string{"grpc_calls_total"},
+		},
+		{
+			description:      "regex",
+			whitelistedRegex: []string{"http_.*"},
+			want:             []string{"http_request_duration_seconds", "http_requests_total"},
+		},
+		{
+			description:      "exact and regex",
+			whitelisted:      []string{"process_start_time_seconds"},
+			whitelistedRegex: []string{"http_.*_total", "grpc_.*"},
+			want:             []string{"grpc_calls_total", "http_requests_total", "process_start_time_seconds"},
+		},
+		{
+			description:      "regex matching nothing",
+			whitelistedRegex: []string{"missing_.*"},
+			want:             []string{},
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			filtered, err := filterWhitelisted(metrics, tc.whitelisted, tc.whitelistedRegex)
+			if assert.NoError(t, err) {
+				assert.Equal(t, tc.want, sortedNames(filtered))
+			}
+		})
+	}
+
+	_, err := filterWhitelisted(metrics, nil, []string{"http_(.*"})
+	assert.Error(t, err)
+}
+
+func TestBuildStartTimeMetric(t *testing.T) {
+	const counter = "# TYPE requests_total counter\nrequests_total 42\n"
+	testcases := []struct {
+		description     string
+		startTimeMetric string
+		response        string
+		want            []string
+	}{
+		{
+			description: "default metric present",
+			response:    counter + "# TYPE process_start_time_seconds gauge\nprocess_start_time_seconds 1234567890\n",
+			want:        []string{"2009-02-13T23:31:30Z", "2009-02-13T23:31:30Z"},
+		},
+		{
+			description:     "custom metric present",
+			startTimeMetric: "app_start_time_seconds",
+			response: counter + "# TYPE app_start_time_seconds gauge\napp_start_time_seconds 1234567890\n" +
+				"# TYPE process_start_time_seconds gauge\nprocess_start_time_seconds 1000000000\n",
+			want: []string{"2009-02-13T23:31:30Z", "2009-02-13T23:31:30Z"},
+		},
+		{
+			description: "metric absent",
+			response:    counter,
+			want:        []string{"2017-07-14T02:39:59Z", "2017-07-14T02:39:59Z"},
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.description, func(t *testing.T) {
+			sourceConfig := *commonConfig.SourceConfig
+			sourceConfig.Whitelisted = []string{"requests_total"}
+			sourceConfig.StartTimeMetric = tc.startTimeMetric
+			startTimeConfig := *commonConfig
+			startTimeConfig.SourceConfig = &sourceConfig
+			tsb := NewTimeSeriesBuilder(&startTimeConfig, buildCacheForTesting())
+
+			var got []string
+			for _, timestamp := range []time.Time{time.Unix(1500000000, 0), time.Unix(1500000060, 0)} {
+				tsb.Update(&PrometheusResponse{rawResponse: tc.response}, timestamp)
+				ts, err := tsb.Build()
+				if !assert.NoError(t, err) || !assert.Equal(t, 1, len(ts)) {
+					return
+				}
+				got = append(got, ts[0].Points[0].Interval.StartTime)
+			}
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestMetricKindOverride(t *testing.T) {
+	sourceConfig := *commonConfig.SourceConfig
+	sourceConfig.Whitelisted = []string{"requests", "queue_length"}
+	sourceConfig.MetricKindOverride = map[string]string{"requests": "CUMULATIVE", "queue_length": "GAUGE"}
+	overrideConfig := *commonConfig
+	overrideConfig.SourceConfig = &sourceConfig
+
+	response := &PrometheusResponse{rawResponse: `
+# TYPE requests gauge
+requests 42
+# TYPE queue_length counter
+queue_length 3
+# TYPE process_start_time_seconds gauge
+process_start_time_seconds 1234567890
+`}
+	metrics, err := response.Build(&overrideConfig, buildCacheForTesting())
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "CUMULATIVE", MetricFamilyToMetricDescriptor(&overrideConfig, metrics["requests"], nil).MetricKind)
+	assert.Equal(t, "GAUGE", MetricFamilyToMetricDescriptor(&overrideConfig, metrics["queue_length"], nil).MetricKind)
+
+	tsb := NewTimeSeriesBuilder(&overrideConfig, buildCacheForTesting())
+	tsb.Update(response, time.Unix(1500000000, 0))
+	ts, err := tsb.Build()
+	if !assert.NoError(t, err) || !assert.Equal(t, 2, len(ts)) {
+		return
+	}
+	for _, series := range ts {
+		if strings.HasSuffix(series.Metric.Type, "/requests") {
+			assert.Equal(t, "CUMULATIVE", series.MetricKind)
+			assert.Equal(t, "2009-02-13T23:31:30Z", series.Points[0].Interval.StartTime)
+		} else {
+			assert.Equal(t, "GAUGE", series.MetricKind)
+			assert.Equal(t, "", series.Points[0].Interval.StartTime)
+		}
+	}
+}
+
+func TestMetricKindOverrideToDeltaOfNonCounters(t *testing.T) {
+	sourceConfig := *commonConfig.SourceConfig
+	sourceConfig.Whitelisted = []string{"queue_length", "latency"}
+	sourceConfig.MetricKindOverride = map[string]string{"queue_length": "DELTA", "latency": "DELTA"}
+	overrideConfig := *commonConfig
+	overrideConfig.SourceConfig = &sourceConfig
+
+	response := &PrometheusResponse{rawResponse: `
+# TYPE queue_length gauge
+queue_length 3
+# TYPE latency histogram
+latency_bucket{le="1"} 1
+latency_bucket{le="+Inf"} 2
+latency_sum 3
+latency_count 2
+# TYPE process_start_time_seconds gauge
+process_start_time_seconds 1234567890
+`}
+	metrics, err := response.Build(&overrideConfig, buildCacheForTesting())
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "GAUGE", MetricFamilyToMetricDescriptor(&overrideConfig, metrics["queue_length"], nil).MetricKind)
+	assert.Equal(t, "CUMULATIVE", MetricFamilyToMetricDescriptor(&overrideConfig, metrics["latency"], nil).MetricKind)
+
+	tsb := NewTimeSeriesBuilder(&overrideConfig, buildCacheForTesting())
+	tsb.Update(response, time.Unix(1500000000, 0))
+	ts, err := tsb.Build()
+	if !assert.NoError(t, err) || !assert.Equal(t, 2, len(ts)) {
+		return
+	}
+	for _, series := range ts {
+		if strings.HasSuffix(series.Metric.Type, "/queue_length") {
+			assert.Equal(t, "GAUGE", series.MetricKind)
+			assert.Equal(t, "", series.Points[0].Interval.StartTime)
+			assert.Equal(t, int64(3), *series.Points[0].Value.Int64Value)
+		} else {
+			assert.Equal(t, "CUMULATIVE", series.MetricKind)
+			assert.Equal(t, "2009-02-13T23:31:30Z", series.Points[0].Interval.StartTime)
+			assert.Equal(t, int64(2), series.Points[0].Value.DistributionValue.Count)
+		}
+	}
+}